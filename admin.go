@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// maxStagedConfigSize limits the size of config accepted by the stage endpoint. This matches the ConfigMap size limit
+const maxStagedConfigSize = 1048576
+
+// configStager holds a validated config that hasn't been activated yet
+type configStager struct {
+	lock   sync.Mutex
+	staged *AppConfig
+}
+
+type stageConfigResponse struct {
+	Rules   int           `json:"rules"`
+	Dropped []DroppedRule `json:"dropped"`
+}
+
+type activateConfigResponse struct {
+	Rules        int `json:"rules"`
+	CacheFlushed int `json:"cache_flushed"`
+}
+
+type flushCacheResponse struct {
+	Host    string `json:"host,omitempty"`
+	Flushed int    `json:"flushed"`
+}
+
+type cacheStatsResponse struct {
+	Backend         string `json:"backend"`
+	TTL             int64  `json:"ttl"`
+	NegativeTTL     int64  `json:"negative_ttl"`
+	CleanupInterval int    `json:"cleanup_interval"`
+	CacheStats
+}
+
+type resetRuleCountersResponse struct {
+	Previous []ruleCount `json:"previous"`
+}
+
+type debugRule struct {
+	Rule    string `json:"rule"`
+	Match   string `json:"match"`
+	Pattern string `json:"pattern"`
+	Matches int64  `json:"matches"`
+}
+
+type debugHost struct {
+	Host  string      `json:"host"`
+	Count int         `json:"count"`
+	Rules []debugRule `json:"rules"`
+}
+
+type debugRulesResponse struct {
+	Hosts  int         `json:"hosts"`
+	Rules  int         `json:"rules"`
+	ByHost []debugHost `json:"by_host"`
+}
+
+type adminErrorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func countRules(r RuleMapping) int {
+	n := 0
+	for _, rules := range r {
+		n += len(rules)
+	}
+	return n
+}
+
+// handleStageConfig validates the config in the request body and stages it for activation
+//
+// The response reports which rules would be dropped. The running config is left untouched
+func handleStageConfig(l *slog.Logger, stager *configStager) http.Handler {
+	logger := l.WithGroup("admin").With("action", "stage_config")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxStagedConfigSize))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, adminErrorResponse{Error: err.Error()})
+			return
+		}
+
+		cfg, err := parseConfig(logger, body)
+		if err != nil {
+			logger.Warn("rejecting invalid config", "err", err)
+			writeJSON(w, http.StatusBadRequest, adminErrorResponse{Error: err.Error()})
+			return
+		}
+
+		stager.lock.Lock()
+		stager.staged = cfg
+		stager.lock.Unlock()
+
+		logger.Info("staged config", "rules", countRules(cfg.RuleMap), "dropped", len(cfg.droppedRules))
+		writeJSON(w, http.StatusOK, stageConfigResponse{
+			Rules:   countRules(cfg.RuleMap),
+			Dropped: append([]DroppedRule{}, cfg.droppedRules...),
+		})
+	})
+}
+
+// handleActivateConfig swaps the staged rules into the running config and flushes the cache
+func handleActivateConfig(l *slog.Logger, stager *configStager, cache Cache, ac *AppConfig) http.Handler {
+	logger := l.WithGroup("admin").With("action", "activate_config")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stager.lock.Lock()
+		defer stager.lock.Unlock()
+
+		if stager.staged == nil {
+			writeJSON(w, http.StatusConflict, adminErrorResponse{Error: "no config staged"})
+			return
+		}
+
+		ac.setRuleMap(stager.staged.RuleMap)
+		rules := countRules(stager.staged.RuleMap)
+		stager.staged = nil
+
+		// cached responses were built from the old rules
+		flushed, err := cache.Flush()
+		if err != nil {
+			logger.Error("error flushing cache after activating config", "err", err)
+		}
+
+		logger.Info("activated staged config", "rules", rules, "cache_flushed", flushed)
+		writeJSON(w, http.StatusOK, activateConfigResponse{Rules: rules, CacheFlushed: flushed})
+	})
+}
+
+// handleFlushCache removes every entry from the cache, or only the entries for the host in the `host` query parameter
+//
+// The host is normalized the same way as a request's, so e.g. `example.com:8080` flushes `example.com`
+func handleFlushCache(l *slog.Logger, cache Cache, ac *AppConfig) http.Handler {
+	logger := l.WithGroup("admin").With("action", "flush_cache")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var resp flushCacheResponse
+		var err error
+		if r.URL.Query().Has("host") {
+			resp.Host = requestHost(r.URL.Query().Get("host"), ac.StripHostPrefix)
+			if resp.Host == "" {
+				writeJSON(w, http.StatusBadRequest, adminErrorResponse{Error: "host is empty"})
+				return
+			}
+			resp.Flushed, err = cache.FlushHost(resp.Host)
+		} else {
+			resp.Flushed, err = cache.Flush()
+		}
+		if err != nil {
+			logger.Error("error flushing cache", "host", resp.Host, "err", err)
+			writeJSON(w, http.StatusInternalServerError, adminErrorResponse{Error: err.Error()})
+			return
+		}
+
+		logger.Info("flushed cache", "host", resp.Host, "entries", resp.Flushed)
+		writeJSON(w, http.StatusOK, resp)
+	})
+}
+
+// handleCacheStats responds with the number of entries in the cache, overall and by host, alongside the cache's config
+func handleCacheStats(l *slog.Logger, cache Cache, c CacheConfig) http.Handler {
+	logger := l.WithGroup("admin").With("action", "cache_stats")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stats, err := cache.Stats()
+		if err != nil {
+			logger.Error("error counting cache entries", "err", err)
+			writeJSON(w, http.StatusInternalServerError, adminErrorResponse{Error: err.Error()})
+			return
+		}
+
+		negativeTTL := c.NegativeTTL
+		if c.Negative != nil {
+			negativeTTL = c.Negative.TTL
+		}
+		writeJSON(w, http.StatusOK, cacheStatsResponse{
+			Backend:         c.Backend,
+			TTL:             c.TTL,
+			NegativeTTL:     negativeTTL,
+			CleanupInterval: c.CleanupInterval,
+			CacheStats:      stats,
+		})
+	})
+}
+
+// handleResetRuleCounters zeroes the in-process rule match counts used to find unmatched rules, responding with the
+// counts from before the reset
+func handleResetRuleCounters(l *slog.Logger) http.Handler {
+	logger := l.WithGroup("admin").With("action", "reset_rule_counters")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		previous := ruleMatchCounts.reset()
+
+		logger.Info("reset rule match counters", "rules", len(previous))
+		writeJSON(w, http.StatusOK, resetRuleCountersResponse{Previous: previous})
+	})
+}
+
+// handleDebugRules describes the running rules of every host: how many there are, the pattern each matches requests
+// against, and how many requests each has matched since its counter was last reset
+func handleDebugRules(ac *AppConfig) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rules := ac.ruleMap()
+
+		hosts := make([]string, 0, len(rules))
+		for host := range rules {
+			hosts = append(hosts, host)
+		}
+		sort.Strings(hosts)
+
+		resp := debugRulesResponse{Hosts: len(rules), Rules: countRules(rules), ByHost: []debugHost{}}
+		for _, host := range hosts {
+			row := debugHost{Host: host, Count: len(rules[host]), Rules: []debugRule{}}
+			for _, rule := range rules[host] {
+				match := rule.Match
+				if match == MatchUnset {
+					match = MatchRegex
+				}
+				row.Rules = append(row.Rules, debugRule{
+					Rule:    rule.id(),
+					Match:   match,
+					Pattern: rule.pattern(),
+					Matches: ruleMatchCounts.get(host, rule),
+				})
+			}
+			resp.ByHost = append(resp.ByHost, row)
+		}
+
+		writeJSON(w, http.StatusOK, resp)
+	})
+}
@@ -0,0 +1,222 @@
+//go:build unit_test
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const stagedConfig = `
+rules:
+  - from: 'staged.example.com/foo'
+    to: 'https://foo.com/bar'
+  - from: 'staged.example.com/(invalid'
+    to: 'https://foo.com/bar'
+`
+
+func TestStageAndActivateConfig(t *testing.T) {
+	logger := newTestLogger()
+	cfg, _ := loadConfig(logger, "./fixtures/rules.yml")
+	cache := &spyCache{}
+	srv := newMetricsServer(logger, cache, cfg)
+
+	// nothing has been staged yet
+	req := httptest.NewRequest("POST", "http://localhost/admin/config/activate", nil)
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	req = httptest.NewRequest("POST", "http://localhost/admin/config/stage", strings.NewReader(stagedConfig))
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var staged stageConfigResponse
+	assert.Nil(t, json.NewDecoder(w.Body).Decode(&staged))
+	assert.Equal(t, 1, staged.Rules)
+	assert.Equal(t, 1, len(staged.Dropped))
+	assert.Equal(t, "staged.example.com/(invalid", staged.Dropped[0].From)
+
+	// staging must not change the running config
+	assert.NotContains(t, cfg.ruleMap(), "staged.example.com")
+	assert.Equal(t, 0, cache.flushes)
+
+	req = httptest.NewRequest("POST", "http://localhost/admin/config/activate", nil)
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	assert.Contains(t, cfg.ruleMap(), "staged.example.com")
+	assert.NotContains(t, cfg.ruleMap(), "localhost")
+	assert.Equal(t, 1, cache.flushes)
+
+	// the staged config can only be activated once
+	req = httptest.NewRequest("POST", "http://localhost/admin/config/activate", nil)
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
+
+func TestFlushCache(t *testing.T) {
+	logger := newTestLogger()
+	cfg, err := parseConfig(logger, []byte("strip_host_prefix: 'www.'\n"))
+	assert.NoError(t, err)
+	cache := NewInMemoryCache(t.Context(), logger, 3600, 3600)
+	for _, host := range []string{"example.com", "example.org"} {
+		for _, path := range []string{"/foo", "/bar"} {
+			_ = cache.Set(CacheSetParameters{host: host, path: path, location: "https://example.net/", code: 301})
+		}
+	}
+	srv := newMetricsServer(logger, cache, cfg)
+
+	tests := []struct {
+		name     string
+		target   string
+		wantCode int
+		want     flushCacheResponse
+	}{
+		{name: "one host, normalized like a request's", target: "/admin/cache/flush?host=WWW.example.com:8080", wantCode: http.StatusOK, want: flushCacheResponse{Host: "example.com", Flushed: 2}},
+		{name: "host with no entries", target: "/admin/cache/flush?host=example.com", wantCode: http.StatusOK, want: flushCacheResponse{Host: "example.com"}},
+		{name: "empty host", target: "/admin/cache/flush?host=", wantCode: http.StatusBadRequest},
+		{name: "every host", target: "/admin/cache/flush", wantCode: http.StatusOK, want: flushCacheResponse{Flushed: 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			srv.ServeHTTP(w, httptest.NewRequest("POST", "http://localhost"+tt.target, nil))
+			assert.Equal(t, tt.wantCode, w.Code)
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+			var got flushCacheResponse
+			assert.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	got, _ := cache.Get(CacheGetParameters{host: "example.org", path: "/foo"})
+	assert.Nil(t, got)
+}
+
+func TestCacheStats(t *testing.T) {
+	logger := newTestLogger()
+	cfg, err := parseConfig(logger, []byte("cache:\n  ttl: 600\n  cleanup_interval: 60\n  negative_ttl: 30\n"))
+	assert.NoError(t, err)
+	cache := NewInMemoryCache(t.Context(), logger, 3600, 3600)
+	for host, paths := range map[string][]string{"example.org": {"/foo", "/bar"}, "example.com": {"/foo"}} {
+		for _, path := range paths {
+			_ = cache.Set(CacheSetParameters{host: host, path: path, location: "https://example.net/", code: 301})
+		}
+	}
+	// a flushed host has no entries left, so it isn't listed
+	_ = cache.Set(CacheSetParameters{host: "example.net", path: "/foo", location: "https://example.net/", code: 301})
+	_, _ = cache.FlushHost("example.net")
+
+	w := httptest.NewRecorder()
+	newMetricsServer(logger, cache, cfg).ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/admin/cache/stats", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{
+		"backend": "memory",
+		"ttl": 600,
+		"negative_ttl": 30,
+		"cleanup_interval": 60,
+		"entries": 3,
+		"hosts": [{"host": "example.com", "entries": 1}, {"host": "example.org", "entries": 2}]
+	}`, w.Body.String())
+
+	// an empty cache lists no hosts, rather than null
+	_, _ = cache.Flush()
+	w = httptest.NewRecorder()
+	newMetricsServer(logger, cache, cfg).ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/admin/cache/stats", nil))
+	var got cacheStatsResponse
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+	assert.Equal(t, CacheStats{Hosts: []CacheHostStats{}}, got.CacheStats)
+}
+
+func TestStageInvalidConfig(t *testing.T) {
+	logger := newTestLogger()
+	cfg, _ := loadConfig(logger, "./fixtures/rules.yml")
+	srv := newMetricsServer(logger, &spyCache{}, cfg)
+
+	req := httptest.NewRequest("POST", "http://localhost/admin/config/stage", strings.NewReader("rules: {{"))
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	req = httptest.NewRequest("GET", "http://localhost/admin/config/stage", nil)
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestResetRuleCounters(t *testing.T) {
+	logger := newTestLogger()
+	cfg, _ := loadConfig(logger, "./fixtures/rules.yml")
+	srv := newMetricsServer(logger, &spyCache{}, cfg)
+
+	ruleMatchCounts.reset()
+	rule := Rule{From: "reset.example.com/foo"}
+	ruleMatchCounts.inc("reset.example.com", rule)
+	ruleMatchCounts.inc("reset.example.com", rule)
+
+	req := httptest.NewRequest("POST", "http://localhost/admin/metrics/reset-rule-counters", nil)
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var got resetRuleCountersResponse
+	assert.Nil(t, json.NewDecoder(w.Body).Decode(&got))
+	assert.Equal(t, []ruleCount{{Host: "reset.example.com", Rule: "reset.example.com/foo", Matches: 2}}, got.Previous)
+	assert.Equal(t, int64(0), ruleMatchCounts.get("reset.example.com", rule))
+
+	// nothing has matched since the reset
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("POST", "http://localhost/admin/metrics/reset-rule-counters", nil))
+	assert.Nil(t, json.NewDecoder(w.Body).Decode(&got))
+	assert.Empty(t, got.Previous)
+}
+
+func TestDebugRules(t *testing.T) {
+	logger := newTestLogger()
+	cfg, err := parseConfig(logger, []byte(`
+rules:
+  - name: 'blog'
+    from: 'debug.example.com/blog/(.+)'
+    to: 'https://blog.example.com/$1'
+  - from: 'debug.example.com/docs'
+    to: 'https://docs.example.com/'
+    match: 'prefix'
+  - from: 'other.example.com'
+    to: 'https://example.com/'
+`))
+	assert.NoError(t, err)
+	srv := newMetricsServer(logger, &spyCache{}, cfg)
+
+	ruleMatchCounts.reset()
+	handleRequest(logger, &spyCache{}, cfg).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://debug.example.com/blog/hello", nil))
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/debug/rules", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var got debugRulesResponse
+	assert.Nil(t, json.NewDecoder(w.Body).Decode(&got))
+	assert.Equal(t, debugRulesResponse{
+		Hosts: 2,
+		Rules: 3,
+		ByHost: []debugHost{
+			{Host: "debug.example.com", Count: 2, Rules: []debugRule{
+				{Rule: "blog", Match: MatchRegex, Pattern: "^/blog/(.+)", Matches: 1},
+				{Rule: "debug.example.com/docs", Match: MatchPrefix, Pattern: "/docs"},
+			}},
+			{Host: "other.example.com", Count: 1, Rules: []debugRule{
+				{Rule: "other.example.com", Match: MatchRegex, Pattern: "^.*"},
+			}},
+		},
+	}, got)
+}
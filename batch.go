@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	BatchFormatCSV  = "csv"
+	BatchFormatJSON = "json"
+)
+
+var (
+	testBatchPath  string
+	testOutputPath string
+	testFormat     string
+	testURLs       []string
+)
+
+func parseTestArgs(args []string) {
+	testFS := flag.NewFlagSet("test", flag.ExitOnError)
+	b := testFS.String("batch", "", "file of URLs to test, one per line, optionally preceded by a method, e.g. `HEAD example.com/foo`")
+	o := testFS.String("out", "", "where to write the results. Defaults to stdout")
+	f := testFS.String("format", BatchFormatCSV, "format of the results, csv or json")
+
+	if err := testFS.Parse(args); err != nil {
+		log.Fatal(err.Error())
+	}
+
+	testBatchPath = *b
+	testOutputPath = *o
+	testFormat = *f
+	testURLs = testFS.Args()
+}
+
+// batchRequest is a request to run through the rules
+type batchRequest struct {
+	method string
+	url    string
+}
+
+// batchResult is how a request was handled. MatchedRule is empty for misses
+type batchResult struct {
+	Input       string `json:"input"`
+	Method      string `json:"method"`
+	MatchedRule string `json:"matched_rule"`
+	Location    string `json:"location"`
+	Code        int    `json:"code"`
+}
+
+// readBatch reads one request per line. Blank lines and lines starting with `#` are skipped
+func readBatch(r io.Reader) ([]batchRequest, error) {
+	reqs := []batchRequest{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		req := batchRequest{method: http.MethodGet, url: line}
+		if method, target, ok := strings.Cut(line, " "); ok {
+			req = batchRequest{method: strings.ToUpper(method), url: strings.TrimSpace(target)}
+		}
+		reqs = append(reqs, req)
+	}
+	return reqs, scanner.Err()
+}
+
+// runBatch runs every request through handler, which must send the X-Redirector-Rule header
+func runBatch(handler http.Handler, reqs []batchRequest) []batchResult {
+	results := make([]batchResult, 0, len(reqs))
+	for _, br := range reqs {
+		result := batchResult{Input: br.url, Method: br.method}
+		req, err := newTestRequest(br.method, br.url)
+		if err != nil {
+			results = append(results, result)
+			continue
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		result.MatchedRule = w.Header().Get("X-Redirector-Rule")
+		result.Location = w.Header().Get("Location")
+		result.Code = w.Code
+		results = append(results, result)
+	}
+	return results
+}
+
+// writeBatchResults writes results as format, either BatchFormatCSV or BatchFormatJSON
+func writeBatchResults(w io.Writer, format string, results []batchResult) error {
+	switch format {
+	case BatchFormatJSON:
+		e := json.NewEncoder(w)
+		e.SetIndent("", "  ")
+		return e.Encode(results)
+	case BatchFormatCSV:
+		cw := csv.NewWriter(w)
+		_ = cw.Write([]string{"input", "method", "matched_rule", "location", "code"})
+		for _, r := range results {
+			_ = cw.Write([]string{r.Input, r.Method, r.MatchedRule, r.Location, strconv.Itoa(r.Code)})
+		}
+		cw.Flush()
+		return cw.Error()
+	default:
+		return fmt.Errorf("unknown format '%s', expected %s or %s", format, BatchFormatCSV, BatchFormatJSON)
+	}
+}
+
+// testRequests runs the URLs given as arguments, and those in the -batch file, through the rules of the config at
+// CONFIG_PATH and writes how each was handled
+func testRequests(logger *slog.Logger) error {
+	if testFormat != BatchFormatCSV && testFormat != BatchFormatJSON {
+		return fmt.Errorf("unknown format '%s', expected %s or %s", testFormat, BatchFormatCSV, BatchFormatJSON)
+	}
+
+	confPath, ok := os.LookupEnv("CONFIG_PATH")
+	if !ok {
+		logger.Error("CONFIG_PATH environment variable is not set, exiting")
+		os.Exit(1)
+	}
+
+	cfg, err := loadConfig(logger, confPath)
+	if err != nil {
+		logger.Error("error parsing cfg file", "err", err.Error())
+		return err
+	}
+	// the rule header is how results record the rule that matched
+	cfg.Debug.RuleHeader = true
+
+	reqs := []batchRequest{}
+	for _, u := range testURLs {
+		reqs = append(reqs, batchRequest{method: http.MethodGet, url: u})
+	}
+	if testBatchPath != "" {
+		f, err := os.Open(testBatchPath)
+		if err != nil {
+			return err
+		}
+		batch, err := readBatch(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		reqs = append(reqs, batch...)
+	}
+
+	// responses aren't cached so that each request is matched against the rules
+	handler := handleRequest(slog.New(slog.DiscardHandler), &noopCache{}, cfg)
+	results := runBatch(handler, reqs)
+
+	var out io.Writer = os.Stdout
+	if testOutputPath != "" {
+		f, err := os.Create(testOutputPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	if err := writeBatchResults(out, testFormat, results); err != nil {
+		return err
+	}
+
+	misses := 0
+	for _, r := range results {
+		if r.MatchedRule == "" {
+			misses++
+		}
+	}
+	logger.Info("tested requests", "total", len(results), "matched", len(results)-misses, "misses", misses)
+	return nil
+}
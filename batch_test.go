@@ -0,0 +1,75 @@
+//go:build unit_test
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func Test_readBatch(t *testing.T) {
+	got, err := readBatch(strings.NewReader(`
+# old marketing URLs
+example.com/foo
+head https://example.com/bar?a=b
+
+POST  example.com/baz
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, []batchRequest{
+		{method: http.MethodGet, url: "example.com/foo"},
+		{method: http.MethodHead, url: "https://example.com/bar?a=b"},
+		{method: http.MethodPost, url: "example.com/baz"},
+	}, got)
+}
+
+func Test_runBatch(t *testing.T) {
+	logger := newTestLogger()
+	cfg, err := parseConfig(logger, []byte(`
+debug:
+  rule_header: true
+rules:
+  - name: 'foo'
+    from: 'example.com/foo'
+    to: 'https://foo.com/bar'
+  - from: 'example.com/found'
+    to: 'https://foo.com/found'
+    code: 302
+`))
+	assert.NoError(t, err)
+	handler := handleRequest(logger, &noopCache{}, cfg)
+
+	results := runBatch(handler, []batchRequest{
+		{method: http.MethodGet, url: "example.com/foo"},
+		{method: http.MethodHead, url: "https://example.com/found"},
+		{method: http.MethodGet, url: "example.com/missing"},
+		{method: http.MethodGet, url: "http://%zz"},
+	})
+	assert.Equal(t, []batchResult{
+		{Input: "example.com/foo", Method: http.MethodGet, MatchedRule: "foo", Location: "https://foo.com/bar", Code: http.StatusMovedPermanently},
+		{Input: "https://example.com/found", Method: http.MethodHead, MatchedRule: "example.com/found", Location: "https://foo.com/found", Code: http.StatusFound},
+		{Input: "example.com/missing", Method: http.MethodGet, Code: http.StatusNotFound},
+		// invalid URLs aren't requested
+		{Input: "http://%zz", Method: http.MethodGet},
+	}, results)
+
+	var buf bytes.Buffer
+	assert.NoError(t, writeBatchResults(&buf, BatchFormatCSV, results[:3]))
+	assert.Equal(t, `input,method,matched_rule,location,code
+example.com/foo,GET,foo,https://foo.com/bar,301
+https://example.com/found,HEAD,example.com/found,https://foo.com/found,302
+example.com/missing,GET,,,404
+`, buf.String())
+
+	buf.Reset()
+	assert.NoError(t, writeBatchResults(&buf, BatchFormatJSON, results[:1]))
+	var decoded []map[string]any
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &decoded))
+	assert.Equal(t, []map[string]any{{"input": "example.com/foo", "method": "GET", "matched_rule": "foo", "location": "https://foo.com/bar", "code": float64(301)}}, decoded)
+
+	assert.Error(t, writeBatchResults(&buf, "xml", results))
+}
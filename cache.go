@@ -1,30 +1,59 @@
 package main
 
 import (
+	"container/list"
 	"context"
+	"errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"hash/fnv"
 	"log/slog"
+	"os"
+	"sort"
 	"sync"
 	"time"
 )
 
 var (
-	cacheHitMetric = promauto.NewCounterVec(
+	cacheHitMetric = promauto.With(appMetrics).NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "cache_hit",
 			Help: "Number of cache hits",
 		},
 		[]string{"host", "path"},
 	)
-	cacheMissMetric = promauto.NewCounterVec(
+	cacheMissMetric = promauto.With(appMetrics).NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "cache_miss",
 			Help: "Number of cache hits",
 		},
 		[]string{"host", "path"},
 	)
-	cacheCleanupJobDuration = promauto.NewHistogram(
+	cacheHostEvictionsMetric = promauto.With(appMetrics).NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cache_host_evictions_total",
+			Help: "Number of cache entries evicted because their host reached cache.max_entries_per_host",
+		},
+		[]string{"host"},
+	)
+	cacheEvictionsMetric = promauto.With(appMetrics).NewCounter(
+		prometheus.CounterOpts{
+			Name: "cache_evictions_total",
+			Help: "Number of cache entries evicted because the cache reached cache.max_entries",
+		})
+	cacheHostEntriesMetric = promauto.With(appMetrics).NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cache_host_entries",
+			Help: "Number of entries in the in-memory cache for each host",
+		},
+		[]string{"host"},
+	)
+	cacheEntriesMetric = promauto.With(appMetrics).NewGauge(
+		prometheus.GaugeOpts{
+			Name: "cache_entries_total",
+			Help: "Number of entries in the in-memory cache",
+		})
+	cacheCleanupJobDuration = promauto.With(appMetrics).NewHistogram(
 		prometheus.HistogramOpts{
 			Name: "cache_cleanup_job_duration_milliseconds",
 			Help: "Duration of cache cleanup job",
@@ -34,42 +63,311 @@ var (
 type Cache interface {
 	Get(parameters CacheGetParameters) (*CacheResponse, error)
 	Set(parameters CacheSetParameters) error
+	// Flush removes every entry from the cache and returns the number of entries removed
+	Flush() (int, error)
+	// FlushHost removes every entry for host from the cache and returns the number of entries removed
+	FlushHost(host string) (int, error)
+	// Stats counts the entries in the cache
+	Stats() (CacheStats, error)
+}
+
+// CacheStats are the number of entries in a cache, overall and by host
+type CacheStats struct {
+	Entries int `json:"entries"`
+	// Hosts are sorted by host, and only include hosts with entries
+	Hosts []CacheHostStats `json:"hosts"`
+}
+
+type CacheHostStats struct {
+	Host    string `json:"host"`
+	Entries int    `json:"entries"`
+}
+
+// newCacheStats returns the stats for a cache with the given number of entries for each host
+func newCacheStats(hosts map[string]int) CacheStats {
+	stats := CacheStats{Hosts: make([]CacheHostStats, 0, len(hosts))}
+	for host, n := range hosts {
+		if n == 0 {
+			continue
+		}
+		stats.Entries += n
+		stats.Hosts = append(stats.Hosts, CacheHostStats{Host: host, Entries: n})
+	}
+	sort.Slice(stats.Hosts, func(i, j int) bool { return stats.Hosts[i].Host < stats.Hosts[j].Host })
+	return stats
+}
+
+// noopCache never stores anything, so every request is matched against the rules
+type noopCache struct{}
+
+func (c *noopCache) Get(parameters CacheGetParameters) (*CacheResponse, error) {
+	return nil, nil
+}
+
+func (c *noopCache) Set(parameters CacheSetParameters) error {
+	return nil
+}
+
+func (c *noopCache) Flush() (int, error) {
+	return 0, nil
+}
+
+func (c *noopCache) FlushHost(host string) (int, error) {
+	return 0, nil
+}
+
+func (c *noopCache) Stats() (CacheStats, error) {
+	return newCacheStats(nil), nil
+}
+
+const (
+	// CacheBackendMemory caches responses in the process's memory. This is the default
+	CacheBackendMemory = "memory"
+	// CacheBackendRedis caches responses in Redis, so that they're shared between instances
+	CacheBackendRedis = "redis"
+)
+
+func validCacheBackend(backend string) bool {
+	return backend == CacheBackendMemory || backend == CacheBackendRedis
+}
+
+// newCache returns the cache configured by the cache section of the config, or an error if the Redis TLS config can't
+// be loaded
+func newCache(ctx context.Context, l *slog.Logger, c CacheConfig) (Cache, error) {
+	var cache Cache
+	switch c.Backend {
+	case CacheBackendRedis:
+		redisCache, err := NewRedisCache(l, c.Redis, redisKeyPrefix, c.TTL)
+		if err != nil {
+			return nil, err
+		}
+		cache = redisCache
+	default:
+		cache = NewInMemoryCacheFromConfig(ctx, l, c)
+	}
+	if c.Negative == nil {
+		return cache, nil
+	}
+
+	var negative Cache
+	switch c.Negative.Backend {
+	case CacheBackendRedis:
+		redisCache, err := NewRedisCache(l.WithGroup("negative"), c.Redis, redisNegativeKeyPrefix, c.Negative.TTL)
+		if err != nil {
+			return nil, err
+		}
+		negative = redisCache
+	default:
+		negative = NewInMemoryCache(ctx, l.WithGroup("negative"), c.Negative.CleanupInterval, c.Negative.TTL)
+	}
+	return &splitCache{positive: cache, negative: negative}, nil
+}
+
+// splitCache stores redirects in one cache and misses in another, e.g. so that short-lived misses don't take up space
+// in a cache that's shared between instances
+type splitCache struct {
+	positive Cache
+	negative Cache
+}
+
+func (c *splitCache) Get(parameters CacheGetParameters) (*CacheResponse, error) {
+	// an error from one cache shouldn't stop the other from being read
+	r, err := c.positive.Get(parameters)
+	if r != nil {
+		return r, err
+	}
+	nr, nerr := c.negative.Get(parameters)
+	if nr != nil {
+		return nr, nerr
+	}
+	return nil, errors.Join(err, nerr)
+}
+
+func (c *splitCache) Set(parameters CacheSetParameters) error {
+	if parameters.miss {
+		// the negative cache's own TTL applies to misses
+		parameters.ttl = 0
+		return c.negative.Set(parameters)
+	}
+	return c.positive.Set(parameters)
+}
+
+func (c *splitCache) Flush() (int, error) {
+	n, err := c.positive.Flush()
+	if err != nil {
+		return n, err
+	}
+	m, err := c.negative.Flush()
+	return n + m, err
+}
+
+func (c *splitCache) FlushHost(host string) (int, error) {
+	n, err := c.positive.FlushHost(host)
+	if err != nil {
+		return n, err
+	}
+	m, err := c.negative.FlushHost(host)
+	return n + m, err
+}
+
+// Stats adds up the entries of both caches, so a host with redirects and misses is listed once
+func (c *splitCache) Stats() (CacheStats, error) {
+	hosts := map[string]int{}
+	for _, cache := range []Cache{c.positive, c.negative} {
+		stats, err := cache.Stats()
+		if err != nil {
+			return CacheStats{}, err
+		}
+		for _, h := range stats.Hosts {
+			hosts[h.Host] += h.Entries
+		}
+	}
+	return newCacheStats(hosts), nil
 }
 
 type CacheGetParameters struct {
 	host string
 	path string
+	// query is the request's query with its parameters in a canonical order, since it contributes to the Location
+	query string
+	// variant distinguishes responses for the same path that depend on more than the path, e.g. the request's language
+	variant string
+}
+
+// cacheKey returns the key a response is stored under for a path, query, and variant
+func cacheKey(path string, query string, variant string) string {
+	if query != "" {
+		// a path can't contain a NUL, so the query can't be confused with part of another path
+		path += "\x00?" + query
+	}
+	return variantKey(path, variant)
+}
+
+// variantKey returns the key a path's response is stored under for a variant
+func variantKey(path string, variant string) string {
+	if variant == "" {
+		return path
+	}
+	// a path can't contain a NUL, so the key can't be confused with another path
+	return path + "\x00" + variant
 }
 
 type CacheSetParameters struct {
 	host               string
 	path               string
 	location           string
+	canonical          string
 	code               int
 	cacheControlMaxAge int
+	// preserveRequestPort is set when the request's port is added to location when responding
+	preserveRequestPort bool
+	// miss is set when the response is for a request that didn't match a rule, including fallback redirects
+	miss bool
+	// rule is the ID of the rule that matched
+	rule string
+	// variant is the same as CacheGetParameters.variant
+	variant string
+	// query is the same as CacheGetParameters.query
+	query string
+	// ttl, if set, is how long the entry is cached for, in seconds, instead of the cache's TTL
+	ttl int64
+}
+
+// entryTTL returns the TTL of an entry set with parameters, in a cache whose TTL is ttl
+func (p CacheSetParameters) entryTTL(ttl int64) int64 {
+	if p.ttl > 0 {
+		return p.ttl
+	}
+	return ttl
 }
 
+// defaultCacheShards is the number of shards an InMemoryCache is split into
+const defaultCacheShards = 32
+
 type InMemoryCache struct {
 	logger *slog.Logger
 	ttl    int64
-	lock   sync.RWMutex
+	// maxEntriesPerHost is the number of entries a host can have before its least recently used entries are evicted.
+	// 0 is unlimited
+	maxEntriesPerHost int
+	// maxEntries is the number of entries the whole cache can have before its least recently used entries are evicted.
+	// 0 is unlimited
+	maxEntries int
+	// entries are sharded by host so that requests for different hosts don't contend for the same lock
+	shards []*inMemoryCacheShard
+	// lru orders every entry across the shards. It's only kept when the cache's entries are capped
+	lru *cacheLRU
+}
+
+type inMemoryCacheShard struct {
+	lock sync.RWMutex
 	// {host: {path: Item}}
 	cache map[string]map[string]InMemoryCacheItem
+	// recency orders each host's keys from most to least recently used. It's only kept when entries per host are capped
+	recency map[string]*list.List
+	// lru is the cache's LRU, shared by every shard. It's nil when the cache's entries aren't capped
+	lru *cacheLRU
+}
+
+// cacheLRU orders entries from most to least recently used across all shards. It has its own lock so that reads, which
+// only hold their shard's read lock, can move entries to the front
+//
+// Shard locks are always taken before the LRU's lock
+type cacheLRU struct {
+	lock  sync.Mutex
+	order *list.List
+}
+
+// cacheLRUKey identifies an entry in the cacheLRU
+type cacheLRUKey struct {
+	host string
+	key  string
+}
+
+func (l *cacheLRU) touch(e *list.Element) {
+	l.lock.Lock()
+	l.order.MoveToFront(e)
+	l.lock.Unlock()
+}
+
+func (l *cacheLRU) remove(e *list.Element) {
+	l.lock.Lock()
+	l.order.Remove(e)
+	l.lock.Unlock()
+}
+
+// shard returns the shard that entries for host are stored in
+func (c *InMemoryCache) shard(host string) *inMemoryCacheShard {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(host))
+	return c.shards[h.Sum32()%uint32(len(c.shards))]
 }
 
 type InMemoryCacheItem struct {
-	path               string
-	location           string
-	code               int
-	ttl                int64
-	createdAt          int64
-	cacheControlMaxAge int
+	path                string
+	location            string
+	canonical           string
+	code                int
+	ttl                 int64
+	createdAt           int64
+	cacheControlMaxAge  int
+	preserveRequestPort bool
+	miss                bool
+	rule                string
+	// element is the item's key in its host's recency list, if there is one
+	element *list.Element
+	// lruElement is the item's place in the cache's LRU, if there is one
+	lruElement *list.Element
 }
 
 type CacheResponse struct {
-	location    string
-	code        int
-	cacheMaxAge int
+	location            string
+	canonical           string
+	code                int
+	cacheMaxAge         int
+	preserveRequestPort bool
+	miss                bool
+	rule                string
 }
 
 func recordCacheMetric(t string, host string, path string) {
@@ -92,55 +390,321 @@ func recordCacheMetric(t string, host string, path string) {
 }
 
 func (c *InMemoryCache) Get(parameters CacheGetParameters) (*CacheResponse, error) {
-	c.lock.RLock()
-	defer c.lock.RUnlock()
-
-	if d, ok := c.cache[parameters.host]; ok {
-		if r, ok := d[parameters.path]; ok {
-			c.logger.Debug("cache hit for path", "host", parameters.host, "path", parameters.path)
-			recordCacheMetric("hit", parameters.host, parameters.path)
-			return &CacheResponse{code: r.code, location: r.location, cacheMaxAge: r.cacheControlMaxAge}, nil
-		} else {
-			c.logger.Debug("path-level cache miss", "host", parameters.host, "path", parameters.path)
-			recordCacheMetric("miss", parameters.host, parameters.path)
-			return nil, nil
+	shard := c.shard(parameters.host)
+	var d map[string]InMemoryCacheItem
+	var r InMemoryCacheItem
+	var hostFound, pathFound bool
+	if c.maxEntriesPerHost > 0 {
+		// reads move the entry to the front of its host's recency list, so they need the write lock
+		shard.lock.Lock()
+		d, hostFound = shard.cache[parameters.host]
+		r, pathFound = d[cacheKey(parameters.path, parameters.query, parameters.variant)]
+		if pathFound && r.element != nil {
+			shard.recency[parameters.host].MoveToFront(r.element)
 		}
+		shard.lock.Unlock()
 	} else {
+		shard.lock.RLock()
+		d, hostFound = shard.cache[parameters.host]
+		r, pathFound = d[cacheKey(parameters.path, parameters.query, parameters.variant)]
+		shard.lock.RUnlock()
+	}
+	// an element that's been removed since the entry was read isn't moved
+	if pathFound && r.lruElement != nil {
+		c.lru.touch(r.lruElement)
+	}
+
+	switch {
+	case !hostFound:
 		c.logger.Debug("host-level cache miss", "host", parameters.host, "path", parameters.path)
-		recordCacheMetric("miss", parameters.host, parameters.path)
-		return nil, nil
+	case !pathFound:
+		c.logger.Debug("path-level cache miss", "host", parameters.host, "path", parameters.path)
+	case r.expired(time.Now().Unix()):
+		// the cleanup job may not have run since the entry expired, so expiry is checked here too
+		c.logger.Debug("expired cache entry", "host", parameters.host, "path", parameters.path, "ttl", r.ttl)
+		shard.deleteExpired(parameters.host, cacheKey(parameters.path, parameters.query, parameters.variant))
+	default:
+		c.logger.Debug("cache hit for path", "host", parameters.host, "path", parameters.path)
+		recordCacheMetric("hit", parameters.host, parameters.path)
+		return &CacheResponse{code: r.code, location: r.location, canonical: r.canonical, cacheMaxAge: r.cacheControlMaxAge, preserveRequestPort: r.preserveRequestPort, miss: r.miss, rule: r.rule}, nil
+	}
+
+	recordCacheMetric("miss", parameters.host, parameters.path)
+	return nil, nil
+}
+
+// expired reports whether the item has outlived its TTL
+func (i InMemoryCacheItem) expired(now int64) bool {
+	return now > i.createdAt+i.ttl
+}
+
+// deleteExpired removes an entry if it's still expired once the write lock is held, since it may have been replaced
+// after it was read
+func (s *inMemoryCacheShard) deleteExpired(host string, path string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if r, ok := s.cache[host][path]; ok && r.expired(time.Now().Unix()) {
+		s.remove(host, path)
+	}
+}
+
+// remove deletes an entry and its place in the host's recency list. The write lock must be held
+func (s *inMemoryCacheShard) remove(host string, key string) {
+	r, ok := s.cache[host][key]
+	if !ok {
+		return
+	}
+	if r.element != nil {
+		s.recency[host].Remove(r.element)
+	}
+	if r.lruElement != nil {
+		s.lru.remove(r.lruElement)
+	}
+	delete(s.cache[host], key)
+	cacheHostEntriesMetric.WithLabelValues(host).Dec()
+	cacheEntriesMetric.Dec()
+}
+
+// evict removes a host's least recently used entries until it has at most max entries, returning the number removed.
+// The write lock must be held
+func (s *inMemoryCacheShard) evict(host string, max int) int {
+	order := s.recency[host]
+	n := 0
+	for order != nil && len(s.cache[host]) > max {
+		oldest := order.Back()
+		if oldest == nil {
+			break
+		}
+		s.remove(host, oldest.Value.(string))
+		n++
+	}
+	return n
+}
+
+// evictLRU removes the cache's least recently used entries until it has at most maxEntries, returning the number
+// removed. No shard lock can be held, since the entries may be in any shard
+func (c *InMemoryCache) evictLRU() int {
+	n := 0
+	for {
+		c.lru.lock.Lock()
+		if c.lru.order.Len() <= c.maxEntries {
+			c.lru.lock.Unlock()
+			return n
+		}
+		oldest := c.lru.order.Back()
+		entry := oldest.Value.(cacheLRUKey)
+		c.lru.lock.Unlock()
+
+		shard := c.shard(entry.host)
+		shard.lock.Lock()
+		c.lru.lock.Lock()
+		// the entry may have been read or removed while no lock was held, in which case the next oldest is found again
+		stillOldest := c.lru.order.Back() == oldest
+		c.lru.lock.Unlock()
+		if stillOldest {
+			shard.remove(entry.host, entry.key)
+			n++
+		}
+		shard.lock.Unlock()
 	}
 }
 
 func (c *InMemoryCache) Set(parameters CacheSetParameters) error {
-	c.lock.Lock()
-	defer c.lock.Unlock()
+	c.set(parameters)
+
+	if c.maxEntries > 0 {
+		if n := c.evictLRU(); n > 0 {
+			c.logger.Debug("evicted least recently used entries", "evicted", n, "max_entries", c.maxEntries)
+			cacheEvictionsMetric.Add(float64(n))
+		}
+	}
+	return nil
+}
+
+// set stores an entry, evicting its host's least recently used entries if it has too many
+func (c *InMemoryCache) set(parameters CacheSetParameters) {
+	shard := c.shard(parameters.host)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
 
 	item := InMemoryCacheItem{
-		path:               parameters.path,
-		location:           parameters.location,
-		code:               parameters.code,
-		ttl:                c.ttl,
-		createdAt:          time.Now().Unix(),
-		cacheControlMaxAge: parameters.cacheControlMaxAge,
+		path:                parameters.path,
+		location:            parameters.location,
+		canonical:           parameters.canonical,
+		code:                parameters.code,
+		ttl:                 parameters.entryTTL(c.ttl),
+		createdAt:           time.Now().Unix(),
+		cacheControlMaxAge:  parameters.cacheControlMaxAge,
+		preserveRequestPort: parameters.preserveRequestPort,
+		miss:                parameters.miss,
+		rule:                parameters.rule,
 	}
 
-	if _, ok := c.cache[parameters.host]; ok {
-		c.cache[parameters.host][parameters.path] = item
-	} else {
-		c.cache[parameters.host] = make(map[string]InMemoryCacheItem)
-		c.cache[parameters.host][parameters.path] = item
+	key := cacheKey(parameters.path, parameters.query, parameters.variant)
+	if c.maxEntriesPerHost > 0 {
+		order, ok := shard.recency[parameters.host]
+		if !ok {
+			order = list.New()
+			shard.recency[parameters.host] = order
+		}
+		if existing, ok := shard.cache[parameters.host][key]; ok && existing.element != nil {
+			item.element = existing.element
+			order.MoveToFront(item.element)
+		} else {
+			item.element = order.PushFront(key)
+		}
+	}
+	if c.maxEntries > 0 {
+		if existing, ok := shard.cache[parameters.host][key]; ok && existing.lruElement != nil {
+			item.lruElement = existing.lruElement
+			c.lru.touch(item.lruElement)
+		} else {
+			c.lru.lock.Lock()
+			item.lruElement = c.lru.order.PushFront(cacheLRUKey{host: parameters.host, key: key})
+			c.lru.lock.Unlock()
+		}
+	}
+
+	if _, ok := shard.cache[parameters.host]; !ok {
+		shard.cache[parameters.host] = make(map[string]InMemoryCacheItem)
 	}
+	// replacing an entry doesn't change the number of entries
+	if _, ok := shard.cache[parameters.host][key]; !ok {
+		cacheHostEntriesMetric.WithLabelValues(parameters.host).Inc()
+		cacheEntriesMetric.Inc()
+	}
+	shard.cache[parameters.host][key] = item
 	c.logger.Debug("adding item to cache", "host", parameters.host, "path", parameters.path, "code", parameters.code, "ttl", c.ttl, "location", parameters.location)
-	return nil
+
+	if c.maxEntriesPerHost > 0 {
+		if n := shard.evict(parameters.host, c.maxEntriesPerHost); n > 0 {
+			c.logger.Debug("evicted least recently used entries for host", "host", parameters.host, "evicted", n, "max_entries_per_host", c.maxEntriesPerHost)
+			cacheHostEvictionsMetric.WithLabelValues(parameters.host).Add(float64(n))
+		}
+	}
+}
+
+func (c *InMemoryCache) Flush() (int, error) {
+	n := 0
+	for _, shard := range c.shards {
+		shard.lock.Lock()
+		for host, domain := range shard.cache {
+			n += len(domain)
+			cacheHostEntriesMetric.WithLabelValues(host).Sub(float64(len(domain)))
+			cacheEntriesMetric.Sub(float64(len(domain)))
+			for _, item := range domain {
+				if item.lruElement != nil {
+					shard.lru.remove(item.lruElement)
+				}
+			}
+		}
+		shard.cache = make(map[string]map[string]InMemoryCacheItem)
+		shard.recency = make(map[string]*list.List)
+		shard.lock.Unlock()
+	}
+
+	c.logger.Debug("flushed cache", "entries", n)
+	return n, nil
+}
+
+// Stats counts entries one shard at a time, holding each shard's read lock only while its hosts are counted, so that
+// requests and the cleanup job aren't blocked for the whole cache. Expired entries the cleanup job hasn't removed yet are
+// counted
+func (c *InMemoryCache) Stats() (CacheStats, error) {
+	hosts := map[string]int{}
+	for _, shard := range c.shards {
+		shard.lock.RLock()
+		for host, domain := range shard.cache {
+			hosts[host] = len(domain)
+		}
+		shard.lock.RUnlock()
+	}
+	return newCacheStats(hosts), nil
+}
+
+func (c *InMemoryCache) FlushHost(host string) (int, error) {
+	shard := c.shard(host)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	n := len(shard.cache[host])
+	for key := range shard.cache[host] {
+		shard.remove(host, key)
+	}
+	delete(shard.cache, host)
+	delete(shard.recency, host)
+
+	c.logger.Debug("flushed host from cache", "host", host, "entries", n)
+	return n, nil
+}
+
+// flushOnSignal flushes cache whenever a signal is received on signals, until ctx is done
+func flushOnSignal(ctx context.Context, l *slog.Logger, cache Cache, signals <-chan os.Signal) {
+	logger := l.WithGroup("cache")
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case sig := <-signals:
+			flushed, err := cache.Flush()
+			if err != nil {
+				logger.Error("error flushing cache", "signal", sig.String(), "err", err)
+				continue
+			}
+			logger.Info("flushed cache", "signal", sig.String(), "entries", flushed)
+		}
+	}
+}
+
+// cleanup removes expired entries from every shard
+func (c *InMemoryCache) cleanup() {
+	start := time.Now().UnixMilli()
+
+	c.logger.Debug("starting cache cleanup")
+	// expired entries are already treated as misses by Get, this only reclaims their memory
+	// TODO a time-based cache is a lazy way to not have to implement more complex logic while keeping the cache size in check
+	for _, shard := range c.shards {
+		shard.lock.Lock()
+		for host, domain := range shard.cache {
+			for path, item := range domain {
+				now := time.Now().Unix()
+				if item.expired(now) {
+					c.logger.Debug("removing expired rule from cache", "path", path, "code", item.code, "location", item.location, "ttl", item.ttl, "now", now)
+					shard.remove(host, path)
+				}
+			}
+		}
+		shard.lock.Unlock()
+	}
+	end := time.Now().UnixMilli()
+	cacheCleanupJobDuration.Observe(float64(end - start))
+	c.logger.Debug("finished cache cleanup")
 }
 
 func NewInMemoryCache(ctx context.Context, l *slog.Logger, interval int, ttl int64) *InMemoryCache {
+	return newShardedInMemoryCache(ctx, l, interval, ttl, defaultCacheShards, 0, 0)
+}
+
+// NewInMemoryCacheFromConfig returns an InMemoryCache configured by the cache section of the config
+func NewInMemoryCacheFromConfig(ctx context.Context, l *slog.Logger, c CacheConfig) *InMemoryCache {
+	return newShardedInMemoryCache(ctx, l, c.CleanupInterval, c.TTL, defaultCacheShards, c.MaxEntriesPerHost, c.MaxEntries)
+}
+
+func newShardedInMemoryCache(ctx context.Context, l *slog.Logger, interval int, ttl int64, shards int, maxEntriesPerHost int, maxEntries int) *InMemoryCache {
 	logger := l.WithGroup("cache")
 	c := &InMemoryCache{
-		logger: logger,
-		cache:  make(map[string]map[string]InMemoryCacheItem),
-		ttl:    ttl,
+		logger:            logger,
+		ttl:               ttl,
+		maxEntriesPerHost: maxEntriesPerHost,
+		maxEntries:        maxEntries,
+		shards:            make([]*inMemoryCacheShard, shards),
+	}
+	if maxEntries > 0 {
+		c.lru = &cacheLRU{order: list.New()}
+	}
+	for i := range c.shards {
+		c.shards[i] = &inMemoryCacheShard{cache: make(map[string]map[string]InMemoryCacheItem), recency: make(map[string]*list.List), lru: c.lru}
 	}
 
 	// Start background job to clean up expired records
@@ -150,24 +714,7 @@ func NewInMemoryCache(ctx context.Context, l *slog.Logger, interval int, ttl int
 				logger.Info("stopping cache cleanup")
 				return
 			}
-			start := time.Now().UnixMilli()
-
-			c.logger.Debug("starting cache cleanup")
-			// TODO a time-based cache is a lazy way to not have to implement more complex logic while keeping the cache size in check
-			for _, domain := range c.cache {
-				for path, item := range domain {
-					now := time.Now().Unix()
-					if now > (item.createdAt + item.ttl) {
-						c.logger.Debug("removing expired rule from cache", "path", path, "code", item.code, "location", item.location, "ttl", item.ttl, "now", now)
-						c.lock.Lock()
-						delete(domain, path)
-						c.lock.Unlock()
-					}
-				}
-			}
-			end := time.Now().UnixMilli()
-			cacheCleanupJobDuration.Observe(float64(end - start))
-			c.logger.Debug("finished cache cleanup")
+			c.cleanup()
 			time.Sleep(time.Duration(interval) * time.Second)
 		}
 	}(ctx, c)
@@ -0,0 +1,327 @@
+//go:build unit_test
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+func TestInMemoryCacheShards(t *testing.T) {
+	logger := newTestLogger()
+	cache := newShardedInMemoryCache(t.Context(), logger, 3600, 86400, 4, 0, 0)
+
+	var wg sync.WaitGroup
+	for i := range 100 {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			host := fmt.Sprintf("host-%d.example.com", i)
+			_ = cache.Set(CacheSetParameters{host: host, path: "/foo", location: "https://" + host + "/bar", code: 301})
+		}(i)
+	}
+	wg.Wait()
+
+	for i := range 100 {
+		host := fmt.Sprintf("host-%d.example.com", i)
+		got, err := cache.Get(CacheGetParameters{host: host, path: "/foo"})
+		assert.NoError(t, err)
+		assert.Equal(t, "https://"+host+"/bar", got.location)
+	}
+
+	// entries should be spread across shards rather than all landing in one
+	for _, shard := range cache.shards {
+		assert.NotEmpty(t, shard.cache)
+	}
+
+	n, err := cache.Flush()
+	assert.NoError(t, err)
+	assert.Equal(t, 100, n)
+
+	got, _ := cache.Get(CacheGetParameters{host: "host-0.example.com", path: "/foo"})
+	assert.Nil(t, got)
+}
+
+// BenchmarkInMemoryCache compares a single lock against the default number of shards with many goroutines writing
+// to and reading from different hosts
+func BenchmarkInMemoryCache(b *testing.B) {
+	logger := NewLogger(slog.LevelInfo, false, io.Discard)
+
+	for _, shards := range []int{1, defaultCacheShards} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			cache := newShardedInMemoryCache(b.Context(), logger, 3600, 86400, shards, 0, 0)
+
+			b.SetParallelism(64)
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					host := fmt.Sprintf("host-%d.example.com", i%256)
+					path := fmt.Sprintf("/path-%d", i)
+					_ = cache.Set(CacheSetParameters{host: host, path: path, location: "https://example.com/", code: 301})
+					_, _ = cache.Get(CacheGetParameters{host: host, path: path})
+					i++
+				}
+			})
+		})
+	}
+}
+
+func TestInMemoryCacheExpiredOnRead(t *testing.T) {
+	logger := newTestLogger()
+	// the cleanup job won't run again during the test
+	cache := NewInMemoryCache(t.Context(), logger, 3600, 60)
+
+	_ = cache.Set(CacheSetParameters{host: "example.com", path: "/foo", location: "https://example.com/bar", code: 301})
+	got, _ := cache.Get(CacheGetParameters{host: "example.com", path: "/foo"})
+	assert.NotNil(t, got)
+
+	// age the entry past its TTL
+	shard := cache.shard("example.com")
+	shard.lock.Lock()
+	item := shard.cache["example.com"]["/foo"]
+	item.createdAt -= 61
+	shard.cache["example.com"]["/foo"] = item
+	shard.lock.Unlock()
+
+	got, _ = cache.Get(CacheGetParameters{host: "example.com", path: "/foo"})
+	assert.Nil(t, got)
+
+	// the expired entry is deleted when it's read
+	shard.lock.RLock()
+	_, ok := shard.cache["example.com"]["/foo"]
+	shard.lock.RUnlock()
+	assert.False(t, ok)
+}
+
+func TestInMemoryCacheMaxEntriesPerHost(t *testing.T) {
+	logger := newTestLogger()
+	cache := newShardedInMemoryCache(t.Context(), logger, 3600, 86400, 1, 3, 0)
+	evicted := testutil.ToFloat64(cacheHostEvictionsMetric.WithLabelValues("noisy.example.com"))
+
+	// both hosts share the only shard, so only the noisy host's own entries count towards its cap
+	_ = cache.Set(CacheSetParameters{host: "quiet.example.com", path: "/foo", location: "https://example.com/", code: 301})
+	for i := range 3 {
+		_ = cache.Set(CacheSetParameters{host: "noisy.example.com", path: fmt.Sprintf("/path-%d", i), location: "https://example.com/", code: 301})
+	}
+
+	// reading /path-0 makes /path-1 the least recently used entry
+	got, _ := cache.Get(CacheGetParameters{host: "noisy.example.com", path: "/path-0"})
+	assert.NotNil(t, got)
+	for i := 3; i < 10; i++ {
+		_ = cache.Set(CacheSetParameters{host: "noisy.example.com", path: fmt.Sprintf("/path-%d", i), location: "https://example.com/", code: 301})
+		if i == 3 {
+			got, _ = cache.Get(CacheGetParameters{host: "noisy.example.com", path: "/path-1"})
+			assert.Nil(t, got)
+			got, _ = cache.Get(CacheGetParameters{host: "noisy.example.com", path: "/path-0"})
+			assert.NotNil(t, got)
+		}
+	}
+
+	shard := cache.shard("noisy.example.com")
+	assert.Len(t, shard.cache["noisy.example.com"], 3)
+	assert.Equal(t, 3, shard.recency["noisy.example.com"].Len())
+	for i := 7; i < 10; i++ {
+		got, _ = cache.Get(CacheGetParameters{host: "noisy.example.com", path: fmt.Sprintf("/path-%d", i)})
+		assert.NotNil(t, got)
+	}
+	assert.Equal(t, evicted+7, testutil.ToFloat64(cacheHostEvictionsMetric.WithLabelValues("noisy.example.com")))
+
+	got, _ = cache.Get(CacheGetParameters{host: "quiet.example.com", path: "/foo"})
+	assert.NotNil(t, got)
+
+	// replacing an entry doesn't count as a new one
+	_ = cache.Set(CacheSetParameters{host: "noisy.example.com", path: "/path-9", location: "https://example.com/new", code: 301})
+	assert.Len(t, shard.cache["noisy.example.com"], 3)
+	assert.Equal(t, evicted+7, testutil.ToFloat64(cacheHostEvictionsMetric.WithLabelValues("noisy.example.com")))
+}
+
+func TestInMemoryCacheMaxEntries(t *testing.T) {
+	logger := newTestLogger()
+	cache := newShardedInMemoryCache(t.Context(), logger, 3600, 86400, 4, 0, 3)
+	evicted := testutil.ToFloat64(cacheEvictionsMetric)
+
+	// entries for different hosts, in different shards, all count towards the cap
+	for i := range 3 {
+		_ = cache.Set(CacheSetParameters{host: fmt.Sprintf("host-%d.example.com", i), path: "/foo", location: "https://example.com/", code: 301})
+	}
+
+	// reading host-0 makes host-1 the least recently used entry
+	got, _ := cache.Get(CacheGetParameters{host: "host-0.example.com", path: "/foo"})
+	assert.NotNil(t, got)
+	_ = cache.Set(CacheSetParameters{host: "host-3.example.com", path: "/foo", location: "https://example.com/", code: 301})
+
+	got, _ = cache.Get(CacheGetParameters{host: "host-1.example.com", path: "/foo"})
+	assert.Nil(t, got)
+	for _, host := range []string{"host-0.example.com", "host-2.example.com", "host-3.example.com"} {
+		got, _ = cache.Get(CacheGetParameters{host: host, path: "/foo"})
+		assert.NotNil(t, got, host)
+	}
+	assert.Equal(t, evicted+1, testutil.ToFloat64(cacheEvictionsMetric))
+
+	// filling the cache well past the cap keeps it at the cap
+	for i := range 20 {
+		_ = cache.Set(CacheSetParameters{host: "example.com", path: fmt.Sprintf("/path-%d", i), location: "https://example.com/", code: 301})
+	}
+	assert.Equal(t, 3, cache.lru.order.Len())
+	assert.Equal(t, evicted+21, testutil.ToFloat64(cacheEvictionsMetric))
+
+	// replacing an entry doesn't count as a new one
+	_ = cache.Set(CacheSetParameters{host: "example.com", path: "/path-19", location: "https://example.com/new", code: 301})
+	assert.Equal(t, evicted+21, testutil.ToFloat64(cacheEvictionsMetric))
+
+	n, err := cache.Flush()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, 0, cache.lru.order.Len())
+}
+
+func TestInMemoryCacheEntriesMetrics(t *testing.T) {
+	logger := newTestLogger()
+	cache := newShardedInMemoryCache(t.Context(), logger, 3600, 60, 4, 3, 0)
+	host := "gauge.example.com"
+	total := testutil.ToFloat64(cacheEntriesMetric)
+	entries := func() float64 {
+		return testutil.ToFloat64(cacheHostEntriesMetric.WithLabelValues(host))
+	}
+
+	for i := range 3 {
+		_ = cache.Set(CacheSetParameters{host: host, path: fmt.Sprintf("/path-%d", i), location: "https://example.com/", code: 301})
+	}
+	// replacing an entry doesn't count as a new one
+	_ = cache.Set(CacheSetParameters{host: host, path: "/path-0", location: "https://example.com/new", code: 301})
+	assert.Equal(t, float64(3), entries())
+	assert.Equal(t, total+3, testutil.ToFloat64(cacheEntriesMetric))
+
+	// evicting an entry to stay under max_entries_per_host replaces it
+	_ = cache.Set(CacheSetParameters{host: host, path: "/path-3", location: "https://example.com/", code: 301})
+	assert.Equal(t, float64(3), entries())
+
+	// age two entries past their TTL, one is removed by the cleanup job and the other when it's read
+	shard := cache.shard(host)
+	shard.lock.Lock()
+	for _, path := range []string{"/path-2", "/path-3"} {
+		item := shard.cache[host][path]
+		item.createdAt -= 61
+		shard.cache[host][path] = item
+	}
+	shard.lock.Unlock()
+	got, _ := cache.Get(CacheGetParameters{host: host, path: "/path-3"})
+	assert.Nil(t, got)
+	assert.Equal(t, float64(2), entries())
+	cache.cleanup()
+	assert.Equal(t, float64(1), entries())
+	assert.Equal(t, total+1, testutil.ToFloat64(cacheEntriesMetric))
+
+	_, _ = cache.Flush()
+	assert.Equal(t, float64(0), entries())
+	assert.Equal(t, total, testutil.ToFloat64(cacheEntriesMetric))
+}
+
+func TestSplitCache(t *testing.T) {
+	logger := newTestLogger()
+	positive := NewInMemoryCache(t.Context(), logger, 3600, 3600)
+	negative := NewInMemoryCache(t.Context(), logger, 3600, 60)
+	cache := &splitCache{positive: positive, negative: negative}
+
+	_ = cache.Set(CacheSetParameters{host: "example.com", path: "/hit", location: "https://example.com/", code: 301})
+	_ = cache.Set(CacheSetParameters{host: "example.com", path: "/miss", code: 404, miss: true})
+
+	// each entry is only stored in its own cache
+	got, _ := positive.Get(CacheGetParameters{host: "example.com", path: "/hit"})
+	assert.NotNil(t, got)
+	got, _ = negative.Get(CacheGetParameters{host: "example.com", path: "/hit"})
+	assert.Nil(t, got)
+	got, _ = positive.Get(CacheGetParameters{host: "example.com", path: "/miss"})
+	assert.Nil(t, got)
+	got, _ = negative.Get(CacheGetParameters{host: "example.com", path: "/miss"})
+	assert.NotNil(t, got)
+
+	// both are read through the split cache
+	got, _ = cache.Get(CacheGetParameters{host: "example.com", path: "/hit"})
+	if assert.NotNil(t, got) {
+		assert.Equal(t, 301, got.code)
+	}
+	got, _ = cache.Get(CacheGetParameters{host: "example.com", path: "/miss"})
+	if assert.NotNil(t, got) {
+		assert.True(t, got.miss)
+	}
+
+	n, err := cache.Flush()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+}
+
+func TestNegativeCacheConfig(t *testing.T) {
+	logger := newTestLogger()
+
+	cfg, err := parseConfig(logger, []byte(`
+status_on_miss: 404
+cache:
+  negative: {}
+rules:
+  - from: 'example.com/foo'
+    to: 'https://foo.com/'
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, &NegativeCacheConfig{Backend: CacheBackendMemory, TTL: defaultNegativeCacheTTL, CleanupInterval: defaultNegativeCacheCleanup}, cfg.Cache.Negative)
+
+	c, err := newCache(t.Context(), logger, cfg.Cache)
+	assert.NoError(t, err)
+	cache, ok := c.(*splitCache)
+	if !assert.True(t, ok) {
+		return
+	}
+	positive := &spyCache{}
+	negative := &spyCache{}
+	cache.positive, cache.negative = positive, negative
+
+	// the handler's misses go to the negative cache, its redirects to the positive one
+	handler := handleRequest(logger, cache, cfg)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com/missing", nil))
+	assert.Equal(t, 0, positive.sets)
+	assert.Equal(t, 1, negative.sets)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com/foo", nil))
+	assert.Equal(t, 1, positive.sets)
+	assert.Equal(t, 1, negative.sets)
+
+	// without a negative cache, one cache stores both
+	cfg, err = parseConfig(logger, []byte(""))
+	assert.NoError(t, err)
+	assert.Nil(t, cfg.Cache.Negative)
+	c, err = newCache(t.Context(), logger, cfg.Cache)
+	assert.NoError(t, err)
+	assert.IsType(t, &InMemoryCache{}, c)
+}
+
+func TestFlushOnSignal(t *testing.T) {
+	logger := newTestLogger()
+	cache := &spyCache{}
+	flushed := make(chan struct{})
+	cache.onFlush = func() { flushed <- struct{}{} }
+
+	ctx, cancel := context.WithCancel(t.Context())
+	signals := make(chan os.Signal)
+	done := make(chan struct{})
+	go func() {
+		flushOnSignal(ctx, logger, cache, signals)
+		close(done)
+	}()
+
+	for i := 1; i <= 2; i++ {
+		signals <- syscall.SIGUSR1
+		<-flushed
+		assert.Equal(t, i, cache.flushes)
+	}
+
+	cancel()
+	<-done
+}
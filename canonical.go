@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	// CanonicalHostWWW redirects `example.com` to `www.example.com`
+	CanonicalHostWWW = "www"
+	// CanonicalHostApex redirects `www.example.com` to `example.com`
+	CanonicalHostApex = "apex"
+
+	wwwPrefix = "www."
+)
+
+func validCanonicalHost(mode string) bool {
+	switch mode {
+	case "", CanonicalHostWWW, CanonicalHostApex:
+		return true
+	default:
+		return false
+	}
+}
+
+// canonicalHostname returns the canonical form of hostname, and whether it differs from hostname
+//
+// IP addresses and hosts with a single label, e.g. `localhost`, have no www form, so they're always canonical. The
+// canonical form of a host is always canonical itself, so redirecting to it can't loop
+func canonicalHostname(hostname string, mode string) (string, bool) {
+	if net.ParseIP(strings.Trim(hostname, "[]")) != nil || !strings.Contains(strings.TrimSuffix(hostname, "."), ".") {
+		return hostname, false
+	}
+
+	hasWWW := len(hostname) > len(wwwPrefix) && strings.EqualFold(hostname[:len(wwwPrefix)], wwwPrefix)
+	switch {
+	case mode == CanonicalHostWWW && !hasWWW:
+		return wwwPrefix + hostname, true
+	// `www.com` is an apex domain, not the www form of `com`
+	case mode == CanonicalHostApex && hasWWW && strings.Contains(strings.TrimSuffix(hostname[len(wwwPrefix):], "."), "."):
+		return hostname[len(wwwPrefix):], true
+	default:
+		return hostname, false
+	}
+}
+
+// canonicalHostURL returns the URL of a request on its canonical host, or an empty string if the request's host is
+// already canonical, or if the canonical host has no rules
+//
+// Requiring rules for the canonical host keeps subdomains, e.g. `api.example.com`, from being permanently redirected to
+// a `www.` form that doesn't exist. The path and query are preserved. When forceHTTPS is set, the URL is on https and
+// the request's port is dropped, as with httpsURL, so that http requests to a non-canonical host are redirected once
+// rather than twice
+func canonicalHostURL(r *http.Request, scheme string, mode string, forceHTTPS bool, rules RuleMapping) string {
+	hostname := stripPort(r.Host)
+	canonical, ok := canonicalHostname(hostname, mode)
+	if !ok || len(matchHosts(requestHost(canonical, ""), rules, false)) == 0 {
+		return ""
+	}
+
+	if forceHTTPS && scheme == SchemeHTTP {
+		return SchemeHTTPS + "://" + canonical + r.URL.RequestURI()
+	}
+	// the port, if any, is kept
+	return scheme + "://" + canonical + r.Host[len(hostname):] + r.URL.RequestURI()
+}
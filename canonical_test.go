@@ -0,0 +1,98 @@
+//go:build unit_test
+
+package main
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_canonicalHostname(t *testing.T) {
+	tests := []struct {
+		hostname string
+		mode     string
+		want     string
+		wantOK   bool
+	}{
+		{hostname: "example.com", mode: CanonicalHostWWW, want: "www.example.com", wantOK: true},
+		{hostname: "www.example.com", mode: CanonicalHostWWW, want: "www.example.com"},
+		{hostname: "WWW.example.com", mode: CanonicalHostWWW, want: "WWW.example.com"},
+		{hostname: "www.example.com", mode: CanonicalHostApex, want: "example.com", wantOK: true},
+		{hostname: "example.com", mode: CanonicalHostApex, want: "example.com"},
+		{hostname: "www.com", mode: CanonicalHostApex, want: "www.com"},
+		{hostname: "localhost", mode: CanonicalHostWWW, want: "localhost"},
+		{hostname: "192.0.2.1", mode: CanonicalHostWWW, want: "192.0.2.1"},
+		{hostname: "[2001:db8::1]", mode: CanonicalHostWWW, want: "[2001:db8::1]"},
+		{hostname: "example.com", mode: "", want: "example.com"},
+		// subdomains have a www form too, so canonicalHostURL checks the canonical host has rules
+		{hostname: "go.example.com", mode: CanonicalHostWWW, want: "www.go.example.com", wantOK: true},
+		{hostname: "www.go.example.com", mode: CanonicalHostApex, want: "go.example.com", wantOK: true},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %s", tt.mode, tt.hostname), func(t *testing.T) {
+			got, ok := canonicalHostname(tt.hostname, tt.mode)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.wantOK, ok)
+
+			// the canonical form is canonical itself
+			_, ok = canonicalHostname(got, tt.mode)
+			assert.False(t, ok)
+		})
+	}
+}
+
+func TestCanonicalHost(t *testing.T) {
+	logger := newTestLogger()
+	rules := `
+rules:
+  - from: 'example.com/foo'
+    to: 'https://example.org/apex'
+  - from: 'www.example.com/foo'
+    to: 'https://example.org/www'
+  - from: 'go.example.com/foo'
+    to: 'https://example.org/go'
+  - from: 'www.blog.example.com/foo'
+    to: 'https://example.org/www-blog'
+`
+
+	tests := []struct {
+		name         string
+		mode         string
+		forceHTTPS   bool
+		target       string
+		wantCode     int
+		wantLocation string
+	}{
+		{name: "apex to www", mode: CanonicalHostWWW, target: "http://example.com/foo?a=1", wantCode: http.StatusMovedPermanently, wantLocation: "http://www.example.com/foo?a=1"},
+		{name: "www is matched", mode: CanonicalHostWWW, target: "http://www.example.com/foo", wantCode: http.StatusMovedPermanently, wantLocation: "https://example.org/www"},
+		{name: "www to apex", mode: CanonicalHostApex, target: "https://www.example.com/foo?a=1", wantCode: http.StatusMovedPermanently, wantLocation: "https://example.com/foo?a=1"},
+		{name: "apex is matched", mode: CanonicalHostApex, target: "http://example.com/foo", wantCode: http.StatusMovedPermanently, wantLocation: "https://example.org/apex"},
+		{name: "port is kept", mode: CanonicalHostWWW, target: "http://example.com:8080/foo", wantCode: http.StatusMovedPermanently, wantLocation: "http://www.example.com:8080/foo"},
+		{name: "with force_https", mode: CanonicalHostWWW, forceHTTPS: true, target: "http://example.com:8080/foo", wantCode: http.StatusMovedPermanently, wantLocation: "https://www.example.com/foo"},
+		{name: "unmatched paths are redirected too", mode: CanonicalHostWWW, target: "http://example.com/missing", wantCode: http.StatusMovedPermanently, wantLocation: "http://www.example.com/missing"},
+		{name: "subdomain whose www form has no rules", mode: CanonicalHostWWW, target: "http://go.example.com/foo", wantCode: http.StatusMovedPermanently, wantLocation: "https://example.org/go"},
+		{name: "unknown subdomain", mode: CanonicalHostWWW, target: "http://api.example.com/foo", wantCode: http.StatusNotFound},
+		{name: "subdomain whose www form has rules", mode: CanonicalHostWWW, target: "http://blog.example.com/foo", wantCode: http.StatusMovedPermanently, wantLocation: "http://www.blog.example.com/foo"},
+		{name: "www subdomain whose apex form has no rules", mode: CanonicalHostApex, target: "http://www.blog.example.com/foo", wantCode: http.StatusMovedPermanently, wantLocation: "https://example.org/www-blog"},
+		{name: "disabled", target: "http://example.com/foo", wantCode: http.StatusMovedPermanently, wantLocation: "https://example.org/apex"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := parseConfig(logger, []byte(fmt.Sprintf("canonical_host: '%s'\nforce_https: %t\n%s", tt.mode, tt.forceHTTPS, rules)))
+			assert.NoError(t, err)
+
+			w := httptest.NewRecorder()
+			// https targets are requested over TLS
+			handleRequest(logger, &noopCache{}, cfg).ServeHTTP(w, httptest.NewRequest("GET", tt.target, nil))
+			assert.Equal(t, tt.wantCode, w.Code)
+			assert.Equal(t, tt.wantLocation, w.Header().Get("Location"))
+		})
+	}
+
+	cfg, err := parseConfig(logger, []byte("canonical_host: 'both'\n"+rules))
+	assert.NoError(t, err)
+	assert.Equal(t, "", cfg.CanonicalHost)
+}
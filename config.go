@@ -3,17 +3,29 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/fsnotify/fsnotify"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/net/idna"
 	"gopkg.in/yaml.v3"
 	"io"
 	"log/slog"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"regexp"
+	"regexp/syntax"
+	"slices"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 	"unicode"
 )
 
@@ -24,27 +36,218 @@ const (
 	defaultMetricsServerListenAddress = "0.0.0.0:8485"
 	defaultCacheTTL                   = 86400
 	defaultCacheCleanupInterval       = 3600
+	defaultNegativeCacheTTL           = 60
+	defaultNegativeCacheCleanup       = 60
 	defaultLocationOnMiss             = ""
 	defaultStatusOnMiss               = http.StatusNotFound
+	defaultForceHTTPSCode             = http.StatusMovedPermanently
 	defaultCacheControlMaxAge         = 86400 * 7 // cache for one week
+	defaultCacheControlOnMiss         = "no-store"
+	defaultToScheme                   = "https"
+	defaultTracingHeaderName          = "X-Request-Id"
+	defaultLogMaxSize                 = 100
+	defaultAccessLogSampleRate        = 1.0
+	defaultMaxPathLength              = 8192
+	defaultRateLimitMaxTrackedIPs     = 10000
+	defaultMaxDrainedBody             = 64 << 10
+	defaultRedisTimeout               = time.Second
+)
+
+var (
+	activeHostsMetric = promauto.With(appMetrics).NewGauge(
+		prometheus.GaugeOpts{
+			Name: "active_hosts",
+			Help: "Number of hosts with rules being served",
+		})
 )
 
 type AppConfig struct {
 	lock                       sync.RWMutex
-	ListenAddress              string      `yaml:"listen_address"`
-	MetricsServerListenAddress string      `yaml:"metrics_server_listen_address"`
-	LocationOnMiss             string      `yaml:"location_on_miss"`
-	StatusOnMiss               int         `yaml:"status_on_miss"`
-	DefaultParameterStrategy   string      `yaml:"default_parameter_strategy"`
-	CacheControlMaxAge         int         `yaml:"cache_control_max_age"`
-	Cache                      CacheConfig `yaml:"cache"`
-	RuleMap                    RuleMapping
-	Rules                      `yaml:"rules"`
+	ListenAddress              string         `yaml:"listen_address"`
+	MetricsServerListenAddress string         `yaml:"metrics_server_listen_address"`
+	LocationOnMiss             string         `yaml:"location_on_miss"`
+	StatusOnMiss               int            `yaml:"status_on_miss"`
+	DefaultParameterStrategy   string         `yaml:"default_parameter_strategy"`
+	DefaultParameters          RuleParameters `yaml:"default_parameters"`
+	MalformedQuery             string         `yaml:"malformed_query"`
+	ErrorFormat                string         `yaml:"error_format"`
+	CacheControlMaxAge         int            `yaml:"cache_control_max_age"`
+	// CacheControlOnMiss is the Cache-Control header sent with miss responses. An empty value sends no header
+	CacheControlOnMiss string `yaml:"cache_control_on_miss"`
+	// UnknownPathStatus is the status of misses for paths under a host with rules, by host: 404 or 410. It's sent instead
+	// of the location_on_miss redirect, e.g. so that search engines drop a retired section
+	UnknownPathStatus map[string]int `yaml:"unknown_path_status"`
+	// MatchCacheSize is the number of requests whose matching rule is remembered, separately from the response cache.
+	// 0 disables it
+	MatchCacheSize int `yaml:"match_cache_size"`
+	// PreserveQueryOrder encodes the Location header's query parameters in the order the request sent them, rather than
+	// sorted. Parameters the request didn't send follow, sorted
+	PreserveQueryOrder bool `yaml:"preserve_query_order"`
+	// QueryDedup collapses repeated request parameters, e.g. `?a=1&a=2`, before the rule's parameter strategy is applied
+	QueryDedup string `yaml:"query_dedup"`
+	// EmptyToPath is what a rule redirects to when its `to` expands to an empty path, e.g. `https://example.com`. See the
+	// EmptyToPath constants
+	EmptyToPath string `yaml:"empty_to_path"`
+	// SemicolonQuerySeparator treats `;` in the request's query as a parameter separator, as well as `&`
+	SemicolonQuerySeparator bool `yaml:"semicolon_query_separator"`
+	// WildcardFallthrough matches a request against the rules of its wildcard host, e.g. `*.example.com`, when its own
+	// host has rules but none of them match
+	WildcardFallthrough bool `yaml:"wildcard_fallthrough"`
+	// StripHostPrefix is removed from the start of the request's host before it's matched and cached, e.g. `www.`, so
+	// that one set of rules serves both hosts
+	StripHostPrefix string `yaml:"strip_host_prefix"`
+	// CanonicalHost redirects requests between a host's apex and www forms before they're matched against the rules.
+	// See the CanonicalHost constants
+	CanonicalHost string `yaml:"canonical_host"`
+	// ConfigPollInterval, if set, reloads the config on a timer as well as when the file watcher sees it change, for
+	// filesystems where file events are unreliable. The config is only applied if its content has changed
+	ConfigPollInterval time.Duration `yaml:"config_poll_interval"`
+	// RefererLoop compares the Location of each redirect with the request's Referer header to catch redirect loops that
+	// span several requests. See the RefererLoop constants
+	RefererLoop string `yaml:"referer_loop"`
+	// ForceHTTPS redirects every http request to the same URL on https before it's matched against the rules
+	ForceHTTPS bool `yaml:"force_https"`
+	// ForceHTTPSCode is the status code of force_https redirects: 301, 302, 307, or 308
+	ForceHTTPSCode int `yaml:"force_https_code"`
+	// HSTS is sent with responses to https requests
+	HSTS HSTSConfig `yaml:"hsts"`
+	// TieBreak decides which of several equally specific matching rules wins. See the TieBreak constants
+	TieBreak                  string            `yaml:"tie_break"`
+	MissOnSelfRedirect        bool              `yaml:"miss_on_self_redirect"`
+	PathSegmentBoundary       bool              `yaml:"path_segment_boundary"`
+	NormalizePath             bool              `yaml:"normalize_path"`
+	DefaultToScheme           string            `yaml:"default_to_scheme"`
+	StrictToScheme            bool              `yaml:"strict_to_scheme"`
+	UnmatchedRulesLogInterval int               `yaml:"unmatched_rules_log_interval"`
+	LintOverlappingRules      bool              `yaml:"lint_overlapping_rules"`
+	Cache                     CacheConfig       `yaml:"cache"`
+	Server                    ServerConfig      `yaml:"server"`
+	Tracing                   TracingConfig     `yaml:"tracing"`
+	Metrics                   MetricsConfig     `yaml:"metrics"`
+	Debug                     DebugConfig       `yaml:"debug"`
+	TLS                       TLSConfig         `yaml:"tls"`
+	Maintenance               MaintenanceConfig `yaml:"maintenance"`
+	RateLimit                 RateLimitConfig   `yaml:"rate_limit"`
+	GeoIP                     GeoIPConfig       `yaml:"geoip"`
+	// Tests are run through the rules at startup and by the selftest command
+	Tests      []SelfTest      `yaml:"tests"`
+	Limits     LimitsConfig    `yaml:"limits"`
+	Log        LogConfig       `yaml:"log"`
+	AccessLogs AccessLogConfig `yaml:"access_logs"`
+	RuleMap    RuleMapping
+	matchCache *ruleMatchLRU
+	// conditions are the request attributes matched on by each host's rules, for hosts with conditional rules
+	conditions map[string]ruleConditions
+	Rules      `yaml:"rules"`
+	// Hosts is an alternative to Rules that groups rules by host. It's normalized into Rules when loaded
+	Hosts        map[string]Rules `yaml:"hosts"`
+	droppedRules []DroppedRule
+	// contentHash is the hash of the config files the config was loaded from, see configHash. It's empty for configs that
+	// weren't loaded from files
+	contentHash string
+	// expressions are compiled expressions from the previous config that buildRules reuses rather than compiling again
+	expressions map[string]*regexp.Regexp
+	// reusedExpressions is the number of rules whose expression was reused from the previous config
+	reusedExpressions int
+	// uncached are the hosts whose rules all set no_cache
+	uncached map[string]bool
+	// geoip looks up the countries matched by match_country. It's opened once GeoIP.Database is loaded, and reloaded
+	// when the file changes rather than with the config
+	geoip *geoIPDatabase
 }
 
 type CacheConfig struct {
 	TTL             int64 `yaml:"ttl"`
 	CleanupInterval int   `yaml:"cleanup_interval"`
+	// MaxEntriesPerHost is the number of entries a host can have before its least recently used entries are evicted.
+	// 0 is unlimited
+	MaxEntriesPerHost int `yaml:"max_entries_per_host"`
+	// MaxEntries is the number of entries the cache can have before its least recently used entries are evicted, across
+	// every host. 0 is unlimited
+	MaxEntries int `yaml:"max_entries"`
+	// Backend stores the cached responses. See the CacheBackend constants
+	Backend string `yaml:"backend"`
+	// Negative, if set, caches misses in their own backend, leaving Backend for redirects
+	Negative *NegativeCacheConfig `yaml:"negative"`
+	// SkipCaptures stops caching redirects from rules whose `to` directive references a capture, since each path gets
+	// its own Location. A rule's `cacheable` overrides it
+	SkipCaptures bool `yaml:"skip_captures"`
+	// Redis configures the connection to Redis when Backend, or Negative's backend, is `redis`
+	Redis RedisConfig `yaml:"redis"`
+	// NegativeTTL is how long misses, including redirects to location_on_miss, are cached for, in seconds. It's shorter
+	// than TTL so that a miss doesn't hide a newly added rule for long. Negative's own TTL applies instead when it's set
+	NegativeTTL int64 `yaml:"negative_ttl"`
+	// CacheMisses caches misses. When it's off, every miss is matched against the rules
+	CacheMisses bool `yaml:"cache_misses"`
+}
+
+// NegativeCacheConfig configures the cache for misses, including redirects to location_on_miss
+type NegativeCacheConfig struct {
+	Backend         string `yaml:"backend"`
+	TTL             int64  `yaml:"ttl"`
+	CleanupInterval int    `yaml:"cleanup_interval"`
+}
+
+type ServerConfig struct {
+	// Compression enables gzip/deflate compression of response bodies for clients that accept it
+	Compression bool `yaml:"compression"`
+	// ServerHeader is sent as the Server header. An empty string leaves the header unset, "-" suppresses it entirely
+	ServerHeader string `yaml:"server_header"`
+	// MaxConcurrentRequests is the number of requests handled at once before responding with a 503. 0 is unlimited
+	MaxConcurrentRequests int `yaml:"max_concurrent_requests"`
+	// RetryAfter is the number of seconds sent in the Retry-After header when MaxConcurrentRequests is reached
+	RetryAfter int `yaml:"retry_after"`
+	// SlowRequestThreshold is how long handling a request can take before it's logged as slow. 0 disables logging
+	SlowRequestThreshold time.Duration `yaml:"slow_request_threshold"`
+	// ETag sends an ETag with redirects and responds with a 304 to requests whose If-None-Match header matches it
+	ETag bool `yaml:"etag"`
+	// Network is the network listened on, `tcp`, `tcp4`, or `tcp6`
+	Network string `yaml:"network"`
+	// AllowedMethods are the request methods that are handled. Other methods get a 405. An empty list allows every method
+	AllowedMethods []string `yaml:"allowed_methods"`
+	// TrustedProxies are the networks of proxies whose X-Forwarded-For header is used to find a client's IP address
+	TrustedProxies []string `yaml:"trusted_proxies"`
+	trustedProxies []*net.IPNet
+	// ArtificialDelay is added to every request before responding, to test how clients handle a slow redirector. It
+	// requires debug.enabled
+	ArtificialDelay time.Duration `yaml:"artificial_delay"`
+	// BasePath is prepended to the Location of relative redirects, for when redirector is mounted under a path by a
+	// proxy, e.g. `/redirect`
+	BasePath string `yaml:"base_path"`
+	// ResolveEndpoint serves GET /resolve?url=..., which responds with the redirect for a URL as JSON rather than
+	// redirecting. It's off by default since /resolve is then no longer redirected on any host
+	ResolveEndpoint bool `yaml:"resolve_endpoint"`
+	// ConnectionTimeout is how long a connection can be open before requests on it are cancelled and get a 503 asking
+	// the client to reconnect. 0 is unlimited
+	ConnectionTimeout time.Duration `yaml:"connection_timeout"`
+	// RejectGETBody responds with a 400 to GET and HEAD requests that have a body, rather than discarding it
+	RejectGETBody bool `yaml:"reject_get_body"`
+}
+
+type LimitsConfig struct {
+	// MaxPathLength is the longest request path, in bytes, that is matched. Longer paths get a 414. 0 is unlimited
+	MaxPathLength int `yaml:"max_path_length"`
+	// MaxLocationLength is the longest Location header, in bytes, that a rule can expand to. Rules expanding to longer
+	// locations are treated as misses. 0 is unlimited
+	MaxLocationLength int `yaml:"max_location_length"`
+	// MaxDrainedBody is the number of bytes of a request's body that are read and discarded so that its connection can
+	// be reused. Connections of requests with longer bodies are closed instead
+	MaxDrainedBody int64 `yaml:"max_drained_body"`
+}
+
+type DebugConfig struct {
+	// Enabled allows settings that are only meant for testing, such as server.artificial_delay
+	Enabled bool `yaml:"enabled"`
+	// RuleHeader adds the X-Redirector-Rule header, set to the name of the matched rule, to redirects
+	RuleHeader bool `yaml:"rule_header"`
+	// CapturesHeader adds the X-Redirector-Captures header, listing the matched rule's named capture groups and their
+	// values, to redirects that weren't served from the cache
+	CapturesHeader bool `yaml:"captures_header"`
+}
+
+type TracingConfig struct {
+	// HeaderName is the header a correlation ID is read from and returned in
+	HeaderName string `yaml:"header_name"`
 }
 
 // RuleMapping maps a hostname to a list of Rule objects
@@ -53,17 +256,146 @@ type RuleMapping map[string]Rules
 type Rules []Rule
 
 type Rule struct {
+	Name               string         `yaml:"name"`
 	From               string         `yaml:"from"`
+	FromPath           string         `yaml:"from_path"`
 	To                 string         `yaml:"to"`
+	ToFallback         string         `yaml:"to_fallback"`
 	Code               int            `yaml:"code"`
 	Parameters         RuleParameters `yaml:"parameters"`
 	CacheControlMaxAge int            `yaml:"cache_control_max_age"`
-	compiled           *regexp.Regexp
+	Match              string         `yaml:"match"`
+	AllowQuery         []string       `yaml:"allow_query"`
+	// PreserveRequestPort adds the port the request was made on to the `to` host, unless `to` has a port
+	PreserveRequestPort bool `yaml:"preserve_request_port"`
+	// LowercasePath lowercases the path of the Location header after captures are expanded
+	LowercasePath bool `yaml:"lowercase_path"`
+	// Canonical is sent in a `Link: <url>; rel="canonical"` header alongside the redirect. It can reference captures
+	Canonical string `yaml:"canonical"`
+	// PreserveMethod turns a 301 into a 308 and a 302 into a 307 so that clients keep the request method
+	PreserveMethod bool `yaml:"preserve_method"`
+	// Healthcheck, if set, is probed in the background. Requests matching the rule are treated as misses while it fails
+	Healthcheck *HealthcheckConfig `yaml:"healthcheck"`
+	// Weight is the rule's share of requests when tie_break is `weight`. Unset weights count as 1
+	Weight int `yaml:"weight"`
+	// MatchLanguage restricts the rule to requests whose preferred Accept-Language is one of these languages
+	MatchLanguage []string `yaml:"match_language"`
+	// MatchCountry restricts the rule to requests from clients whose IP is in one of these countries, by ISO 3166-1
+	// alpha-2 code, in the GeoIP database
+	MatchCountry []string `yaml:"match_country"`
+	// MatchScheme restricts the rule to requests made over `http` or `https`
+	MatchScheme string `yaml:"match_scheme"`
+	// MatchCookie restricts the rule to requests with these cookies, by name, whose values match the expressions. Their
+	// values can be referenced in `to` as `$cookie.<name>`
+	MatchCookie map[string]string `yaml:"match_cookie"`
+	// Tags group rules, e.g. by the team that owns them, so that subcommands can operate on a subset of rules
+	Tags []string `yaml:"tags"`
+	// PreserveOriginalAs, if set, is the name of a query parameter added to the Location header with the URL that was
+	// requested, e.g. `from` for `?from=http%3A%2F%2Fexample.com%2Ffoo`
+	PreserveOriginalAs string `yaml:"preserve_original_as"`
+	// Cacheable overrides whether the rule's redirects are cached. Unset, rules are cached unless cache.skip_captures
+	// is set and their `to` directive references a capture
+	Cacheable *bool `yaml:"cacheable"`
+	// NoCache turns off caching for the rule, so that every request is matched against the rules. It takes precedence
+	// over Cacheable
+	NoCache  bool `yaml:"no_cache"`
+	compiled *regexp.Regexp
+	// path is the literal path used by rules that aren't matched with a regular expression
+	path string
+	// catchAll is set for rules that only declare a hostname. They're matched after the host's other rules
+	catchAll bool
+	// tieBreak is the config's tie_break policy
+	tieBreak string
+	// countTags is set when the rule's matches are counted per tag
+	countTags bool
+	// uncacheable is set for rules whose redirects aren't cached
+	uncacheable bool
+	// cookieExpressions are the compiled expressions of MatchCookie
+	cookieExpressions map[string]*regexp.Regexp
+	// prefixLength is the length of the literal path every match of the rule starts with, see prefixLength. It's
+	// found once when the rule is built, since finding it for an expression means parsing the expression again
+	prefixLength int
+}
+
+// id returns the name of the rule if it has one, otherwise its from directive
+func (r Rule) id() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return r.From
+}
+
+// referencesCaptures reports whether the rule's `to` directive references one of its expression's capture groups,
+// including the whole match, `$0`
+func (r Rule) referencesCaptures() bool {
+	if r.compiled == nil {
+		return false
+	}
+
+	// expand every group to a byte that can't be in `to`. References to groups that don't exist expand to nothing
+	match := make([]int, 2*(r.compiled.NumSubexp()+1))
+	for i := 0; i < len(match); i += 2 {
+		match[i+1] = 1
+	}
+	return strings.Contains(string(r.compiled.ExpandString(nil, r.To, "\x00", match)), "\x00")
+}
+
+// relative reports whether the rule redirects to a path on the requested host rather than to an absolute URL
+func (r Rule) relative() bool {
+	return strings.HasPrefix(r.To, "/") && !strings.HasPrefix(r.To, "//")
+}
+
+// hasAnyTag reports whether the rule has at least one of tags. Every rule has any of no tags
+func (r Rule) hasAnyTag(tags []string) bool {
+	if len(tags) == 0 {
+		return true
+	}
+	for _, t := range r.Tags {
+		if slices.Contains(tags, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// withAnyTag returns the rules that have at least one of tags, leaving out hosts without any
+func (rm RuleMapping) withAnyTag(tags []string) RuleMapping {
+	filtered := RuleMapping{}
+	for host, bucket := range rm {
+		for _, rule := range bucket {
+			if rule.hasAnyTag(tags) {
+				filtered[host] = append(filtered[host], rule)
+			}
+		}
+	}
+	return filtered
+}
+
+// pattern returns the expression or literal path that the rule matches requests against
+func (r Rule) pattern() string {
+	if r.compiled != nil {
+		return r.compiled.String()
+	}
+	return r.path
+}
+
+// DroppedRule describes a rule that wasn't loaded and why
+type DroppedRule struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Reason string `json:"reason"`
+}
+
+// dropRule records that a rule wasn't loaded
+func (c *AppConfig) dropRule(r Rule, reason string) {
+	c.droppedRules = append(c.droppedRules, DroppedRule{From: r.From, To: r.To, Reason: reason})
 }
 
 type RuleParameters struct {
 	Strategy string              `yaml:"strategy"`
 	Values   map[string][]string `yaml:"values"`
+	// OnlyIfAbsent makes the combine strategy add each of Values only when the request doesn't have that parameter
+	OnlyIfAbsent bool `yaml:"only_if_absent"`
 }
 
 type InvalidConfigError struct{}
@@ -72,53 +404,518 @@ func (e InvalidConfigError) Error() string {
 	return "Invalid configuration"
 }
 
+// configPaths splits a CONFIG_PATH value into the files it lists. Files are separated by `,` or `:`
+func configPaths(s string) []string {
+	paths := []string{}
+	for _, p := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ':' }) {
+		if p = strings.TrimSpace(p); p != "" {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// ConfigUnchangedError is returned by reloadConfig when the config files have the same content as the current config
+type ConfigUnchangedError struct{}
+
+func (e ConfigUnchangedError) Error() string {
+	return "config is unchanged"
+}
+
+// loadConfig reads every file listed in path, in order, and builds a single AppConfig from them
 func loadConfig(l *slog.Logger, path string) (*AppConfig, error) {
+	buffers, err := readConfigFiles(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := parseConfig(l, buffers...)
+	if err != nil {
+		return nil, err
+	}
+	cfg.contentHash = configHash(buffers)
+	return cfg, nil
+}
+
+// reloadConfig is loadConfig, but rules whose expression is unchanged from the current config reuse its compiled
+// expression rather than compiling it again
+//
+// If the files' content is the same as the current config's, nothing is parsed and a ConfigUnchangedError is returned
+func reloadConfig(l *slog.Logger, path string, current *AppConfig) (*AppConfig, error) {
+	buffers, err := readConfigFiles(path)
+	if err != nil {
+		return nil, err
+	}
+	hash := configHash(buffers)
+	if hash == current.contentHash {
+		return nil, ConfigUnchangedError{}
+	}
+
+	cfg, err := parseConfigReusing(l, compiledExpressions(current.ruleMap()), buffers...)
+	if err != nil {
+		return nil, err
+	}
+	cfg.contentHash = hash
+	return cfg, nil
+}
+
+// readConfigFiles reads every file listed in path, in order
+func readConfigFiles(path string) ([][]byte, error) {
+	buffers := [][]byte{}
+	for _, p := range configPaths(path) {
+		buffer, err := readConfigFile(p)
+		if err != nil {
+			return nil, err
+		}
+		buffers = append(buffers, buffer)
+	}
+	return buffers, nil
+}
+
+// configHash returns a hash of the content of config files, which changes if any file's content or the order of the
+// files changes
+func configHash(buffers [][]byte) string {
+	h := sha256.New()
+	for _, b := range buffers {
+		// the length separates the files, so that moving content from one file to the next changes the hash
+		_ = binary.Write(h, binary.BigEndian, uint64(len(b)))
+		h.Write(b)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// compiledExpressions returns the compiled expressions of rules, keyed by the expression
+func compiledExpressions(rules RuleMapping) map[string]*regexp.Regexp {
+	expressions := map[string]*regexp.Regexp{}
+	for _, bucket := range rules {
+		for _, rule := range bucket {
+			if rule.compiled != nil {
+				expressions[rule.compiled.String()] = rule.compiled
+			}
+		}
+	}
+	return expressions
+}
+
+func readConfigFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return io.ReadAll(f)
+}
+
+// parseConfig builds an AppConfig, including bucketed rules, from the contents of one or more config files
+//
+// Settings in later files override those in earlier ones, while the rules and host groups of every file are kept in
+// file order
+func parseConfig(l *slog.Logger, buffers ...[]byte) (*AppConfig, error) {
+	return parseConfigReusing(l, nil, buffers...)
+}
+
+// parseConfigReusing is parseConfig, but rules whose expression is in expressions reuse it rather than compiling it
+func parseConfigReusing(l *slog.Logger, expressions map[string]*regexp.Regexp, buffers ...[]byte) (*AppConfig, error) {
 	// Set defaults
 	c := &AppConfig{
+		expressions:                expressions,
 		ListenAddress:              defaultListenAddress,
 		CacheControlMaxAge:         defaultCacheControlMaxAge,
+		CacheControlOnMiss:         defaultCacheControlOnMiss,
+		TieBreak:                   TieBreakOrder,
 		MetricsServerListenAddress: defaultMetricsServerListenAddress,
 		DefaultParameterStrategy:   defaultParameterStrategy,
 		LocationOnMiss:             defaultLocationOnMiss,
 		StatusOnMiss:               defaultStatusOnMiss,
+		ForceHTTPSCode:             defaultForceHTTPSCode,
+		DefaultToScheme:            defaultToScheme,
+		MalformedQuery:             MalformedQueryBestEffort,
+		QueryDedup:                 QueryDedupKeep,
+		EmptyToPath:                EmptyToPathRoot,
+		RefererLoop:                RefererLoopOff,
 
 		Cache: CacheConfig{
 			TTL:             defaultCacheTTL,
 			CleanupInterval: defaultCacheCleanupInterval,
+			Backend:         CacheBackendMemory,
+			NegativeTTL:     defaultNegativeCacheTTL,
+			CacheMisses:     true,
+			Redis: RedisConfig{
+				Timeout: defaultRedisTimeout,
+			},
+		},
+		Server: ServerConfig{
+			Network:        NetworkTCP,
+			AllowedMethods: []string{http.MethodGet, http.MethodHead},
+		},
+		Tracing: TracingConfig{
+			HeaderName: defaultTracingHeaderName,
+		},
+		Limits: LimitsConfig{
+			MaxPathLength:  defaultMaxPathLength,
+			MaxDrainedBody: defaultMaxDrainedBody,
+		},
+		RateLimit: RateLimitConfig{
+			MaxTrackedIPs: defaultRateLimitMaxTrackedIPs,
+		},
+		AccessLogs: AccessLogConfig{
+			SampleRate: defaultAccessLogSampleRate,
+		},
+		Log: LogConfig{
+			Output:  LogOutputStdout,
+			MaxSize: defaultLogMaxSize,
 		},
 	}
 
 	c.lock.Lock()
 
-	f, err := os.Open(path)
-	if err != nil {
-		return nil, err
+	// Unmarshalling here yields a config without bucketed rules, but does contain the rest of the settings
+	var loaded Rules
+	var hosts map[string]Rules
+	for _, buffer := range buffers {
+		c.Rules = nil
+		c.Hosts = nil
+		err := yaml.Unmarshal(buffer, c)
+		if err != nil {
+			return nil, err
+		}
+
+		loaded = append(loaded, c.Rules...)
+		for host, hostRules := range c.Hosts {
+			if hosts == nil {
+				hosts = map[string]Rules{}
+			}
+			hosts[host] = append(hosts[host], hostRules...)
+		}
 	}
-	defer f.Close()
+	c.Rules = loaded
+	c.Hosts = hosts
 
-	buffer, err := io.ReadAll(f)
-	if err != nil {
-		return nil, err
+	if !validParameterStrategy(c.DefaultParameterStrategy) {
+		l.WithGroup("config").Warn("unknown default_parameter_strategy, using built-in default", "strategy", c.DefaultParameterStrategy, "default", defaultParameterStrategy)
+		c.DefaultParameterStrategy = defaultParameterStrategy
 	}
-	// Unmarshalling here yields a config without bucketed rules, but does contain the rest of the settings
-	err = yaml.Unmarshal(buffer, c)
-	if err != nil {
+
+	if !validQueryDedup(c.QueryDedup) {
+		l.WithGroup("config").Warn("unknown query_dedup, using built-in default", "query_dedup", c.QueryDedup, "default", QueryDedupKeep)
+		c.QueryDedup = QueryDedupKeep
+	}
+
+	c.StripHostPrefix = strings.ToLower(c.StripHostPrefix)
+	if c.ConfigPollInterval < 0 {
+		l.WithGroup("config").Warn("config_poll_interval is negative, not polling the config", "config_poll_interval", c.ConfigPollInterval)
+		c.ConfigPollInterval = 0
+	}
+	if !validCanonicalHost(c.CanonicalHost) {
+		l.WithGroup("config").Warn("unknown canonical_host, not redirecting to a canonical host", "canonical_host", c.CanonicalHost)
+		c.CanonicalHost = ""
+	}
+
+	if !validEmptyToPath(c.EmptyToPath) {
+		l.WithGroup("config").Warn("unknown empty_to_path, using built-in default", "empty_to_path", c.EmptyToPath, "default", EmptyToPathRoot)
+		c.EmptyToPath = EmptyToPathRoot
+	}
+	if !validRefererLoop(c.RefererLoop) {
+		l.WithGroup("config").Warn("unknown referer_loop, using built-in default", "referer_loop", c.RefererLoop, "default", RefererLoopOff)
+		c.RefererLoop = RefererLoopOff
+	}
+
+	if !validTieBreak(c.TieBreak) {
+		l.WithGroup("config").Warn("unknown tie_break, using built-in default", "tie_break", c.TieBreak, "default", TieBreakOrder)
+		c.TieBreak = TieBreakOrder
+	}
+
+	for i, method := range c.Server.AllowedMethods {
+		c.Server.AllowedMethods[i] = strings.ToUpper(method)
+	}
+	if !validNetwork(c.Server.Network) {
+		l.WithGroup("config").Warn("unknown server.network, using built-in default", "network", c.Server.Network, "default", NetworkTCP)
+		c.Server.Network = NetworkTCP
+	}
+	if !validCacheBackend(c.Cache.Backend) {
+		l.WithGroup("config").Warn("unknown cache.backend, using built-in default", "backend", c.Cache.Backend, "default", CacheBackendMemory)
+		c.Cache.Backend = CacheBackendMemory
+	}
+	if c.Cache.Backend == CacheBackendRedis && c.Cache.Redis.Address == "" {
+		l.WithGroup("config").Warn("cache.backend is redis, but cache.redis.address isn't set, using built-in default", "default", CacheBackendMemory)
+		c.Cache.Backend = CacheBackendMemory
+	}
+	if c.Cache.Backend == CacheBackendRedis && c.Cache.MaxEntriesPerHost > 0 {
+		l.WithGroup("config").Warn("cache.max_entries_per_host is ignored by the redis backend", "max_entries_per_host", c.Cache.MaxEntriesPerHost)
+	}
+	if c.Cache.Backend == CacheBackendRedis && c.Cache.MaxEntries > 0 {
+		l.WithGroup("config").Warn("cache.max_entries is ignored by the redis backend", "max_entries", c.Cache.MaxEntries)
+	}
+	if c.Cache.NegativeTTL <= 0 {
+		l.WithGroup("config").Warn("cache.negative_ttl must be positive, using built-in default", "negative_ttl", c.Cache.NegativeTTL, "default", defaultNegativeCacheTTL)
+		c.Cache.NegativeTTL = defaultNegativeCacheTTL
+	}
+	if c.Cache.Redis.Timeout <= 0 {
+		c.Cache.Redis.Timeout = defaultRedisTimeout
+	}
+	if n := c.Cache.Negative; n != nil {
+		if n.Backend == "" {
+			n.Backend = CacheBackendMemory
+		}
+		if !validCacheBackend(n.Backend) {
+			l.WithGroup("config").Warn("unknown cache.negative.backend, using built-in default", "backend", n.Backend, "default", CacheBackendMemory)
+			n.Backend = CacheBackendMemory
+		}
+		if n.Backend == CacheBackendRedis && c.Cache.Redis.Address == "" {
+			l.WithGroup("config").Warn("cache.negative.backend is redis, but cache.redis.address isn't set, using built-in default", "default", CacheBackendMemory)
+			n.Backend = CacheBackendMemory
+		}
+		if n.TTL <= 0 {
+			n.TTL = defaultNegativeCacheTTL
+		}
+		if n.CleanupInterval <= 0 {
+			n.CleanupInterval = defaultNegativeCacheCleanup
+		}
+	}
+	if c.HSTS.Preload && !c.HSTS.preloadable() {
+		l.WithGroup("config").Warn("hsts.preload is set, but preload lists require include_subdomains and a max_age of at least a year", "max_age", c.HSTS.MaxAge, "include_subdomains", c.HSTS.IncludeSubdomains)
+	}
+	if !validForceHTTPSCode(c.ForceHTTPSCode) {
+		l.WithGroup("config").Warn("force_https_code isn't a redirect status, using built-in default", "force_https_code", c.ForceHTTPSCode, "default", defaultForceHTTPSCode)
+		c.ForceHTTPSCode = defaultForceHTTPSCode
+	}
+	// a forgotten delay would slow down every redirect, so it has to be opted into twice
+	if c.Server.ArtificialDelay != 0 && !c.Debug.Enabled {
+		l.WithGroup("config").Warn("ignoring server.artificial_delay, debug.enabled isn't set", "artificial_delay", c.Server.ArtificialDelay)
+		c.Server.ArtificialDelay = 0
+	}
+	c.Server.BasePath = normalizeBasePath(c.Server.BasePath)
+	if c.RateLimit.enabled() {
+		if c.RateLimit.Burst <= 0 {
+			c.RateLimit.Burst = max(1, int(c.RateLimit.RequestsPerSecond))
+		}
+		if c.RateLimit.MaxTrackedIPs <= 0 {
+			l.WithGroup("config").Warn("rate_limit.max_tracked_ips must be positive, using built-in default", "max_tracked_ips", c.RateLimit.MaxTrackedIPs, "default", defaultRateLimitMaxTrackedIPs)
+			c.RateLimit.MaxTrackedIPs = defaultRateLimitMaxTrackedIPs
+		}
+	}
+
+	if err := c.Metrics.Auth.parsePasswordHash(); err != nil {
 		return nil, err
 	}
 
-	rules := buildRules(l, &c.Rules, defaultStatusCode, c.DefaultParameterStrategy, c.CacheControlMaxAge)
+	c.Server.trustedProxies = parseCIDRs(l, c.Server.TrustedProxies)
+	c.Maintenance.bypass = parseCIDRs(l, c.Maintenance.BypassCIDRs)
+	if c.Maintenance.Status == 0 {
+		c.Maintenance.Status = http.StatusServiceUnavailable
+		if c.Maintenance.Location != "" {
+			c.Maintenance.Status = http.StatusFound
+		}
+	}
+
+	c.Rules = append(c.Rules, flattenHostGroups(l, c)...)
+
+	rules := buildRules(l, &c.Rules, c)
+	if onlySafeMethodsAllowed(c.Server.AllowedMethods) {
+		for _, rule := range *rules {
+			if rule.PreserveMethod {
+				l.WithGroup("config").Warn("rule sets preserve_method, but server.allowed_methods only allows GET and HEAD, so other methods get a 405 before they're redirected", "rule", rule.id(), "allowed_methods", c.Server.AllowedMethods)
+			}
+		}
+	}
+	if !c.GeoIP.enabled() {
+		for _, rule := range *rules {
+			if len(rule.MatchCountry) > 0 {
+				l.WithGroup("config").Warn("rule sets match_country, but geoip.database isn't set, so it never matches", "rule", rule.id())
+			}
+		}
+	}
 	bucketed := bucketRules(l, rules)
+	if c.LintOverlappingRules {
+		lintRules(l, bucketed)
+	}
+
+	if c.StripHostPrefix != "" {
+		for host := range bucketed {
+			if strings.HasPrefix(host, c.StripHostPrefix) {
+				l.WithGroup("config").Warn("rules for host never match, since strip_host_prefix is removed from request hosts before matching", "host", host, "strip_host_prefix", c.StripHostPrefix)
+			}
+		}
+	}
+
+	c.UnknownPathStatus = validUnknownPathStatuses(l, c.UnknownPathStatus, bucketed)
 
 	c.RuleMap = bucketed
+	c.matchCache = newRuleMatchLRU(c.MatchCacheSize)
+	c.conditions = hostConditions(bucketed)
+	c.uncached = uncachedHosts(bucketed)
 	c.lock.Unlock()
 
 	return c, nil
 }
 
+// flattenHostGroups converts rules grouped by host into a flat list of rules
+//
+// Rules in a group can use from_path instead of from, in which case the group's host is prepended to it. Rules that
+// specify a host in from that conflicts with their group are dropped.
+//
+// Hosts are sorted so that the order of the resulting rules doesn't change between loads. Rules within a host keep
+// the order they were declared in
+func flattenHostGroups(l *slog.Logger, c *AppConfig) Rules {
+	logger := l.WithGroup("config")
+
+	names := make([]string, 0, len(c.Hosts))
+	for host := range c.Hosts {
+		names = append(names, host)
+	}
+	sort.Strings(names)
+
+	flat := Rules{}
+	for _, host := range names {
+		group, err := fromAsURL(logger, host)
+		if err != nil {
+			logger.Warn("not loading host group, invalid host", "host", host, "err", err)
+			for _, rule := range c.Hosts[host] {
+				c.dropRule(rule, "invalid host group: "+host)
+			}
+			continue
+		}
+
+		for _, rule := range c.Hosts[host] {
+			switch {
+			case rule.From != "" && rule.FromPath != "":
+				logger.Warn("not loading rule, from and from_path are both set", "rule", fmt.Sprintf("+%v", rule), "host", host)
+				c.dropRule(rule, "from and from_path are both set")
+				continue
+			case rule.FromPath != "":
+				p := rule.FromPath
+				if !strings.HasPrefix(p, "/") {
+					p = "/" + p
+				}
+				rule.From = host + p
+				rule.FromPath = ""
+			case rule.From != "":
+				u, err := fromAsURL(logger, rule.From)
+				if err == nil && u.Host != group.Host {
+					logger.Warn("not loading rule, from directive host doesn't match host group", "rule", fmt.Sprintf("+%v", rule), "host", host)
+					c.dropRule(rule, "from directive host doesn't match host group "+host)
+					continue
+				}
+			default:
+				logger.Warn("not loading rule, from and from_path are both empty", "rule", fmt.Sprintf("+%v", rule), "host", host)
+				c.dropRule(rule, "from and from_path are both empty")
+				continue
+			}
+			flat = append(flat, rule)
+		}
+	}
+	return flat
+}
+
+// ruleMap returns the bucketed rules while holding the config lock, since they are swapped out on reload
+func (c *AppConfig) ruleMap() RuleMapping {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.RuleMap
+}
+
+// matchState returns the bucketed rules along with the LRU of matches made against them
+func (c *AppConfig) matchState() (RuleMapping, *ruleMatchLRU) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.RuleMap, c.matchCache
+}
+
+// cacheVariant returns the variant a request to host with attrs is cached under
+//
+// Attributes are only part of the variant for hosts with rules that match on them, so that other hosts don't store a
+// copy of every response per language or scheme
+func (c *AppConfig) cacheVariant(host string, attrs requestAttributes) string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	conditions := c.conditions[host]
+	// requests can be matched against their wildcard host's rules too
+	if wildcard, ok := c.conditions[wildcardHost(host)]; ok {
+		conditions = conditions.merge(wildcard)
+	}
+	return conditions.variant(attrs)
+}
+
+// validUnknownPathStatuses lowercases the hosts of unknown_path_status, dropping statuses other than 404 and 410 so that
+// those hosts use the default miss response
+func validUnknownPathStatuses(l *slog.Logger, statuses map[string]int, rules RuleMapping) map[string]int {
+	valid := make(map[string]int, len(statuses))
+	for host, status := range statuses {
+		host = strings.ToLower(host)
+		if status != http.StatusNotFound && status != http.StatusGone {
+			l.WithGroup("config").Warn("unknown_path_status must be 404 or 410, using the default miss response", "host", host, "status", status)
+			continue
+		}
+		if _, ok := rules[host]; !ok {
+			l.WithGroup("config").Warn("unknown_path_status is set for a host without rules, requests to it are misses for every path", "host", host)
+		}
+		valid[host] = status
+	}
+	return valid
+}
+
+// unknownPathStatus returns the unknown_path_status of host, or of its wildcard host, or 0 if neither is set
+func (c *AppConfig) unknownPathStatus(host string) int {
+	if status, ok := c.UnknownPathStatus[host]; ok {
+		return status
+	}
+	return c.UnknownPathStatus[wildcardHost(host)]
+}
+
+// skipsCache reports whether requests to host skip the cache. That's the case when every rule they can be matched
+// against sets no_cache, since nothing they match is ever stored
+func (c *AppConfig) skipsCache(host string) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	hosts := matchHosts(host, c.RuleMap, c.WildcardFallthrough)
+	for _, h := range hosts {
+		if !c.uncached[h] {
+			return false
+		}
+	}
+	return len(hosts) > 0
+}
+
+// compile compiles a rule's expression, or reuses the expression compiled for the previous config if it's unchanged
+func (c *AppConfig) compile(exp string) (*regexp.Regexp, error) {
+	if compiled, ok := c.expressions[exp]; ok {
+		c.reusedExpressions++
+		return compiled, nil
+	}
+
+	compiled, err := regexp.Compile(exp)
+	if err != nil {
+		return nil, err
+	}
+	// prefer the longest match so that captures are as long as possible. This is set once here, rather than when
+	// matching, because regexp.Regexp is shared between requests, and between configs when it's reused
+	compiled.Longest()
+	return compiled, nil
+}
+
+// setRuleMap replaces the bucketed rules while holding the config lock
+//
+// The match LRU is replaced too, so that matches made against the old rules can't be stored after they're replaced
+func (c *AppConfig) setRuleMap(r RuleMapping) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.RuleMap = r
+	c.matchCache = newRuleMatchLRU(c.MatchCacheSize)
+	c.conditions = hostConditions(r)
+	c.uncached = uncachedHosts(r)
+	recordActiveHosts(r)
+}
+
+// recordActiveHosts sets the active_hosts gauge to the number of host buckets being served
+func recordActiveHosts(r RuleMapping) {
+	activeHostsMetric.Set(float64(len(r)))
+}
+
 // buildRules returns a pointer to a Rules object that contains only valid rules with configured behavior and compiled expressions
 //
-// Invalid rules will be logged and dropped from returned object
-func buildRules(l *slog.Logger, r *Rules, c int, s string, a int) *Rules {
+// Invalid rules will be logged and dropped from returned object. Rule-level settings that aren't set are defaulted from ac
+func buildRules(l *slog.Logger, r *Rules, ac *AppConfig) *Rules {
 	n := Rules{}
 
 	logger := l.WithGroup("config")
@@ -129,48 +926,172 @@ func buildRules(l *slog.Logger, r *Rules, c int, s string, a int) *Rules {
 		if err != nil {
 			// don't load rule if we can't convert to a URL
 			logger.Warn("not loading rule, from directive cannot be converted to URL", "rule", fmt.Sprintf("+%v", rule), "err", err)
+			ac.dropRule(rule, "from directive cannot be converted to URL: "+err.Error())
 			continue
 		}
 
-		if !strings.Contains(rule.To, "://") {
-			logger.Warn("not loading rule, to directive missing protocol", "rule", fmt.Sprintf("+%v", rule))
+		// relative redirects stay on the requested host, so they don't need a scheme
+		if !rule.relative() && !strings.Contains(rule.To, "://") {
+			if ac.StrictToScheme || ac.DefaultToScheme == "" {
+				logger.Warn("not loading rule, to directive missing protocol", "rule", fmt.Sprintf("+%v", rule))
+				ac.dropRule(rule, "to directive missing protocol")
+				continue
+			}
+			// mirror fromAsURL by setting a default scheme rather than forcing users to specify one
+			rule.To = ac.DefaultToScheme + "://" + rule.To
+		}
+
+		if rule.ToFallback != "" && !strings.Contains(rule.ToFallback, "://") {
+			if ac.StrictToScheme || ac.DefaultToScheme == "" {
+				logger.Warn("not loading rule, to_fallback directive missing protocol", "rule", fmt.Sprintf("+%v", rule))
+				ac.dropRule(rule, "to_fallback directive missing protocol")
+				continue
+			}
+			rule.ToFallback = ac.DefaultToScheme + "://" + rule.ToFallback
+		}
+
+		if rule.Canonical != "" && !validHTTPURL(rule.Canonical) {
+			logger.Warn("not loading rule, canonical is not an absolute http(s) URL", "rule", fmt.Sprintf("+%v", rule))
+			ac.dropRule(rule, "canonical is not an absolute http(s) URL")
 			continue
 		}
 
-		var exp *regexp.Regexp
-		var compileErr error
-		// if _only_ the hostname was provided, we'll assume this is a blanket redirect for any request
-		if u.Path == "" {
-			exp, compileErr = regexp.Compile("^.*")
-		} else {
-			p := u.Path
-			// anchor all paths if not already anchored in order to guarantee behavior that one would expect
-			// out of the box, which is to say if I declare `to: foo.com/bar`, I don't want it to match 'foo.com/x/y/z/bar',
-			// I only want it to match `/bar...`
-			if string(p[0]) != "^" {
-				p = "^" + p
+		if rule.Healthcheck != nil {
+			if !validHTTPURL(rule.Healthcheck.URL) {
+				logger.Warn("not loading rule, healthcheck url is not an absolute http(s) URL", "rule", fmt.Sprintf("+%v", rule))
+				ac.dropRule(rule, "healthcheck url is not an absolute http(s) URL")
+				continue
+			}
+			if rule.Healthcheck.Interval <= 0 {
+				rule.Healthcheck.Interval = defaultHealthcheckInterval
+			}
+			if rule.Healthcheck.Timeout <= 0 {
+				rule.Healthcheck.Timeout = defaultHealthcheckTimeout
 			}
-			exp, compileErr = regexp.Compile(p)
 		}
 
-		if compileErr != nil {
-			logger.WithGroup("config").Warn("invalid regexp, skipping", "regexp", u.Path, "host", u.Host, "err", compileErr)
+		switch rule.Match {
+		case MatchPrefix, MatchExact:
+			// these rules are matched literally, so there is nothing to compile
+			rule.path = u.Path
+		case MatchRegex, MatchUnset:
+			var exp *regexp.Regexp
+			var compileErr error
+			switch {
+			case hostOnly(rule.From):
+				// if _only_ the hostname was provided, we'll assume this is a blanket redirect for any request
+				exp, compileErr = ac.compile("^.*")
+				rule.catchAll = true
+			case u.Path == "/":
+				// the root path only matches the root path, otherwise it would match every request for the host
+				exp, compileErr = ac.compile("^/$")
+			default:
+				// translate `/*` wildcards into a capture group that `to` can reference as :splat or $SPLAT
+				p, to := expandWildcard(u.Path, rule.To)
+				rule.To = to
+				_, rule.Canonical = expandWildcard(u.Path, rule.Canonical)
+				_, rule.ToFallback = expandWildcard(u.Path, rule.ToFallback)
+				// anchor all paths if not already anchored in order to guarantee behavior that one would expect
+				// out of the box, which is to say if I declare `to: foo.com/bar`, I don't want it to match 'foo.com/x/y/z/bar',
+				// I only want it to match `/bar...`
+				if string(p[0]) != "^" {
+					p = "^" + p
+				}
+				// optionally stop `/bar` from matching `/barbaz` by requiring the match to end on a path segment boundary
+				if ac.PathSegmentBoundary && endsWithLiteral(p) {
+					p = p + pathSegmentBoundary
+				}
+				exp, compileErr = ac.compile(p)
+			}
+
+			if compileErr != nil {
+				logger.WithGroup("config").Warn("invalid regexp, skipping", "regexp", u.Path, "host", u.Host, "err", compileErr)
+				ac.dropRule(rule, "invalid regexp: "+compileErr.Error())
+				continue
+			}
+
+			rule.compiled = exp
+		default:
+			logger.Warn("not loading rule, unknown match mode", "rule", fmt.Sprintf("+%v", rule), "match", rule.Match)
+			ac.dropRule(rule, "unknown match mode: "+rule.Match)
+			continue
+		}
+
+		rule.MatchScheme = strings.ToLower(rule.MatchScheme)
+		if !validMatchScheme(rule.MatchScheme) {
+			logger.Warn("not loading rule, match_scheme must be http or https", "rule", fmt.Sprintf("+%v", rule), "match_scheme", rule.MatchScheme)
+			ac.dropRule(rule, "unknown match_scheme: "+rule.MatchScheme)
 			continue
 		}
 
-		rule.compiled = exp
+		cookieExpressions, err := compileCookieExpressions(rule.MatchCookie)
+		if err != nil {
+			logger.Warn("not loading rule, invalid match_cookie expression", "rule", fmt.Sprintf("+%v", rule), "err", err)
+			ac.dropRule(rule, "invalid match_cookie expression: "+err.Error())
+			continue
+		}
+		rule.cookieExpressions = cookieExpressions
+		// only cookies whose values have been matched can end up in the Location header
+		if unmatched := unmatchedCookieReferences(rule); len(unmatched) > 0 {
+			logger.Warn("not loading rule, to references cookies that aren't in match_cookie", "rule", fmt.Sprintf("+%v", rule), "cookies", unmatched)
+			ac.dropRule(rule, "to references cookies that aren't in match_cookie: "+strings.Join(unmatched, ", "))
+			continue
+		}
 
 		if rule.Code == 0 {
-			rule.Code = c
+			rule.Code = defaultStatusCode
+		}
+
+		// 301 and 302 allow clients to change the method to GET, their method-preserving equivalents don't
+		if rule.PreserveMethod {
+			switch rule.Code {
+			case http.StatusMovedPermanently:
+				rule.Code = http.StatusPermanentRedirect
+			case http.StatusFound:
+				rule.Code = http.StatusTemporaryRedirect
+			}
+		}
+
+		// rules without their own parameters inherit the default parameters
+		if rule.Parameters.Strategy == "" && rule.Parameters.Values == nil {
+			rule.Parameters = ac.DefaultParameters
 		}
 
 		if rule.Parameters.Strategy == "" {
-			rule.Parameters.Strategy = s
+			rule.Parameters.Strategy = ac.DefaultParameterStrategy
+		}
+
+		// surface typos once at load time rather than on every request
+		if !validParameterStrategy(rule.Parameters.Strategy) {
+			logger.Warn("unknown parameter strategy, using default_parameter_strategy instead", "rule", fmt.Sprintf("+%v", rule), "strategy", rule.Parameters.Strategy, "default", ac.DefaultParameterStrategy)
+			rule.Parameters.Strategy = ac.DefaultParameterStrategy
+		}
+		if rule.Parameters.OnlyIfAbsent && rule.Parameters.Strategy != ParamsStrategyCombine {
+			logger.Warn("ignoring only_if_absent, it only applies to the combine strategy", "rule", fmt.Sprintf("+%v", rule), "strategy", rule.Parameters.Strategy)
 		}
 
 		// if unset at the rule-level, we'll set it to the default value
 		if rule.CacheControlMaxAge == 0 {
-			rule.CacheControlMaxAge = a
+			rule.CacheControlMaxAge = ac.CacheControlMaxAge
+		}
+		rule.prefixLength = prefixLength(rule)
+		rule.tieBreak = ac.TieBreak
+		rule.countTags = ac.Metrics.RuleTags
+		rule.uncacheable = ac.Cache.SkipCaptures && rule.referencesCaptures()
+		if rule.Cacheable != nil {
+			rule.uncacheable = !*rule.Cacheable
+		}
+		if rule.NoCache {
+			if rule.Cacheable != nil && *rule.Cacheable {
+				logger.Warn("ignoring cacheable, no_cache takes precedence", "rule", fmt.Sprintf("+%v", rule))
+			}
+			rule.uncacheable = true
+		}
+		for i, lang := range rule.MatchLanguage {
+			rule.MatchLanguage[i] = strings.ToLower(lang)
+		}
+		for i, country := range rule.MatchCountry {
+			rule.MatchCountry[i] = strings.ToUpper(country)
 		}
 		n = append(n, rule)
 	}
@@ -178,6 +1099,38 @@ func buildRules(l *slog.Logger, r *Rules, c int, s string, a int) *Rules {
 	return &n
 }
 
+// pathSegmentBoundary is appended to expressions that end in a literal so that they only match whole path segments
+const pathSegmentBoundary = "(?:/|$)"
+
+// hostOnly reports whether a from directive only declares a hostname, e.g. `example.com` rather than `example.com/`
+func hostOnly(from string) bool {
+	if i := strings.Index(from, "://"); i != -1 {
+		from = from[i+3:]
+	}
+	return !strings.Contains(from, "/")
+}
+
+// endsWithLiteral reports whether the expression ends with a literal character other than a forward slash
+//
+// Expressions ending in anything else, e.g. `$`, `.*`, or a capture group, already express where the match should end
+func endsWithLiteral(exp string) bool {
+	re, err := syntax.Parse(exp, syntax.Perl)
+	if err != nil {
+		return false
+	}
+
+	last := re
+	if re.Op == syntax.OpConcat && len(re.Sub) > 0 {
+		last = re.Sub[len(re.Sub)-1]
+	}
+
+	if last.Op != syntax.OpLiteral || len(last.Rune) == 0 {
+		return false
+	}
+
+	return last.Rune[len(last.Rune)-1] != '/'
+}
+
 // TODO if we need to sub-bucket by first path part, we can do like so:
 /*
 splitFrom := strings.Split(rule.From, "/")
@@ -193,8 +1146,79 @@ if len(splitFrom[1:]) > 1 {
 
 */
 
+// normalizeHost converts an internationalized hostname into its ASCII (punycode) form, which is what clients send
+//
+// ASCII hostnames are returned unchanged
+func normalizeHost(hostname string) (string, error) {
+	for _, char := range hostname {
+		if char > unicode.MaxASCII {
+			return idna.Lookup.ToASCII(hostname)
+		}
+	}
+	return hostname, nil
+}
+
+// stripPort removes the port, if present, from a host. Bracketed IPv6 literals keep their brackets
+func stripPort(host string) string {
+	if strings.HasPrefix(host, "[") {
+		if i := strings.Index(host, "]"); i != -1 {
+			return host[:i+1]
+		}
+		return host
+	}
+
+	if i := strings.LastIndex(host, ":"); i != -1 {
+		return host[:i]
+	}
+	return host
+}
+
+// validHTTPURL reports whether s is an absolute http or https URL
+func validHTTPURL(s string) bool {
+	u, err := url.Parse(s)
+	if err != nil {
+		return false
+	}
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// normalizeBasePath returns p with a leading slash and without a trailing one, so that it can be prepended to a path.
+// An empty or root path is returned as an empty string
+func normalizeBasePath(p string) string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return ""
+	}
+	return "/" + p
+}
+
+// requestPort returns the port, if present, from a request's Host header
+func requestPort(host string) string {
+	_, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return ""
+	}
+	return port
+}
+
+// validHostname reports whether hostname is a valid DNS name or bracketed IPv6 literal
+//
+// A single trailing dot, as in the fully-qualified `example.com.`, is allowed
 func validHostname(l *slog.Logger, hostname string) bool {
 	logger := l
+
+	if strings.HasPrefix(hostname, "[") {
+		ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(hostname, "["), "]"))
+		if !strings.HasSuffix(hostname, "]") || ip == nil || ip.To4() != nil {
+			logger.Warn("invalid IPv6 hostname", "hostname", hostname)
+			return false
+		}
+		return true
+	}
+
+	// a wildcard host covers every subdomain one label below it, e.g. `*.example.com` covers `www.example.com`
+	hostname = strings.TrimPrefix(hostname, wildcardHostPrefix)
+
 	validSpecialChars := []string{
 		"_", "-", ".",
 	}
@@ -213,6 +1237,17 @@ func validHostname(l *slog.Logger, hostname string) bool {
 			return false
 		}
 	}
+
+	for _, label := range strings.Split(strings.TrimSuffix(hostname, "."), ".") {
+		if label == "" {
+			logger.Warn("invalid hostname, empty label", "hostname", hostname)
+			return false
+		}
+		if strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			logger.Warn("invalid hostname, label starts or ends with hyphen", "hostname", hostname, "label", label)
+			return false
+		}
+	}
 	return true
 }
 
@@ -250,6 +1285,15 @@ func fromAsURL(l *slog.Logger, f string) (url.URL, error) {
 	escaped := url.PathEscape(f)
 	// Unescape forward slash otherwise we'll receive a parsing error if there is a colon in the paths
 	escaped = strings.Replace(escaped, "%2F", "/", -1)
+	// Unescape brackets in the host, otherwise IPv6 literals can't be parsed. Brackets in the path stay escaped
+	if i := strings.Index(escaped, "://"); i != -1 {
+		authorityEnd := len(escaped)
+		if j := strings.Index(escaped[i+3:], "/"); j != -1 {
+			authorityEnd = i + 3 + j
+		}
+		authority := strings.NewReplacer("%5B", "[", "%5D", "]", "%2A", "*").Replace(escaped[:authorityEnd])
+		escaped = authority + escaped[authorityEnd:]
+	}
 	parsed, err := url.Parse(escaped)
 	if err != nil {
 		pathSegmentError := strings.Contains(err.Error(), "first path segment in URL cannot contain colon")
@@ -340,12 +1384,18 @@ func fromAsURL(l *slog.Logger, f string) (url.URL, error) {
 	}
 
 	if u.Host != "" {
-		if strings.Contains(u.Host, ":") {
-			u.Host = strings.Split(u.Host, ":")[0]
+		u.Host = stripPort(u.Host)
+		h, err := normalizeHost(u.Host)
+		if err != nil {
+			logger.Warn("unable to convert hostname to punycode", "hostname", u.Host, "err", err)
+			return url.URL{}, InvalidHostnameError{u.Host}
 		}
+		u.Host = h
 		if !validHostname(logger, u.Host) {
 			return url.URL{}, InvalidHostnameError{u.Host}
 		}
+		// example.com. and example.com are the same host, so they belong in the same bucket
+		u.Host = strings.TrimSuffix(u.Host, ".")
 	}
 
 	return u, nil
@@ -353,7 +1403,8 @@ func fromAsURL(l *slog.Logger, f string) (url.URL, error) {
 
 // bucketedRules organizes rules into per-hostname buckets in order to reduce time spent searching for matches
 //
-// Within a hostname bucket, compiled expressions are mapped to a Rule object
+// Within a hostname bucket, compiled expressions are mapped to a Rule object. Rules keep the order they're declared in,
+// except catch-all rules, which are moved after the host's other rules
 // TODO should we just consolidate this into `buildRules()`? Would save another iteration and speed up config load time
 func bucketRules(l *slog.Logger, r *Rules) RuleMapping {
 	bucketedRules := RuleMapping{}
@@ -377,12 +1428,34 @@ func bucketRules(l *slog.Logger, r *Rules) RuleMapping {
 		logger.Debug("loaded rule", "rule", fmt.Sprintf("+%v", rule), "host", u.Host)
 	}
 
+	for _, rules := range bucketedRules {
+		sort.SliceStable(rules, func(i, j int) bool {
+			return !rules[i].catchAll && rules[j].catchAll
+		})
+	}
+
 	return bucketedRules
 
 }
 
+// onlySafeMethodsAllowed reports whether allowed methods only includes GET and HEAD. An empty list allows every method
+func onlySafeMethodsAllowed(methods []string) bool {
+	if len(methods) == 0 {
+		return false
+	}
+	for _, method := range methods {
+		if method != http.MethodGet && method != http.MethodHead {
+			return false
+		}
+	}
+	return true
+}
+
+// configRewatchInterval is how often the reloader retries watching a config file that was removed or renamed
+var configRewatchInterval = time.Second
+
 // reloader watches the config file and reloads rules if the config file changes
-func reloader(ctx context.Context, l *slog.Logger, f string, ac *AppConfig) {
+func reloader(ctx context.Context, l *slog.Logger, f string, ac *AppConfig, cache Cache) {
 	logger := l.WithGroup("reloader").With("config_path", f)
 	logger.Info("starting config reloader")
 
@@ -393,10 +1466,42 @@ func reloader(ctx context.Context, l *slog.Logger, f string, ac *AppConfig) {
 	}
 	defer watcher.Close()
 
-	err = watcher.Add(f)
-	if err != nil {
-		logger.Error("failed to watch file", "err", err)
-		return
+	for _, p := range configPaths(f) {
+		err = watcher.Add(p)
+		if err != nil {
+			logger.Error("failed to watch file", "path", p, "err", err)
+			return
+		}
+	}
+
+	// a nil channel is never ready, so without a poll interval only file events reload the config
+	var poll <-chan time.Time
+	if ac.ConfigPollInterval > 0 {
+		ticker := time.NewTicker(ac.ConfigPollInterval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+
+	// current is the config the running rules were last loaded from, and is what changes are detected against
+	current := ac
+	reload := func(trigger string) {
+		cfg, err := reloadConfig(logger, f, current)
+		var unchanged ConfigUnchangedError
+		switch {
+		case errors.As(err, &unchanged):
+			logger.Debug("config is unchanged, not reloading", "trigger", trigger)
+		case err != nil:
+			logger.Error("error reloading config, reusing existing config", "trigger", trigger, "err", err)
+		default:
+			current = cfg
+			ac.setRuleMap(cfg.RuleMap)
+			// cached responses were built from the old rules
+			flushed, err := cache.Flush()
+			if err != nil {
+				logger.Error("error flushing cache after reloading config", "err", err)
+			}
+			logger.Info("reloaded config", "trigger", trigger, "reused_expressions", cfg.reusedExpressions, "cache_flushed", flushed)
+		}
 	}
 
 	for {
@@ -404,18 +1509,24 @@ func reloader(ctx context.Context, l *slog.Logger, f string, ac *AppConfig) {
 		case <-ctx.Done():
 			logger.Info("shutting down config reload worker")
 			return
-		case _, ok := <-watcher.Events:
-			if ok {
-				cfg, err := loadConfig(logger, f)
-				if err != nil {
-					logger.Error("error reloading config, reusing existing config", "err", err)
-				} else {
-					// TODO bust cache
-					// TODO this runs twice - is that just IDE double-saving?
-					ac.RuleMap = cfg.RuleMap
-					logger.Info("reloaded config")
+		case <-poll:
+			reload("poll")
+		case event, ok := <-watcher.Events:
+			if !ok {
+				continue
+			}
+
+			// The watch is gone along with the file, so it has to be added again once the path exists
+			if event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename) {
+				logger.Warn("config file vanished, keeping the last loaded config until it's back", "path", event.Name)
+				if !rewatch(ctx, logger, watcher, event.Name) {
+					return
 				}
+				logger.Info("config file is back", "path", event.Name)
 			}
+
+			// editors often write a file more than once per save, the later events find it unchanged
+			reload("watch")
 		case err, ok := <-watcher.Errors:
 			if !ok {
 				logger.Error("error watching file but continuing to try", "err", err)
@@ -423,3 +1534,25 @@ func reloader(ctx context.Context, l *slog.Logger, f string, ac *AppConfig) {
 		}
 	}
 }
+
+// rewatch adds path to the watcher, retrying until it succeeds or ctx is done. It reports whether the path is watched
+func rewatch(ctx context.Context, l *slog.Logger, watcher *fsnotify.Watcher, path string) bool {
+	ticker := time.NewTicker(configRewatchInterval)
+	defer ticker.Stop()
+
+	for {
+		// a rename may have left the watch in place, so drop it before adding it back
+		_ = watcher.Remove(path)
+		err := watcher.Add(path)
+		if err == nil {
+			return true
+		}
+		l.Debug("config file still missing, retrying", "path", path, "err", err)
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+}
@@ -3,12 +3,22 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	"io"
+	"log/slog"
+	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
 	"regexp"
+	"strings"
 	"testing"
+	"time"
 )
 
 func Test_loadConfig(t *testing.T) {
@@ -33,28 +43,29 @@ func Test_loadConfig(t *testing.T) {
 			wantRuleMapping: RuleMapping{
 				"example.com": Rules{
 					{
-						From:               "example.com",
+						From:               "example.com/xyz",
 						To:                 "https://foo.com/hello",
-						Code:               308,
-						compiled:           regexp.MustCompile(`.*`),
-						CacheControlMaxAge: 604800,
+						Code:               301,
+						compiled:           regexp.MustCompile(""),
+						CacheControlMaxAge: -1,
 						Parameters: RuleParameters{
-							Strategy: "combine",
+							Strategy: "replace",
 							Values: map[string][]string{
 								"hello": {"world"},
 								"foo":   {"bar"},
-								"whiz":  {"bang", "test"},
+								"whiz":  {"bang"},
 							},
 						},
 					},
 					{
-						From:               "example.com/xyz",
+						From:               "example.com/unrecognized-parameter.strategy",
 						To:                 "https://foo.com/hello",
 						Code:               301,
 						compiled:           regexp.MustCompile(""),
-						CacheControlMaxAge: -1,
+						CacheControlMaxAge: 5,
 						Parameters: RuleParameters{
-							Strategy: "replace",
+							// unknown strategies fall back to default_parameter_strategy
+							Strategy: "combine",
 							Values: map[string][]string{
 								"hello": {"world"},
 								"foo":   {"bar"},
@@ -63,17 +74,18 @@ func Test_loadConfig(t *testing.T) {
 						},
 					},
 					{
-						From:               "example.com/unrecognized-parameter.strategy",
+						// catch-all rules are matched after the host's other rules
+						From:               "example.com",
 						To:                 "https://foo.com/hello",
-						Code:               301,
-						compiled:           regexp.MustCompile(""),
-						CacheControlMaxAge: 5,
+						Code:               308,
+						compiled:           regexp.MustCompile(`.*`),
+						CacheControlMaxAge: 604800,
 						Parameters: RuleParameters{
-							Strategy: "idontexist",
+							Strategy: "combine",
 							Values: map[string][]string{
 								"hello": {"world"},
 								"foo":   {"bar"},
-								"whiz":  {"bang"},
+								"whiz":  {"bang", "test"},
 							},
 						},
 					},
@@ -92,7 +104,7 @@ func Test_loadConfig(t *testing.T) {
 
 			assert.Equal(t, tt.wantDefaultMiss, got.LocationOnMiss)
 
-			if !cmp.Equal(got.RuleMap, tt.wantRuleMapping, cmpopts.IgnoreFields(Rule{}, "compiled")) {
+			if !cmp.Equal(got.RuleMap, tt.wantRuleMapping, cmpopts.IgnoreUnexported(Rule{})) {
 				t.Errorf("\ngot  = %v\nwant = %v", got.RuleMap, tt.wantRuleMapping)
 			}
 		})
@@ -364,6 +376,86 @@ func Test_testFromAsURL(t *testing.T) {
 			},
 			wantError: false,
 		},
+		{
+			name: "internationalized hostname",
+			args: args{
+				url: "münchen.example/test",
+			},
+			want: want{
+				host:  "xn--mnchen-3ya.example",
+				proto: "https",
+				path:  "/test",
+			},
+			wantError: false,
+		},
+		{
+			name: "internationalized hostname with protocol",
+			args: args{
+				url: "http://münchen.example/test",
+			},
+			want: want{
+				host:  "xn--mnchen-3ya.example",
+				proto: "http",
+				path:  "/test",
+			},
+			wantError: false,
+		},
+		{
+			name: "punycode hostname",
+			args: args{
+				url: "xn--mnchen-3ya.example/test",
+			},
+			want: want{
+				host:  "xn--mnchen-3ya.example",
+				proto: "https",
+				path:  "/test",
+			},
+			wantError: false,
+		},
+		{
+			name: "fully-qualified hostname",
+			args: args{
+				url: "example.com./test",
+			},
+			want: want{
+				host:  "example.com",
+				proto: "https",
+				path:  "/test",
+			},
+			wantError: false,
+		},
+		{
+			name: "IPv6 literal with port",
+			args: args{
+				url: "http://[::1]:8080/test",
+			},
+			want: want{
+				host:  "[::1]",
+				proto: "http",
+				path:  "/test",
+			},
+			wantError: false,
+		},
+		{
+			name: "IPv6 literal with regex",
+			args: args{
+				url: "[2001:db8::1]/blog/[[:digit:]]{4}",
+			},
+			want: want{
+				host:  "[2001:db8::1]",
+				proto: "https",
+				path:  "/blog/[[:digit:]]{4}",
+			},
+			wantError: false,
+		},
+		{
+			name: "empty label",
+			args: args{
+				url: "example..com/test",
+			},
+			want:      want{},
+			wantError: true,
+		},
 	}
 	for _, tt := range testCases {
 		t.Run(tt.name, func(t *testing.T) {
@@ -382,3 +474,572 @@ func Test_testFromAsURL(t *testing.T) {
 		})
 	}
 }
+
+func Test_endsWithLiteral(t *testing.T) {
+	var testCases = []struct {
+		exp  string
+		want bool
+	}{
+		{exp: "^/bar", want: true},
+		{exp: `^/bar\.html`, want: true},
+		{exp: "^/bar/", want: false},
+		{exp: "^/bar$", want: false},
+		{exp: "^/bar.*", want: false},
+		{exp: "^/bar/(.+)", want: false},
+		{exp: "^/bar/[[:digit:]]{4}", want: false},
+		{exp: "^/", want: false},
+	}
+	for _, tt := range testCases {
+		t.Run(tt.exp, func(t *testing.T) {
+			assert.Equal(t, tt.want, endsWithLiteral(tt.exp))
+		})
+	}
+}
+
+func Test_buildRulesDefaultToScheme(t *testing.T) {
+	logger := newTestLogger()
+
+	var testCases = []struct {
+		name      string
+		ac        *AppConfig
+		to        string
+		wantTo    string
+		wantRules int
+	}{
+		{
+			name:      "scheme prepended",
+			ac:        &AppConfig{DefaultToScheme: "https"},
+			to:        "foo.com/bar",
+			wantTo:    "https://foo.com/bar",
+			wantRules: 1,
+		},
+		{
+			name:      "configured scheme prepended",
+			ac:        &AppConfig{DefaultToScheme: "http"},
+			to:        "foo.com/bar",
+			wantTo:    "http://foo.com/bar",
+			wantRules: 1,
+		},
+		{
+			name:      "existing scheme kept",
+			ac:        &AppConfig{DefaultToScheme: "https"},
+			to:        "http://foo.com/bar",
+			wantTo:    "http://foo.com/bar",
+			wantRules: 1,
+		},
+		{
+			name:      "strict rejects missing scheme",
+			ac:        &AppConfig{DefaultToScheme: "https", StrictToScheme: true},
+			to:        "foo.com/bar",
+			wantRules: 0,
+		},
+		{
+			name:      "strict keeps existing scheme",
+			ac:        &AppConfig{DefaultToScheme: "https", StrictToScheme: true},
+			to:        "https://foo.com/bar",
+			wantTo:    "https://foo.com/bar",
+			wantRules: 1,
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			got := *buildRules(logger, &Rules{{From: "example.com/foo", To: tt.to}}, tt.ac)
+			assert.Equal(t, tt.wantRules, len(got))
+			if len(got) > 0 {
+				assert.Equal(t, tt.wantTo, got[0].To)
+			}
+		})
+	}
+}
+
+func Test_validHostname(t *testing.T) {
+	logger := newTestLogger()
+
+	var testCases = []struct {
+		hostname string
+		want     bool
+	}{
+		{hostname: "example.com", want: true},
+		{hostname: "example.com.", want: true},
+		{hostname: "sub-domain.example.com", want: true},
+		{hostname: "under_score.example.com", want: true},
+		{hostname: "xn--mnchen-3ya.example", want: true},
+		{hostname: "localhost", want: true},
+		{hostname: "[::1]", want: true},
+		{hostname: "[2001:db8::1]", want: true},
+		{hostname: "*.example.com", want: true},
+		{hostname: "example..com", want: false},
+		{hostname: "*example.com", want: false},
+		{hostname: "www.*.example.com", want: false},
+		{hostname: "*.*.example.com", want: false},
+		{hostname: ".example.com", want: false},
+		{hostname: "example.com..", want: false},
+		{hostname: "-example.com", want: false},
+		{hostname: "example-.com", want: false},
+		{hostname: "example.-com", want: false},
+		{hostname: "exa mple.com", want: false},
+		{hostname: "example.com/", want: false},
+		{hostname: "[::1", want: false},
+		{hostname: "[127.0.0.1]", want: false},
+		{hostname: "[not-an-ip]", want: false},
+	}
+	for _, tt := range testCases {
+		t.Run(tt.hostname, func(t *testing.T) {
+			assert.Equal(t, tt.want, validHostname(logger, tt.hostname))
+		})
+	}
+}
+
+func Test_stripPort(t *testing.T) {
+	var testCases = []struct {
+		host string
+		want string
+	}{
+		{host: "example.com", want: "example.com"},
+		{host: "example.com:8080", want: "example.com"},
+		{host: "[::1]", want: "[::1]"},
+		{host: "[::1]:8080", want: "[::1]"},
+	}
+	for _, tt := range testCases {
+		t.Run(tt.host, func(t *testing.T) {
+			assert.Equal(t, tt.want, stripPort(tt.host))
+		})
+	}
+}
+
+func Test_configPaths(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{in: "./a.yml", want: []string{"./a.yml"}},
+		{in: "./a.yml:./b.yml", want: []string{"./a.yml", "./b.yml"}},
+		{in: "./a.yml, ./b.yml,", want: []string{"./a.yml", "./b.yml"}},
+		{in: "", want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			assert.Equal(t, tt.want, configPaths(tt.in))
+		})
+	}
+}
+
+func Test_loadConfigMultiplePaths(t *testing.T) {
+	logger := newTestLogger()
+
+	cfg, err := loadConfig(logger, "./fixtures/layered_base.yml:./fixtures/layered_override.yml")
+	assert.NoError(t, err)
+
+	// later files override settings, including single keys of nested settings
+	assert.Equal(t, 60, cfg.CacheControlMaxAge)
+	assert.Equal(t, 410, cfg.StatusOnMiss)
+	assert.Equal(t, int64(120), cfg.Cache.TTL)
+	assert.Equal(t, 30, cfg.Cache.CleanupInterval)
+
+	// rules from every file are kept, in file order
+	assert.Equal(t, 2, len(cfg.RuleMap["example.com"]))
+	assert.Equal(t, "example.com/base", cfg.RuleMap["example.com"][0].From)
+	assert.Equal(t, "example.com/override", cfg.RuleMap["example.com"][1].From)
+	assert.Equal(t, 2, len(cfg.RuleMap["example.org"]))
+	assert.Equal(t, "https://example.net/org-base", cfg.RuleMap["example.org"][0].To)
+	assert.Equal(t, "https://example.net/org-override", cfg.RuleMap["example.org"][1].To)
+
+	_, err = loadConfig(logger, "./fixtures/layered_base.yml,./fixtures/missing.yml")
+	assert.Error(t, err)
+}
+
+func Test_loadConfigHostGroups(t *testing.T) {
+	logger := newTestLogger()
+
+	grouped, err := loadConfig(logger, "./fixtures/host_groups.yml")
+	assert.Nil(t, err)
+	flat, err := loadConfig(logger, "./fixtures/host_groups_flat.yml")
+	assert.Nil(t, err)
+
+	if !cmp.Equal(grouped.RuleMap, flat.RuleMap, cmpopts.IgnoreUnexported(Rule{})) {
+		t.Errorf("\ngrouped = %v\nflat    = %v", grouped.RuleMap, flat.RuleMap)
+	}
+}
+
+func Test_flattenHostGroups(t *testing.T) {
+	logger := newTestLogger()
+
+	c := &AppConfig{
+		Hosts: map[string]Rules{
+			"example.com": {
+				{FromPath: "/a", To: "https://foo.com/a"},
+				{FromPath: "b", To: "https://foo.com/b"},
+				{From: "http://example.com/c", To: "https://foo.com/c"},
+				{From: "localhost/d", To: "https://foo.com/d"},
+				{From: "example.com/e", FromPath: "/e", To: "https://foo.com/e"},
+				{To: "https://foo.com/f"},
+			},
+		},
+	}
+
+	want := Rules{
+		{From: "example.com/a", To: "https://foo.com/a"},
+		{From: "example.com/b", To: "https://foo.com/b"},
+		{From: "http://example.com/c", To: "https://foo.com/c"},
+	}
+
+	got := flattenHostGroups(logger, c)
+	if !cmp.Equal(got, want, cmpopts.IgnoreUnexported(Rule{})) {
+		t.Errorf("\ngot  = %v\nwant = %v", got, want)
+	}
+	assert.Equal(t, 3, len(c.droppedRules))
+}
+
+func Test_buildRulesDefaultParameters(t *testing.T) {
+	logger := newTestLogger()
+
+	ac := &AppConfig{
+		DefaultParameterStrategy: ParamsStrategyCombine,
+		DefaultParameters: RuleParameters{
+			Strategy: ParamsStrategyReplace,
+			Values:   map[string][]string{"utm_medium": {"redirect"}},
+		},
+	}
+
+	var testCases = []struct {
+		name       string
+		parameters RuleParameters
+		want       RuleParameters
+	}{
+		{
+			name:       "unset parameters use default",
+			parameters: RuleParameters{},
+			want:       ac.DefaultParameters,
+		},
+		{
+			name:       "rule parameters override default",
+			parameters: RuleParameters{Strategy: ParamsStrategyReplace, Values: map[string][]string{"foo": {"bar"}}},
+			want:       RuleParameters{Strategy: ParamsStrategyReplace, Values: map[string][]string{"foo": {"bar"}}},
+		},
+		{
+			name:       "empty rule values override default",
+			parameters: RuleParameters{Values: map[string][]string{}},
+			want:       RuleParameters{Strategy: ParamsStrategyCombine, Values: map[string][]string{}},
+		},
+		{
+			name:       "rule strategy without values overrides default",
+			parameters: RuleParameters{Strategy: ParamsStrategyCombine},
+			want:       RuleParameters{Strategy: ParamsStrategyCombine},
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			got := *buildRules(logger, &Rules{{From: "example.com/foo", To: "https://foo.com", Parameters: tt.parameters}}, ac)
+			assert.Equal(t, tt.want, got[0].Parameters)
+		})
+	}
+}
+
+func Test_buildRulesDefaultParametersStrategy(t *testing.T) {
+	logger := newTestLogger()
+
+	// default parameters without a strategy fall back to default_parameter_strategy
+	ac := &AppConfig{
+		DefaultParameterStrategy: ParamsStrategyCombine,
+		DefaultParameters:        RuleParameters{Values: map[string][]string{"utm_medium": {"redirect"}}},
+	}
+
+	got := *buildRules(logger, &Rules{{From: "example.com/foo", To: "https://foo.com"}}, ac)
+	assert.Equal(t, ParamsStrategyCombine, got[0].Parameters.Strategy)
+	assert.Equal(t, []string{"redirect"}, got[0].Parameters.Values["utm_medium"])
+}
+
+func Test_buildRulesUnknownParameterStrategy(t *testing.T) {
+	logger := newTestLogger()
+
+	ac := &AppConfig{DefaultParameterStrategy: ParamsStrategyReplace}
+	got := *buildRules(logger, &Rules{
+		{From: "example.com/typo", To: "https://foo.com", Parameters: RuleParameters{Strategy: "idontexist"}},
+		{From: "example.com/valid", To: "https://foo.com", Parameters: RuleParameters{Strategy: ParamsStrategyCombine}},
+	}, ac)
+
+	assert.Equal(t, 2, len(got))
+	assert.Equal(t, ParamsStrategyReplace, got[0].Parameters.Strategy)
+	assert.Equal(t, ParamsStrategyCombine, got[1].Parameters.Strategy)
+}
+
+func Test_buildRulesCanonical(t *testing.T) {
+	logger := newTestLogger()
+
+	ac := &AppConfig{}
+	got := *buildRules(logger, &Rules{
+		{From: "example.com/valid", To: "https://foo.com", Canonical: "https://www.foo.com/valid"},
+		{From: "example.com/relative", To: "https://foo.com", Canonical: "/relative"},
+		{From: "example.com/scheme", To: "https://foo.com", Canonical: "ftp://foo.com/scheme"},
+		{From: "example.com/wildcard/*", To: "https://foo.com/:splat", Canonical: "https://www.foo.com/:splat"},
+	}, ac)
+
+	assert.Equal(t, 2, len(got))
+	assert.Equal(t, "https://www.foo.com/valid", got[0].Canonical)
+	assert.Equal(t, "https://www.foo.com/${SPLAT}", got[1].Canonical)
+	assert.Equal(t, "https://www.foo.com/x/y", expandCanonical("/wildcard/x/y", ruleMatch{rule: got[1]}))
+	assert.Equal(t, 2, len(ac.droppedRules))
+}
+
+func Test_buildRulesPreserveMethod(t *testing.T) {
+	logger := newTestLogger()
+
+	tests := []struct {
+		name     string
+		code     int
+		preserve bool
+		want     int
+	}{
+		{name: "default code", preserve: true, want: http.StatusPermanentRedirect},
+		{name: "permanent", code: http.StatusMovedPermanently, preserve: true, want: http.StatusPermanentRedirect},
+		{name: "temporary", code: http.StatusFound, preserve: true, want: http.StatusTemporaryRedirect},
+		{name: "already preserved", code: http.StatusTemporaryRedirect, preserve: true, want: http.StatusTemporaryRedirect},
+		{name: "see other", code: http.StatusSeeOther, preserve: true, want: http.StatusSeeOther},
+		{name: "not preserved", code: http.StatusFound, want: http.StatusFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := *buildRules(logger, &Rules{{From: "example.com/foo", To: "https://foo.com", Code: tt.code, PreserveMethod: tt.preserve}}, &AppConfig{})
+			assert.Equal(t, tt.want, got[0].Code)
+		})
+	}
+}
+
+func TestPreserveMethodAllowedMethodsWarning(t *testing.T) {
+	tests := []struct {
+		name     string
+		methods  string
+		wantWarn bool
+	}{
+		{name: "default methods", wantWarn: true},
+		{name: "post allowed", methods: "server:\n  allowed_methods: ['GET', 'HEAD', 'POST']\n"},
+		{name: "every method allowed", methods: "server:\n  allowed_methods: []\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger := slog.New(slog.NewJSONHandler(&buf, nil))
+			_, err := parseConfig(logger, []byte(tt.methods+"rules:\n  - from: 'example.com/form'\n    to: 'https://foo.com/form'\n    preserve_method: true\n"))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantWarn, strings.Contains(buf.String(), "rule sets preserve_method"))
+		})
+	}
+}
+
+func Test_setRuleMapActiveHosts(t *testing.T) {
+	ac := &AppConfig{}
+
+	ac.setRuleMap(RuleMapping{"foo.example": Rules{}, "bar.example": Rules{}})
+	assert.Equal(t, float64(2), testutil.ToFloat64(activeHostsMetric))
+
+	ac.setRuleMap(RuleMapping{"foo.example": Rules{}})
+	assert.Equal(t, float64(1), testutil.ToFloat64(activeHostsMetric))
+}
+
+func TestReloaderConfigRemoved(t *testing.T) {
+	logger := newTestLogger()
+	configRewatchInterval = 10 * time.Millisecond
+
+	path := filepath.Join(t.TempDir(), "rules.yml")
+	write := func(from string) {
+		assert.NoError(t, os.WriteFile(path, []byte("rules:\n  - from: '"+from+"'\n    to: 'https://foo.com/'\n"), 0o600))
+	}
+	write("reload.example.com/before")
+
+	cfg, err := loadConfig(logger, path)
+	assert.NoError(t, err)
+	cache := &spyCache{}
+	go reloader(t.Context(), logger, path, cfg, cache)
+	// give the watcher time to start
+	time.Sleep(100 * time.Millisecond)
+
+	assert.NoError(t, os.Remove(path))
+	time.Sleep(100 * time.Millisecond)
+	// the last loaded rules are kept while the file is missing
+	assert.Equal(t, "reload.example.com/before", cfg.ruleMap()["reload.example.com"][0].From)
+
+	write("reload.example.com/after")
+	assert.Eventually(t, func() bool {
+		rules := cfg.ruleMap()["reload.example.com"]
+		return len(rules) == 1 && rules[0].From == "reload.example.com/after"
+	}, 5*time.Second, 10*time.Millisecond)
+	// responses cached from the old rules are flushed
+	assert.Eventually(t, func() bool {
+		cache.lock.Lock()
+		defer cache.lock.Unlock()
+		return cache.flushes > 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the file is still watched after it's been recreated
+	write("reload.example.com/again")
+	assert.Eventually(t, func() bool {
+		rules := cfg.ruleMap()["reload.example.com"]
+		return len(rules) == 1 && rules[0].From == "reload.example.com/again"
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestReloaderPoll(t *testing.T) {
+	logger := newTestLogger()
+
+	path := filepath.Join(t.TempDir(), "rules.yml")
+	write := func(from string) {
+		assert.NoError(t, os.WriteFile(path, []byte("config_poll_interval: 10ms\nrules:\n  - from: '"+from+"'\n    to: 'https://foo.com/'\n"), 0o600))
+	}
+	write("poll.example.com/before")
+
+	cfg, err := loadConfig(logger, path)
+	assert.NoError(t, err)
+	assert.Equal(t, 10*time.Millisecond, cfg.ConfigPollInterval)
+	cache := &spyCache{}
+	go reloader(t.Context(), logger, path, cfg, cache)
+
+	// polling an unchanged file doesn't reload it
+	time.Sleep(100 * time.Millisecond)
+	cache.lock.Lock()
+	assert.Equal(t, 0, cache.flushes)
+	cache.lock.Unlock()
+
+	write("poll.example.com/after")
+	assert.Eventually(t, func() bool {
+		rules := cfg.ruleMap()["poll.example.com"]
+		return len(rules) == 1 && rules[0].From == "poll.example.com/after"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// once applied, the change isn't applied again however many times it's polled
+	time.Sleep(50 * time.Millisecond)
+	cache.lock.Lock()
+	flushes := cache.flushes
+	cache.lock.Unlock()
+	assert.Positive(t, flushes)
+	time.Sleep(100 * time.Millisecond)
+	cache.lock.Lock()
+	assert.Equal(t, flushes, cache.flushes)
+	cache.lock.Unlock()
+}
+
+func Test_configHash(t *testing.T) {
+	a := configHash([][]byte{[]byte("foo"), []byte("bar")})
+	assert.Equal(t, a, configHash([][]byte{[]byte("foo"), []byte("bar")}))
+	assert.NotEqual(t, a, configHash([][]byte{[]byte("bar"), []byte("foo")}))
+	assert.NotEqual(t, a, configHash([][]byte{[]byte("foob"), []byte("ar")}))
+}
+
+func Test_parseConfigReusing(t *testing.T) {
+	logger := newTestLogger()
+
+	current, err := parseConfig(logger, []byte(`
+rules:
+  - from: 'example.com/unchanged/(.+)'
+    to: 'https://foo.com/$1'
+  - from: 'example.com/changed/(.+)'
+    to: 'https://foo.com/$1'
+`))
+	assert.NoError(t, err)
+
+	next, err := parseConfigReusing(logger, compiledExpressions(current.RuleMap), []byte(`
+rules:
+  - from: 'example.com/unchanged/(.+)'
+    to: 'https://bar.com/$1'
+  - from: 'example.com/changed/([a-z]+)'
+    to: 'https://foo.com/$1'
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, next.reusedExpressions)
+
+	// only the compiled expression is reused, the rest of the rule comes from the new config
+	assert.Same(t, current.RuleMap["example.com"][0].compiled, next.RuleMap["example.com"][0].compiled)
+	assert.Equal(t, "https://bar.com/$1", next.RuleMap["example.com"][0].To)
+	assert.NotSame(t, current.RuleMap["example.com"][1].compiled, next.RuleMap["example.com"][1].compiled)
+	assert.Equal(t, "^/changed/([a-z]+)", next.RuleMap["example.com"][1].compiled.String())
+}
+
+func TestReloadConfig(t *testing.T) {
+	logger := newTestLogger()
+
+	current, err := loadConfig(logger, "./fixtures/rules.yml")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, current.contentHash)
+
+	// the file hasn't changed, so it isn't parsed again
+	_, err = reloadConfig(logger, "./fixtures/rules.yml", current)
+	assert.ErrorAs(t, err, &ConfigUnchangedError{})
+
+	// as though the file had changed
+	current.contentHash = ""
+	next, err := reloadConfig(logger, "./fixtures/rules.yml", current)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, next.contentHash)
+
+	// nothing changed, so every expression is reused
+	assert.Equal(t, len(compiledExpressions(current.RuleMap)), len(compiledExpressions(next.RuleMap)))
+	assert.Equal(t, countRules(current.RuleMap)-countLiteralRules(current.RuleMap), next.reusedExpressions)
+}
+
+func countLiteralRules(r RuleMapping) int {
+	n := 0
+	for _, rules := range r {
+		for _, rule := range rules {
+			if rule.compiled == nil {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// BenchmarkReloadConfig compares reloading a large config where one rule changed with and without reusing the
+// previous config's compiled expressions
+func BenchmarkReloadConfig(b *testing.B) {
+	logger := NewLogger(slog.LevelInfo, false, io.Discard)
+
+	build := func(changed string) []byte {
+		var buf bytes.Buffer
+		buf.WriteString("rules:\n")
+		for i := range 5000 {
+			fmt.Fprintf(&buf, "  - from: 'example.com/section-%d/(?P<year>[0-9]{4})/([a-z]+)-(\\d+)'\n    to: 'https://foo.com/$year/$2/$3'\n", i)
+		}
+		fmt.Fprintf(&buf, "  - from: 'example.com/%s'\n    to: 'https://foo.com/'\n", changed)
+		return buf.Bytes()
+	}
+	current, err := parseConfig(logger, build("before"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	next := build("after")
+
+	b.Run("full", func(b *testing.B) {
+		for b.Loop() {
+			_, _ = parseConfig(logger, next)
+		}
+	})
+	b.Run("incremental", func(b *testing.B) {
+		for b.Loop() {
+			_, _ = parseConfigReusing(logger, compiledExpressions(current.RuleMap), next)
+		}
+	})
+}
+
+func TestReadmeDefaultConfig(t *testing.T) {
+	logger := newTestLogger()
+	readme, err := os.ReadFile("README.md")
+	assert.NoError(t, err)
+	_, block, found := strings.Cut(string(readme), "Default values for server configuration:\n\n```yaml\n")
+	assert.True(t, found)
+	block, _, _ = strings.Cut(block, "```")
+
+	// copying the documented defaults should give the built-in ones
+	cfg, err := parseConfig(logger, []byte(block))
+	assert.NoError(t, err)
+	want, err := parseConfig(logger, []byte(""))
+	assert.NoError(t, err)
+	assert.Equal(t, want.ConfigPollInterval, cfg.ConfigPollInterval)
+	assert.Equal(t, want.Cache, cfg.Cache)
+	assert.Equal(t, want.Limits, cfg.Limits)
+	assert.Equal(t, want.Log, cfg.Log)
+	assert.Equal(t, want.Server.SlowRequestThreshold, cfg.Server.SlowRequestThreshold)
+	assert.Equal(t, want.Server.ArtificialDelay, cfg.Server.ArtificialDelay)
+	assert.Equal(t, want.Server.ConnectionTimeout, cfg.Server.ConnectionTimeout)
+}
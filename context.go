@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type requestValuesKey struct{}
+
+// requestValues are established once per request, before it's handled, so that handlers and middleware share them
+// rather than working them out again
+type requestValues struct {
+	traceID  string
+	clientIP net.IP
+}
+
+// requestValuesMiddleware adds the request's correlation ID and client IP to its context
+func requestValuesMiddleware(tracingHeader string, trustedProxies []*net.IPNet, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v := requestValues{traceID: getTraceID(r, tracingHeader), clientIP: clientIP(r, trustedProxies)}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestValuesKey{}, v)))
+	})
+}
+
+// requestTraceID returns the request's correlation ID from its context, falling back to getTraceID for requests that
+// didn't pass through requestValuesMiddleware
+func requestTraceID(r *http.Request, header string) string {
+	if v, ok := r.Context().Value(requestValuesKey{}).(requestValues); ok {
+		return v.traceID
+	}
+	return getTraceID(r, header)
+}
+
+// requestClientIP returns the request's client IP from its context, falling back to clientIP for requests that didn't
+// pass through requestValuesMiddleware
+func requestClientIP(r *http.Request, trustedProxies []*net.IPNet) net.IP {
+	if v, ok := r.Context().Value(requestValuesKey{}).(requestValues); ok {
+		return v.clientIP
+	}
+	return clientIP(r, trustedProxies)
+}
+
+// connContexts gives each connection a context that's cancelled once the connection has been open for timeout, or
+// when it's closed. A timeout <= 0 only cancels the context when the connection is closed
+type connContexts struct {
+	timeout time.Duration
+	cancels sync.Map
+}
+
+// connContext is used as http.Server.ConnContext
+func (c *connContexts) connContext(ctx context.Context, conn net.Conn) context.Context {
+	var cancel context.CancelFunc
+	if c.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	c.cancels.Store(conn, cancel)
+	return ctx
+}
+
+// connState is used as http.Server.ConnState, releasing the context of connections that are done with
+func (c *connContexts) connState(conn net.Conn, state http.ConnState) {
+	if state != http.StateClosed && state != http.StateHijacked {
+		return
+	}
+	if cancel, ok := c.cancels.LoadAndDelete(conn); ok {
+		cancel.(context.CancelFunc)()
+	}
+}
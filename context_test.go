@@ -0,0 +1,89 @@
+//go:build unit_test
+
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRequestValuesMiddleware(t *testing.T) {
+	var got requestValues
+	handler := requestValuesMiddleware("X-Request-Id", nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = requestValues{traceID: requestTraceID(r, "X-Other"), clientIP: requestClientIP(r, nil)}
+	}))
+
+	req := httptest.NewRequest("GET", "http://example.com/foo", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("X-Request-Id", "abc")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	// the values come from the context, not the arguments the handler passed
+	assert.Equal(t, "abc", got.traceID)
+	assert.Equal(t, "192.0.2.1", got.clientIP.String())
+}
+
+func TestCancelledBaseContext(t *testing.T) {
+	logger := newTestLogger()
+	cfg, err := parseConfig(logger, []byte(`
+rules:
+  - from: '127.0.0.1/foo'
+    to: 'https://foo.com/'
+`))
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		cancel bool
+		want   int
+	}{
+		{name: "handled", want: http.StatusMovedPermanently},
+		{name: "cancelled", cancel: true, want: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancel {
+				cancel()
+			}
+
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			assert.NoError(t, err)
+			s := newHTTPServer(ctx, cfg, newServer(logger, &noopCache{}, cfg))
+			go s.Serve(ln)
+			defer s.Close()
+
+			client := &http.Client{
+				CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+				Timeout:       time.Second,
+			}
+			resp, err := client.Get("http://" + ln.Addr().String() + "/foo")
+			assert.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, tt.want, resp.StatusCode)
+		})
+	}
+}
+
+func TestConnContexts(t *testing.T) {
+	c := &connContexts{timeout: 10 * time.Millisecond}
+	client, conn := net.Pipe()
+	defer client.Close()
+
+	ctx := c.connContext(context.Background(), conn)
+	<-ctx.Done()
+	assert.ErrorIs(t, ctx.Err(), context.DeadlineExceeded)
+
+	c = &connContexts{}
+	ctx = c.connContext(context.Background(), conn)
+	c.connState(conn, http.StateActive)
+	assert.NoError(t, ctx.Err())
+	c.connState(conn, http.StateClosed)
+	assert.ErrorIs(t, ctx.Err(), context.Canceled)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// cookieReference matches references to a cookie's value in a `to` directive, e.g. `$cookie.locale`
+var cookieReference = regexp.MustCompile(`\$cookie\.([A-Za-z0-9_-]+)`)
+
+// requestCookies returns the value of each cookie sent with the request. If a cookie is sent more than once, the first
+// value wins
+func requestCookies(r *http.Request) map[string]string {
+	cookies := r.Cookies()
+	if len(cookies) == 0 {
+		return nil
+	}
+	values := make(map[string]string, len(cookies))
+	for _, c := range cookies {
+		if _, ok := values[c.Name]; !ok {
+			values[c.Name] = c.Value
+		}
+	}
+	return values
+}
+
+// cookieReferences returns the names of the cookies referenced in to, sorted
+func cookieReferences(to string) []string {
+	names := []string{}
+	for _, m := range cookieReference.FindAllStringSubmatch(to, -1) {
+		names = append(names, m[1])
+	}
+	sort.Strings(names)
+	return names
+}
+
+// unmatchedCookieReferences returns the cookies referenced in the rule's `to` and `to_fallback` that it doesn't match on
+func unmatchedCookieReferences(r Rule) []string {
+	unmatched := []string{}
+	for _, name := range cookieReferences(r.To + " " + r.ToFallback) {
+		if _, ok := r.MatchCookie[name]; !ok && !slices.Contains(unmatched, name) {
+			unmatched = append(unmatched, name)
+		}
+	}
+	return unmatched
+}
+
+// compileCookieExpressions compiles the expressions of a rule's match_cookie. Each expression has to match the whole
+// cookie value
+func compileCookieExpressions(matchCookie map[string]string) (map[string]*regexp.Regexp, error) {
+	if len(matchCookie) == 0 {
+		return nil, nil
+	}
+	expressions := make(map[string]*regexp.Regexp, len(matchCookie))
+	for name, exp := range matchCookie {
+		compiled, err := regexp.Compile("^(?:" + exp + ")$")
+		if err != nil {
+			return nil, err
+		}
+		expressions[name] = compiled
+	}
+	return expressions, nil
+}
+
+// matchesCookies reports whether every cookie the rule matches on was sent, with a value its expression matches
+func (r Rule) matchesCookies(cookies map[string]string) bool {
+	for name, exp := range r.cookieExpressions {
+		v, ok := cookies[name]
+		if !ok || !exp.MatchString(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// expandCookies replaces references to cookies in the rule's `to` directive with their values, escaped for a path
+//
+// Only cookies in match_cookie can be referenced, so the values have already been matched by the rule's expressions.
+// Regular expression rules have `$` escaped, since their `to` is expanded again to fill in captures
+func (r Rule) expandCookies(to string, cookies map[string]string) string {
+	if len(r.cookieExpressions) == 0 {
+		return to
+	}
+	return cookieReference.ReplaceAllStringFunc(to, func(ref string) string {
+		v := url.PathEscape(cookies[strings.TrimPrefix(ref, "$cookie.")])
+		if r.compiled != nil {
+			v = strings.ReplaceAll(v, "$", "$$")
+		}
+		return v
+	})
+}
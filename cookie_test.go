@@ -0,0 +1,85 @@
+//go:build unit_test
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_requestCookies(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	assert.Nil(t, requestCookies(req))
+
+	req.Header.Add("Cookie", "locale=fr; theme=dark")
+	req.Header.Add("Cookie", "locale=de")
+	assert.Equal(t, map[string]string{"locale": "fr", "theme": "dark"}, requestCookies(req))
+}
+
+func TestRule_expandCookies(t *testing.T) {
+	logger := newTestLogger()
+	cfg, err := parseConfig(logger, []byte(`
+rules:
+  - from: 'example.com/regex/(.*)'
+    to: 'https://example.com/$cookie.locale/$1'
+    match_cookie:
+      locale: '.*'
+  - from: 'example.com/prefix/'
+    to: 'https://example.com/$cookie.locale/'
+    match: 'prefix'
+    match_cookie:
+      locale: '.*'
+`))
+	assert.NoError(t, err)
+	regex, prefix := cfg.RuleMap["example.com"][0], cfg.RuleMap["example.com"][1]
+
+	tests := []struct {
+		name   string
+		rule   Rule
+		cookie string
+		want   string
+	}{
+		{name: "regex", rule: regex, cookie: "fr", want: "https://example.com/fr/$1"},
+		{name: "regex escapes $", rule: regex, cookie: "a$1", want: "https://example.com/a$$1/$1"},
+		{name: "prefix", rule: prefix, cookie: "a$1", want: "https://example.com/a$1/"},
+		{name: "path escaped", rule: prefix, cookie: "a/b?c", want: "https://example.com/a%2Fb%3Fc/"},
+		{name: "missing", rule: prefix, want: "https://example.com//"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cookies := map[string]string{}
+			if tt.cookie != "" {
+				cookies["locale"] = tt.cookie
+			}
+			assert.Equal(t, tt.want, tt.rule.expandCookies(tt.rule.To, cookies))
+		})
+	}
+}
+
+func TestMatchCookieConfig(t *testing.T) {
+	logger := newTestLogger()
+	cfg, err := parseConfig(logger, []byte(`
+rules:
+  - from: 'example.com/invalid'
+    to: 'https://example.com/'
+    match_cookie:
+      locale: '(fr'
+  - from: 'example.com/unmatched'
+    to: 'https://example.com/$cookie.theme/'
+    match_cookie:
+      locale: 'fr'
+  - from: 'example.com/valid'
+    to: 'https://example.com/$cookie.locale/'
+    match_cookie:
+      locale: 'fr|de'
+`))
+	assert.NoError(t, err)
+	assert.Len(t, cfg.RuleMap["example.com"], 1)
+	assert.Equal(t, "example.com/valid", cfg.RuleMap["example.com"][0].From)
+	if assert.Len(t, cfg.droppedRules, 2) {
+		assert.Contains(t, cfg.droppedRules[0].Reason, "invalid match_cookie expression")
+		assert.Contains(t, cfg.droppedRules[1].Reason, "theme")
+	}
+	assert.Equal(t, ruleConditions{cookies: []string{"locale"}}, cfg.conditions["example.com"])
+}
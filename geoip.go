@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"github.com/oschwald/maxminddb-golang/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var (
+	geoIPLastReloadMetric = promauto.With(appMetrics).NewGauge(
+		prometheus.GaugeOpts{
+			Name: "geoip_db_last_reload_timestamp",
+			Help: "Unix time the GeoIP database was last loaded",
+		})
+)
+
+type GeoIPConfig struct {
+	// Database is the path to a MaxMind DB with countries, e.g. GeoLite2-Country.mmdb, that match_country looks up
+	// client IPs in. It's reloaded when the file changes
+	Database string `yaml:"database"`
+}
+
+func (c GeoIPConfig) enabled() bool {
+	return c.Database != ""
+}
+
+type GeoIPDatabaseError struct {
+	path string
+	err  error
+}
+
+func (e GeoIPDatabaseError) Error() string {
+	return fmt.Sprintf("invalid GeoIP database '%s': %s", e.path, e.err)
+}
+
+func (e GeoIPDatabaseError) Unwrap() error {
+	return e.err
+}
+
+// geoIPRecord is the part of a MaxMind country or city record that rules match on
+type geoIPRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+// geoIPDatabase looks up the countries of client IPs. When the file changes, the reader is swapped under the lock, the
+// way RuleMap is swapped when the config changes
+type geoIPDatabase struct {
+	lock   sync.RWMutex
+	path   string
+	reader *maxminddb.Reader
+}
+
+// openGeoIPDatabase loads the database at path
+func openGeoIPDatabase(path string) (*geoIPDatabase, error) {
+	g := &geoIPDatabase{path: path}
+	if err := g.reload(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// loadGeoIPReader reads and verifies the database at path
+//
+// The file is read into memory rather than memory mapped, so that rewriting it in place can't change the database under
+// a reader that's in use. It's verified in full, since a partially written file can still have valid metadata
+func loadGeoIPReader(path string) (*maxminddb.Reader, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := maxminddb.OpenBytes(b)
+	if err != nil {
+		return nil, GeoIPDatabaseError{path: path, err: err}
+	}
+	if err := reader.Verify(); err != nil {
+		return nil, GeoIPDatabaseError{path: path, err: err}
+	}
+	return reader, nil
+}
+
+// reload swaps the reader for one with the current content of the file. The previous reader is kept if the file can't
+// be loaded, e.g. while it's still being written
+func (g *geoIPDatabase) reload() error {
+	reader, err := loadGeoIPReader(g.path)
+	if err != nil {
+		return err
+	}
+
+	g.lock.Lock()
+	previous := g.reader
+	g.reader = reader
+	g.lock.Unlock()
+
+	// lookups hold the read lock, so none of them are still using the previous reader
+	if previous != nil {
+		_ = previous.Close()
+	}
+	geoIPLastReloadMetric.SetToCurrentTime()
+	return nil
+}
+
+// country returns the ISO code of ip's country, uppercased, or an empty string if it isn't in the database. A nil
+// database has no countries
+func (g *geoIPDatabase) country(ip net.IP) string {
+	if g == nil {
+		return ""
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return ""
+	}
+
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	var record geoIPRecord
+	if err := g.reader.Lookup(addr.Unmap()).Decode(&record); err != nil {
+		return ""
+	}
+	return strings.ToUpper(record.Country.ISOCode)
+}
+
+// geoIPReloader reloads the GeoIP database when its file changes
+//
+// The file's directory is watched rather than the file, since database updaters usually replace the file by renaming a
+// new one over it, which would drop a watch on the file itself
+func geoIPReloader(ctx context.Context, l *slog.Logger, g *geoIPDatabase) {
+	logger := l.WithGroup("geoip").With("path", g.path)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logger.Error("failed to create file watcher", "err", err)
+		return
+	}
+	defer watcher.Close()
+
+	if err := watcher.Add(filepath.Dir(g.path)); err != nil {
+		logger.Error("failed to watch GeoIP database directory", "err", err)
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) != filepath.Clean(g.path) || !event.Has(fsnotify.Create) && !event.Has(fsnotify.Write) {
+				continue
+			}
+
+			// a file that's still being copied fails to load, and the write that completes it loads it
+			if err := g.reload(); err != nil {
+				logger.Warn("error reloading GeoIP database, keeping the previous one", "err", err)
+				continue
+			}
+			logger.Info("reloaded GeoIP database")
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			logger.Error("error watching GeoIP database", "err", err)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+//go:build unit_test
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testGeoIPNode is a node of the search tree built by buildTestGeoIPDatabase. Nodes with a country are leaves
+type testGeoIPNode struct {
+	children [2]*testGeoIPNode
+	country  string
+}
+
+// mmdbString, mmdbUint, and mmdbMap encode values in the MaxMind DB data format, for the few types the test database
+// needs
+func mmdbString(s string) []byte {
+	return append([]byte{2<<5 | byte(len(s))}, s...)
+}
+
+func mmdbUint(typ byte, v uint32) []byte {
+	b := binary.BigEndian.AppendUint32(nil, v)
+	b = bytes.TrimLeft(b, "\x00")
+	return append([]byte{typ<<5 | byte(len(b))}, b...)
+}
+
+func mmdbMap(pairs ...[]byte) []byte {
+	b := []byte{7<<5 | byte(len(pairs)/2)}
+	for _, p := range pairs {
+		b = append(b, p...)
+	}
+	return b
+}
+
+// buildTestGeoIPDatabase returns an IPv4 MaxMind DB with a country record for each network
+func buildTestGeoIPDatabase(t *testing.T, networks map[string]string) []byte {
+	t.Helper()
+
+	root := &testGeoIPNode{}
+	for network, country := range networks {
+		prefix := netip.MustParsePrefix(network)
+		addr := prefix.Addr().As4()
+		n := root
+		for i := range prefix.Bits() {
+			bit := addr[i/8] >> (7 - i%8) & 1
+			if n.children[bit] == nil {
+				n.children[bit] = &testGeoIPNode{}
+			}
+			n = n.children[bit]
+		}
+		n.country = country
+	}
+
+	// number the nodes that aren't leaves, then encode each country's record once
+	nodes := []*testGeoIPNode{root}
+	index := map[*testGeoIPNode]int{root: 0}
+	for i := 0; i < len(nodes); i++ {
+		for _, child := range nodes[i].children {
+			if child != nil && child.country == "" {
+				index[child] = len(nodes)
+				nodes = append(nodes, child)
+			}
+		}
+	}
+	var data []byte
+	offsets := map[string]int{}
+	for _, country := range networks {
+		if _, ok := offsets[country]; !ok {
+			offsets[country] = len(data)
+			data = append(data, mmdbMap(mmdbString("country"), mmdbMap(mmdbString("iso_code"), mmdbString(country)))...)
+		}
+	}
+
+	// records point to a node, to no data with the node count, or past the node count and the separator into the data
+	var tree []byte
+	for _, n := range nodes {
+		for _, child := range n.children {
+			record := len(nodes)
+			if child != nil && child.country != "" {
+				record = len(nodes) + 16 + offsets[child.country]
+			} else if child != nil {
+				record = index[child]
+			}
+			tree = append(tree, byte(record>>16), byte(record>>8), byte(record))
+		}
+	}
+
+	db := append(tree, make([]byte, 16)...)
+	db = append(db, data...)
+	db = append(db, "\xAB\xCD\xEFMaxMind.com"...)
+	return append(db, mmdbMap(
+		mmdbString("binary_format_major_version"), mmdbUint(5, 2),
+		mmdbString("binary_format_minor_version"), mmdbUint(5, 0),
+		mmdbString("database_type"), mmdbString("Test-Country"),
+		mmdbString("description"), mmdbMap(mmdbString("en"), mmdbString("test")),
+		mmdbString("ip_version"), mmdbUint(5, 4),
+		mmdbString("node_count"), mmdbUint(6, uint32(len(nodes))),
+		mmdbString("record_size"), mmdbUint(5, 24),
+	)...)
+}
+
+// writeTestGeoIPDatabase writes a database built by buildTestGeoIPDatabase to path
+func writeTestGeoIPDatabase(t *testing.T, path string, networks map[string]string) {
+	t.Helper()
+	assert.NoError(t, os.WriteFile(path, buildTestGeoIPDatabase(t, networks), 0o600))
+}
+
+func Test_geoIPDatabase_country(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "country.mmdb")
+	writeTestGeoIPDatabase(t, path, map[string]string{"192.0.2.0/24": "FR", "198.51.100.0/25": "be"})
+	db, err := openGeoIPDatabase(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{ip: "192.0.2.1", want: "FR"},
+		{ip: "192.0.2.255", want: "FR"},
+		{ip: "::ffff:192.0.2.1", want: "FR"},
+		// codes are uppercased, whatever the database has
+		{ip: "198.51.100.1", want: "BE"},
+		{ip: "198.51.100.200"},
+		{ip: "203.0.113.1"},
+		// the database is IPv4 only
+		{ip: "2001:db8::1"},
+		{ip: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			assert.Equal(t, tt.want, db.country(net.ParseIP(tt.ip)))
+		})
+	}
+
+	var none *geoIPDatabase
+	assert.Equal(t, "", none.country(net.ParseIP("192.0.2.1")))
+}
+
+func TestGeoIPDatabaseReload(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "country.mmdb")
+	writeTestGeoIPDatabase(t, path, map[string]string{"192.0.2.0/24": "FR"})
+
+	_, err := openGeoIPDatabase(filepath.Join(dir, "missing.mmdb"))
+	assert.Error(t, err)
+
+	db, err := openGeoIPDatabase(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NotZero(t, testutil.ToFloat64(geoIPLastReloadMetric))
+
+	// a partially written file fails verification, and the previous database is kept
+	updated := buildTestGeoIPDatabase(t, map[string]string{"192.0.2.0/24": "DE"})
+	for _, partial := range [][]byte{updated[:len(updated)/2], updated[:len(updated)-10], []byte("not a database")} {
+		assert.NoError(t, os.WriteFile(path, partial, 0o600))
+		var target GeoIPDatabaseError
+		assert.ErrorAs(t, db.reload(), &target)
+		assert.Equal(t, "FR", db.country(net.ParseIP("192.0.2.1")))
+	}
+
+	assert.NoError(t, os.WriteFile(path, updated, 0o600))
+	assert.NoError(t, db.reload())
+	assert.Equal(t, "DE", db.country(net.ParseIP("192.0.2.1")))
+}
+
+func TestGeoIPReloader(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "country.mmdb")
+	writeTestGeoIPDatabase(t, path, map[string]string{"192.0.2.0/24": "FR"})
+	db, err := openGeoIPDatabase(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	go geoIPReloader(t.Context(), newTestLogger(), db)
+	// give the watcher time to start
+	time.Sleep(100 * time.Millisecond)
+
+	// updaters write a new file and rename it over the old one
+	next := filepath.Join(dir, "country.mmdb.tmp")
+	writeTestGeoIPDatabase(t, next, map[string]string{"192.0.2.0/24": "DE"})
+	assert.NoError(t, os.Rename(next, path))
+	assert.Eventually(t, func() bool {
+		return db.country(net.ParseIP("192.0.2.1")) == "DE"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// as well as rewriting it in place
+	writeTestGeoIPDatabase(t, path, map[string]string{"192.0.2.0/24": "ES"})
+	assert.Eventually(t, func() bool {
+		return db.country(net.ParseIP("192.0.2.1")) == "ES"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// other files in the directory are ignored
+	writeTestGeoIPDatabase(t, filepath.Join(dir, "other.mmdb"), map[string]string{"192.0.2.0/24": "IT"})
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, "ES", db.country(net.ParseIP("192.0.2.1")))
+}
+
+func TestMatchCountry(t *testing.T) {
+	logger := newTestLogger()
+	path := filepath.Join(t.TempDir(), "country.mmdb")
+	writeTestGeoIPDatabase(t, path, map[string]string{"192.0.2.0/24": "FR", "198.51.100.0/24": "BE", "203.0.113.0/24": "DE"})
+
+	cfg, err := parseConfig(logger, []byte(`
+geoip:
+  database: '`+path+`'
+server:
+  trusted_proxies: ['10.0.0.0/8']
+rules:
+  - from: 'example.com/shop'
+    to: 'https://example.com/fr/shop'
+    match_country: ['fr', 'BE']
+  - from: 'example.com/shop'
+    to: 'https://example.com/en/shop'
+  - from: 'other.com/shop'
+    to: 'https://other.com/en/shop'
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"FR", "BE"}, cfg.Rules[0].MatchCountry)
+	cfg.geoip, err = openGeoIPDatabase(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	cache := NewInMemoryCache(t.Context(), logger, 3600, 3600)
+	handler := handleRequest(logger, cache, cfg)
+
+	tests := []struct {
+		name         string
+		host         string
+		remoteAddr   string
+		forwardedFor string
+		wantLocation string
+	}{
+		{name: "matched country", host: "example.com", remoteAddr: "192.0.2.1:1234", wantLocation: "https://example.com/fr/shop"},
+		{name: "second matched country", host: "example.com", remoteAddr: "198.51.100.1:1234", wantLocation: "https://example.com/fr/shop"},
+		{name: "other country", host: "example.com", remoteAddr: "203.0.113.1:1234", wantLocation: "https://example.com/en/shop"},
+		{name: "unknown country", host: "example.com", remoteAddr: "127.0.0.1:1234", wantLocation: "https://example.com/en/shop"},
+		{name: "client IP from a trusted proxy", host: "example.com", remoteAddr: "10.0.0.1:1234", forwardedFor: "192.0.2.1", wantLocation: "https://example.com/fr/shop"},
+		{name: "host without match_country", host: "other.com", remoteAddr: "192.0.2.1:1234", wantLocation: "https://other.com/en/shop"},
+	}
+	// each request is made twice, so that the second is served from the cache
+	for range 2 {
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				req := httptest.NewRequest("GET", "http://"+tt.host+"/shop", nil)
+				req.RemoteAddr = tt.remoteAddr
+				if tt.forwardedFor != "" {
+					req.Header.Set("X-Forwarded-For", tt.forwardedFor)
+				}
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, req)
+				assert.Equal(t, http.StatusMovedPermanently, w.Code)
+				assert.Equal(t, tt.wantLocation, w.Header().Get("Location"))
+			})
+		}
+	}
+
+	// matched countries are cached separately, while the rest share an entry
+	stats, err := cache.Stats()
+	assert.NoError(t, err)
+	assert.Equal(t, CacheStats{Entries: 4, Hosts: []CacheHostStats{{Host: "example.com", Entries: 3}, {Host: "other.com", Entries: 1}}}, stats)
+}
+
+func TestMatchCountryWithoutDatabaseWarning(t *testing.T) {
+	rules := "rules:\n  - from: 'example.com/shop'\n    to: 'https://example.com/fr/shop'\n    match_country: ['FR']\n"
+	tests := []struct {
+		name     string
+		config   string
+		wantWarn bool
+	}{
+		{name: "no database", wantWarn: true},
+		{name: "database", config: "geoip:\n  database: '/var/lib/GeoIP/GeoLite2-Country.mmdb'\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger := slog.New(slog.NewJSONHandler(&buf, nil))
+			_, err := parseConfig(logger, []byte(tt.config+rules))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantWarn, strings.Contains(buf.String(), "rule sets match_country"))
+		})
+	}
+}
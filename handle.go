@@ -1,16 +1,183 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/sync/singleflight"
+	"hash/fnv"
+	"io"
 	"log/slog"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 )
 
-func handleMatchError(err error, w http.ResponseWriter, cache Cache, host string, path string, fallback string) {
+var (
+	selfRedirectMetric = promauto.With(appMetrics).NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "self_redirect_total",
+			Help: "Number of computed Location headers that point back at the request URL",
+		},
+		[]string{"host"},
+	)
+)
+
+type SelfRedirectError struct {
+	location string
+}
+
+func (e SelfRedirectError) Error() string {
+	return fmt.Sprintf("location '%s' redirects to itself", e.location)
+}
+
+const (
+	// EmptyToPathRoot redirects to `/` when a rule's `to` expands to an empty path. This is the default
+	EmptyToPathRoot = "root"
+	// EmptyToPathPreserve redirects to the request's path when a rule's `to` expands to an empty path
+	EmptyToPathPreserve = "preserve"
+)
+
+func validEmptyToPath(mode string) bool {
+	return mode == EmptyToPathRoot || mode == EmptyToPathPreserve
+}
+
+const (
+	// MalformedQueryBestEffort uses whichever query parameters could be parsed. This is the default
+	MalformedQueryBestEffort = "best_effort"
+	// MalformedQueryReject responds with a 400 if the query can't be parsed
+	MalformedQueryReject = "reject"
+)
+
+type MalformedQueryError struct {
+	err error
+}
+
+func (e MalformedQueryError) Error() string {
+	return fmt.Sprintf("malformed query: %s", e.err)
+}
+
+func (e MalformedQueryError) Unwrap() error {
+	return e.err
+}
+
+type PathTooLongError struct {
+	length int
+}
+
+func (e PathTooLongError) Error() string {
+	return fmt.Sprintf("path length %d exceeds max_path_length", e.length)
+}
+
+type UnexpectedBodyError struct {
+	method string
+}
+
+func (e UnexpectedBodyError) Error() string {
+	return fmt.Sprintf("%s requests can't have a body", e.method)
+}
+
+type LocationTooLongError struct {
+	length int
+	rule   string
+}
+
+func (e LocationTooLongError) Error() string {
+	return fmt.Sprintf("location length %d of rule '%s' exceeds max_location_length", e.length, e.rule)
+}
+
+const (
+	// ErrorFormatJSON sends a JSON body describing misses and errors to clients that don't ask for HTML
+	ErrorFormatJSON = "json"
+)
+
+// errorResponse is the body sent for misses and errors when JSON error responses are enabled
+type errorResponse struct {
+	Error string `json:"error"`
+	Host  string `json:"host,omitempty"`
+	Path  string `json:"path,omitempty"`
+}
+
+// wantsJSONError reports whether a miss or error should be described in a JSON body
+//
+// Browsers asking for HTML keep the empty body. Everyone else gets JSON when error_format is json, or when they ask for it
+func wantsJSONError(r *http.Request, format string) bool {
+	accept := r.Header.Get("Accept")
+	if strings.Contains(accept, "text/html") {
+		return false
+	}
+	return format == ErrorFormatJSON || strings.Contains(accept, "application/json")
+}
+
+// newErrorResponse describes err for the JSON error body
+func newErrorResponse(err error, host string, path string) errorResponse {
+	var noRuleForHostError NoRuleForHostError
+	var noMatchFoundError NoRuleForPathError
+	var selfRedirectError SelfRedirectError
+	var malformedQueryError MalformedQueryError
+	var ruleUnhealthyError RuleUnhealthyError
+	var pathTooLongError PathTooLongError
+	var locationTooLongError LocationTooLongError
+	var unexpectedBodyError UnexpectedBodyError
+	var refererLoopError RefererLoopError
+
+	e := errorResponse{Host: host, Path: path}
+	switch {
+	case errors.As(err, &noRuleForHostError):
+		e.Error = "no_rule_for_host"
+	case errors.As(err, &noMatchFoundError):
+		e.Error = "no_rule_for_path"
+	case errors.As(err, &selfRedirectError):
+		e.Error = "self_redirect"
+	case errors.As(err, &malformedQueryError):
+		e.Error = "malformed_query"
+	case errors.As(err, &ruleUnhealthyError):
+		e.Error = "rule_unhealthy"
+	case errors.As(err, &pathTooLongError):
+		e.Error = "path_too_long"
+	case errors.As(err, &locationTooLongError):
+		e.Error = "location_too_long"
+	case errors.As(err, &unexpectedBodyError):
+		e.Error = "unexpected_body"
+	case errors.As(err, &refererLoopError):
+		e.Error = "referer_loop"
+	default:
+		e.Error = "internal_error"
+	}
+	return e
+}
+
+// writeErrorStatus writes the status code for a miss or error, followed by a JSON body describing err if jsonBody is
+// set and the response isn't a redirect
+func writeErrorStatus(w http.ResponseWriter, status int, err error, host string, path string, jsonBody bool) {
+	if !jsonBody || (status >= 300 && status < 400) {
+		w.WriteHeader(status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(newErrorResponse(err, host, path))
+}
+
+// missError returns the error describing why a request for host and path didn't match a rule
+func missError(host string, path string, rules RuleMapping) error {
+	if len(matchHosts(host, rules, false)) == 0 {
+		return NoRuleForHostError{h: host}
+	}
+	return NoRuleForPathError{h: host, p: path}
+}
+
+// handleMatchError writes the miss response for a request that didn't match a rule, and caches it
+//
+// unknownPathStatus, if not 0, is the status sent for paths under a host with rules instead of the fallback redirect.
+// The response is cached for ttl seconds
+func handleMatchError(err error, w http.ResponseWriter, cache Cache, host string, path string, query string, variant string, fallback string, unknownPathStatus int, cacheControl string, ttl int64, jsonBody bool) {
 	var noRuleForHostError NoRuleForHostError
 	var noMatchFoundError NoRuleForPathError
 
@@ -29,7 +196,9 @@ func handleMatchError(err error, w http.ResponseWriter, cache Cache, host string
 		}
 	case errors.As(err, &noMatchFoundError):
 		{
-			if fallback != "" {
+			if unknownPathStatus != 0 {
+				s = unknownPathStatus
+			} else if fallback != "" {
 				s = http.StatusTemporaryRedirect
 				l = fallback
 			}
@@ -43,14 +212,19 @@ func handleMatchError(err error, w http.ResponseWriter, cache Cache, host string
 	if l != "" {
 		w.Header().Set("Location", l)
 	}
-	w.WriteHeader(s)
+	setMissCacheControl(cacheControl, w)
+	writeErrorStatus(w, s, err, host, path, jsonBody)
 
 	// TODO should this run in a goroutine?
 	_ = cache.Set(CacheSetParameters{
 		host:     host,
 		path:     path,
+		query:    query,
+		variant:  variant,
 		location: l,
 		code:     s,
+		miss:     true,
+		ttl:      ttl,
 	})
 }
 
@@ -58,11 +232,72 @@ func handleRewritePathError(err error, w http.ResponseWriter) {
 
 }
 
-func getTraceID(r *http.Request) (traceID string) {
-	// TODO this should look for headers first
+// getTraceID returns the correlation ID sent in the request's header, generating one if it wasn't sent
+func getTraceID(r *http.Request, header string) (traceID string) {
+	if id := r.Header.Get(header); id != "" {
+		return id
+	}
 	return uuid.New().String()
 }
 
+// redirectETag returns a strong ETag identifying a redirect by its Location header and status code
+func redirectETag(location string, code int) string {
+	h := fnv.New64a()
+	_, _ = fmt.Fprintf(h, "%d %s", code, location)
+	return fmt.Sprintf("\"%x\"", h.Sum64())
+}
+
+// etagMatches reports whether an If-None-Match header matches etag. If-None-Match uses weak comparison, so W/ prefixes
+// are ignored
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// writeRedirectStatus writes the status code of a redirect. If ETags are enabled, the redirect's ETag is sent and a
+// 304 is written instead when the client already has it
+func writeRedirectStatus(w http.ResponseWriter, r *http.Request, etags bool, location string, code int) {
+	if !etags {
+		w.WriteHeader(code)
+		return
+	}
+
+	etag := redirectETag(location, code)
+	w.Header().Set("ETag", etag)
+	if inm := r.Header.Get("If-None-Match"); inm != "" && etagMatches(inm, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(code)
+}
+
+// setCanonicalLink advertises the canonical URL of a redirect in a Link header
+func setCanonicalLink(canonical string, w http.ResponseWriter) {
+	if canonical == "" {
+		return
+	}
+	w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"canonical\"", canonical))
+}
+
+// setRuleHeader sets the X-Redirector-Rule header to the matched rule's ID when enabled
+func setRuleHeader(enabled bool, rule string, w http.ResponseWriter) {
+	if enabled {
+		w.Header().Set("X-Redirector-Rule", rule)
+	}
+}
+
+// setMissCacheControl sets the Cache-Control header of a miss response to the configured value, if there is one
+func setMissCacheControl(v string, w http.ResponseWriter) {
+	if v != "" {
+		w.Header().Set("Cache-Control", v)
+	}
+}
+
 func setCacheControlMaxAge(d int, r int, w http.ResponseWriter) {
 	switch r {
 	case -1:
@@ -79,107 +314,448 @@ func setCacheControlMaxAge(d int, r int, w http.ResponseWriter) {
 	}
 }
 
+// requestHost returns the host a request is matched and cached under
+func requestHost(host string, stripPrefix string) string {
+	// if port included in Host, strip it out
+	host = stripPort(host)
+	// match internationalized hostnames against their punycode form
+	if h, err := normalizeHost(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(host, ".")
+	// a host that's only the prefix is left alone, since there'd be nothing to match
+	if n := len(stripPrefix); n > 0 && len(host) > n && strings.EqualFold(host[:n], stripPrefix) {
+		host = host[n:]
+	}
+	return host
+}
+
 func handleRequest(l *slog.Logger, cache Cache, ac *AppConfig) http.Handler {
+	var group singleflight.Group
+
 	return http.HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
-			host := r.Host
-			// if port included in Host, strip it out
-			if strings.Contains(host, ":") {
-				sp := strings.Split(host, ":")
-				if len(sp) > 1 {
-					host = sp[0]
-				}
-			}
+			host := requestHost(r.Host, ac.StripHostPrefix)
 			path := r.URL.Path
-			params := r.URL.Query()
+			// normalize before matching and caching so that equivalent paths share a cache entry
+			if ac.NormalizePath {
+				path = normalizePath(path)
+			}
+			traceID := requestTraceID(r, ac.Tracing.HeaderName)
+			w.Header().Set(ac.Tracing.HeaderName, traceID)
 
-			logger := l.WithGroup("request_handler").With("host", host).With("path", path).With("correlation_id", getTraceID(r))
+			logger := l.WithGroup("request_handler").With("host", host).With("path", path).With("correlation_id", traceID)
 
-			cached, err := cache.Get(CacheGetParameters{
-				host: host,
-				path: path,
-			})
-			if err != nil {
-				logger.Warn("error from cache.Get", "err", err.Error())
+			start := time.Now()
+			matchedRule := ""
+			// only successful redirects are sampled, misses and errors are always access logged
+			redirected := false
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			w = rec
+			defer func() {
+				d := time.Since(start)
+				threshold := ac.Server.SlowRequestThreshold
+				if threshold > 0 && d > threshold {
+					logger.Warn("slow request", "method", r.Method, "duration_ms", d.Milliseconds(), "rule", matchedRule)
+				}
+				if ac.AccessLogs.Enabled && (!redirected || sampleAccessLog(traceID, ac.AccessLogs.SampleRate)) {
+					logger.Info("access", "method", r.Method, "status", rec.status, "location", w.Header().Get("Location"), "duration_ms", d.Milliseconds(), "rule", matchedRule)
+				}
+			}()
+
+			if ac.Server.ArtificialDelay > 0 {
+				delay(r.Context(), ac.Server.ArtificialDelay)
 			}
 
-			if cached != nil {
-				logger.Debug("cache hit", "location", cached.location)
-				w.Header().Set("X-Redirector-Cache-Status", "cached")
-				w.Header().Set("Location", cached.location)
-				setCacheControlMaxAge(ac.CacheControlMaxAge, cached.cacheMaxAge, w)
-				w.WriteHeader(cached.code)
+			// the server is shutting down or the connection has timed out, so there's no point in matching the request
+			if err := r.Context().Err(); err != nil {
+				logger.Debug("request cancelled before it was handled", "err", err.Error())
+				w.Header().Set("Connection", "close")
+				w.WriteHeader(http.StatusServiceUnavailable)
 				return
 			}
 
-			rule, err := findMatch(logger, host, path, ac.RuleMap)
-			if err != nil {
-				handleMatchError(
-					err,
-					w,
-					cache,
-					host,
-					path,
-					ac.LocationOnMiss)
+			// redirects never read the body, and one that's left unread can stop the connection from being reused
+			if r.ContentLength != 0 {
+				if ac.Server.RejectGETBody && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+					logger.Debug("rejecting request with a body", "method", r.Method, "content_length", r.ContentLength)
+					w.Header().Set("Connection", "close")
+					writeErrorStatus(w, http.StatusBadRequest, UnexpectedBodyError{method: r.Method}, host, path, wantsJSONError(r, ac.ErrorFormat))
+					return
+				}
+				if !drainBody(r.Body, ac.Limits.MaxDrainedBody) {
+					logger.Debug("request body exceeds max_drained_body, closing connection", "content_length", r.ContentLength, "max_drained_body", ac.Limits.MaxDrainedBody)
+					w.Header().Set("Connection", "close")
+				}
+			}
 
+			// only plaintext requests are upgraded, so the upgraded request can't be upgraded again
+			scheme := requestScheme(r, ac.Server.trustedProxies)
+			if ac.CanonicalHost != "" {
+				if location := canonicalHostURL(r, scheme, ac.CanonicalHost, ac.ForceHTTPS, ac.ruleMap()); location != "" {
+					logger.Debug("redirecting request to canonical host", "location", location)
+					w.Header().Set("Location", location)
+					w.WriteHeader(http.StatusMovedPermanently)
+					return
+				}
+			}
+			if ac.ForceHTTPS && scheme == SchemeHTTP {
+				location := httpsURL(r)
+				logger.Debug("upgrading request to https", "location", location)
+				w.Header().Set("Location", location)
+				w.WriteHeader(ac.ForceHTTPSCode)
 				return
 			}
 
-			p, err := rewritePath(path, rule.compiled, rule.To)
+			// long paths are rejected before they're matched against expressions or used as cache keys
+			if ac.Limits.MaxPathLength > 0 && len(r.URL.Path) > ac.Limits.MaxPathLength {
+				logger.Debug("path too long", "length", len(r.URL.Path), "max_path_length", ac.Limits.MaxPathLength)
+				writeErrorStatus(w, http.StatusRequestURITooLong, PathTooLongError{length: len(r.URL.Path)}, host, "", wantsJSONError(r, ac.ErrorFormat))
+				return
+			}
 
-			// There was an error turning the rules 'from' directive into the rule's 'to' directive
+			rawQuery := r.URL.RawQuery
+			// url.ParseQuery rejects `;`, so legacy separators are swapped for `&` first. Escaped semicolons are left alone
+			if ac.SemicolonQuerySeparator {
+				rawQuery = strings.ReplaceAll(rawQuery, ";", "&")
+			}
+
+			// url.ParseQuery returns whatever it could parse alongside the error, which is the same as r.URL.Query()
+			params, err := url.ParseQuery(rawQuery)
 			if err != nil {
-				// We won't cache this because it's the result of a configuration error
-				if ac.LocationOnMiss != "" {
-					w.Header().Set("Location", ac.LocationOnMiss)
+				logger.Debug("unable to parse query", "raw_query", r.URL.RawQuery, "err", err.Error())
+				if ac.MalformedQuery == MalformedQueryReject {
+					writeErrorStatus(w, http.StatusBadRequest, MalformedQueryError{err: err}, host, path, wantsJSONError(r, ac.ErrorFormat))
+					return
 				}
-				w.WriteHeader(ac.StatusOnMiss)
-				return
 			}
 
-			newParams, err := buildLocationParams(rule.Parameters.Strategy, params, rule.Parameters.Values)
-			// this doesn't need its own error handling function because we just eat these errors
+			attrs := requestAttributes{
+				language: preferredLanguage(r.Header.Get("Accept-Language")),
+				scheme:   scheme,
+				cookies:  requestCookies(r),
+				country:  ac.geoip.country(requestClientIP(r, ac.Server.trustedProxies)),
+			}
+			variant := ac.cacheVariant(host, attrs)
+
+			var queryOrder []string
+			if ac.PreserveQueryOrder {
+				queryOrder = queryKeyOrder(rawQuery)
+			}
+			// the query contributes to the Location header, so it's part of the cache key. Its parameters are sorted, unless
+			// their order is preserved, so that equivalent queries share an entry
+			query := encodeParams(params, queryOrder)
+
+			// hosts whose rules all set no_cache never have anything stored, so they don't look it up either
+			requestCache := cache
+			if ac.skipsCache(host) {
+				requestCache = &noopCache{}
+			}
+
+			cached, err := requestCache.Get(CacheGetParameters{
+				host:    host,
+				path:    path,
+				query:   query,
+				variant: variant,
+			})
 			if err != nil {
-				switch {
-				case errors.As(err, &UnknownParameterStrategyError{}):
-					logger.Warn("unknown parameter strategy", "strategy", rule.Parameters.Strategy)
-				default:
-					logger.Warn("error building location params", "err", err.Error(), "rule", rule)
+				logger.Warn("error from cache.Get", "err", err.Error())
+			}
+
+			if cached != nil {
+				logger.Debug("cache hit", "location", cached.location)
+				w.Header().Set("X-Redirector-Cache-Status", "cached")
+				location := cached.location
+				if cached.preserveRequestPort {
+					location = withPort(location, requestPort(r.Host))
+				}
+				if !cached.miss && handleRefererLoop(logger, w, r, ac, host, path, location) {
+					return
 				}
+				w.Header().Set("Location", location)
+				setCanonicalLink(cached.canonical, w)
+				redirected = !cached.miss
+				if redirected {
+					matchedRule = cached.rule
+					setRuleHeader(ac.Debug.RuleHeader || wantsRuleHeader(r), cached.rule, w)
+					setCacheControlMaxAge(ac.CacheControlMaxAge, cached.cacheMaxAge, w)
+					writeRedirectStatus(w, r, ac.Server.ETag, location, cached.code)
+					return
+				}
+				setMissCacheControl(ac.CacheControlOnMiss, w)
+				// cached misses don't record why they missed, so work it out again for the error body
+				writeErrorStatus(w, cached.code, missError(host, path, ac.ruleMap()), host, path, wantsJSONError(r, ac.ErrorFormat))
+				return
+			}
+
+			// concurrent misses for the same request share a single match computation
+			// the raw query is part of the key because it contributes to the Location header
+			// the scheme is part of the key because it's part of the original URL, for rules that preserve it
+			original := scheme + "://" + r.Host + r.URL.RequestURI()
+			key := variantKey(scheme+"://"+host+path+"?"+r.URL.RawQuery, variant)
+			v, err, shared := group.Do(key, func() (interface{}, error) {
+				return resolveRequest(logger, requestCache, host, path, query, original, attrs, variant, params, queryOrder, ac)
+			})
+			if shared {
+				logger.Debug("shared match result with concurrent requests")
 			}
 
-			location, err := buildLocationHeader(logger, rule.To, p, newParams)
 			if err != nil {
-				// an error here means we couldn't parse the 'to' directive into a URL, meaning we don't have a Location header to provide,
-				// but there _was_ a match
-				// as with errors from rewritePath(), this is likely the result of a configuration error, so we won't cache this
+				var noRuleForHostError NoRuleForHostError
+				var noMatchFoundError NoRuleForPathError
+				if errors.As(err, &noRuleForHostError) || errors.As(err, &noMatchFoundError) {
+					missCache := requestCache
+					if !ac.Cache.CacheMisses {
+						missCache = &noopCache{}
+					}
+					handleMatchError(
+						err,
+						w,
+						missCache,
+						host,
+						path,
+						query,
+						variant,
+						ac.LocationOnMiss,
+						ac.unknownPathStatus(host),
+						ac.CacheControlOnMiss,
+						ac.Cache.NegativeTTL,
+						wantsJSONError(r, ac.ErrorFormat))
+
+					return
+				}
+
+				// We won't cache this because it's the result of a configuration error
 				if ac.LocationOnMiss != "" {
 					w.Header().Set("Location", ac.LocationOnMiss)
 				}
-				w.WriteHeader(ac.StatusOnMiss)
+				setMissCacheControl(ac.CacheControlOnMiss, w)
+				writeErrorStatus(w, ac.StatusOnMiss, err, host, path, wantsJSONError(r, ac.ErrorFormat))
 				return
 			}
 
+			res := v.(resolvedRequest)
+			matchedRule = res.rule.id()
+			redirected = true
+
+			location := res.location
+			if res.rule.PreserveRequestPort {
+				location = withPort(location, requestPort(r.Host))
+			}
+			if handleRefererLoop(logger, w, r, ac, host, path, location) {
+				redirected = false
+				return
+			}
 			w.Header().Set("Location", location)
-			setCacheControlMaxAge(ac.CacheControlMaxAge, rule.CacheControlMaxAge, w)
-			w.WriteHeader(rule.Code)
-
-			err = cache.Set(CacheSetParameters{
-				host:               host,
-				path:               path,
-				location:           location,
-				code:               rule.Code,
-				cacheControlMaxAge: rule.CacheControlMaxAge,
-			})
-			if err != nil {
-				logger.Warn("error from cache.Set", "err", err.Error())
+			setCanonicalLink(res.canonical, w)
+			setRuleHeader(ac.Debug.RuleHeader || wantsRuleHeader(r), matchedRule, w)
+			if res.captures != "" {
+				w.Header().Set("X-Redirector-Captures", res.captures)
 			}
-
+			setCacheControlMaxAge(ac.CacheControlMaxAge, res.rule.CacheControlMaxAge, w)
+			writeRedirectStatus(w, r, ac.Server.ETag, location, res.rule.Code)
 		},
 	)
 }
 
-func buildLocationHeader(l *slog.Logger, to string, path string, params url.Values) (string, error) {
+// delay waits for d, or until ctx is done
+func delay(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
+
+// drainBody reads and discards up to max bytes of body, reporting whether that was all of it
+func drainBody(body io.Reader, max int64) bool {
+	n, err := io.Copy(io.Discard, io.LimitReader(body, max+1))
+	return err == nil && n <= max
+}
+
+// resolvedRequest is the result of matching a request against the configured rules
+type resolvedRequest struct {
+	rule      Rule
+	location  string
+	canonical string
+	// captures are the rule's named capture groups and their values, when debug.captures_header is set
+	captures string
+}
+
+// resolveRequest finds the rule matching the request, builds the Location header, and caches the result
+//
+// Errors from matchRequest are returned as-is so that they can be handled by handleMatchError. Any other error is the
+// result of a configuration error and should not be cached
+//
+// query is the request's query as it's cached, and queryOrder is the order the Location header's query parameters are
+// encoded in. If it's empty, they're sorted
+func resolveRequest(logger *slog.Logger, cache Cache, host string, path string, query string, original string, attrs requestAttributes, variant string, params url.Values, queryOrder []string, ac *AppConfig) (resolvedRequest, error) {
+	// the match is found once and its submatches are reused to expand the rule's directives
+	match, err := matchRequest(logger, host, path, attrs, variant, ac)
+	if err != nil {
+		return resolvedRequest{}, err
+	}
+	// cookies are filled in first, so that the result is expanded like any other `to`
+	match.rule.To = match.rule.expandCookies(match.rule.To, attrs.cookies)
+	rule := match.rule
+
+	// to_fallback replaces `to` when the rule is unhealthy or `to` can't be expanded, before falling back to the miss response
+	fallback := match
+	fallback.rule.To = rule.expandCookies(rule.ToFallback, attrs.cookies)
+	usingFallback := false
+
+	// health is tracked per host bucket, which isn't the request's host for rules matched through a wildcard host
+	if rule.Healthcheck != nil && !ruleHealth.healthy(match.host, rule) {
+		if rule.ToFallback == "" {
+			logger.Warn("matched rule is unhealthy, using miss response", "rule", rule.id(), "healthcheck", rule.Healthcheck.URL)
+			return resolvedRequest{}, RuleUnhealthyError{rule.Healthcheck.URL}
+		}
+		logger.Warn("matched rule is unhealthy, using to_fallback", "rule", rule.id(), "healthcheck", rule.Healthcheck.URL)
+		match = fallback
+		rule = match.rule
+		usingFallback = true
+	}
+
+	p, err := rewriteRulePath(path, match)
+	if err != nil && !usingFallback && rule.ToFallback != "" {
+		logger.Warn("unable to expand to directive, using to_fallback", "rule", rule.id(), "err", err.Error())
+		match = fallback
+		rule = match.rule
+		p, err = rewriteRulePath(path, match)
+	}
+	// There was an error turning the rules 'from' directive into the rule's 'to' directive
+	if err != nil {
+		return resolvedRequest{}, err
+	}
+	// a `to` without a path, e.g. `https://example.com`, expands to an empty path, which buildLocationHeader sends as `/`
+	if p == "" && ac.EmptyToPath == EmptyToPathPreserve {
+		p = path
+	}
+
+	// only the path is lowercased, the host and query are left alone
+	if rule.LowercasePath {
+		p = strings.ToLower(p)
+	}
+
+	if rule.relative() {
+		p = ac.Server.BasePath + p
+	}
+
+	// drop request parameters that the rule doesn't allow before its strategy is applied
+	if rule.AllowQuery != nil {
+		params = filterParams(params, rule.AllowQuery)
+	}
+	params = dedupParams(params, ac.QueryDedup)
+
+	newParams, err := buildLocationParams(rule.Parameters.strategy(), params, rule.Parameters.Values)
+	// this doesn't need its own error handling function because we just eat these errors
+	if err != nil {
+		switch {
+		case errors.As(err, &UnknownParameterStrategyError{}):
+			logger.Warn("unknown parameter strategy", "strategy", rule.Parameters.Strategy)
+		default:
+			logger.Warn("error building location params", "err", err.Error(), "rule", rule)
+		}
+	}
+
+	// the original URL is added after the rule's strategy is applied, replacing any parameter with the same name
+	if rule.PreserveOriginalAs != "" {
+		newParams.Del(rule.PreserveOriginalAs)
+	}
+
+	location, err := buildLocationHeader(logger, rule.To, p, newParams, queryOrder)
+	if err != nil {
+		// an error here means we couldn't parse the 'to' directive into a URL, meaning we don't have a Location header to provide,
+		// but there _was_ a match
+		// as with errors from rewritePath(), this is likely the result of a configuration error, so we won't cache this
+		return resolvedRequest{}, err
+	}
+	if rule.PreserveOriginalAs != "" {
+		location = appendQueryParam(location, rule.PreserveOriginalAs, original)
+	}
+
+	// captures can be repeated in `to`, so a long path can expand into a much longer location
+	if maxLength := ac.Limits.MaxLocationLength; maxLength > 0 && len(location) > maxLength {
+		logger.Warn("location exceeds max_location_length, using miss response", "rule", rule.id(), "length", len(location), "max_location_length", maxLength)
+		// as with other configuration errors, we won't cache this
+		return resolvedRequest{}, LocationTooLongError{length: len(location), rule: rule.id()}
+	}
+
+	if isSelfRedirect(host, path, params, location) {
+		logger.Warn("rule redirects request to itself", "location", location, "rule", rule.From)
+		selfRedirectMetric.With(prometheus.Labels{"host": host}).Inc()
+		if ac.MissOnSelfRedirect {
+			// as with other configuration errors, we won't cache this
+			return resolvedRequest{}, SelfRedirectError{location}
+		}
+	}
+
+	canonical := expandCanonical(path, match)
+	captures := ""
+	if ac.Debug.CapturesHeader {
+		captures = namedCaptures(path, match)
+	}
+
+	// rules with a health check aren't cached, otherwise a cached location would outlive the destination's health.
+	// Neither are rules that won a tie at random, otherwise every later request would go to the same rule, nor rules
+	// that preserve the original URL, since it differs between requests that share a cache entry, nor rules that aren't
+	// cacheable
+	if rule.Healthcheck != nil || match.tied || rule.PreserveOriginalAs != "" || rule.uncacheable {
+		return resolvedRequest{rule: rule, location: location, canonical: canonical, captures: captures}, nil
+	}
+
+	err = cache.Set(CacheSetParameters{
+		host:               host,
+		path:               path,
+		query:              query,
+		variant:            variant,
+		location:           location,
+		canonical:          canonical,
+		code:               rule.Code,
+		cacheControlMaxAge: rule.CacheControlMaxAge,
+		// the port is added when responding, otherwise requests on different ports would share a location
+		preserveRequestPort: rule.PreserveRequestPort,
+		rule:                rule.id(),
+	})
+	if err != nil {
+		logger.Warn("error from cache.Set", "err", err.Error())
+	}
+
+	return resolvedRequest{rule: rule, location: location, canonical: canonical, captures: captures}, nil
+}
+
+// isSelfRedirect reports whether location points at the same host, path, and query as the request, regardless of scheme.
+// A relative location points at the request's host
+func isSelfRedirect(host string, path string, params url.Values, location string) bool {
+	u, err := url.Parse(location)
+	if err != nil {
+		return false
+	}
+
+	return (u.Host == "" || u.Hostname() == host) && u.Path == path && u.Query().Encode() == params.Encode()
+}
+
+// withPort adds port to the host in location, unless location already has a port or port is empty
+func withPort(location string, port string) string {
+	if port == "" {
+		return location
+	}
+
+	u, err := url.Parse(location)
+	if err != nil || u.Host == "" || u.Port() != "" {
+		return location
+	}
+
+	// splice the port in rather than re-encoding the whole location
+	prefix := u.Scheme + "://" + u.Host
+	if !strings.HasPrefix(location, prefix) {
+		return location
+	}
+	return prefix + ":" + port + location[len(prefix):]
+}
+
+func buildLocationHeader(l *slog.Logger, to string, path string, params url.Values, order []string) (string, error) {
 	parsed, err := url.Parse(to)
 	logger := l
 
@@ -188,11 +764,16 @@ func buildLocationHeader(l *slog.Logger, to string, path string, params url.Valu
 		return "", err
 	}
 
+	// some clients mishandle a Location without a path
+	if path == "" {
+		path = "/"
+	}
+
 	location := url.URL{
 		Scheme:   parsed.Scheme,
 		Host:     parsed.Host,
 		Path:     path,
-		RawQuery: params.Encode(),
+		RawQuery: encodeParams(params, order),
 	}
 
 	return location.String(), nil
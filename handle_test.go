@@ -3,11 +3,18 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -87,7 +94,7 @@ func TestCacheFunctionality(t *testing.T) {
 
 	handleRequest(logger, cache, cfg).ServeHTTP(w, req)
 
-	params := CacheGetParameters{req.Host, req.URL.Path}
+	params := CacheGetParameters{host: req.Host, path: req.URL.Path, query: req.URL.Query().Encode()}
 	cached, _ := cache.Get(params)
 	assert.NotNil(t, cached)
 
@@ -143,6 +150,827 @@ func TestPortInToDirective(t *testing.T) {
 	assert.Equal(t, expected.Path, resp.Path)
 }
 
+func TestPreserveRequestPort(t *testing.T) {
+	t.Parallel()
+
+	logger := newTestLogger()
+	cfg, _ := loadConfig(logger, "./fixtures/rules.yml")
+	cache := NewInMemoryCache(t.Context(), logger, cfg.Cache.CleanupInterval, cfg.Cache.TTL)
+
+	var testCases = []struct {
+		name     string
+		url      string
+		wantHost string
+	}{
+		{name: "request port added", url: "http://localhost:8443/preserve-port", wantHost: "demo.localhost.com:8443"},
+		// the first request cached the location, a request on another port must not reuse that port
+		{name: "cached location uses the request port", url: "http://localhost:9443/preserve-port", wantHost: "demo.localhost.com:9443"},
+		{name: "no request port", url: "http://localhost/preserve-port", wantHost: "demo.localhost.com"},
+		{name: "port in to directive wins", url: "http://localhost:8443/to-port-preserved", wantHost: "demo.localhost.com:8080"},
+		{name: "option unset", url: "http://localhost:8443/port", wantHost: "demo.localhost.com:8080"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", testCase.url, nil)
+			w := httptest.NewRecorder()
+			handleRequest(logger, cache, cfg).ServeHTTP(w, req)
+
+			resp, _ := url.Parse(w.Header().Get("Location"))
+			assert.Equal(t, defaultStatusCode, w.Code)
+			assert.Equal(t, testCase.wantHost, resp.Host)
+			assert.Equal(t, "/foo", resp.Path)
+		})
+	}
+}
+
+func TestNormalizePath(t *testing.T) {
+	t.Parallel()
+
+	logger := newTestLogger()
+	cfg, _ := loadConfig(logger, "./fixtures/rules.yml")
+	cfg.NormalizePath = true
+	cache := NewInMemoryCache(t.Context(), logger, cfg.Cache.CleanupInterval, cfg.Cache.TTL)
+	handler := handleRequest(logger, cache, cfg)
+
+	// every path normalizes to /foo, so only the first request misses the cache
+	for i, p := range []string{"/foo", "//foo", "/./foo", "/bar/../foo", "/../foo"} {
+		req := httptest.NewRequest("GET", "http://localhost"+p, nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		assert.Equal(t, defaultStatusCode, w.Code, p)
+		if i > 0 {
+			assert.Equal(t, "cached", w.Header().Get("X-Redirector-Cache-Status"), p)
+		}
+	}
+}
+
+func TestLowercasePath(t *testing.T) {
+	t.Parallel()
+
+	logger := newTestLogger()
+	cfg, _ := loadConfig(logger, "./fixtures/rules.yml")
+
+	req := httptest.NewRequest("GET", "http://localhost/cms/Hello-World?Page=2", nil)
+	w := httptest.NewRecorder()
+	handleRequest(logger, &spyCache{}, cfg).ServeHTTP(w, req)
+
+	resp, _ := url.Parse(w.Header().Get("Location"))
+	assert.Equal(t, defaultStatusCode, w.Code)
+	assert.Equal(t, "demo.localhost.com", resp.Host)
+	assert.Equal(t, "/articles/hello-world", resp.Path)
+	assert.Equal(t, url.Values{"Page": {"2"}, "Ref": {"Redirector"}}, resp.Query())
+}
+
+func TestCanonicalLink(t *testing.T) {
+	t.Parallel()
+
+	logger := newTestLogger()
+	cfg, _ := loadConfig(logger, "./fixtures/rules.yml")
+	cache := NewInMemoryCache(t.Context(), logger, cfg.Cache.CleanupInterval, cfg.Cache.TTL)
+	handler := handleRequest(logger, cache, cfg)
+
+	// the second request is served from the cache and should replay the header
+	for _, wantCacheStatus := range []string{"", "cached"} {
+		req := httptest.NewRequest("GET", "http://localhost/docs/getting-started", nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		assert.Equal(t, defaultStatusCode, w.Code)
+		assert.Equal(t, wantCacheStatus, w.Header().Get("X-Redirector-Cache-Status"))
+		assert.Equal(t, "https://demo.localhost.com/docs/getting-started", w.Header().Get("Location"))
+		assert.Equal(t, `<https://www.example.com/docs/getting-started>; rel="canonical"`, w.Header().Get("Link"))
+	}
+
+	// rules without a canonical URL don't send the header
+	req := httptest.NewRequest("GET", "http://localhost/foo", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Empty(t, w.Header().Get("Link"))
+}
+
+func TestToFallback(t *testing.T) {
+	t.Parallel()
+
+	logger := newTestLogger()
+	cfg, _ := loadConfig(logger, "./fixtures/rules.yml")
+
+	var testCases = []struct {
+		name         string
+		url          string
+		wantCode     int
+		wantLocation string
+	}{
+		{name: "to", url: "http://localhost/expand/foo", wantCode: defaultStatusCode, wantLocation: "https://demo.localhost.com/new/foo"},
+		// a lone % in the capture can't be expanded into a valid URL
+		{name: "to_fallback", url: "http://localhost/expand/100%25", wantCode: defaultStatusCode, wantLocation: "https://demo.localhost.com/fallback"},
+		{name: "location_on_miss", url: "http://localhost/expand-no-fallback/100%25", wantCode: cfg.StatusOnMiss, wantLocation: cfg.LocationOnMiss},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", testCase.url, nil)
+			w := httptest.NewRecorder()
+			handleRequest(logger, &spyCache{}, cfg).ServeHTTP(w, req)
+
+			assert.Equal(t, testCase.wantCode, w.Code)
+			assert.Equal(t, testCase.wantLocation, w.Header().Get("Location"))
+		})
+	}
+}
+
+func TestETag(t *testing.T) {
+	t.Parallel()
+
+	logger := newTestLogger()
+	cfg, _ := loadConfig(logger, "./fixtures/rules.yml")
+	cfg.Server.ETag = true
+	cache := NewInMemoryCache(t.Context(), logger, cfg.Cache.CleanupInterval, cfg.Cache.TTL)
+	handler := handleRequest(logger, cache, cfg)
+	etag := redirectETag("https://example.com/", defaultStatusCode)
+
+	var testCases = []struct {
+		name        string
+		ifNoneMatch string
+		wantCode    int
+	}{
+		{name: "no If-None-Match", wantCode: defaultStatusCode},
+		{name: "matching", ifNoneMatch: etag, wantCode: http.StatusNotModified},
+		{name: "weak match", ifNoneMatch: `"abc", W/` + etag, wantCode: http.StatusNotModified},
+		{name: "wildcard", ifNoneMatch: "*", wantCode: http.StatusNotModified},
+		{name: "changed", ifNoneMatch: `"abc"`, wantCode: defaultStatusCode},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			// the first request is resolved, the second is served from the cache
+			for range 2 {
+				req := httptest.NewRequest("GET", "http://localhost/foo", nil)
+				if testCase.ifNoneMatch != "" {
+					req.Header.Set("If-None-Match", testCase.ifNoneMatch)
+				}
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, req)
+
+				assert.Equal(t, testCase.wantCode, w.Code)
+				assert.Equal(t, etag, w.Header().Get("ETag"))
+			}
+		})
+	}
+
+	// ETags change with the Location header
+	assert.NotEqual(t, etag, redirectETag("https://example.com/other", defaultStatusCode))
+	assert.NotEqual(t, etag, redirectETag("https://example.com", http.StatusFound))
+}
+
+func TestETagDisabled(t *testing.T) {
+	t.Parallel()
+
+	logger := newTestLogger()
+	cfg, _ := loadConfig(logger, "./fixtures/rules.yml")
+
+	req := httptest.NewRequest("GET", "http://localhost/foo", nil)
+	req.Header.Set("If-None-Match", "*")
+	w := httptest.NewRecorder()
+	handleRequest(logger, &spyCache{}, cfg).ServeHTTP(w, req)
+
+	assert.Equal(t, defaultStatusCode, w.Code)
+	assert.Empty(t, w.Header().Get("ETag"))
+}
+
+func TestMaxPathLength(t *testing.T) {
+	t.Parallel()
+
+	logger := newTestLogger()
+	cfg, _ := loadConfig(logger, "./fixtures/rules.yml")
+	assert.Equal(t, defaultMaxPathLength, cfg.Limits.MaxPathLength)
+	cfg.Limits.MaxPathLength = 64
+
+	var testCases = []struct {
+		name     string
+		path     string
+		wantCode int
+	}{
+		{name: "within limit", path: "/foo", wantCode: defaultStatusCode},
+		{name: "at limit", path: "/foo/" + strings.Repeat("a", 59), wantCode: defaultStatusCode},
+		{name: "over limit", path: "/foo/" + strings.Repeat("a", 60), wantCode: http.StatusRequestURITooLong},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			cache := &spyCache{}
+			req := httptest.NewRequest("GET", "http://localhost"+testCase.path, nil)
+			w := httptest.NewRecorder()
+			handleRequest(logger, cache, cfg).ServeHTTP(w, req)
+
+			assert.Equal(t, testCase.wantCode, w.Code)
+			if testCase.wantCode == http.StatusRequestURITooLong {
+				assert.Equal(t, 0, cache.gets)
+				assert.Equal(t, 0, cache.sets)
+			}
+		})
+	}
+}
+
+func TestMaxLocationLength(t *testing.T) {
+	logger := newTestLogger()
+	cfg, err := parseConfig(logger, []byte(`
+location_on_miss: 'https://example.com/missing'
+status_on_miss: 302
+limits:
+  max_location_length: 64
+rules:
+  - name: 'repeated'
+    from: 'example.com/r/(.*)'
+    to: 'https://foo.com/$1$1$1$1'
+`))
+	assert.NoError(t, err)
+
+	var testCases = []struct {
+		name         string
+		path         string
+		wantCode     int
+		wantLocation string
+	}{
+		// https://foo.com/ is 16 bytes, leaving 48 for the four captures
+		{name: "at limit", path: "/r/" + strings.Repeat("a", 12), wantCode: defaultStatusCode, wantLocation: "https://foo.com/" + strings.Repeat("a", 48)},
+		{name: "over limit", path: "/r/" + strings.Repeat("a", 13), wantCode: http.StatusFound, wantLocation: "https://example.com/missing"},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			cache := &spyCache{}
+			req := httptest.NewRequest("GET", "http://example.com"+testCase.path, nil)
+			w := httptest.NewRecorder()
+			handleRequest(logger, cache, cfg).ServeHTTP(w, req)
+
+			assert.Equal(t, testCase.wantCode, w.Code)
+			assert.Equal(t, testCase.wantLocation, w.Header().Get("Location"))
+			if testCase.wantCode != defaultStatusCode {
+				assert.Equal(t, 0, cache.sets)
+			}
+		})
+	}
+
+	// misses describe why in their JSON body
+	cfg.StatusOnMiss = http.StatusNotFound
+	cfg.LocationOnMiss = ""
+	req := httptest.NewRequest("GET", "http://example.com/r/"+strings.Repeat("a", 13), nil)
+	req.Header.Set("Accept", "application/json")
+	w := httptest.NewRecorder()
+	handleRequest(logger, &spyCache{}, cfg).ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Body.String(), `"error":"location_too_long"`)
+}
+
+func TestCacheControlOnMiss(t *testing.T) {
+	logger := newTestLogger()
+
+	tests := []struct {
+		name   string
+		config string
+		url    string
+		want   string
+	}{
+		{
+			name:   "no rule for host defaults to no-store",
+			config: "rules: [{from: 'example.com/foo', to: 'https://foo.com/'}]",
+			url:    "http://other.example.com/foo",
+			want:   "no-store",
+		},
+		{
+			name:   "no rule for path defaults to no-store",
+			config: "rules: [{from: 'example.com/foo', to: 'https://foo.com/'}]",
+			url:    "http://example.com/bar",
+			want:   "no-store",
+		},
+		{
+			name:   "configured for fallback redirects",
+			config: "location_on_miss: 'https://status.example.com/'\ncache_control_on_miss: 'max-age=60'\nrules: [{from: 'example.com/foo', to: 'https://foo.com/'}]",
+			url:    "http://example.com/bar",
+			want:   "max-age=60",
+		},
+		{
+			name:   "disabled",
+			config: "cache_control_on_miss: ''\nrules: [{from: 'example.com/foo', to: 'https://foo.com/'}]",
+			url:    "http://example.com/bar",
+			want:   "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := parseConfig(logger, []byte(tt.config))
+			assert.NoError(t, err)
+			handler := handleRequest(logger, NewInMemoryCache(t.Context(), logger, 3600, 3600), cfg)
+
+			// the second request is served from the cache
+			for range 2 {
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, httptest.NewRequest("GET", tt.url, nil))
+				assert.Equal(t, tt.want, w.Header().Get("Cache-Control"))
+			}
+
+			// redirects still use cache_control_max_age
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/foo", nil))
+			assert.Equal(t, fmt.Sprintf("max-age=%d", defaultCacheControlMaxAge), w.Header().Get("Cache-Control"))
+		})
+	}
+}
+
+func TestRuleHeader(t *testing.T) {
+	logger := newTestLogger()
+
+	cfg, err := parseConfig(logger, []byte(`
+debug:
+  rule_header: true
+rules:
+  - name: 'named'
+    from: 'example.com/named'
+    to: 'https://foo.com/'
+  - from: 'example.com/unnamed'
+    to: 'https://foo.com/'
+`))
+	assert.NoError(t, err)
+	handler := handleRequest(logger, NewInMemoryCache(t.Context(), logger, 3600, 3600), cfg)
+
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{url: "http://example.com/named", want: "named"},
+		{url: "http://example.com/unnamed", want: "example.com/unnamed"},
+		// misses didn't match a rule
+		{url: "http://example.com/missing", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			// the second request is served from the cache
+			for _, cacheStatus := range []string{"", "cached"} {
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, httptest.NewRequest("GET", tt.url, nil))
+				assert.Equal(t, cacheStatus, w.Header().Get("X-Redirector-Cache-Status"))
+				assert.Equal(t, tt.want, w.Header().Get("X-Redirector-Rule"))
+			}
+		})
+	}
+
+	// the header is off by default
+	cfg.Debug.RuleHeader = false
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/named", nil))
+	assert.Empty(t, w.Header().Get("X-Redirector-Rule"))
+}
+
+func TestTieBreakNotCached(t *testing.T) {
+	logger := newTestLogger()
+
+	cfg, err := parseConfig(logger, []byte(`
+tie_break: 'random'
+rules:
+  - from: 'example.com/experiment'
+    to: 'https://a.example.com/'
+  - from: 'example.com/experiment'
+    to: 'https://b.example.com/'
+  - from: 'example.com/other'
+    to: 'https://other.example.com/'
+`))
+	assert.NoError(t, err)
+	cache := &spyCache{}
+	handler := handleRequest(logger, cache, cfg)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/experiment", nil))
+	assert.Equal(t, defaultStatusCode, w.Code)
+	assert.Equal(t, 0, cache.sets)
+
+	// rules without a tie are still cached
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/other", nil))
+	assert.Equal(t, 1, cache.sets)
+}
+
+func TestPreserveQueryOrder(t *testing.T) {
+	logger := newTestLogger()
+
+	tests := []struct {
+		name   string
+		config string
+		want   string
+	}{
+		{name: "sorted by default", config: "", want: "https://foo.com/?alpha=2&lang=en&mid=3&zeta=1"},
+		{name: "preserved", config: "preserve_query_order: true", want: "https://foo.com/?zeta=1&alpha=2&mid=3&lang=en"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := parseConfig(logger, []byte(tt.config+`
+rules:
+  - from: 'example.com/foo'
+    to: 'https://foo.com/'
+    parameters:
+      strategy: 'combine'
+      values:
+        lang: ['en']
+`))
+			assert.NoError(t, err)
+
+			w := httptest.NewRecorder()
+			handleRequest(logger, &spyCache{}, cfg).ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/foo?zeta=1&alpha=2&mid=3", nil))
+			assert.Equal(t, tt.want, w.Header().Get("Location"))
+		})
+	}
+}
+
+func TestMatchLanguage(t *testing.T) {
+	logger := newTestLogger()
+
+	cfg, err := parseConfig(logger, []byte(`
+rules:
+  - from: 'example.com/docs'
+    to: 'https://example.fr/docs'
+    match_language: ['FR']
+  - from: 'example.com/docs'
+    to: 'https://example.de/docs'
+    match_language: ['de-AT', 'de-CH']
+  - from: 'example.com/docs'
+    to: 'https://example.com/en/docs'
+  - from: 'example.com/fr-only'
+    to: 'https://example.fr/'
+    match_language: ['fr']
+`))
+	assert.NoError(t, err)
+	handler := handleRequest(logger, NewInMemoryCache(t.Context(), logger, 3600, 3600), cfg)
+
+	tests := []struct {
+		name           string
+		path           string
+		acceptLanguage string
+		wantCode       int
+		wantLocation   string
+	}{
+		{name: "no header", path: "/docs", wantCode: defaultStatusCode, wantLocation: "https://example.com/en/docs"},
+		{name: "language", path: "/docs", acceptLanguage: "fr", wantCode: defaultStatusCode, wantLocation: "https://example.fr/docs"},
+		{name: "region matches language", path: "/docs", acceptLanguage: "fr-CA", wantCode: defaultStatusCode, wantLocation: "https://example.fr/docs"},
+		{name: "region", path: "/docs", acceptLanguage: "de-at", wantCode: defaultStatusCode, wantLocation: "https://example.de/docs"},
+		{name: "other region", path: "/docs", acceptLanguage: "de-DE", wantCode: defaultStatusCode, wantLocation: "https://example.com/en/docs"},
+		{name: "highest quality", path: "/docs", acceptLanguage: "en;q=0.5, fr;q=0.9, de-AT;q=0.7", wantCode: defaultStatusCode, wantLocation: "https://example.fr/docs"},
+		{name: "first of equal quality", path: "/docs", acceptLanguage: "de-CH, fr", wantCode: defaultStatusCode, wantLocation: "https://example.de/docs"},
+		{name: "wildcard", path: "/docs", acceptLanguage: "*", wantCode: defaultStatusCode, wantLocation: "https://example.com/en/docs"},
+		{name: "unwanted language", path: "/docs", acceptLanguage: "fr;q=0, en", wantCode: defaultStatusCode, wantLocation: "https://example.com/en/docs"},
+		{name: "only rule matches", path: "/fr-only", acceptLanguage: "fr-FR,fr;q=0.9", wantCode: defaultStatusCode, wantLocation: "https://example.fr/"},
+		{name: "only rule without header", path: "/fr-only", wantCode: http.StatusNotFound},
+		{name: "only rule other language", path: "/fr-only", acceptLanguage: "en-GB", wantCode: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the repeated request is served from the cache, which must keep languages apart
+			for i := 0; i < 2; i++ {
+				req := httptest.NewRequest("GET", "http://example.com"+tt.path, nil)
+				if tt.acceptLanguage != "" {
+					req.Header.Set("Accept-Language", tt.acceptLanguage)
+				}
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, req)
+				if i > 0 {
+					assert.Equal(t, "cached", w.Header().Get("X-Redirector-Cache-Status"))
+				}
+				assert.Equal(t, tt.wantCode, w.Code)
+				assert.Equal(t, tt.wantLocation, w.Header().Get("Location"))
+			}
+		})
+	}
+}
+
+func TestMatchLanguageCacheKey(t *testing.T) {
+	logger := newTestLogger()
+
+	cfg, err := parseConfig(logger, []byte(`
+rules:
+  - from: 'example.com/docs'
+    to: 'https://example.fr/docs'
+    match_language: ['fr']
+  - from: 'other.com/docs'
+    to: 'https://other.com/en/docs'
+`))
+	assert.NoError(t, err)
+	cache := NewInMemoryCache(t.Context(), logger, 3600, 3600)
+	handler := handleRequest(logger, cache, cfg)
+
+	req := httptest.NewRequest("GET", "http://example.com/docs", nil)
+	req.Header.Set("Accept-Language", "fr-FR")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	req = httptest.NewRequest("GET", "http://other.com/docs", nil)
+	req.Header.Set("Accept-Language", "fr-FR")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	// the variant is the configured language that matched, not the client's tag
+	got, _ := cache.Get(CacheGetParameters{host: "example.com", path: "/docs", variant: "lang=fr"})
+	if assert.NotNil(t, got) {
+		assert.Equal(t, "https://example.fr/docs", got.location)
+	}
+	got, _ = cache.Get(CacheGetParameters{host: "example.com", path: "/docs"})
+	assert.Nil(t, got)
+
+	// other tags that match the same languages share the entry, and tags that match none share another
+	for _, lang := range []string{"fr-x-random", "fr-CA", "en", "de-x-random"} {
+		req = httptest.NewRequest("GET", "http://example.com/docs", nil)
+		req.Header.Set("Accept-Language", lang)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	stats, _ := cache.Stats()
+	assert.Equal(t, []CacheHostStats{{Host: "example.com", Entries: 2}, {Host: "other.com", Entries: 1}}, stats.Hosts)
+
+	// hosts without language rules share one entry between languages
+	got, _ = cache.Get(CacheGetParameters{host: "other.com", path: "/docs"})
+	assert.NotNil(t, got)
+}
+
+func TestMatchScheme(t *testing.T) {
+	logger := newTestLogger()
+
+	cfg, err := parseConfig(logger, []byte(`
+server:
+  trusted_proxies: ['10.0.0.0/8']
+rules:
+  - from: 'example.com/foo'
+    to: 'https://example.com/foo'
+    match_scheme: 'HTTP'
+  - from: 'example.com/foo'
+    to: 'https://example.com/bar'
+`))
+	assert.NoError(t, err)
+	handler := handleRequest(logger, NewInMemoryCache(t.Context(), logger, 3600, 3600), cfg)
+
+	tests := []struct {
+		name           string
+		remoteAddr     string
+		tls            bool
+		forwardedProto string
+		want           string
+	}{
+		{name: "http", want: "https://example.com/foo"},
+		{name: "https", tls: true, want: "https://example.com/bar"},
+		{name: "https behind trusted proxy", remoteAddr: "10.0.0.1:1234", forwardedProto: "https", want: "https://example.com/bar"},
+		{name: "http behind trusted proxy", remoteAddr: "10.0.0.1:1234", tls: true, forwardedProto: "http", want: "https://example.com/foo"},
+		{name: "untrusted proxy", remoteAddr: "192.0.2.1:1234", forwardedProto: "https", want: "https://example.com/foo"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the repeated request is served from the cache, which must keep schemes apart
+			for range 2 {
+				req := httptest.NewRequest("GET", "http://example.com/foo", nil)
+				if tt.remoteAddr != "" {
+					req.RemoteAddr = tt.remoteAddr
+				}
+				if tt.tls {
+					req.TLS = &tls.ConnectionState{}
+				}
+				if tt.forwardedProto != "" {
+					req.Header.Set("X-Forwarded-Proto", tt.forwardedProto)
+				}
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, req)
+				assert.Equal(t, defaultStatusCode, w.Code)
+				assert.Equal(t, tt.want, w.Header().Get("Location"))
+			}
+		})
+	}
+
+	// rules with an unknown scheme aren't loaded
+	cfg, err = parseConfig(logger, []byte(`
+rules:
+  - from: 'example.com/foo'
+    to: 'https://example.com/foo'
+    match_scheme: 'ftp'
+`))
+	assert.NoError(t, err)
+	assert.Empty(t, cfg.RuleMap["example.com"])
+}
+
+func TestForceHTTPS(t *testing.T) {
+	logger := newTestLogger()
+
+	cfg, err := parseConfig(logger, []byte(`
+force_https: true
+rules:
+  - from: 'example.com/foo'
+    to: 'https://foo.com/'
+`))
+	assert.NoError(t, err)
+	cache := &spyCache{}
+	handler := handleRequest(logger, cache, cfg)
+
+	// http requests are upgraded before they're matched, even if no rule would match them
+	for _, target := range []string{"http://example.com/foo?a=b", "http://example.com:8080/missing", "http://other.com/"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		assert.Equal(t, http.StatusMovedPermanently, w.Code)
+		assert.Equal(t, "https"+strings.TrimPrefix(strings.Replace(target, ":8080", "", 1), "http"), w.Header().Get("Location"))
+	}
+	assert.Equal(t, 0, cache.sets)
+
+	// https requests are matched against the rules as usual
+	req := httptest.NewRequest("GET", "https://example.com/foo", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, defaultStatusCode, w.Code)
+	assert.Equal(t, "https://foo.com/", w.Header().Get("Location"))
+}
+
+func TestForceHTTPSCode(t *testing.T) {
+	logger := newTestLogger()
+
+	tests := []struct {
+		name     string
+		config   string
+		wantCode int
+	}{
+		{name: "default", config: "", wantCode: http.StatusMovedPermanently},
+		{name: "configured", config: "force_https_code: 308\n", wantCode: http.StatusPermanentRedirect},
+		{name: "not a redirect", config: "force_https_code: 200\n", wantCode: http.StatusMovedPermanently},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := parseConfig(logger, []byte("force_https: true\n"+tt.config))
+			assert.NoError(t, err)
+
+			w := httptest.NewRecorder()
+			handleRequest(logger, &spyCache{}, cfg).ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/foo", nil))
+			assert.Equal(t, tt.wantCode, w.Code)
+			assert.Equal(t, "https://example.com/foo", w.Header().Get("Location"))
+		})
+	}
+}
+
+func TestForceHTTPSBehindProxy(t *testing.T) {
+	logger := newTestLogger()
+
+	cfg, err := parseConfig(logger, []byte(`
+force_https: true
+server:
+  trusted_proxies: ['10.0.0.0/8']
+rules:
+  - from: 'example.com/foo'
+    to: 'https://foo.com/'
+`))
+	assert.NoError(t, err)
+	handler := handleRequest(logger, &spyCache{}, cfg)
+
+	tests := []struct {
+		name           string
+		remoteAddr     string
+		forwardedProto string
+		wantLocation   string
+	}{
+		// the proxy terminated TLS, so upgrading would loop
+		{name: "https at the proxy", remoteAddr: "10.0.0.1:1234", forwardedProto: "https", wantLocation: "https://foo.com/"},
+		{name: "http at the proxy", remoteAddr: "10.0.0.1:1234", forwardedProto: "http", wantLocation: "https://example.com/foo"},
+		{name: "untrusted client", remoteAddr: "192.0.2.1:1234", forwardedProto: "https", wantLocation: "https://example.com/foo"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://example.com/foo", nil)
+			req.RemoteAddr = tt.remoteAddr
+			req.Header.Set("X-Forwarded-Proto", tt.forwardedProto)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			assert.Equal(t, tt.wantLocation, w.Header().Get("Location"))
+
+			// following the upgrade reaches the rules rather than being upgraded again
+			if tt.wantLocation == "https://example.com/foo" {
+				req = httptest.NewRequest("GET", tt.wantLocation, nil)
+				w = httptest.NewRecorder()
+				handler.ServeHTTP(w, req)
+				assert.Equal(t, "https://foo.com/", w.Header().Get("Location"))
+			}
+		})
+	}
+}
+
+func TestPreserveOriginalAs(t *testing.T) {
+	logger := newTestLogger()
+
+	cfg, err := parseConfig(logger, []byte(`
+rules:
+  - from: 'example.com/combine'
+    to: 'https://foo.com/landing'
+    preserve_original_as: 'from'
+    parameters:
+      strategy: 'combine'
+      values:
+        utm_source: ['redirector']
+  - from: 'example.com/replace'
+    to: 'https://foo.com/landing?from=ignored'
+    preserve_original_as: 'from'
+    parameters:
+      strategy: 'replace'
+      values:
+        from: ['rule']
+`))
+	assert.NoError(t, err)
+	cache := &spyCache{}
+	handler := handleRequest(logger, cache, cfg)
+
+	tests := []struct {
+		name         string
+		url          string
+		wantPrefix   string
+		wantOriginal string
+	}{
+		{
+			name:         "combined with the request's parameters",
+			url:          "http://example.com/combine?a=1&b=x%20y",
+			wantPrefix:   "https://foo.com/landing?a=1&b=x+y&utm_source=redirector&from=",
+			wantOriginal: "http://example.com/combine?a=1&b=x%20y",
+		},
+		{
+			name:         "replaces a parameter with the same name",
+			url:          "https://example.com/replace",
+			wantPrefix:   "https://foo.com/landing?from=",
+			wantOriginal: "https://example.com/replace",
+		},
+		{
+			name:         "request's port",
+			url:          "http://example.com:8080/combine",
+			wantPrefix:   "https://foo.com/landing?utm_source=redirector&from=",
+			wantOriginal: "http://example.com:8080/combine",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", tt.url, nil))
+			location := w.Header().Get("Location")
+			assert.True(t, strings.HasPrefix(location, tt.wantPrefix), location)
+
+			u, err := url.Parse(location)
+			assert.NoError(t, err)
+			assert.Equal(t, []string{tt.wantOriginal}, u.Query()["from"])
+		})
+	}
+
+	// the original URL differs between requests to the same path, so it isn't cached
+	assert.Equal(t, 0, cache.sets)
+}
+
+func TestWildcardFallthrough(t *testing.T) {
+	logger := newTestLogger()
+
+	for _, wildcardFallthrough := range []bool{false, true} {
+		t.Run(fmt.Sprintf("wildcard_fallthrough=%t", wildcardFallthrough), func(t *testing.T) {
+			cfg, err := parseConfig(logger, []byte(fmt.Sprintf(`
+wildcard_fallthrough: %t
+rules:
+  - from: 'www.example.com/exact'
+    to: 'https://exact.example.net/'
+  - from: '*.example.com/wild'
+    to: 'https://wild.example.net/'
+`, wildcardFallthrough)))
+			assert.NoError(t, err)
+			handler := handleRequest(logger, NewInMemoryCache(t.Context(), logger, 3600, 3600), cfg)
+
+			// the repeated request is served from the cache
+			for range 2 {
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, httptest.NewRequest("GET", "http://www.example.com/wild", nil))
+				if wildcardFallthrough {
+					assert.Equal(t, defaultStatusCode, w.Code)
+					assert.Equal(t, "https://wild.example.net/", w.Header().Get("Location"))
+				} else {
+					assert.Equal(t, http.StatusNotFound, w.Code)
+				}
+
+				// hosts without rules of their own always use their wildcard host's rules
+				w = httptest.NewRecorder()
+				handler.ServeHTTP(w, httptest.NewRequest("GET", "http://blog.example.com/wild", nil))
+				assert.Equal(t, "https://wild.example.net/", w.Header().Get("Location"))
+			}
+		})
+	}
+}
+
+func Test_withPort(t *testing.T) {
+	tests := []struct {
+		location string
+		port     string
+		want     string
+	}{
+		{location: "https://foo.com/bar?x=1", port: "8443", want: "https://foo.com:8443/bar?x=1"},
+		{location: "https://foo.com", port: "8443", want: "https://foo.com:8443"},
+		{location: "https://foo.com:8080/bar", port: "8443", want: "https://foo.com:8080/bar"},
+		{location: "https://[2001:db8::1]/bar", port: "8443", want: "https://[2001:db8::1]:8443/bar"},
+		{location: "https://foo.com/bar", port: "", want: "https://foo.com/bar"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.location, func(t *testing.T) {
+			assert.Equal(t, tt.want, withPort(tt.location, tt.port))
+		})
+	}
+}
+
 func Test_parameterHandling(t *testing.T) {
 	t.Parallel()
 	logger := newTestLogger()
@@ -150,55 +978,1138 @@ func Test_parameterHandling(t *testing.T) {
 	ctx, cancel := context.WithCancel(ctx)
 	t.Cleanup(cancel)
 	cfg, _ := loadConfig(logger, "./fixtures/rules.yml")
-	type args struct {
-		u string
-	}
+	type args struct {
+		u string
+	}
+	var testCases = []struct {
+		name string
+		want string
+		args args
+	}{
+		{
+			name: "empty parameters directive",
+			args: args{
+				u: "http://localhost/empty-param",
+			},
+			want: "http://foo/",
+		},
+		{
+			name: "empty parameters directive with param in to",
+			args: args{
+				u: "http://localhost/param-in-directive-empty",
+			},
+			want: "http://foo/",
+		},
+		{
+			name: "parameters directive unset with param in to",
+			args: args{
+				u: "http://localhost/param-in-directive",
+			},
+			want: "http://foo/",
+		},
+		{
+			name: "parameters directive unset with param in to",
+			args: args{
+				u: "http://localhost/param-in-directive-with-parameters-set",
+			},
+			want: "http://foo/?foo=bar",
+		},
+	}
+
+	for _, testCase := range testCases {
+		req := httptest.NewRequest("GET", testCase.args.u, nil)
+		w := httptest.NewRecorder()
+		cache := NewInMemoryCache(ctx, logger, 1, 10)
+
+		t.Run(testCase.name, func(t *testing.T) {
+			handleRequest(logger, cache, cfg).ServeHTTP(w, req)
+
+			assert.Equal(t, testCase.want, w.Header().Get("Location"))
+
+		})
+	}
+
+}
+
+// TestConcurrentMissesCoalesced verifies that concurrent cache misses for the same request only compute a match once
+func TestConcurrentMissesCoalesced(t *testing.T) {
+	logger := newTestLogger()
+	cfg, _ := loadConfig(logger, "./fixtures/rules.yml")
+
+	const n = 10
+	var arrived sync.WaitGroup
+	arrived.Add(n)
+	release := make(chan struct{})
+
+	cache := &spyCache{
+		// hold every request at the cache lookup until all of them have missed
+		onGet: func() {
+			arrived.Done()
+			arrived.Wait()
+		},
+		// hold the single computation open long enough for the other requests to join it
+		onSet: func() {
+			<-release
+		},
+	}
+
+	handler := handleRequest(logger, cache, cfg)
+
+	var done sync.WaitGroup
+	codes := make([]int, n)
+	locations := make([]string, n)
+	for i := 0; i < n; i++ {
+		done.Add(1)
+		go func(i int) {
+			defer done.Done()
+			req := httptest.NewRequest("GET", "http://localhost/blog/2020/01/01/foo/post", nil)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			codes[i] = w.Code
+			locations[i] = w.Header().Get("Location")
+		}(i)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	done.Wait()
+
+	assert.Equal(t, n, cache.gets)
+	assert.Equal(t, 1, cache.sets)
+	for i := 0; i < n; i++ {
+		assert.Equal(t, http.StatusMovedPermanently, codes[i])
+		assert.Equal(t, "https://blog.localhost.com/posts/foo/post", locations[i])
+	}
+}
+
+func TestSelfRedirect(t *testing.T) {
+	logger := newTestLogger()
+	ctx := t.Context()
+	ctx, cancel := context.WithCancel(ctx)
+	t.Cleanup(cancel)
+
+	var testCases = []struct {
+		name               string
+		missOnSelfRedirect bool
+		wantCode           int
+		wantLocation       string
+	}{
+		{
+			name:               "redirect is served by default",
+			missOnSelfRedirect: false,
+			wantCode:           http.StatusMovedPermanently,
+			wantLocation:       "http://localhost/self-redirect",
+		},
+		{
+			name:               "miss response is served when enabled",
+			missOnSelfRedirect: true,
+			wantCode:           http.StatusNotFound,
+			wantLocation:       "https://www.nps.gov/articles/prairie-dogs.htm",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			cfg, _ := loadConfig(logger, "./fixtures/rules.yml")
+			cfg.MissOnSelfRedirect = testCase.missOnSelfRedirect
+			cache := NewInMemoryCache(ctx, logger, 1, 10)
+
+			req := httptest.NewRequest("GET", "https://localhost/self-redirect", nil)
+			w := httptest.NewRecorder()
+			handleRequest(logger, cache, cfg).ServeHTTP(w, req)
+
+			assert.Equal(t, testCase.wantCode, w.Code)
+			assert.Equal(t, testCase.wantLocation, w.Header().Get("Location"))
+		})
+	}
+}
+
+func Test_isSelfRedirect(t *testing.T) {
+	var testCases = []struct {
+		name     string
+		host     string
+		path     string
+		params   url.Values
+		location string
+		want     bool
+	}{
+		{
+			name:     "same url different scheme",
+			host:     "example.com",
+			path:     "/foo",
+			params:   url.Values{},
+			location: "http://example.com/foo",
+			want:     true,
+		},
+		{
+			name:     "same query in different order",
+			host:     "example.com",
+			path:     "/foo",
+			params:   url.Values{"b": {"2"}, "a": {"1"}},
+			location: "https://example.com/foo?a=1&b=2",
+			want:     true,
+		},
+		{
+			name:     "different query",
+			host:     "example.com",
+			path:     "/foo",
+			params:   url.Values{"a": {"1"}},
+			location: "https://example.com/foo?a=2",
+			want:     false,
+		},
+		{
+			name:     "different path",
+			host:     "example.com",
+			path:     "/foo",
+			params:   url.Values{},
+			location: "https://example.com/bar",
+			want:     false,
+		},
+		{
+			name:     "different host",
+			host:     "example.com",
+			path:     "/foo",
+			params:   url.Values{},
+			location: "https://www.example.com/foo",
+			want:     false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			assert.Equal(t, testCase.want, isSelfRedirect(testCase.host, testCase.path, testCase.params, testCase.location))
+		})
+	}
+}
+
+func TestWildcardRules(t *testing.T) {
+	t.Parallel()
+	logger := newTestLogger()
+	ctx := t.Context()
+	ctx, cancel := context.WithCancel(ctx)
+	t.Cleanup(cancel)
+	cfg, _ := loadConfig(logger, "./fixtures/rules.yml")
+
+	var testCases = []struct {
+		name string
+		u    string
+		want string
+	}{
+		{
+			name: "splat variable",
+			u:    "http://localhost/old/some/nested/page",
+			want: "https://demo.localhost.com/new/some/nested/page",
+		},
+		{
+			name: "splat token",
+			u:    "http://localhost/legacy/page",
+			want: "https://demo.localhost.com/archive/page",
+		},
+		{
+			name: "empty splat",
+			u:    "http://localhost/old/",
+			want: "https://demo.localhost.com/new/",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", testCase.u, nil)
+			w := httptest.NewRecorder()
+			cache := NewInMemoryCache(ctx, logger, 1, 10)
+			handleRequest(logger, cache, cfg).ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusMovedPermanently, w.Code)
+			assert.Equal(t, testCase.want, w.Header().Get("Location"))
+		})
+	}
+}
+
+func TestPrefixRules(t *testing.T) {
+	t.Parallel()
+	logger := newTestLogger()
+	ctx := t.Context()
+	ctx, cancel := context.WithCancel(ctx)
+	t.Cleanup(cancel)
+	cfg, _ := loadConfig(logger, "./fixtures/rules.yml")
+
+	req := httptest.NewRequest("GET", "http://localhost/prefix/(literal)/a/b", nil)
+	w := httptest.NewRecorder()
+	cache := NewInMemoryCache(ctx, logger, 1, 10)
+	handleRequest(logger, cache, cfg).ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusMovedPermanently, w.Code)
+	assert.Equal(t, "https://demo.localhost.com/prefixed/a/b", w.Header().Get("Location"))
+}
+
+func TestInternationalizedHostnames(t *testing.T) {
+	t.Parallel()
+	logger := newTestLogger()
+	ctx := t.Context()
+	ctx, cancel := context.WithCancel(ctx)
+	t.Cleanup(cancel)
+	cfg, _ := loadConfig(logger, "./fixtures/rules.yml")
+
+	// both forms of the hostname are declared in the fixture, so they must share a bucket
+	assert.Equal(t, 2, len(cfg.RuleMap["xn--mnchen-3ya.example"]))
+	assert.NotContains(t, cfg.RuleMap, "münchen.example")
+
 	var testCases = []struct {
 		name string
+		u    string
 		want string
-		args args
 	}{
 		{
-			name: "empty parameters directive",
-			args: args{
-				u: "http://localhost/empty-param",
-			},
-			want: "http://foo",
+			name: "unicode host",
+			u:    "http://münchen.example/unicode",
+			want: "https://demo.localhost.com/unicode",
 		},
 		{
-			name: "empty parameters directive with param in to",
-			args: args{
-				u: "http://localhost/param-in-directive-empty",
-			},
-			want: "http://foo",
+			name: "punycode host",
+			u:    "http://xn--mnchen-3ya.example/punycode",
+			want: "https://demo.localhost.com/punycode",
 		},
 		{
-			name: "parameters directive unset with param in to",
-			args: args{
-				u: "http://localhost/param-in-directive",
-			},
-			want: "http://foo",
+			name: "punycode host matching unicode rule",
+			u:    "http://xn--mnchen-3ya.example/unicode",
+			want: "https://demo.localhost.com/unicode",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", testCase.u, nil)
+			w := httptest.NewRecorder()
+			cache := NewInMemoryCache(ctx, logger, 1, 10)
+			handleRequest(logger, cache, cfg).ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusMovedPermanently, w.Code)
+			assert.Equal(t, testCase.want, w.Header().Get("Location"))
+		})
+	}
+}
+
+func TestSlowRequestLog(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+	cfg, _ := loadConfig(logger, "./fixtures/rules.yml")
+
+	req := httptest.NewRequest("GET", "http://localhost/foo", nil)
+
+	// nothing is logged when disabled
+	handleRequest(logger, &spyCache{}, cfg).ServeHTTP(httptest.NewRecorder(), req)
+	assert.NotContains(t, buf.String(), "slow request")
+
+	cfg.Server.SlowRequestThreshold = time.Nanosecond
+	handleRequest(logger, &spyCache{}, cfg).ServeHTTP(httptest.NewRecorder(), req)
+	assert.Contains(t, buf.String(), `"msg":"slow request"`)
+	assert.Contains(t, buf.String(), `"rule":"localhost/foo"`)
+	assert.Contains(t, buf.String(), `"method":"GET"`)
+}
+
+func TestArtificialDelay(t *testing.T) {
+	logger := newTestLogger()
+
+	tests := []struct {
+		name    string
+		config  string
+		delayed bool
+	}{
+		{name: "disabled by default", config: ""},
+		{name: "requires debug", config: "server:\n  artificial_delay: 200ms\n"},
+		{name: "enabled", config: "debug:\n  enabled: true\nserver:\n  artificial_delay: 200ms\n", delayed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := parseConfig(logger, []byte(tt.config+`
+rules:
+  - from: 'example.com/foo'
+    to: 'https://foo.com/'
+`))
+			assert.NoError(t, err)
+
+			start := time.Now()
+			w := httptest.NewRecorder()
+			handleRequest(logger, &spyCache{}, cfg).ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/foo", nil))
+			assert.Equal(t, defaultStatusCode, w.Code)
+			assert.Equal(t, tt.delayed, time.Since(start) >= 200*time.Millisecond)
+		})
+	}
+
+	// the delay ends early if the client goes away
+	cfg, err := parseConfig(logger, []byte("debug:\n  enabled: true\nserver:\n  artificial_delay: 1h\n"))
+	assert.NoError(t, err)
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	handleRequest(logger, &spyCache{}, cfg).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com/foo", nil).WithContext(ctx))
+	assert.Less(t, time.Since(start), time.Minute)
+}
+
+func TestAllowQuery(t *testing.T) {
+	t.Parallel()
+	logger := newTestLogger()
+	cfg, _ := loadConfig(logger, "./fixtures/rules.yml")
+
+	req := httptest.NewRequest("GET", "http://localhost/allow-query?page=2&ref=email&tracking=abc", nil)
+	w := httptest.NewRecorder()
+	handleRequest(logger, &spyCache{}, cfg).ServeHTTP(w, req)
+
+	resp, _ := url.Parse(w.Header().Get("Location"))
+	assert.Equal(t, http.StatusMovedPermanently, w.Code)
+	// tracking isn't allowed, and the rule's value for ref wins under the combine strategy
+	assert.Equal(t, url.Values{"page": {"2"}, "ref": {"redirector"}}, resp.Query())
+}
+
+func TestMalformedQuery(t *testing.T) {
+	t.Parallel()
+	logger := newTestLogger()
+
+	var testCases = []struct {
+		name           string
+		malformedQuery string
+		wantCode       int
+		wantQuery      url.Values
+	}{
+		{
+			name:           "best effort",
+			malformedQuery: MalformedQueryBestEffort,
+			wantCode:       http.StatusMovedPermanently,
+			wantQuery:      url.Values{"new": {"hello"}, "existing": {"world"}, "ok": {"1"}},
 		},
 		{
-			name: "parameters directive unset with param in to",
-			args: args{
-				u: "http://localhost/param-in-directive-with-parameters-set",
-			},
-			want: "http://foo?foo=bar",
+			name:           "reject",
+			malformedQuery: MalformedQueryReject,
+			wantCode:       http.StatusBadRequest,
 		},
 	}
 
 	for _, testCase := range testCases {
-		req := httptest.NewRequest("GET", testCase.args.u, nil)
-		w := httptest.NewRecorder()
-		cache := NewInMemoryCache(ctx, logger, 1, 10)
-
 		t.Run(testCase.name, func(t *testing.T) {
+			cfg, _ := loadConfig(logger, "./fixtures/rules.yml")
+			cfg.MalformedQuery = testCase.malformedQuery
+			cache := &spyCache{}
+
+			req := httptest.NewRequest("GET", "http://localhost/params/test?ok=1&a=%zz", nil)
+			w := httptest.NewRecorder()
 			handleRequest(logger, cache, cfg).ServeHTTP(w, req)
 
-			assert.Equal(t, testCase.want, w.Header().Get("Location"))
+			assert.Equal(t, testCase.wantCode, w.Code)
+			if testCase.wantQuery != nil {
+				resp, _ := url.Parse(w.Header().Get("Location"))
+				assert.Equal(t, testCase.wantQuery, resp.Query())
+			} else {
+				assert.Equal(t, 0, cache.gets)
+				assert.Equal(t, 0, cache.sets)
+			}
+		})
+	}
+}
+
+func TestCorrelationIDHeader(t *testing.T) {
+	t.Parallel()
+	logger := newTestLogger()
+	cfg, _ := loadConfig(logger, "./fixtures/rules.yml")
+
+	assert.Equal(t, "X-Request-Id", cfg.Tracing.HeaderName)
+
+	// an ID is generated when the request doesn't have one
+	req := httptest.NewRequest("GET", "http://localhost/foo", nil)
+	w := httptest.NewRecorder()
+	handleRequest(logger, &spyCache{}, cfg).ServeHTTP(w, req)
+	assert.NotEqual(t, "", w.Header().Get("X-Request-Id"))
+
+	cfg.Tracing.HeaderName = "X-Trace-Id"
+	req = httptest.NewRequest("GET", "http://localhost/foo", nil)
+	req.Header.Set("X-Trace-Id", "abc123")
+	w = httptest.NewRecorder()
+	handleRequest(logger, &spyCache{}, cfg).ServeHTTP(w, req)
+	assert.Equal(t, "abc123", w.Header().Get("X-Trace-Id"))
+	assert.Equal(t, "", w.Header().Get("X-Request-Id"))
+}
+
+func TestJSONErrorResponses(t *testing.T) {
+	t.Parallel()
+	logger := newTestLogger()
+
+	var testCases = []struct {
+		name        string
+		errorFormat string
+		url         string
+		accept      string
+		wantCode    int
+		wantBody    *errorResponse
+	}{
+		{
+			name:     "empty body by default",
+			url:      "http://i-dont-exist.com/foo",
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name:        "no rule for host",
+			errorFormat: ErrorFormatJSON,
+			url:         "http://i-dont-exist.com/foo",
+			wantCode:    http.StatusNotFound,
+			wantBody:    &errorResponse{Error: "no_rule_for_host", Host: "i-dont-exist.com", Path: "/foo"},
+		},
+		{
+			name:     "no rule for path negotiated with accept",
+			url:      "http://localhost/i-dont-exist",
+			accept:   "application/json",
+			wantCode: http.StatusNotFound,
+			wantBody: &errorResponse{Error: "no_rule_for_path", Host: "localhost", Path: "/i-dont-exist"},
+		},
+		{
+			name:        "browsers keep the empty body",
+			errorFormat: ErrorFormatJSON,
+			url:         "http://localhost/i-dont-exist",
+			accept:      "text/html,application/xhtml+xml",
+			wantCode:    http.StatusNotFound,
+		},
+		{
+			name:        "redirects don't have a body",
+			errorFormat: ErrorFormatJSON,
+			url:         "http://localhost/foo",
+			wantCode:    http.StatusMovedPermanently,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			cfg, _ := loadConfig(logger, "./fixtures/rules.yml")
+			cfg.ErrorFormat = testCase.errorFormat
+			cfg.LocationOnMiss = ""
+			handler := handleRequest(logger, NewInMemoryCache(t.Context(), logger, cfg.Cache.CleanupInterval, cfg.Cache.TTL), cfg)
+
+			// the second request is served from the cache and should get the same body
+			for range 2 {
+				req := httptest.NewRequest("GET", testCase.url, nil)
+				if testCase.accept != "" {
+					req.Header.Set("Accept", testCase.accept)
+				}
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, req)
+
+				assert.Equal(t, testCase.wantCode, w.Code)
+				if testCase.wantBody == nil {
+					assert.Empty(t, w.Body.String())
+					continue
+				}
 
+				var got errorResponse
+				assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+				assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+				assert.Equal(t, *testCase.wantBody, got)
+			}
 		})
 	}
+}
+
+func TestBasePath(t *testing.T) {
+	logger := newTestLogger()
+
+	rules := `
+rules:
+  - from: 'example.com/old'
+    to: '/new'
+  - from: 'example.com/docs/(.*)'
+    to: '/documentation/$1'
+  - from: 'example.com/away'
+    to: 'https://foo.com/away'
+`
+
+	tests := []struct {
+		name     string
+		basePath string
+		url      string
+		want     string
+	}{
+		{name: "relative without a base path", url: "http://example.com/old?a=1", want: "/new?a=1"},
+		{name: "relative", basePath: "/redirect", url: "http://example.com/old?a=1", want: "/redirect/new?a=1"},
+		{name: "relative with a capture", basePath: "/redirect", url: "http://example.com/docs/intro", want: "/redirect/documentation/intro"},
+		{name: "base path slashes are normalized", basePath: "redirect/", url: "http://example.com/old", want: "/redirect/new"},
+		{name: "absolute is unaffected", basePath: "/redirect", url: "http://example.com/away", want: "https://foo.com/away"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := parseConfig(logger, []byte(fmt.Sprintf("server:\n  base_path: '%s'\n%s", tt.basePath, rules)))
+			assert.NoError(t, err)
+
+			w := httptest.NewRecorder()
+			handleRequest(logger, &noopCache{}, cfg).ServeHTTP(w, httptest.NewRequest("GET", tt.url, nil))
+			assert.Equal(t, http.StatusMovedPermanently, w.Code)
+			assert.Equal(t, tt.want, w.Header().Get("Location"))
+		})
+	}
+}
+
+func TestCapturesHeader(t *testing.T) {
+	logger := newTestLogger()
+	rules := `
+rules:
+  - from: 'example.com/blog/(?P<year>\d+)/(?P<slug>[^/]+)'
+    to: 'https://blog.example.com/$year/$slug'
+  - from: 'example.com/docs/*'
+    to: 'https://docs.example.com/:splat'
+  - from: 'example.com/exact'
+    to: 'https://foo.com/'
+`
+
+	tests := []struct {
+		name    string
+		enabled bool
+		url     string
+		want    string
+	}{
+		{name: "disabled by default", url: "http://example.com/blog/2024/hello"},
+		{name: "named groups", enabled: true, url: "http://example.com/blog/2024/hello", want: "year=2024&slug=hello"},
+		{name: "wildcard", enabled: true, url: "http://example.com/docs/a/b", want: "SPLAT=a%2Fb"},
+		{name: "no captures", enabled: true, url: "http://example.com/exact"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := parseConfig(logger, []byte(fmt.Sprintf("debug:\n  captures_header: %t\n%s", tt.enabled, rules)))
+			assert.NoError(t, err)
+
+			w := httptest.NewRecorder()
+			handleRequest(logger, &noopCache{}, cfg).ServeHTTP(w, httptest.NewRequest("GET", tt.url, nil))
+			assert.Equal(t, http.StatusMovedPermanently, w.Code)
+			assert.Equal(t, tt.want, w.Header().Get("X-Redirector-Captures"))
+			_, ok := w.Header()["X-Redirector-Captures"]
+			assert.Equal(t, tt.want != "", ok)
+		})
+	}
+}
+
+func TestQueryDedup(t *testing.T) {
+	logger := newTestLogger()
+	rules := `
+rules:
+  - from: 'example.com/foo'
+    to: 'https://foo.com/'
+    parameters:
+      strategy: 'combine'
+      values:
+        b: ['rule', 'values']
+`
+
+	tests := []struct {
+		mode string
+		want string
+	}{
+		{mode: "", want: "https://foo.com/?a=1&a=2&b=rule&b=values"},
+		{mode: QueryDedupKeep, want: "https://foo.com/?a=1&a=2&b=rule&b=values"},
+		{mode: QueryDedupFirst, want: "https://foo.com/?a=1&b=rule&b=values"},
+		{mode: QueryDedupLast, want: "https://foo.com/?a=2&b=rule&b=values"},
+		{mode: "unknown", want: "https://foo.com/?a=1&a=2&b=rule&b=values"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			cfg, err := parseConfig(logger, []byte(fmt.Sprintf("query_dedup: '%s'\n%s", tt.mode, rules)))
+			assert.NoError(t, err)
+
+			w := httptest.NewRecorder()
+			handleRequest(logger, &noopCache{}, cfg).ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/foo?a=1&a=2", nil))
+			assert.Equal(t, tt.want, w.Header().Get("Location"))
+		})
+	}
+}
+
+func TestSkipCaptures(t *testing.T) {
+	logger := newTestLogger()
+	rules := `
+rules:
+  - from: 'example.com/blog/(\d+)'
+    to: 'https://blog.example.com/$1'
+  - from: 'example.com/named/(?P<slug>\w+)'
+    to: 'https://foo.com/${slug}'
+  - from: 'example.com/docs/*'
+    to: 'https://docs.example.com/:splat'
+  - from: 'example.com/literal/(\d+)'
+    to: 'https://foo.com/literal'
+  - from: 'example.com/dollar/(\d+)'
+    to: 'https://foo.com/$$1'
+  - from: 'example.com/exact'
+    to: 'https://foo.com/exact'
+  - from: 'example.com/popular/(\d+)'
+    to: 'https://foo.com/$1'
+    cacheable: true
+  - from: 'example.com/opt-out'
+    to: 'https://foo.com/opt-out'
+    cacheable: false
+  - from: 'example.com/whole/\d+'
+    to: 'https://foo.com$0'
+  - from: 'example.com/braced/(\d+)'
+    to: 'https://foo.com/whole${0}'
+`
+
+	tests := []struct {
+		name         string
+		skipCaptures bool
+		url          string
+		cached       bool
+	}{
+		{name: "captures are cached when off", url: "http://example.com/blog/1", cached: true},
+		{name: "numbered capture", skipCaptures: true, url: "http://example.com/blog/1"},
+		{name: "named capture", skipCaptures: true, url: "http://example.com/named/hello"},
+		{name: "wildcard", skipCaptures: true, url: "http://example.com/docs/a/b"},
+		{name: "expression without references", skipCaptures: true, url: "http://example.com/literal/1", cached: true},
+		{name: "escaped dollar", skipCaptures: true, url: "http://example.com/dollar/1", cached: true},
+		{name: "exact", skipCaptures: true, url: "http://example.com/exact", cached: true},
+		{name: "cacheable overrides", skipCaptures: true, url: "http://example.com/popular/1", cached: true},
+		{name: "cacheable false", url: "http://example.com/opt-out"},
+		{name: "whole match", skipCaptures: true, url: "http://example.com/whole/1"},
+		{name: "braced whole match", skipCaptures: true, url: "http://example.com/braced/1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := parseConfig(logger, []byte(fmt.Sprintf("cache:\n  skip_captures: %t\n%s", tt.skipCaptures, rules)))
+			assert.NoError(t, err)
+			cache := &spyCache{}
+
+			w := httptest.NewRecorder()
+			handleRequest(logger, cache, cfg).ServeHTTP(w, httptest.NewRequest("GET", tt.url, nil))
+			assert.Equal(t, http.StatusMovedPermanently, w.Code)
+			assert.Equal(t, tt.cached, cache.sets == 1)
+		})
+	}
+}
+
+func TestNoCache(t *testing.T) {
+	logger := newTestLogger()
+	cfg, err := parseConfig(logger, []byte(`
+rules:
+  - from: 'example.com/foo'
+    to: 'https://foo.com/'
+    no_cache: true
+  - from: 'example.org/foo'
+    to: 'https://foo.com/'
+    no_cache: true
+    cacheable: true
+  - from: 'example.org/bar'
+    to: 'https://foo.com/bar'
+`))
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		url      string
+		wantGets int
+	}{
+		{name: "every rule for the host skips the cache", url: "http://example.com/foo"},
+		{name: "other rules for the host are cached", url: "http://example.org/foo", wantGets: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := &spyCache{}
+			handler := handleRequest(logger, cache, cfg)
+
+			for range 2 {
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, httptest.NewRequest("GET", tt.url, nil))
+				assert.Equal(t, http.StatusMovedPermanently, w.Code)
+				assert.Empty(t, w.Header().Get("X-Redirector-Cache-Status"))
+			}
+			assert.Equal(t, tt.wantGets, cache.gets)
+			assert.Equal(t, 0, cache.sets)
+		})
+	}
+}
+
+func TestUnknownPathStatus(t *testing.T) {
+	logger := newTestLogger()
+	cfg, err := parseConfig(logger, []byte(`
+location_on_miss: 'https://fallback.example.com/'
+unknown_path_status:
+  Retired.example.com: 410
+  kept.example.com: 404
+  '*.wildcard.example.com': 410
+  invalid.example.com: 500
+rules:
+  - from: 'retired.example.com/foo'
+    to: 'https://foo.com/'
+  - from: 'kept.example.com/foo'
+    to: 'https://foo.com/'
+  - from: '*.wildcard.example.com/foo'
+    to: 'https://foo.com/'
+  - from: 'invalid.example.com/foo'
+    to: 'https://foo.com/'
+  - from: 'example.com/foo'
+    to: 'https://foo.com/'
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"retired.example.com": 410, "kept.example.com": 404, "*.wildcard.example.com": 410}, cfg.UnknownPathStatus)
+
+	tests := []struct {
+		name         string
+		url          string
+		wantCode     int
+		wantLocation string
+	}{
+		{name: "gone", url: "http://retired.example.com/old", wantCode: http.StatusGone},
+		{name: "not found", url: "http://kept.example.com/old", wantCode: http.StatusNotFound},
+		{name: "wildcard host", url: "http://a.wildcard.example.com/old", wantCode: http.StatusGone},
+		{name: "invalid status uses the fallback", url: "http://invalid.example.com/old", wantCode: http.StatusTemporaryRedirect, wantLocation: "https://fallback.example.com/"},
+		{name: "unset uses the fallback", url: "http://example.com/old", wantCode: http.StatusTemporaryRedirect, wantLocation: "https://fallback.example.com/"},
+		{name: "matching paths redirect", url: "http://retired.example.com/foo", wantCode: http.StatusMovedPermanently, wantLocation: "https://foo.com/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := handleRequest(logger, NewInMemoryCache(t.Context(), logger, 60, 60), cfg)
+			// the second response comes from the cache
+			for range 2 {
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, httptest.NewRequest("GET", tt.url, nil))
+				assert.Equal(t, tt.wantCode, w.Code)
+				assert.Equal(t, tt.wantLocation, w.Header().Get("Location"))
+			}
+		})
+	}
+}
+
+func TestNegativeTTL(t *testing.T) {
+	logger := newTestLogger()
+	cfg, err := parseConfig(logger, []byte(`
+cache:
+  negative_ttl: 30
+rules:
+  - from: 'example.com/foo'
+    to: 'https://foo.com/'
+`))
+	assert.NoError(t, err)
+	cache := NewInMemoryCache(t.Context(), logger, 3600, cfg.Cache.TTL)
+	handler := handleRequest(logger, cache, cfg)
+	request := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/new", nil))
+		return w
+	}
+
+	assert.Equal(t, http.StatusNotFound, request().Code)
+	shard := cache.shard("example.com")
+	shard.lock.RLock()
+	assert.Equal(t, int64(30), shard.cache["example.com"]["/new"].ttl)
+	shard.lock.RUnlock()
+
+	// a rule added for the path is hidden by the cached miss until it expires
+	added, err := parseConfig(logger, []byte(`
+rules:
+  - from: 'example.com/new'
+    to: 'https://foo.com/new'
+`))
+	assert.NoError(t, err)
+	cfg.setRuleMap(added.RuleMap)
+	w := request()
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "cached", w.Header().Get("X-Redirector-Cache-Status"))
+
+	shard.lock.Lock()
+	item := shard.cache["example.com"]["/new"]
+	item.createdAt -= 31
+	shard.cache["example.com"]["/new"] = item
+	shard.lock.Unlock()
+
+	w = request()
+	assert.Equal(t, http.StatusMovedPermanently, w.Code)
+	assert.Equal(t, "https://foo.com/new", w.Header().Get("Location"))
+
+	cfg, err = parseConfig(logger, []byte("cache:\n  negative_ttl: -1\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(defaultNegativeCacheTTL), cfg.Cache.NegativeTTL)
+}
+
+func TestCacheMisses(t *testing.T) {
+	logger := newTestLogger()
+	tests := []struct {
+		name     string
+		config   string
+		wantSets int
+	}{
+		{name: "misses are cached by default", wantSets: 1},
+		{name: "disabled", config: "cache:\n  cache_misses: false\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := parseConfig(logger, []byte(tt.config+"rules:\n  - from: 'example.com/foo'\n    to: 'https://foo.com/'\n"))
+			assert.NoError(t, err)
+			cache := &spyCache{}
+
+			w := httptest.NewRecorder()
+			handleRequest(logger, cache, cfg).ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/missing", nil))
+			assert.Equal(t, http.StatusNotFound, w.Code)
+			assert.Equal(t, tt.wantSets, cache.sets)
+		})
+	}
+}
+
+func TestSemicolonQuerySeparator(t *testing.T) {
+	logger := newTestLogger()
+	rules := `
+rules:
+  - from: 'example.com/combine'
+    to: 'https://foo.com/'
+    parameters:
+      strategy: 'combine'
+      values:
+        c: ['3']
+`
+
+	tests := []struct {
+		name      string
+		enabled   bool
+		malformed string
+		query     string
+		want      string
+		wantCode  int
+	}{
+		{name: "split on semicolons", enabled: true, query: "a=1;b=2", want: "https://foo.com/?a=1&b=2&c=3"},
+		{name: "mixed separators", enabled: true, query: "a=1;b=2&d=4", want: "https://foo.com/?a=1&b=2&c=3&d=4"},
+		{name: "escaped semicolon", enabled: true, query: "a=1%3B2", want: "https://foo.com/?a=1%3B2&c=3"},
+		{name: "off, best effort", query: "a=1;b=2&d=4", want: "https://foo.com/?c=3&d=4"},
+		{name: "off, rejected", malformed: MalformedQueryReject, query: "a=1;b=2", wantCode: http.StatusBadRequest},
+		{name: "on, not rejected", enabled: true, malformed: MalformedQueryReject, query: "a=1;b=2", want: "https://foo.com/?a=1&b=2&c=3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			malformed := tt.malformed
+			if malformed == "" {
+				malformed = MalformedQueryBestEffort
+			}
+			cfg, err := parseConfig(logger, []byte(fmt.Sprintf("semicolon_query_separator: %t\nmalformed_query: '%s'\n%s", tt.enabled, malformed, rules)))
+			assert.NoError(t, err)
+
+			w := httptest.NewRecorder()
+			handleRequest(logger, &noopCache{}, cfg).ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/combine?"+tt.query, nil))
+			wantCode := tt.wantCode
+			if wantCode == 0 {
+				wantCode = http.StatusMovedPermanently
+			}
+			assert.Equal(t, wantCode, w.Code)
+			assert.Equal(t, tt.want, w.Header().Get("Location"))
+		})
+	}
+}
+
+func TestEmptyToPath(t *testing.T) {
+	logger := newTestLogger()
+	rules := `
+rules:
+  - from: 'example.com/old/(.*)'
+    to: 'https://foo.com'
+  - from: 'other.com'
+    to: 'https://bar.com'
+  - from: 'example.com/prefix'
+    to: 'https://foo.com'
+    match: 'prefix'
+`
+
+	tests := []struct {
+		name string
+		mode string
+		url  string
+		want string
+	}{
+		{name: "root", mode: EmptyToPathRoot, url: "http://example.com/old/page", want: "https://foo.com/"},
+		{name: "root by default", url: "http://example.com/old/page", want: "https://foo.com/"},
+		{name: "root, host only from", mode: EmptyToPathRoot, url: "http://other.com/some/page?a=1", want: "https://bar.com/?a=1"},
+		{name: "preserve", mode: EmptyToPathPreserve, url: "http://example.com/old/page", want: "https://foo.com/old/page"},
+		{name: "preserve, host only from", mode: EmptyToPathPreserve, url: "http://other.com/some/page", want: "https://bar.com/some/page"},
+		{name: "preserve, root request", mode: EmptyToPathPreserve, url: "http://other.com/", want: "https://bar.com/"},
+		{name: "prefix keeps the remainder", mode: EmptyToPathRoot, url: "http://example.com/prefix/rest", want: "https://foo.com/rest"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := rules
+			if tt.mode != "" {
+				config = fmt.Sprintf("empty_to_path: '%s'\n%s", tt.mode, rules)
+			}
+			cfg, err := parseConfig(logger, []byte(config))
+			assert.NoError(t, err)
+
+			w := httptest.NewRecorder()
+			handleRequest(logger, &noopCache{}, cfg).ServeHTTP(w, httptest.NewRequest("GET", tt.url, nil))
+			assert.Equal(t, http.StatusMovedPermanently, w.Code)
+			assert.Equal(t, tt.want, w.Header().Get("Location"))
+		})
+	}
+}
+
+func TestCacheKeyQuery(t *testing.T) {
+	logger := newTestLogger()
+	cfg, err := parseConfig(logger, []byte(`
+rules:
+  - from: 'example.com/combine'
+    to: 'https://foo.com/'
+    parameters:
+      strategy: 'combine'
+      values:
+        src: ['redirector']
+  - from: 'example.com/replace'
+    to: 'https://foo.com/'
+    parameters:
+      strategy: 'replace'
+      values:
+        src: ['redirector']
+`))
+	assert.NoError(t, err)
+	cache := NewInMemoryCache(t.Context(), logger, cfg.Cache.CleanupInterval, cfg.Cache.TTL)
+	handler := handleRequest(logger, cache, cfg)
+
+	// requests run in order against the same cache
+	tests := []struct {
+		url        string
+		want       string
+		wantCached bool
+	}{
+		{url: "http://example.com/combine?new=first", want: "https://foo.com/?new=first&src=redirector"},
+		{url: "http://example.com/combine?new=second", want: "https://foo.com/?new=second&src=redirector"},
+		{url: "http://example.com/combine?new=first", want: "https://foo.com/?new=first&src=redirector", wantCached: true},
+		{url: "http://example.com/combine?a=1&b=2", want: "https://foo.com/?a=1&b=2&src=redirector"},
+		{url: "http://example.com/combine?b=2&a=1", want: "https://foo.com/?a=1&b=2&src=redirector", wantCached: true},
+		{url: "http://example.com/combine", want: "https://foo.com/?src=redirector"},
+		{url: "http://example.com/replace?new=first", want: "https://foo.com/?src=redirector"},
+		{url: "http://example.com/replace?new=second", want: "https://foo.com/?src=redirector"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", tt.url, nil))
+		assert.Equal(t, tt.want, w.Header().Get("Location"), tt.url)
+		assert.Equal(t, tt.wantCached, w.Header().Get("X-Redirector-Cache-Status") == "cached", tt.url)
+	}
+}
+
+func TestRequestBody(t *testing.T) {
+	logger := newTestLogger()
+	rules := `
+rules:
+  - from: 'example.com/foo'
+    to: 'https://foo.com/'
+`
+
+	tests := []struct {
+		name          string
+		reject        bool
+		method        string
+		body          string
+		wantCode      int
+		wantClose     bool
+		wantRemaining int
+	}{
+		{name: "no body", method: "GET", wantCode: http.StatusMovedPermanently},
+		{name: "small body is drained", method: "GET", body: "hello", wantCode: http.StatusMovedPermanently},
+		{name: "large body closes the connection", method: "GET", body: strings.Repeat("a", 1<<20), wantCode: http.StatusMovedPermanently, wantClose: true, wantRemaining: 1<<20 - defaultMaxDrainedBody - 1},
+		{name: "rejected", reject: true, method: "GET", body: strings.Repeat("a", 1<<20), wantCode: http.StatusBadRequest, wantClose: true, wantRemaining: 1 << 20},
+		{name: "rejected head", reject: true, method: "HEAD", body: "hello", wantCode: http.StatusBadRequest, wantClose: true, wantRemaining: 5},
+		{name: "other methods aren't rejected", reject: true, method: "POST", body: "hello", wantCode: http.StatusMovedPermanently},
+		{name: "no body isn't rejected", reject: true, method: "GET", wantCode: http.StatusMovedPermanently},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := parseConfig(logger, []byte(fmt.Sprintf("server:\n  allowed_methods: []\n  reject_get_body: %t\n%s", tt.reject, rules)))
+			assert.NoError(t, err)
+
+			body := strings.NewReader(tt.body)
+			w := httptest.NewRecorder()
+			handleRequest(logger, &noopCache{}, cfg).ServeHTTP(w, httptest.NewRequest(tt.method, "http://example.com/foo", body))
+			assert.Equal(t, tt.wantCode, w.Code)
+			assert.Equal(t, tt.wantClose, w.Header().Get("Connection") == "close")
+			assert.Equal(t, tt.wantRemaining, body.Len())
+		})
+	}
+}
 
+func TestStripHostPrefix(t *testing.T) {
+	logger := newTestLogger()
+	rules := `
+rules:
+  - from: 'example.com/foo'
+    to: 'https://www.example.org/foo'
+`
+
+	tests := []struct {
+		name     string
+		prefix   string
+		target   string
+		wantCode int
+	}{
+		{name: "stripped", prefix: "www.", target: "http://www.example.com/foo", wantCode: http.StatusMovedPermanently},
+		{name: "without the prefix", prefix: "www.", target: "http://example.com/foo", wantCode: http.StatusMovedPermanently},
+		{name: "case insensitive", prefix: "WWW.", target: "http://Www.example.com/foo", wantCode: http.StatusMovedPermanently},
+		{name: "only the leading prefix", prefix: "www.", target: "http://www.www.example.com/foo", wantCode: http.StatusNotFound},
+		{name: "disabled", target: "http://www.example.com/foo", wantCode: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := parseConfig(logger, []byte(fmt.Sprintf("strip_host_prefix: '%s'\n%s", tt.prefix, rules)))
+			assert.NoError(t, err)
+
+			w := httptest.NewRecorder()
+			handleRequest(logger, &noopCache{}, cfg).ServeHTTP(w, httptest.NewRequest("GET", tt.target, nil))
+			assert.Equal(t, tt.wantCode, w.Code)
+			if tt.wantCode == http.StatusMovedPermanently {
+				// the rule's `to` is unaffected
+				assert.Equal(t, "https://www.example.org/foo", w.Header().Get("Location"))
+			}
+		})
+	}
+
+	// both hosts share a cache entry
+	cfg, err := parseConfig(logger, []byte("strip_host_prefix: 'www.'\n"+rules))
+	assert.NoError(t, err)
+	handler := handleRequest(logger, NewInMemoryCache(t.Context(), logger, 3600, 3600), cfg)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://www.example.com/foo", nil))
+	assert.Equal(t, "", w.Header().Get("X-Redirector-Cache-Status"))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/foo", nil))
+	assert.Equal(t, "cached", w.Header().Get("X-Redirector-Cache-Status"))
+}
+
+func TestMatchCookie(t *testing.T) {
+	logger := newTestLogger()
+	cfg, err := parseConfig(logger, []byte(`
+rules:
+  - from: 'example.com/home'
+    to: 'https://example.com/$cookie.locale/home'
+    match_cookie:
+      locale: 'fr|de'
+  - from: 'example.com/home'
+    to: 'https://example.com/en/home'
+  - from: 'example.com/other'
+    to: 'https://example.com/other'
+`))
+	assert.NoError(t, err)
+	handler := handleRequest(logger, NewInMemoryCache(t.Context(), logger, 3600, 3600), cfg)
+
+	tests := []struct {
+		name   string
+		path   string
+		cookie string
+		want   string
+	}{
+		{name: "matching cookie", path: "/home", cookie: "locale=fr", want: "https://example.com/fr/home"},
+		{name: "another matching cookie", path: "/home", cookie: "theme=dark; locale=de", want: "https://example.com/de/home"},
+		{name: "cookie doesn't match", path: "/home", cookie: "locale=es", want: "https://example.com/en/home"},
+		{name: "expression matches the whole value", path: "/home", cookie: "locale=french", want: "https://example.com/en/home"},
+		{name: "no cookie", path: "/home", want: "https://example.com/en/home"},
+		{name: "rules without match_cookie are unaffected", path: "/other", cookie: "locale=fr", want: "https://example.com/other"},
+	}
+	// each case runs twice, so that the second request is served from the cache
+	for _, pass := range []string{"uncached", "cached"} {
+		for _, tt := range tests {
+			t.Run(pass+" "+tt.name, func(t *testing.T) {
+				req := httptest.NewRequest("GET", "http://example.com"+tt.path, nil)
+				if tt.cookie != "" {
+					req.Header.Set("Cookie", tt.cookie)
+				}
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, req)
+				assert.Equal(t, http.StatusMovedPermanently, w.Code)
+				assert.Equal(t, tt.want, w.Header().Get("Location"))
+				if pass == "cached" {
+					assert.Equal(t, "cached", w.Header().Get("X-Redirector-Cache-Status"))
+				}
+			})
+		}
+	}
 }
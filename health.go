@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHealthcheckInterval = 30 * time.Second
+	defaultHealthcheckTimeout  = 5 * time.Second
+	// healthcheckTick is how often rules are checked for a health check that is due
+	healthcheckTick = time.Second
+)
+
+var (
+	ruleHealthMetric = promauto.With(appMetrics).NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "rule_healthy",
+			Help: "Whether the last health check of a rule's destination succeeded. 1 is healthy, 0 is unhealthy",
+		},
+		[]string{"host", "rule"},
+	)
+)
+
+type HealthcheckConfig struct {
+	// URL is requested to check that the rule's destination is up. Any response below 500 is healthy
+	URL      string        `yaml:"url"`
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+}
+
+type RuleUnhealthyError struct {
+	url string
+}
+
+func (e RuleUnhealthyError) Error() string {
+	return fmt.Sprintf("health check '%s' is failing", e.url)
+}
+
+type healthStatus struct {
+	healthy   bool
+	checkedAt time.Time
+	inflight  bool
+}
+
+// ruleHealthChecker tracks the last-known health of rules with a health check
+//
+// Rules that haven't been checked yet are healthy, so that a restart doesn't send every request to the fallback
+type ruleHealthChecker struct {
+	lock     sync.Mutex
+	statuses map[string]*healthStatus
+}
+
+var ruleHealth = &ruleHealthChecker{statuses: map[string]*healthStatus{}}
+
+func (h *ruleHealthChecker) healthy(host string, rule Rule) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	s, ok := h.statuses[host+" "+rule.id()]
+	return !ok || s.healthy
+}
+
+// due reports whether the rule's health check should run, marking it as in flight if so
+func (h *ruleHealthChecker) due(host string, rule Rule, now time.Time) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	key := host + " " + rule.id()
+	s, ok := h.statuses[key]
+	if !ok {
+		s = &healthStatus{healthy: true}
+		h.statuses[key] = s
+	}
+	if s.inflight || (!s.checkedAt.IsZero() && now.Sub(s.checkedAt) < rule.Healthcheck.Interval) {
+		return false
+	}
+
+	s.inflight = true
+	return true
+}
+
+func (h *ruleHealthChecker) record(host string, rule Rule, healthy bool, now time.Time) {
+	h.lock.Lock()
+	s := h.statuses[host+" "+rule.id()]
+	s.healthy = healthy
+	s.checkedAt = now
+	s.inflight = false
+	h.lock.Unlock()
+
+	v := 0.0
+	if healthy {
+		v = 1
+	}
+	ruleHealthMetric.With(prometheus.Labels{"host": host, "rule": rule.id()}).Set(v)
+}
+
+// probe requests a health check URL, reporting whether the destination is up
+func probe(ctx context.Context, client *http.Client, c HealthcheckConfig) bool {
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.URL, nil)
+	if err != nil {
+		return false
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	_ = resp.Body.Close()
+
+	return resp.StatusCode < http.StatusInternalServerError
+}
+
+// runHealthChecks probes the health check of every rule that has one on the rule's interval
+//
+// Rules are read on every tick so that health checks follow config reloads
+func runHealthChecks(ctx context.Context, l *slog.Logger, ac *AppConfig, client *http.Client) {
+	logger := l.WithGroup("healthcheck")
+	ticker := time.NewTicker(healthcheckTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for host, rules := range ac.ruleMap() {
+				for _, rule := range rules {
+					if rule.Healthcheck == nil || !ruleHealth.due(host, rule, now) {
+						continue
+					}
+
+					go func(host string, rule Rule) {
+						healthy := probe(ctx, client, *rule.Healthcheck)
+						if !healthy {
+							logger.Warn("health check failed", "host", host, "rule", rule.id(), "url", rule.Healthcheck.URL)
+						}
+						ruleHealth.record(host, rule, healthy, time.Now())
+					}(host, rule)
+				}
+			}
+		}
+	}
+}
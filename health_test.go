@@ -0,0 +1,130 @@
+//go:build unit_test
+
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_probe(t *testing.T) {
+	var status atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(status.Load()))
+	}))
+	t.Cleanup(srv.Close)
+
+	tests := []struct {
+		name   string
+		status int
+		url    string
+		want   bool
+	}{
+		{name: "ok", status: http.StatusOK, url: srv.URL, want: true},
+		{name: "not found is up", status: http.StatusNotFound, url: srv.URL, want: true},
+		{name: "server error", status: http.StatusServiceUnavailable, url: srv.URL, want: false},
+		{name: "unreachable", url: "http://127.0.0.1:1", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status.Store(int64(tt.status))
+			got := probe(t.Context(), srv.Client(), HealthcheckConfig{URL: tt.url, Timeout: time.Second})
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestUnhealthyRule(t *testing.T) {
+	logger := newTestLogger()
+
+	var healthy atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	cfg, err := parseConfig(logger, []byte(`
+location_on_miss: 'https://fallback.example.com/'
+status_on_miss: 302
+rules:
+  - from: 'healthcheck.example.com/foo'
+    to: 'https://foo.example.com/'
+    healthcheck:
+      url: '`+srv.URL+`'
+      interval: '10ms'
+  - from: 'healthcheck.example.com/bar'
+    to: 'https://bar.example.com/'
+    to_fallback: 'https://bar-fallback.example.com/'
+    healthcheck:
+      url: '`+srv.URL+`'
+      interval: '10ms'
+`))
+	assert.NoError(t, err)
+
+	cache := &spyCache{}
+	handler := handleRequest(logger, cache, cfg)
+	request := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "http://healthcheck.example.com/foo", nil))
+		return w
+	}
+
+	// rules are healthy until they've been checked
+	w := request()
+	assert.Equal(t, defaultStatusCode, w.Code)
+	assert.Equal(t, "https://foo.example.com/", w.Header().Get("Location"))
+
+	go runHealthChecks(t.Context(), logger, cfg, srv.Client())
+	rule := cfg.RuleMap["healthcheck.example.com"][0]
+
+	fallbackRule := cfg.RuleMap["healthcheck.example.com"][1]
+	assert.Eventually(t, func() bool {
+		return !ruleHealth.healthy("healthcheck.example.com", rule) && !ruleHealth.healthy("healthcheck.example.com", fallbackRule)
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, float64(0), testutil.ToFloat64(ruleHealthMetric.WithLabelValues("healthcheck.example.com", rule.id())))
+
+	w = request()
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "https://fallback.example.com/", w.Header().Get("Location"))
+
+	// to_fallback takes precedence over location_on_miss
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://healthcheck.example.com/bar", nil))
+	assert.Equal(t, defaultStatusCode, w.Code)
+	assert.Equal(t, "https://bar-fallback.example.com/", w.Header().Get("Location"))
+
+	healthy.Store(true)
+	assert.Eventually(t, func() bool {
+		return ruleHealth.healthy("healthcheck.example.com", rule)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	w = request()
+	assert.Equal(t, defaultStatusCode, w.Code)
+	assert.Equal(t, "https://foo.example.com/", w.Header().Get("Location"))
+
+	// rules with a health check are never cached
+	assert.Equal(t, 0, cache.sets)
+}
+
+func Test_buildRulesHealthcheck(t *testing.T) {
+	logger := newTestLogger()
+
+	ac := &AppConfig{}
+	got := *buildRules(logger, &Rules{
+		{From: "example.com/valid", To: "https://foo.com", Healthcheck: &HealthcheckConfig{URL: "https://foo.com/healthz"}},
+		{From: "example.com/invalid", To: "https://foo.com", Healthcheck: &HealthcheckConfig{URL: "foo.com/healthz"}},
+	}, ac)
+
+	assert.Equal(t, 1, len(got))
+	assert.Equal(t, defaultHealthcheckInterval, got[0].Healthcheck.Interval)
+	assert.Equal(t, defaultHealthcheckTimeout, got[0].Healthcheck.Timeout)
+	assert.Equal(t, 1, len(ac.droppedRules))
+}
@@ -4,13 +4,15 @@ package main
 
 import (
 	"log/slog"
+	"os"
+	"sync"
 )
 
 var testLogger *slog.Logger
 
 func newTestLogger() *slog.Logger {
 	if testLogger == nil {
-		testLogger = NewLogger(slog.LevelDebug, true)
+		testLogger = NewLogger(slog.LevelDebug, true, os.Stdout)
 	}
 	return testLogger
 }
@@ -24,3 +26,61 @@ func newTestRules(p string) RuleMapping {
 
 	return r.RuleMap
 }
+
+// spyCache is a Cache that never returns a hit and records calls made to it
+type spyCache struct {
+	lock    sync.Mutex
+	gets    int
+	sets    int
+	flushes int
+	// hostFlushes are the hosts passed to FlushHost, in order
+	hostFlushes []string
+	// onGet, onSet, and onFlush, if set, are called after the call has been recorded
+	onGet   func()
+	onSet   func()
+	onFlush func()
+}
+
+func (s *spyCache) Get(parameters CacheGetParameters) (*CacheResponse, error) {
+	s.lock.Lock()
+	s.gets++
+	s.lock.Unlock()
+
+	if s.onGet != nil {
+		s.onGet()
+	}
+	return nil, nil
+}
+
+func (s *spyCache) Set(parameters CacheSetParameters) error {
+	s.lock.Lock()
+	s.sets++
+	s.lock.Unlock()
+
+	if s.onSet != nil {
+		s.onSet()
+	}
+	return nil
+}
+
+func (s *spyCache) Flush() (int, error) {
+	s.lock.Lock()
+	s.flushes++
+	s.lock.Unlock()
+
+	if s.onFlush != nil {
+		s.onFlush()
+	}
+	return 0, nil
+}
+
+func (s *spyCache) Stats() (CacheStats, error) {
+	return newCacheStats(nil), nil
+}
+
+func (s *spyCache) FlushHost(host string) (int, error) {
+	s.lock.Lock()
+	s.hostFlushes = append(s.hostFlushes, host)
+	s.lock.Unlock()
+	return 0, nil
+}
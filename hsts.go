@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// hstsPreloadMinMaxAge is the shortest max-age accepted by browsers' HSTS preload lists, one year
+const hstsPreloadMinMaxAge = 31536000
+
+// HSTSConfig sets the Strict-Transport-Security header on https responses when MaxAge is set
+type HSTSConfig struct {
+	// MaxAge is how long, in seconds, browsers only use https for the host
+	MaxAge            int  `yaml:"max_age"`
+	IncludeSubdomains bool `yaml:"include_subdomains"`
+	Preload           bool `yaml:"preload"`
+}
+
+func (c HSTSConfig) enabled() bool {
+	return c.MaxAge > 0
+}
+
+// preloadable reports whether the header meets the requirements of browsers' HSTS preload lists
+func (c HSTSConfig) preloadable() bool {
+	return c.IncludeSubdomains && c.MaxAge >= hstsPreloadMinMaxAge
+}
+
+// header returns the value of the Strict-Transport-Security header
+func (c HSTSConfig) header() string {
+	h := "max-age=" + strconv.Itoa(c.MaxAge)
+	if c.IncludeSubdomains {
+		h += "; includeSubDomains"
+	}
+	if c.Preload {
+		h += "; preload"
+	}
+	return h
+}
+
+// hstsMiddleware sets the Strict-Transport-Security header on responses to https requests
+//
+// Browsers ignore the header on plaintext responses, so it isn't sent with them
+func hstsMiddleware(c HSTSConfig, trustedProxies []*net.IPNet, next http.Handler) http.Handler {
+	header := c.header()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requestScheme(r, trustedProxies) == SchemeHTTPS {
+			w.Header().Set("Strict-Transport-Security", header)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// preferredLanguage returns the language tag with the highest quality in an Accept-Language header, lowercased
+//
+// The first of several tags with the same quality wins. The wildcard and tags with a quality of 0 are never preferred,
+// and an empty string is returned if there is no preferred language
+func preferredLanguage(header string) string {
+	preferred := ""
+	best := 0.0
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		tag = strings.TrimSpace(tag)
+		if tag == "" || tag == "*" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			k, v, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if !ok || strings.TrimSpace(k) != "q" {
+				continue
+			}
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil {
+				parsed = 0
+			}
+			q = parsed
+		}
+
+		if q > best {
+			preferred = tag
+			best = q
+		}
+	}
+
+	return strings.ToLower(preferred)
+}
+
+// languageMatches reports whether language is one of the wanted languages. A wanted language without a region, e.g.
+// `fr`, also matches its regional variants, e.g. `fr-ca`
+func languageMatches(want []string, language string) bool {
+	if language == "" {
+		return false
+	}
+
+	for _, w := range want {
+		if language == w || strings.HasPrefix(language, w+"-") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,51 @@
+//go:build unit_test
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_preferredLanguage(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{header: "", want: ""},
+		{header: "fr", want: "fr"},
+		{header: "en-US", want: "en-us"},
+		{header: "en;q=0.5, fr-CA;q=0.8", want: "fr-ca"},
+		{header: "de, en;q=1", want: "de"},
+		{header: "*", want: ""},
+		{header: "*, fr;q=0.1", want: "fr"},
+		{header: "fr;q=0", want: ""},
+		{header: "fr;q=abc, en;q=0.2", want: "en"},
+		{header: " , ;q=1", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			assert.Equal(t, tt.want, preferredLanguage(tt.header))
+		})
+	}
+}
+
+func Test_languageMatches(t *testing.T) {
+	tests := []struct {
+		name     string
+		want     []string
+		language string
+		match    bool
+	}{
+		{name: "exact", want: []string{"fr"}, language: "fr", match: true},
+		{name: "region of language", want: []string{"fr"}, language: "fr-ca", match: true},
+		{name: "language of region", want: []string{"fr-ca"}, language: "fr", match: false},
+		{name: "shared prefix", want: []string{"fr"}, language: "fry", match: false},
+		{name: "no language", want: []string{"fr"}, language: "", match: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.match, languageMatches(tt.want, tt.language))
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"log/slog"
+	"regexp/syntax"
+	"sort"
+	"strings"
+)
+
+// ruleOverlap is a pair of rules for the same host that can both match a path. First is declared before Second, so it
+// wins for the paths they share
+type ruleOverlap struct {
+	Host   string
+	First  string
+	Second string
+}
+
+// literalPrefix returns the literal characters an expression starts with, ignoring a leading `^`
+func literalPrefix(exp string) string {
+	re, err := syntax.Parse(exp, syntax.Perl)
+	if err != nil {
+		return ""
+	}
+
+	subs := []*syntax.Regexp{re}
+	if re.Op == syntax.OpConcat {
+		subs = re.Sub
+	}
+
+	var b strings.Builder
+	for _, sub := range subs {
+		switch {
+		case sub.Op == syntax.OpBeginText || sub.Op == syntax.OpBeginLine:
+		case sub.Op == syntax.OpLiteral && sub.Flags&syntax.FoldCase == 0:
+			b.WriteString(string(sub.Rune))
+		default:
+			return b.String()
+		}
+	}
+	return b.String()
+}
+
+// samplePath returns a path that the rule matches, or at least the literal path every match of the rule starts with
+func samplePath(rule Rule) string {
+	if rule.compiled == nil {
+		return rule.path
+	}
+	return literalPrefix(rule.compiled.String())
+}
+
+// overlappingRules finds pairs of rules for the same host where one rule matches paths the other would
+//
+// This is best-effort: a rule is only compared against the literal prefix of the other's expression, so overlaps
+// between expressions that start with a character class or group aren't found. Catch-all rules are skipped because
+// they're always tried last
+func overlappingRules(rules RuleMapping) []ruleOverlap {
+	logger := slog.New(slog.DiscardHandler)
+	overlaps := []ruleOverlap{}
+
+	hosts := make([]string, 0, len(rules))
+	for host := range rules {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	for _, host := range hosts {
+		bucket := rules[host]
+		for i, first := range bucket {
+			if first.catchAll {
+				continue
+			}
+			for _, second := range bucket[i+1:] {
+				if second.catchAll {
+					continue
+				}
+
+				_, shadows := matchRule(logger, first, samplePath(second))
+				_, shadowed := matchRule(logger, second, samplePath(first))
+				if shadows || shadowed {
+					overlaps = append(overlaps, ruleOverlap{Host: host, First: first.id(), Second: second.id()})
+				}
+			}
+		}
+	}
+
+	return overlaps
+}
+
+// lintRules logs a warning for every pair of overlapping rules
+func lintRules(l *slog.Logger, rules RuleMapping) {
+	logger := l.WithGroup("lint")
+	for _, o := range overlappingRules(rules) {
+		logger.Warn("rules overlap, the first rule wins for paths both match", "host", o.Host, "first", o.First, "second", o.Second)
+	}
+}
@@ -0,0 +1,57 @@
+//go:build unit_test
+
+package main
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func Test_literalPrefix(t *testing.T) {
+	tests := []struct {
+		exp  string
+		want string
+	}{
+		{exp: "^/foo", want: "/foo"},
+		{exp: "^/foo/(.+)", want: "/foo/"},
+		{exp: "^/foo$", want: "/foo"},
+		{exp: "^/blog/[0-9]{4}", want: "/blog/"},
+		{exp: "^(?i)/foo", want: ""},
+		{exp: "^.*", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.exp, func(t *testing.T) {
+			assert.Equal(t, tt.want, literalPrefix(tt.exp))
+		})
+	}
+}
+
+func Test_overlappingRules(t *testing.T) {
+	logger := newTestLogger()
+	cfg, err := loadConfig(logger, "./fixtures/overlapping_rules.yml")
+	assert.NoError(t, err)
+
+	want := []ruleOverlap{
+		{Host: "example.com", First: "foo", Second: "foo-captures"},
+		{Host: "example.com", First: "bar-exact", Second: "bar-prefix"},
+	}
+	assert.Equal(t, want, overlappingRules(cfg.RuleMap))
+}
+
+func Test_loadConfigLintOverlappingRules(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+
+	_, err := loadConfig(logger, "./fixtures/overlapping_rules.yml")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(buf.String(), "rules overlap"))
+
+	// linting is off by default
+	buf.Reset()
+	_, err = loadConfig(logger, "./fixtures/rules.yml")
+	assert.NoError(t, err)
+	assert.NotContains(t, buf.String(), "rules overlap")
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+const (
+	// NetworkTCP listens on IPv4 and IPv6. Binding `[::]` or an empty host accepts both. This is the default
+	NetworkTCP = "tcp"
+	// NetworkTCP4 only listens on IPv4
+	NetworkTCP4 = "tcp4"
+	// NetworkTCP6 only listens on IPv6
+	NetworkTCP6 = "tcp6"
+)
+
+func validNetwork(network string) bool {
+	switch network {
+	case NetworkTCP, NetworkTCP4, NetworkTCP6:
+		return true
+	default:
+		return false
+	}
+}
+
+type InvalidListenAddressError struct {
+	address string
+	reason  string
+}
+
+func (e InvalidListenAddressError) Error() string {
+	return fmt.Sprintf("invalid listen address '%s': %s", e.address, e.reason)
+}
+
+// checkListenAddress reports whether address, e.g. `0.0.0.0:8484`, `[::]:8484`, or `[2001:db8::1]:8484`, can be
+// listened on with network
+func checkListenAddress(network string, address string) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return InvalidListenAddressError{address: address, reason: err.Error()}
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return InvalidListenAddressError{address: address, reason: fmt.Sprintf("port '%s' isn't a number between 0 and 65535", port)}
+	}
+
+	// hostnames are resolved by net.Listen
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+	switch {
+	case network == NetworkTCP4 && ip.To4() == nil:
+		return InvalidListenAddressError{address: address, reason: "tcp4 can't listen on an IPv6 address"}
+	case network == NetworkTCP6 && ip.To4() != nil:
+		return InvalidListenAddressError{address: address, reason: "tcp6 can't listen on an IPv4 address"}
+	}
+	return nil
+}
+
+// listen checks address and listens on it with network
+func listen(network string, address string) (net.Listener, error) {
+	if err := checkListenAddress(network, address); err != nil {
+		return nil, err
+	}
+	return net.Listen(network, address)
+}
@@ -0,0 +1,70 @@
+//go:build unit_test
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_checkListenAddress(t *testing.T) {
+	tests := []struct {
+		name    string
+		network string
+		address string
+		wantErr bool
+	}{
+		{name: "ipv4 any", network: NetworkTCP, address: "0.0.0.0:8484"},
+		{name: "ipv6 any", network: NetworkTCP, address: "[::]:8484"},
+		{name: "empty host", network: NetworkTCP, address: ":8484"},
+		{name: "ipv6 literal", network: NetworkTCP, address: "[2001:db8::1]:8484"},
+		{name: "hostname", network: NetworkTCP, address: "localhost:8484"},
+		{name: "tcp4 ipv4", network: NetworkTCP4, address: "0.0.0.0:8484"},
+		{name: "tcp4 empty host", network: NetworkTCP4, address: ":8484"},
+		{name: "tcp4 ipv6", network: NetworkTCP4, address: "[::]:8484", wantErr: true},
+		{name: "tcp6 ipv6 any", network: NetworkTCP6, address: "[::]:8484"},
+		{name: "tcp6 ipv6 literal", network: NetworkTCP6, address: "[2001:db8::1]:8484"},
+		{name: "tcp6 ipv4", network: NetworkTCP6, address: "0.0.0.0:8484", wantErr: true},
+		{name: "unbracketed ipv6", network: NetworkTCP, address: "::1:8484", wantErr: true},
+		{name: "no port", network: NetworkTCP, address: "0.0.0.0", wantErr: true},
+		{name: "port out of range", network: NetworkTCP, address: "0.0.0.0:84840", wantErr: true},
+		{name: "named port", network: NetworkTCP, address: "0.0.0.0:http", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkListenAddress(tt.network, tt.address)
+			if tt.wantErr {
+				assert.ErrorAs(t, err, &InvalidListenAddressError{})
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func Test_listen(t *testing.T) {
+	ln, err := listen(NetworkTCP4, "127.0.0.1:0")
+	assert.NoError(t, err)
+	assert.Equal(t, "tcp", ln.Addr().Network())
+	assert.NoError(t, ln.Close())
+
+	ln, err = listen(NetworkTCP6, "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 isn't available: %s", err)
+	}
+	assert.Contains(t, ln.Addr().String(), "[::1]:")
+	assert.NoError(t, ln.Close())
+}
+
+func Test_parseConfigNetwork(t *testing.T) {
+	logger := newTestLogger()
+
+	cfg, err := parseConfig(logger, []byte("server:\n  network: 'tcp6'\nlisten_address: '[::]:8484'"))
+	assert.NoError(t, err)
+	assert.Equal(t, NetworkTCP6, cfg.Server.Network)
+
+	cfg, err = parseConfig(logger, []byte("server:\n  network: 'udp'"))
+	assert.NoError(t, err)
+	assert.Equal(t, NetworkTCP, cfg.Server.Network)
+}
@@ -1,15 +1,95 @@
 package main
 
 import (
+	"gopkg.in/natefinch/lumberjack.v2"
+	"hash/fnv"
+	"io"
 	"log/slog"
+	"math"
+	"net/http"
 	"os"
 )
 
-func NewLogger(level slog.Level, src bool) *slog.Logger {
+const (
+	LogOutputStdout = "stdout"
+	LogOutputFile   = "file"
+)
+
+type LogConfig struct {
+	// Output is where logs are written, either stdout or file
+	Output   string `yaml:"output"`
+	FilePath string `yaml:"file_path"`
+	// MaxSize is the size in megabytes a log file can reach before it's rotated
+	MaxSize int `yaml:"max_size"`
+	// MaxAge is the number of days rotated log files are kept. 0 keeps them forever
+	MaxAge int `yaml:"max_age"`
+	// MaxBackups is the number of rotated log files kept. 0 keeps all of them
+	MaxBackups int  `yaml:"max_backups"`
+	Compress   bool `yaml:"compress"`
+}
+
+func NewLogger(level slog.Level, src bool, w io.Writer) *slog.Logger {
 	opts := &slog.HandlerOptions{
 		AddSource:   src,
 		Level:       level,
 		ReplaceAttr: nil,
 	}
-	return slog.New(slog.NewJSONHandler(os.Stdout, opts))
+	return slog.New(slog.NewJSONHandler(w, opts))
+}
+
+// logOptionsFromEnv returns the log level and whether the source of log lines is included, based on DEBUG_LOGS
+func logOptionsFromEnv() (slog.Level, bool) {
+	if os.Getenv("DEBUG_LOGS") != "" {
+		return slog.LevelDebug, true
+	}
+	return slog.LevelInfo, false
+}
+
+// newLogWriter returns the writer logs should be written to. Log files are rotated based on size and age
+func newLogWriter(c LogConfig) io.Writer {
+	if c.Output != LogOutputFile {
+		return os.Stdout
+	}
+
+	return &lumberjack.Logger{
+		Filename:   c.FilePath,
+		MaxSize:    c.MaxSize,
+		MaxAge:     c.MaxAge,
+		MaxBackups: c.MaxBackups,
+		Compress:   c.Compress,
+	}
+}
+
+type AccessLogConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// SampleRate is the fraction, between 0 and 1, of successful redirects that are logged
+	SampleRate float64 `yaml:"sample_rate"`
+}
+
+// statusRecorder records the status code written to a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+// sampleAccessLog reports whether a request should be access logged
+//
+// Sampling is based on a hash of the correlation ID rather than chance, so a request with a given ID is either always
+// or never logged
+func sampleAccessLog(traceID string, rate float64) bool {
+	if rate >= 1 {
+		return true
+	}
+	if rate <= 0 {
+		return false
+	}
+
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(traceID))
+	return float64(h.Sum32())/math.MaxUint32 < rate
 }
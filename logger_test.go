@@ -0,0 +1,72 @@
+//go:build unit_test
+
+package main
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"log/slog"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_newLogWriter(t *testing.T) {
+	assert.Equal(t, os.Stdout, newLogWriter(LogConfig{}))
+	assert.Equal(t, os.Stdout, newLogWriter(LogConfig{Output: LogOutputStdout}))
+
+	p := filepath.Join(t.TempDir(), "redirector.log")
+	w := newLogWriter(LogConfig{Output: LogOutputFile, FilePath: p, MaxSize: 1})
+	logger := NewLogger(slog.LevelInfo, false, w)
+	logger.Info("hello from a file")
+
+	b, err := os.ReadFile(p)
+	assert.Nil(t, err)
+	assert.Contains(t, string(b), `"msg":"hello from a file"`)
+}
+
+func Test_sampleAccessLog(t *testing.T) {
+	assert.True(t, sampleAccessLog("abc", 1))
+	assert.False(t, sampleAccessLog("abc", 0))
+	// the same ID is always sampled the same way
+	assert.Equal(t, sampleAccessLog("abc", 0.5), sampleAccessLog("abc", 0.5))
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+	cfg, _ := loadConfig(logger, "./fixtures/rules.yml")
+	cfg.AccessLogs.Enabled = true
+	cfg.AccessLogs.SampleRate = 0.25
+	handler := handleRequest(logger, &spyCache{}, cfg)
+
+	countAccessLogs := func() int {
+		n := strings.Count(buf.String(), `"msg":"access"`)
+		buf.Reset()
+		return n
+	}
+
+	const n = 2000
+	for i := 0; i < n; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://localhost/foo", nil))
+	}
+	sampled := countAccessLogs()
+	assert.InDelta(t, n*0.25, sampled, n*0.05)
+
+	// misses are always logged
+	for i := 0; i < 100; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://localhost/i-dont-exist", nil))
+	}
+	assert.Equal(t, 100, countAccessLogs())
+
+	// a request with a given correlation ID is logged consistently
+	for i := 0; i < 10; i++ {
+		req := httptest.NewRequest("GET", "http://localhost/foo", nil)
+		req.Header.Set("X-Request-Id", "consistent")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	consistent := countAccessLogs()
+	assert.True(t, consistent == 0 || consistent == 10)
+}
@@ -5,16 +5,20 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	networkingv1 "k8s.io/api/networking/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"log"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	kyaml "sigs.k8s.io/yaml"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -24,15 +28,34 @@ var (
 	generateIngressName      string
 	generateNamespace        string
 	generateIngressClassName string
+	generateTags             tagsFlag
 )
 
+// tagsFlag collects every value of a repeated flag, e.g. `-tag marketing -tag legacy`
+type tagsFlag []string
+
+func (t *tagsFlag) String() string {
+	return strings.Join(*t, ",")
+}
+
+func (t *tagsFlag) Set(v string) error {
+	*t = append(*t, v)
+	return nil
+}
+
 func parseArgs() {
+	if len(os.Args) > 1 && os.Args[1] == "test" {
+		parseTestArgs(os.Args[2:])
+		return
+	}
+
 	generateFS := flag.NewFlagSet("generate", flag.ExitOnError)
 	p := generateFS.String("out", "./redirector-ingress.yml", "where to write Ingress manifest")
 	n := generateFS.String("namespace", "redirector", "Kubernetes namespace where redirector is deployed")
 	s := generateFS.String("service-name", "redirector", "Kubernetes service name to send traffic to")
 	i := generateFS.String("ingress-name", "redirector", "Kubernetes service name to send traffic to")
 	c := generateFS.String("ingress-class", "nginx", "Kubernetes ingress class set as ingressClassName")
+	generateFS.Var(&generateTags, "tag", "only include rules with this tag. Can be repeated to include rules with any of the tags")
 
 	err := generateFS.Parse(os.Args[2:])
 	if err != nil {
@@ -48,8 +71,6 @@ func parseArgs() {
 }
 
 func generateIngress(logger *slog.Logger) error {
-	ingressClass := generateIngressClassName
-
 	// TODO abstract this
 	confPath, ok := os.LookupEnv("CONFIG_PATH")
 	if !ok {
@@ -68,6 +89,30 @@ func generateIngress(logger *slog.Logger) error {
 	}
 
 	logger.With("manifest_path", generateOutputPath).Info("generating manifest")
+	ing, err := newIngress(logger, cfg.RuleMap.withAnyTag(generateTags))
+	if err != nil {
+		return err
+	}
+
+	m, err := kyaml.Marshal(ing)
+
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(generateOutputPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(m)
+
+	return nil
+}
+
+// newIngress returns an Ingress routing the hosts and paths of rules to the redirector's service
+func newIngress(logger *slog.Logger, rules RuleMapping) (networkingv1.Ingress, error) {
+	ingressClass := generateIngressClassName
 	ing := networkingv1.Ingress{
 		TypeMeta: metav1.TypeMeta{
 			Kind:       "Ingress",
@@ -89,7 +134,7 @@ func generateIngress(logger *slog.Logger) error {
 	// Because we use regular expressions, we have to leave it up to the Ingress Controller
 	pt := networkingv1.PathTypeImplementationSpecific
 
-	for domain, rules := range cfg.RuleMap {
+	for domain, rules := range rules {
 		r := networkingv1.IngressRule{
 			Host: domain,
 			IngressRuleValue: networkingv1.IngressRuleValue{
@@ -103,7 +148,7 @@ func generateIngress(logger *slog.Logger) error {
 			u, err := fromAsURL(logger, rule.From)
 			if err != nil {
 				logger.With("from", rule.From).With("to", rule.To).Warn("skipping ")
-				return err
+				return ing, err
 			}
 
 			p := networkingv1.HTTPIngressPath{
@@ -126,35 +171,74 @@ func generateIngress(logger *slog.Logger) error {
 		ing.Spec.Rules = append(ing.Spec.Rules, r)
 	}
 
-	m, err := kyaml.Marshal(ing)
-
-	if err != nil {
-		return err
-	}
-
-	f, err := os.Create(generateOutputPath)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	_, err = f.Write(m)
-
-	return nil
+	return ing, nil
 }
 
-func newMetricsServer() http.Handler {
+func newMetricsServer(logger *slog.Logger, cache Cache, ac *AppConfig) http.Handler {
 	mux := http.NewServeMux()
 	mux.Handle("/metrics", promhttp.Handler())
 
+	stager := &configStager{}
+	mux.Handle("POST /admin/config/stage", handleStageConfig(logger, stager))
+	mux.Handle("POST /admin/config/activate", handleActivateConfig(logger, stager, cache, ac))
+	mux.Handle("POST /admin/cache/flush", handleFlushCache(logger, cache, ac))
+	mux.Handle("GET /admin/cache/stats", handleCacheStats(logger, cache, ac.Cache))
+	mux.Handle("POST /admin/metrics/reset-rule-counters", handleResetRuleCounters(logger))
+	mux.Handle("GET /debug/rules", handleDebugRules(ac))
+
+	if ac.Metrics.Auth.enabled() {
+		return metricsAuthMiddleware(ac.Metrics.Auth, mux)
+	}
 	return mux
 }
 
 func newServer(logger *slog.Logger, cache Cache, ac *AppConfig) http.Handler {
 	mux := http.NewServeMux()
 
-	mux.Handle("/", handleRequest(logger, cache, ac))
-	mux.Handle("/status", handleStatus())
-	return mux
+	var redirects http.Handler = handleRequest(logger, cache, ac)
+	if ac.Maintenance.Enabled {
+		redirects = maintenanceMiddleware(logger, ac.Maintenance, ac.Server.trustedProxies, redirects)
+	}
+	// /status isn't rate limited, since probes tend to come from a single address
+	if ac.RateLimit.enabled() {
+		redirects = rateLimitMiddleware(newRateLimiter(ac.RateLimit), ac.Server.trustedProxies, ac.Server.RetryAfter, redirects)
+	}
+	mux.Handle("/", redirects)
+	mux.Handle("/status", handleStatus(ac))
+	if ac.Server.ResolveEndpoint {
+		mux.Handle("GET /resolve", handleResolve(redirects))
+	}
+
+	var h http.Handler = allowedMethodsMiddleware(ac.Server.AllowedMethods, mux)
+	h = concurrencyLimitMiddleware(ac.Server.MaxConcurrentRequests, ac.Server.RetryAfter, h)
+	if ac.Server.Compression {
+		h = compressionMiddleware(h)
+	}
+	if ac.Server.ServerHeader != "" {
+		h = serverHeaderMiddleware(ac.Server.ServerHeader, h)
+	}
+	if ac.HSTS.enabled() {
+		h = hstsMiddleware(ac.HSTS, ac.Server.trustedProxies, h)
+	}
+	h = requestValuesMiddleware(ac.Tracing.HeaderName, ac.Server.trustedProxies, h)
+	return h
+}
+
+// newHTTPServer returns the redirect server. Every request's context is derived from ctx, and from a per-connection
+// context that's cancelled after server.connection_timeout
+func newHTTPServer(ctx context.Context, cfg *AppConfig, handler http.Handler) *http.Server {
+	conns := &connContexts{timeout: cfg.Server.ConnectionTimeout}
+	return &http.Server{
+		Addr:              cfg.ListenAddress,
+		Handler:           handler,
+		ReadTimeout:       1 * time.Second,
+		ReadHeaderTimeout: 1 * time.Second,
+		WriteTimeout:      1 * time.Second,
+		IdleTimeout:       30 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return ctx },
+		ConnContext:       conns.connContext,
+		ConnState:         conns.connState,
+	}
 }
 
 func server(ctx context.Context, logger *slog.Logger) error {
@@ -173,22 +257,75 @@ func server(ctx context.Context, logger *slog.Logger) error {
 		os.Exit(1)
 	}
 
-	cache := NewInMemoryCache(ctx, logger, cfg.Cache.CleanupInterval, cfg.Cache.TTL)
+	if cfg.Log.Output == LogOutputFile {
+		logger.Info("writing logs to file", "file_path", cfg.Log.FilePath)
+		logLevel, logSrc := logOptionsFromEnv()
+		logger = NewLogger(logLevel, logSrc, newLogWriter(cfg.Log))
+	}
+
+	// metric names depend on the config, so they're only registered once it's loaded
+	if err := registerMetrics(prometheus.DefaultRegisterer, cfg.Metrics); err != nil {
+		logger.Error("error registering metrics", "err", err.Error())
+		os.Exit(1)
+	}
+
+	if len(cfg.Tests) > 0 {
+		if err := runSelfTests(logger, cfg); err != nil {
+			logger.Error("config failed its self tests, exiting", "err", err.Error())
+			os.Exit(1)
+		}
+		// self tests shouldn't count towards finding unmatched rules
+		ruleMatchCounts.reset()
+	}
+
+	recordActiveHosts(cfg.RuleMap)
+
+	if cfg.GeoIP.enabled() {
+		db, err := openGeoIPDatabase(cfg.GeoIP.Database)
+		if err != nil {
+			logger.Error("error loading GeoIP database", "err", err.Error())
+			os.Exit(1)
+		}
+		cfg.geoip = db
+		go geoIPReloader(ctx, logger, db)
+	}
+
+	cache, err := newCache(ctx, logger, cfg.Cache)
+	if err != nil {
+		logger.Error("error creating the cache", "err", err.Error())
+		os.Exit(1)
+	}
+
+	// SIGUSR1 flushes the cache without reloading the config
+	flushSignals := make(chan os.Signal, 1)
+	signal.Notify(flushSignals, syscall.SIGUSR1)
+	defer signal.Stop(flushSignals)
+	go flushOnSignal(ctx, logger, cache, flushSignals)
 
 	// start background config reloader
-	go reloader(ctx, logger, confPath, cfg)
+	go reloader(ctx, logger, confPath, cfg, cache)
+
+	if cfg.UnmatchedRulesLogInterval > 0 {
+		go reportUnmatchedRules(ctx, logger, cfg, cfg.UnmatchedRulesLogInterval)
+	}
+
+	go runHealthChecks(ctx, logger, cfg, &http.Client{})
 
 	srv := newServer(logger, cache, cfg)
 
-	s := &http.Server{
-		Addr:              cfg.ListenAddress,
-		Handler:           srv,
-		ReadTimeout:       1 * time.Second,
-		ReadHeaderTimeout: 1 * time.Second,
-		WriteTimeout:      1 * time.Second,
-		IdleTimeout:       30 * time.Second,
+	// handlers are only cancelled if they're still running once shutdown's grace period is over
+	baseCtx, cancelBase := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelBase()
+	s := newHTTPServer(baseCtx, cfg, srv)
+	if cfg.TLS.enabled() {
+		tlsConfig, err := newTLSConfig(cfg.TLS)
+		if err != nil {
+			logger.Error("error loading TLS certificates", "err", err.Error())
+			os.Exit(1)
+		}
+		s.TLSConfig = tlsConfig
 	}
-	msrv := newMetricsServer()
+	msrv := newMetricsServer(logger, cache, cfg)
 	ms := &http.Server{
 		Addr:         cfg.MetricsServerListenAddress,
 		Handler:      msrv,
@@ -197,9 +334,27 @@ func server(ctx context.Context, logger *slog.Logger) error {
 		IdleTimeout:  1 * time.Minute,
 	}
 
+	ln, err := listen(cfg.Server.Network, cfg.ListenAddress)
+	if err != nil {
+		logger.WithGroup("server").Error("error listening", "err", err.Error())
+		os.Exit(1)
+	}
+	mln, err := listen(cfg.Server.Network, cfg.MetricsServerListenAddress)
+	if err != nil {
+		logger.WithGroup("metrics_server").Error("error listening", "err", err.Error())
+		os.Exit(1)
+	}
+
 	go func() {
-		logger.WithGroup("server").Info("starting server", "listen_address", cfg.ListenAddress)
-		if err := s.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logger.WithGroup("server").Info("starting server", "listen_address", cfg.ListenAddress, "network", cfg.Server.Network, "tls", s.TLSConfig != nil)
+		var err error
+		if s.TLSConfig != nil {
+			// certificates come from TLSConfig.GetCertificate
+			err = s.ServeTLS(ln, "", "")
+		} else {
+			err = s.Serve(ln)
+		}
+		if err != nil && err != http.ErrServerClosed {
 			logger.WithGroup("server").Error("error serving", "err", err.Error())
 			os.Exit(1)
 		}
@@ -207,7 +362,7 @@ func server(ctx context.Context, logger *slog.Logger) error {
 
 	go func() {
 		logger.WithGroup("metrics_server").Info("starting metrics")
-		if err := ms.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := ms.Serve(mln); err != nil && err != http.ErrServerClosed {
 			logger.WithGroup("metrics_server").Error("error serving", "err", err.Error())
 			os.Exit(1)
 		}
@@ -223,6 +378,7 @@ func server(ctx context.Context, logger *slog.Logger) error {
 		shutdownCtx, cancel := context.WithTimeout(shutdownCtx, 5*time.Second)
 		defer cancel()
 		if err := s.Shutdown(shutdownCtx); err != nil {
+			cancelBase()
 			logger.WithGroup("server").Error("error shutting down", "err", err.Error())
 		} else {
 			logger.Info("shutdown redirect server")
@@ -252,22 +408,25 @@ func run(ctx context.Context, args []string) error {
 
 	parseArgs()
 
-	logLevel := slog.LevelInfo
-	logSrc := false
-	if os.Getenv("DEBUG_LOGS") != "" {
-		logLevel = slog.LevelDebug
-		logSrc = true
+	logLevel, logSrc := logOptionsFromEnv()
+	logOut := os.Stdout
+	// test writes its results to stdout, so its logs go elsewhere
+	if args[1] == "test" {
+		logOut = os.Stderr
 	}
-
-	logger := NewLogger(logLevel, logSrc)
+	logger := NewLogger(logLevel, logSrc, logOut)
 
 	switch args[1] {
 	case "server":
 		return server(ctx, logger)
 	case "generate":
 		return generateIngress(logger)
+	case "selftest":
+		return selfTest(logger)
+	case "test":
+		return testRequests(logger)
 	default:
-		return errors.New("usage: redirector [server|generate]")
+		return errors.New("usage: redirector [server|generate|selftest|test]")
 	}
 }
 
@@ -275,7 +434,7 @@ func main() {
 	ctx := context.Background()
 
 	if len(os.Args) < 2 {
-		fmt.Fprintln(os.Stderr, "usage: redirector [server|generate]")
+		fmt.Fprintln(os.Stderr, "usage: redirector [server|generate|selftest|test]")
 		os.Exit(1)
 	}
 
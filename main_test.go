@@ -0,0 +1,83 @@
+//go:build unit_test
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestNewIngressTags(t *testing.T) {
+	logger := newTestLogger()
+	cfg, err := parseConfig(logger, []byte(`
+rules:
+  - from: 'example.com/sale'
+    to: 'https://shop.example.com/'
+    tags: ['marketing']
+  - from: 'example.com/old'
+    to: 'https://example.com/new'
+    tags: ['legacy', 'marketing']
+  - from: 'example.com/untagged'
+    to: 'https://example.com/'
+  - from: 'legacy.example.com/'
+    to: 'https://example.com/'
+    tags: ['legacy']
+`))
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name string
+		tags []string
+		want map[string][]string
+	}{
+		{
+			name: "no filter",
+			want: map[string][]string{
+				"example.com":        {"/sale", "/old", "/untagged"},
+				"legacy.example.com": {"/"},
+			},
+		},
+		{
+			name: "one tag",
+			tags: []string{"marketing"},
+			want: map[string][]string{"example.com": {"/sale", "/old"}},
+		},
+		{
+			name: "any of several tags",
+			tags: []string{"legacy", "unused"},
+			want: map[string][]string{
+				"example.com":        {"/old"},
+				"legacy.example.com": {"/"},
+			},
+		},
+		{
+			name: "unknown tag",
+			tags: []string{"unused"},
+			want: map[string][]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ing, err := newIngress(logger, cfg.RuleMap.withAnyTag(tt.tags))
+			assert.NoError(t, err)
+
+			got := map[string][]string{}
+			for _, r := range ing.Spec.Rules {
+				paths := []string{}
+				for _, p := range r.HTTP.Paths {
+					paths = append(paths, p.Path)
+				}
+				got[r.Host] = paths
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_tagsFlag(t *testing.T) {
+	var tags tagsFlag
+	assert.NoError(t, tags.Set("marketing"))
+	assert.NoError(t, tags.Set("legacy"))
+	assert.Equal(t, tagsFlag{"marketing", "legacy"}, tags)
+	assert.Equal(t, "marketing,legacy", tags.String())
+}
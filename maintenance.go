@@ -0,0 +1,104 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type MaintenanceConfig struct {
+	// Enabled short-circuits every redirect request with the maintenance response
+	Enabled bool `yaml:"enabled"`
+	// Location, if set, is where requests are redirected to during maintenance
+	Location string `yaml:"location"`
+	// Status defaults to 302 when Location is set, otherwise 503
+	Status int `yaml:"status"`
+	// BypassCIDRs are client networks that skip maintenance and are redirected as usual
+	BypassCIDRs []string `yaml:"bypass_cidrs"`
+	bypass      []*net.IPNet
+}
+
+// parseCIDRs parses a list of CIDRs, skipping and logging any that are invalid
+//
+// A bare IP address is treated as a single-address network
+func parseCIDRs(l *slog.Logger, cidrs []string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		if !strings.Contains(c, "/") {
+			if ip := net.ParseIP(c); ip != nil {
+				bits := 8 * net.IPv4len
+				if ip.To4() == nil {
+					bits = 8 * net.IPv6len
+				}
+				c = c + "/" + strconv.Itoa(bits)
+			}
+		}
+
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			l.WithGroup("config").Warn("ignoring invalid CIDR", "cidr", c, "err", err)
+			continue
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// containsIP reports whether ip is in any of nets
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the IP address of the client that made a request
+//
+// X-Forwarded-For is only used when the request came from a trusted proxy. It's read right to left, skipping trusted
+// proxies, so that a client can't spoof its address by sending its own X-Forwarded-For header
+func clientIP(r *http.Request, trustedProxies []*net.IPNet) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !containsIP(trustedProxies, ip) {
+		return ip
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !containsIP(trustedProxies, hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// maintenanceMiddleware responds to every request with the maintenance response, except requests from bypass_cidrs
+func maintenanceMiddleware(l *slog.Logger, c MaintenanceConfig, trustedProxies []*net.IPNet, next http.Handler) http.Handler {
+	logger := l.WithGroup("maintenance")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := requestClientIP(r, trustedProxies)
+		if ip != nil && containsIP(c.bypass, ip) {
+			logger.Debug("bypassing maintenance", "client_ip", ip.String())
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if c.Location != "" {
+			w.Header().Set("Location", c.Location)
+		}
+		w.WriteHeader(c.Status)
+	})
+}
@@ -0,0 +1,92 @@
+//go:build unit_test
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_clientIP(t *testing.T) {
+	logger := newTestLogger()
+	trusted := parseCIDRs(logger, []string{"10.0.0.0/8"})
+
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor string
+		want         string
+	}{
+		{name: "no proxy", remoteAddr: "192.0.2.1:1234", want: "192.0.2.1"},
+		{name: "untrusted proxy", remoteAddr: "192.0.2.1:1234", forwardedFor: "198.51.100.1", want: "192.0.2.1"},
+		{name: "trusted proxy", remoteAddr: "10.0.0.1:1234", forwardedFor: "198.51.100.1", want: "198.51.100.1"},
+		{name: "chain of trusted proxies", remoteAddr: "10.0.0.1:1234", forwardedFor: "198.51.100.1, 10.0.0.2", want: "198.51.100.1"},
+		{name: "spoofed header", remoteAddr: "10.0.0.1:1234", forwardedFor: "10.0.0.5, 198.51.100.1", want: "198.51.100.1"},
+		{name: "trusted proxy without header", remoteAddr: "10.0.0.1:1234", want: "10.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://localhost/foo", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.forwardedFor != "" {
+				req.Header.Set("X-Forwarded-For", tt.forwardedFor)
+			}
+			assert.Equal(t, tt.want, clientIP(req, trusted).String())
+		})
+	}
+}
+
+func Test_parseCIDRs(t *testing.T) {
+	logger := newTestLogger()
+	nets := parseCIDRs(logger, []string{"10.0.0.0/8", "192.0.2.1", "2001:db8::1", "not a cidr"})
+
+	assert.Len(t, nets, 3)
+	assert.Equal(t, "192.0.2.1/32", nets[1].String())
+	assert.Equal(t, "2001:db8::1/128", nets[2].String())
+}
+
+func TestMaintenanceBypass(t *testing.T) {
+	t.Parallel()
+
+	logger := newTestLogger()
+	cfg, _ := loadConfig(logger, "./fixtures/rules.yml")
+	cfg.Maintenance = MaintenanceConfig{
+		Enabled:  true,
+		Location: "https://status.example.com/",
+		Status:   http.StatusFound,
+		bypass:   parseCIDRs(logger, []string{"192.0.2.0/24"}),
+	}
+	trusted := parseCIDRs(logger, []string{"10.0.0.0/8"})
+	handler := maintenanceMiddleware(logger, cfg.Maintenance, trusted, handleRequest(logger, &spyCache{}, cfg))
+
+	var testCases = []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor string
+		wantCode     int
+		wantLocation string
+	}{
+		{name: "bypass", remoteAddr: "192.0.2.10:1234", wantCode: defaultStatusCode, wantLocation: "https://example.com/"},
+		{name: "bypass behind trusted proxy", remoteAddr: "10.0.0.1:1234", forwardedFor: "192.0.2.10", wantCode: defaultStatusCode, wantLocation: "https://example.com/"},
+		{name: "maintenance", remoteAddr: "198.51.100.1:1234", wantCode: http.StatusFound, wantLocation: "https://status.example.com/"},
+		{name: "spoofed bypass", remoteAddr: "198.51.100.1:1234", forwardedFor: "192.0.2.10", wantCode: http.StatusFound, wantLocation: "https://status.example.com/"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://localhost/foo", nil)
+			req.RemoteAddr = testCase.remoteAddr
+			if testCase.forwardedFor != "" {
+				req.Header.Set("X-Forwarded-For", testCase.forwardedFor)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			assert.Equal(t, testCase.wantCode, w.Code)
+			assert.Equal(t, testCase.wantLocation, w.Header().Get("Location"))
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// ruleMatchLRU maps a request's host and path to the rule that matched it, so that rules don't have to be matched
+// again for requests whose response can't be cached
+//
+// A nil ruleMatchLRU stores nothing
+type ruleMatchLRU struct {
+	lock  sync.Mutex
+	size  int
+	order *list.List
+	items map[string]*list.Element
+}
+
+type ruleMatchLRUEntry struct {
+	key   string
+	match ruleMatch
+}
+
+// newRuleMatchLRU returns an LRU holding up to size matches, or nil if size is <= 0
+func newRuleMatchLRU(size int) *ruleMatchLRU {
+	if size <= 0 {
+		return nil
+	}
+	return &ruleMatchLRU{size: size, order: list.New(), items: map[string]*list.Element{}}
+}
+
+func ruleMatchKey(host string, path string) string {
+	return host + " " + path
+}
+
+func (c *ruleMatchLRU) get(host string, path string) (ruleMatch, bool) {
+	if c == nil {
+		return ruleMatch{}, false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e, ok := c.items[ruleMatchKey(host, path)]
+	if !ok {
+		return ruleMatch{}, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*ruleMatchLRUEntry).match, true
+}
+
+// add stores a match, evicting the least recently used match if the LRU is full
+func (c *ruleMatchLRU) add(host string, path string, m ruleMatch) {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	key := ruleMatchKey(host, path)
+	if e, ok := c.items[key]; ok {
+		e.Value.(*ruleMatchLRUEntry).match = m
+		c.order.MoveToFront(e)
+		return
+	}
+
+	c.items[key] = c.order.PushFront(&ruleMatchLRUEntry{key: key, match: m})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*ruleMatchLRUEntry).key)
+	}
+}
+
+func (c *ruleMatchLRU) len() int {
+	if c == nil {
+		return 0
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.order.Len()
+}
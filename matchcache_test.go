@@ -0,0 +1,110 @@
+//go:build unit_test
+
+package main
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"log/slog"
+	"testing"
+)
+
+func TestRuleMatchLRU(t *testing.T) {
+	lru := newRuleMatchLRU(2)
+	lru.add("example.com", "/a", ruleMatch{rule: Rule{Name: "a"}})
+	lru.add("example.com", "/b", ruleMatch{rule: Rule{Name: "b"}})
+
+	// reading /a makes /b the least recently used
+	m, ok := lru.get("example.com", "/a")
+	assert.True(t, ok)
+	assert.Equal(t, "a", m.rule.Name)
+
+	lru.add("example.com", "/c", ruleMatch{rule: Rule{Name: "c"}})
+	assert.Equal(t, 2, lru.len())
+	_, ok = lru.get("example.com", "/b")
+	assert.False(t, ok)
+	_, ok = lru.get("example.com", "/a")
+	assert.True(t, ok)
+
+	// a disabled LRU stores nothing
+	disabled := newRuleMatchLRU(0)
+	disabled.add("example.com", "/a", ruleMatch{})
+	_, ok = disabled.get("example.com", "/a")
+	assert.False(t, ok)
+}
+
+func Test_matchRequest(t *testing.T) {
+	logger := newTestLogger()
+	cfg, err := parseConfig(logger, []byte(`
+match_cache_size: 10
+rules:
+  - from: 'example.com/blog/(?P<year>[0-9]{4})/(.+)'
+    to: 'https://foo.com/posts/$year/$2'
+`))
+	assert.NoError(t, err)
+
+	m, err := matchRequest(logger, "example.com", "/blog/2024/hello", requestAttributes{}, "", cfg)
+	assert.NoError(t, err)
+	_, lru := cfg.matchState()
+	assert.Equal(t, 1, lru.len())
+
+	// the stored match, including its submatches, is used for the next request
+	cached, err := matchRequest(logger, "example.com", "/blog/2024/hello", requestAttributes{}, "", cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, m.submatches, cached.submatches)
+	assert.Equal(t, m.rule.From, cached.rule.From)
+
+	// misses aren't stored
+	_, err = matchRequest(logger, "example.com", "/missing", requestAttributes{}, "", cfg)
+	assert.Error(t, err)
+	assert.Equal(t, 1, lru.len())
+
+	// reloading rules starts a new LRU
+	cfg.setRuleMap(cfg.ruleMap())
+	_, lru = cfg.matchState()
+	assert.Equal(t, 0, lru.len())
+}
+
+func Test_matchRequestTieNotStored(t *testing.T) {
+	logger := newTestLogger()
+	cfg, err := parseConfig(logger, []byte(`
+match_cache_size: 10
+tie_break: 'random'
+rules:
+  - from: 'example.com/experiment'
+    to: 'https://a.example.com/'
+  - from: 'example.com/experiment'
+    to: 'https://b.example.com/'
+`))
+	assert.NoError(t, err)
+
+	_, err = matchRequest(logger, "example.com", "/experiment", requestAttributes{}, "", cfg)
+	assert.NoError(t, err)
+	_, lru := cfg.matchState()
+	assert.Equal(t, 0, lru.len())
+}
+
+// BenchmarkMatchRequest compares matching against a regex-heavy config with and without the match LRU
+func BenchmarkMatchRequest(b *testing.B) {
+	logger := NewLogger(slog.LevelInfo, false, io.Discard)
+
+	rules := Rules{}
+	for i := range 200 {
+		rules = append(rules, Rule{
+			From: fmt.Sprintf("example.com/section-%d/(?P<year>[0-9]{4})/([a-z]+)-(\\d+)", i),
+			To:   "https://foo.com/$year/$2/$3",
+		})
+	}
+
+	for _, size := range []int{0, 1000} {
+		b.Run(fmt.Sprintf("match_cache_size=%d", size), func(b *testing.B) {
+			ac := &AppConfig{MatchCacheSize: size}
+			ac.setRuleMap(bucketRules(logger, buildRules(logger, &rules, ac)))
+
+			for i := 0; b.Loop(); i++ {
+				_, _ = matchRequest(logger, "example.com", fmt.Sprintf("/section-199/2024/post-%d", i%100), requestAttributes{}, "", ac)
+			}
+		})
+	}
+}
@@ -1,10 +1,132 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"log/slog"
+	"math/rand/v2"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
+var (
+	ruleMatchMetric = promauto.With(appMetrics).NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rule_matches_total",
+			Help: "Number of requests matched by a rule",
+		},
+		[]string{"host", "rule"},
+	)
+	ruleTagMatchMetric = promauto.With(appMetrics).NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rule_tag_matches_total",
+			Help: "Number of requests matched by a rule with a tag, when metrics.rule_tags is set",
+		},
+		[]string{"tag"},
+	)
+	matchDurationMetric = promauto.With(appMetrics).NewHistogram(
+		prometheus.HistogramOpts{
+			Name: "match_duration_seconds",
+			Help: "Time spent finding the rule that matches a request, including requests that don't match a rule. Matches found in the match cache aren't observed",
+			// matching usually takes microseconds, far below the default buckets
+			Buckets: prometheus.ExponentialBuckets(0.00001, 4, 8),
+		})
+)
+
+// ruleMatchCounter tracks the number of matches per rule since startup
+//
+// Prometheus counters can't be read back in-process, so we keep our own counts to find rules that never match
+type ruleMatchCounter struct {
+	lock   sync.Mutex
+	counts map[string]int64
+}
+
+var ruleMatchCounts = &ruleMatchCounter{counts: map[string]int64{}}
+
+func (c *ruleMatchCounter) inc(host string, rule Rule) {
+	c.lock.Lock()
+	c.counts[host+" "+rule.id()]++
+	c.lock.Unlock()
+
+	ruleMatchMetric.With(prometheus.Labels{"host": host, "rule": rule.id()}).Inc()
+	if rule.countTags {
+		for _, tag := range rule.Tags {
+			ruleTagMatchMetric.With(prometheus.Labels{"tag": tag}).Inc()
+		}
+	}
+}
+
+func (c *ruleMatchCounter) get(host string, rule Rule) int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.counts[host+" "+rule.id()]
+}
+
+// ruleCount is the number of matches a rule had before its counter was reset
+type ruleCount struct {
+	Host    string `json:"host"`
+	Rule    string `json:"rule"`
+	Matches int64  `json:"matches"`
+}
+
+// reset zeroes every rule's count, returning the counts from before the reset sorted by host and rule
+//
+// The Prometheus counters are left alone
+func (c *ruleMatchCounter) reset() []ruleCount {
+	c.lock.Lock()
+	counts := c.counts
+	c.counts = map[string]int64{}
+	c.lock.Unlock()
+
+	previous := make([]ruleCount, 0, len(counts))
+	for key, n := range counts {
+		// hosts never contain a space, so everything after the first one is the rule ID
+		host, rule, _ := strings.Cut(key, " ")
+		previous = append(previous, ruleCount{Host: host, Rule: rule, Matches: n})
+	}
+	sort.Slice(previous, func(i, j int) bool {
+		if previous[i].Host != previous[j].Host {
+			return previous[i].Host < previous[j].Host
+		}
+		return previous[i].Rule < previous[j].Rule
+	})
+	return previous
+}
+
+const (
+	// MatchRegex treats a rule's from path as a regular expression. This is the default
+	MatchRegex = "regex"
+	// MatchPrefix treats a rule's from path as a literal prefix of the request path
+	MatchPrefix = "prefix"
+	// MatchExact only matches a request path identical to the rule's from path
+	MatchExact = "exact"
+	MatchUnset = ""
+)
+
+const (
+	// TieBreakOrder picks the first declared of several equally specific matching rules. This is the default
+	TieBreakOrder = "order"
+	// TieBreakRandom picks one of several equally specific matching rules at random
+	TieBreakRandom = "random"
+	// TieBreakWeight picks one of several equally specific matching rules at random, in proportion to their weights
+	TieBreakWeight = "weight"
+)
+
+func validTieBreak(policy string) bool {
+	switch policy {
+	case TieBreakOrder, TieBreakRandom, TieBreakWeight:
+		return true
+	default:
+		return false
+	}
+}
+
 type NoRuleForHostError struct {
 	h string
 }
@@ -22,43 +144,367 @@ func (n NoRuleForPathError) Error() string {
 	return fmt.Sprintf("no match for host '%s' with path '%s'", n.h, n.p)
 }
 
+// requestAttributes are the parts of a request, other than its host and path, that rules can match on
+type requestAttributes struct {
+	// language is the client's preferred language from the Accept-Language header, lowercased
+	language string
+	// scheme is the scheme the client made the request with, `http` or `https`
+	scheme string
+	// cookies are the values of the cookies sent with the request, by name
+	cookies map[string]string
+	// country is the ISO code of the client IP's country, uppercased, or empty if it isn't known
+	country string
+}
+
+// matchesAttributes reports whether the request's attributes satisfy the rule's conditions. Rules without conditions
+// match every request
+func (r Rule) matchesAttributes(a requestAttributes) bool {
+	if len(r.MatchLanguage) > 0 && !languageMatches(r.MatchLanguage, a.language) {
+		return false
+	}
+	if r.MatchScheme != "" && r.MatchScheme != a.scheme {
+		return false
+	}
+	if len(r.MatchCountry) > 0 && !slices.Contains(r.MatchCountry, a.country) {
+		return false
+	}
+	return r.matchesCookies(a.cookies)
+}
+
+// ruleConditions are the request attributes that a host's rules match on
+type ruleConditions struct {
+	// languages are the languages in the rules' match_language, sorted
+	languages []string
+	scheme    bool
+	// cookies are the names of the cookies matched on, sorted
+	cookies []string
+	// countries are the countries in the rules' match_country, sorted
+	countries []string
+}
+
+func (c ruleConditions) empty() bool {
+	return len(c.languages) == 0 && !c.scheme && len(c.cookies) == 0 && len(c.countries) == 0
+}
+
+// merge returns the conditions matched on by either c or other
+func (c ruleConditions) merge(other ruleConditions) ruleConditions {
+	return ruleConditions{
+		languages: sortedUnion(c.languages, other.languages),
+		scheme:    c.scheme || other.scheme,
+		cookies:   sortedUnion(c.cookies, other.cookies),
+		countries: sortedUnion(c.countries, other.countries),
+	}
+}
+
+// sortedUnion returns the strings in either a or b, sorted and without duplicates
+func sortedUnion(a []string, b []string) []string {
+	var union []string
+	for _, s := range append(append([]string{}, a...), b...) {
+		if !slices.Contains(union, s) {
+			union = append(union, s)
+		}
+	}
+	sort.Strings(union)
+	return union
+}
+
+// hostConditions returns the request attributes matched on by each host's rules, for hosts with conditional rules
+func hostConditions(rules RuleMapping) map[string]ruleConditions {
+	conditions := map[string]ruleConditions{}
+	for host, bucket := range rules {
+		c := ruleConditions{}
+		for _, rule := range bucket {
+			cookies := make([]string, 0, len(rule.cookieExpressions))
+			for name := range rule.cookieExpressions {
+				cookies = append(cookies, name)
+			}
+			c = c.merge(ruleConditions{languages: rule.MatchLanguage, scheme: rule.MatchScheme != "", cookies: cookies, countries: rule.MatchCountry})
+		}
+		if !c.empty() {
+			conditions[host] = c
+		}
+	}
+	return conditions
+}
+
+// uncachedHosts returns the hosts whose rules all set no_cache
+func uncachedHosts(rules RuleMapping) map[string]bool {
+	uncached := map[string]bool{}
+	for host, bucket := range rules {
+		if len(bucket) > 0 && !slices.ContainsFunc(bucket, func(r Rule) bool { return !r.NoCache }) {
+			uncached[host] = true
+		}
+	}
+	return uncached
+}
+
+// variant returns the cache variant for a request with attrs. It's empty when no attributes are matched on
+func (c ruleConditions) variant(a requestAttributes) string {
+	parts := []string{}
+	// the variant is the configured languages the request's language matches rather than the language itself, since
+	// rules can't tell apart languages that match the same ones, e.g. `fr-fr` and `fr-ca` for `fr`. Otherwise every
+	// distinct Accept-Language would take its own entry
+	if len(c.languages) > 0 {
+		matched := []string{}
+		for _, lang := range c.languages {
+			if languageMatches([]string{lang}, a.language) {
+				matched = append(matched, lang)
+			}
+		}
+		if len(matched) == 0 {
+			parts = append(parts, "lang=none")
+		} else {
+			parts = append(parts, "lang="+strings.Join(matched, "+"))
+		}
+	}
+	if c.scheme {
+		parts = append(parts, "scheme="+a.scheme)
+	}
+	// as with languages, countries no rule matches on share a variant
+	if len(c.countries) > 0 {
+		if slices.Contains(c.countries, a.country) {
+			parts = append(parts, "country="+a.country)
+		} else {
+			parts = append(parts, "country=none")
+		}
+	}
+	// a cookie that wasn't sent is distinguished from one with an empty value by leaving out the `=`
+	for _, name := range c.cookies {
+		if v, ok := a.cookies[name]; ok {
+			parts = append(parts, "cookie."+url.QueryEscape(name)+"="+url.QueryEscape(v))
+		} else {
+			parts = append(parts, "cookie."+url.QueryEscape(name))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
 // findMatch returns the redirect destination, the regular expression that matches the request path, the winning score, and an error
 //
 // If there is no match, an error is returned
 // findMatch assumes `rules` is not empty
 func findMatch(l *slog.Logger, hostname string, path string, rules RuleMapping) (Rule, error) {
-	winner := Rule{}
+	m, err := findRuleMatch(l, hostname, path, requestAttributes{}, rules, false)
+	return m.rule, err
+}
+
+// ruleMatch is the rule that matched a request, along with the submatch indices of the rule's expression
+//
+// submatches is nil for rules that aren't matched with an expression, or when the expression was matched without
+// evaluating it
+type ruleMatch struct {
+	rule       Rule
+	submatches []int
+	// tied is set when the rule was picked at random from several equally specific matching rules
+	tied bool
+	// host is the host bucket the rule is in, which is the request's wildcard host if the rule was matched through it
+	host string
+}
+
+// findRuleMatch is findMatch, but also returns the submatches found while matching so they don't have to be found again
+func findRuleMatch(l *slog.Logger, hostname string, path string, attrs requestAttributes, rules RuleMapping, wildcardFallthrough bool) (ruleMatch, error) {
 	logger := l.WithGroup("matcher")
 
-	if _, ok := rules[hostname]; !ok {
+	hosts := matchHosts(hostname, rules, wildcardFallthrough)
+	if len(hosts) == 0 {
 		logger.Warn("no rules for hostname")
-		return winner, NoRuleForHostError{h: hostname}
+		return ruleMatch{}, NoRuleForHostError{h: hostname}
 	}
 
-	for _, rule := range rules[hostname] {
-		if rule.compiled != nil {
-			prefix, _ := rule.compiled.LiteralPrefix()
-			if prefix == path {
-				winner = rule
-				logger.Info("found exact match", "exp", rule.compiled.String(), "path", path)
-				break
+	for _, host := range hosts {
+		bucket := rules[host]
+		for i, rule := range bucket {
+			if !rule.matchesAttributes(attrs) {
+				continue
 			}
+			if submatches, ok := matchRule(logger, rule, path); ok {
+				m := ruleMatch{rule: rule, submatches: submatches}
+				if rule.tieBreak == TieBreakRandom || rule.tieBreak == TieBreakWeight {
+					m = breakTie(logger, m, bucket[i+1:], path, attrs)
+				}
+				m.host = host
 
-			rule.compiled.Longest()
-
-			if rule.compiled.MatchString(path) {
-				winner = rule
-				logger.Info("found regex match", "exp", rule.compiled.String(), "path", path)
-				break
+				ruleMatchCounts.inc(host, m.rule)
+				logger.Debug(fmt.Sprintf("winning rule '%s'", m.rule.pattern()), "location", m.rule.To, "bucket", host)
+				return m, nil
 			}
 		}
 	}
 
-	if winner.compiled == nil {
-		return winner, NoRuleForPathError{}
+	return ruleMatch{}, NoRuleForPathError{}
+}
+
+// wildcardHostPrefix is the first label of a wildcard host
+const wildcardHostPrefix = "*."
+
+// wildcardHost returns the wildcard host covering hostname, e.g. `*.example.com` for `www.example.com`. Hosts with a
+// single label aren't covered by a wildcard host
+func wildcardHost(hostname string) string {
+	_, parent, ok := strings.Cut(hostname, ".")
+	if !ok || parent == "" {
+		return ""
+	}
+	return wildcardHostPrefix + parent
+}
+
+// matchHosts returns the host buckets a request to hostname is matched against, in order
+//
+// A host's own rules come first. Its wildcard host's rules are only used if it has no rules of its own, or if
+// wildcardFallthrough is set
+func matchHosts(hostname string, rules RuleMapping, wildcardFallthrough bool) []string {
+	hosts := []string{}
+	if _, ok := rules[hostname]; ok {
+		hosts = append(hosts, hostname)
+	}
+	if wildcard := wildcardHost(hostname); wildcard != "" && (len(hosts) == 0 || wildcardFallthrough) {
+		if _, ok := rules[wildcard]; ok {
+			hosts = append(hosts, wildcard)
+		}
+	}
+	return hosts
+}
+
+// prefixLength returns the length of the literal path every match of the rule starts with, which is how specific it is.
+// It parses the rule's expression, so buildRules stores it in Rule.prefixLength rather than it being found per request
+func prefixLength(rule Rule) int {
+	if rule.Match == MatchPrefix || rule.Match == MatchExact {
+		return len(rule.path)
+	}
+	return len(samplePath(rule))
+}
+
+// breakTie picks the winner between the first matching rule and any of the later rules that match path and are as
+// specific as it, using the first rule's tie-break policy
+func breakTie(logger *slog.Logger, first ruleMatch, rest Rules, path string, attrs requestAttributes) ruleMatch {
+	candidates := []ruleMatch{first}
+	n := first.rule.prefixLength
+	for _, rule := range rest {
+		if rule.prefixLength != n || !rule.matchesAttributes(attrs) {
+			continue
+		}
+		if submatches, ok := matchRule(logger, rule, path); ok {
+			candidates = append(candidates, ruleMatch{rule: rule, submatches: submatches})
+		}
+	}
+	if len(candidates) == 1 {
+		return first
+	}
+
+	weight := func(rule Rule) int {
+		if first.rule.tieBreak == TieBreakWeight && rule.Weight > 0 {
+			return rule.Weight
+		}
+		return 1
+	}
+
+	total := 0
+	for _, c := range candidates {
+		total += weight(c.rule)
 	}
+	pick := rand.IntN(total)
+	for _, c := range candidates {
+		pick -= weight(c.rule)
+		if pick < 0 {
+			logger.Debug("broke tie between matching rules", "candidates", len(candidates), "rule", c.rule.id(), "policy", first.rule.tieBreak)
+			c.tied = true
+			return c
+		}
+	}
+
+	return first
+}
+
+// matchRequest finds the rule matching a request, using the config's match LRU when it's enabled
+//
+// Matches are stored under the request's cache variant, since the rule that matches can depend on more than the path.
+// Matches that won a tie at random aren't stored, otherwise every later request would go to the same rule
+func matchRequest(l *slog.Logger, host string, path string, attrs requestAttributes, variant string, ac *AppConfig) (ruleMatch, error) {
+	rules, lru := ac.matchState()
+	key := variantKey(path, variant)
+	if m, ok := lru.get(host, key); ok {
+		ruleMatchCounts.inc(m.host, m.rule)
+		return m, nil
+	}
+
+	start := time.Now()
+	m, err := findRuleMatch(l, host, path, attrs, rules, ac.WildcardFallthrough)
+	matchDurationMetric.Observe(time.Since(start).Seconds())
+	if err == nil && !m.tied {
+		lru.add(host, key, m)
+	}
+	return m, err
+}
+
+// matchRule reports whether a request path matches the rule, returning the submatch indices of the rule's expression
+func matchRule(logger *slog.Logger, rule Rule, path string) ([]int, bool) {
+	switch rule.Match {
+	case MatchPrefix:
+		if strings.HasPrefix(path, rule.path) {
+			logger.Info("found prefix match", "prefix", rule.path, "path", path)
+			return nil, true
+		}
+	case MatchExact:
+		if path == rule.path {
+			logger.Info("found exact match", "path", path)
+			return nil, true
+		}
+	default:
+		if rule.compiled == nil {
+			return nil, false
+		}
+
+		prefix, _ := rule.compiled.LiteralPrefix()
+		if prefix == path {
+			logger.Info("found exact match", "exp", rule.compiled.String(), "path", path)
+			return nil, true
+		}
 
-	logger.Debug(fmt.Sprintf("winning rule '%s'", winner.compiled.String()), "location", winner.To)
+		if submatches := rule.compiled.FindStringSubmatchIndex(path); submatches != nil {
+			logger.Info("found regex match", "exp", rule.compiled.String(), "path", path)
+			return submatches, true
+		}
+	}
+
+	return nil, false
+}
+
+// unmatchedRules returns the IDs of rules that haven't matched a request since startup, sorted by host
+func unmatchedRules(rules RuleMapping) []string {
+	hosts := make([]string, 0, len(rules))
+	for host := range rules {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	unmatched := []string{}
+	for _, host := range hosts {
+		for _, rule := range rules[host] {
+			if ruleMatchCounts.get(host, rule) == 0 {
+				unmatched = append(unmatched, rule.id())
+			}
+		}
+	}
+	return unmatched
+}
+
+// reportUnmatchedRules periodically logs rules that haven't matched a request since startup, and does so once more at shutdown
+func reportUnmatchedRules(ctx context.Context, l *slog.Logger, ac *AppConfig, interval int) {
+	logger := l.WithGroup("unmatched_rules")
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
 
-	return winner, nil
+	report := func() {
+		unmatched := unmatchedRules(ac.ruleMap())
+		logger.Info("rules without matches since startup", "count", len(unmatched), "rules", unmatched)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			report()
+			return
+		case <-ticker.C:
+			report()
+		}
+	}
 }
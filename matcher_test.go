@@ -3,7 +3,13 @@
 package main
 
 import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
 	"log/slog"
+	"net/http/httptest"
 	"reflect"
 	"testing"
 )
@@ -74,6 +80,61 @@ func Test_findMatch(t *testing.T) {
 			want:    "https://blog.localhost.com/posts/$1",
 			wantErr: false,
 		},
+		{
+			name: "prefix match is literal",
+			args: args{
+				logger:   logger,
+				path:     "/prefix/(literal)/foo",
+				hostname: "localhost",
+				rules:    rules,
+			},
+			want:    "https://demo.localhost.com/prefixed",
+			wantErr: false,
+		},
+		{
+			name: "exact match",
+			args: args{
+				logger:   logger,
+				path:     "/exact",
+				hostname: "localhost",
+				rules:    rules,
+			},
+			want:    "https://demo.localhost.com/exactly",
+			wantErr: false,
+		},
+		{
+			name: "exact match with suffix",
+			args: args{
+				logger:   logger,
+				path:     "/exactx",
+				hostname: "localhost",
+				rules:    rules,
+			},
+			want:    "",
+			wantErr: true,
+		},
+		{
+			name: "exact match with extra segment",
+			args: args{
+				logger:   logger,
+				path:     "/exact/extra",
+				hostname: "localhost",
+				rules:    rules,
+			},
+			want:    "",
+			wantErr: true,
+		},
+		{
+			name: "prefix match doesn't use regex",
+			args: args{
+				logger:   logger,
+				path:     "/prefix/literal",
+				hostname: "localhost",
+				rules:    rules,
+			},
+			want:    "",
+			wantErr: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -89,3 +150,302 @@ func Test_findMatch(t *testing.T) {
 		})
 	}
 }
+
+func Test_findMatchPathSegmentBoundary(t *testing.T) {
+	logger := newTestLogger()
+
+	tests := []struct {
+		name     string
+		boundary bool
+		path     string
+		wantErr  bool
+	}{
+		{name: "exact path", boundary: true, path: "/bar", wantErr: false},
+		{name: "trailing slash", boundary: true, path: "/bar/", wantErr: false},
+		{name: "nested path", boundary: true, path: "/bar/x", wantErr: false},
+		{name: "partial segment", boundary: true, path: "/barbaz", wantErr: true},
+		{name: "partial segment without boundary", boundary: false, path: "/barbaz", wantErr: false},
+		{name: "nested path without boundary", boundary: false, path: "/bar/x", wantErr: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := &AppConfig{PathSegmentBoundary: tt.boundary}
+			rules := bucketRules(logger, buildRules(logger, &Rules{{From: "example.com/bar", To: "https://foo.com/"}}, ac))
+
+			_, err := findMatch(logger, "example.com", tt.path, rules)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("findMatch() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_findMatchRootPath(t *testing.T) {
+	logger := newTestLogger()
+
+	tests := []struct {
+		name  string
+		rules Rules
+		path  string
+		want  string
+	}{
+		{name: "root only matches root", rules: Rules{{Name: "root", From: "example.com/", To: "https://foo.com/home"}}, path: "/bar", want: ""},
+		{name: "root", rules: Rules{{Name: "root", From: "example.com/", To: "https://foo.com/home"}}, path: "/", want: "root"},
+		{
+			name: "root declared before catch-all",
+			rules: Rules{
+				{Name: "root", From: "example.com/", To: "https://foo.com/home"},
+				{Name: "catch-all", From: "example.com", To: "https://foo.com/"},
+			},
+			path: "/",
+			want: "root",
+		},
+		{
+			name: "root declared after catch-all",
+			rules: Rules{
+				{Name: "catch-all", From: "example.com", To: "https://foo.com/"},
+				{Name: "root", From: "example.com/", To: "https://foo.com/home"},
+			},
+			path: "/",
+			want: "root",
+		},
+		{
+			name: "catch-all matches everything else",
+			rules: Rules{
+				{Name: "catch-all", From: "example.com", To: "https://foo.com/"},
+				{Name: "root", From: "example.com/", To: "https://foo.com/home"},
+			},
+			path: "/bar",
+			want: "catch-all",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := bucketRules(logger, buildRules(logger, &tt.rules, &AppConfig{}))
+
+			got, err := findMatch(logger, "example.com", tt.path, rules)
+			if tt.want == "" {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got.Name)
+		})
+	}
+}
+
+func Test_findRuleMatch(t *testing.T) {
+	logger := newTestLogger()
+	rules := bucketRules(logger, buildRules(logger, &Rules{
+		{From: "example.com/blog/(?P<year>[0-9]{4})/(.+)", To: "https://foo.com/posts/$year/$2"},
+		{From: "example.com/prefix", To: "https://foo.com/", Match: MatchPrefix},
+	}, &AppConfig{}))
+
+	m, err := findRuleMatch(logger, "example.com", "/blog/2024/hello", requestAttributes{}, rules, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{0, 16, 6, 10, 11, 16}, m.submatches)
+
+	// the submatches found while matching are used to rewrite the path, rather than matching again
+	p, err := rewriteRulePath("/blog/2024/hello", m)
+	assert.NoError(t, err)
+	assert.Equal(t, "/posts/2024/hello", p)
+
+	m, err = findRuleMatch(logger, "example.com", "/prefix/x", requestAttributes{}, rules, false)
+	assert.NoError(t, err)
+	assert.Nil(t, m.submatches)
+	assert.Equal(t, MatchPrefix, m.rule.Match)
+
+	rule, err := findMatch(logger, "example.com", "/prefix/x", rules)
+	assert.NoError(t, err)
+	assert.Equal(t, m.rule.From, rule.From)
+}
+
+func Test_findRuleMatchTieBreak(t *testing.T) {
+	logger := newTestLogger()
+	rules := Rules{
+		{Name: "a", From: "example.com/experiment", To: "https://a.example.com/", Weight: 1},
+		{Name: "b", From: "example.com/experiment", To: "https://b.example.com/", Weight: 99},
+		// less specific than the rules above, so it never ties with them
+		{Name: "c", From: "example.com/exp(.*)", To: "https://c.example.com/"},
+	}
+
+	tests := []struct {
+		policy string
+		want   func(t *testing.T, wins map[string]int)
+	}{
+		{
+			policy: TieBreakOrder,
+			want: func(t *testing.T, wins map[string]int) {
+				assert.Equal(t, map[string]int{"a": 200}, wins)
+			},
+		},
+		{
+			policy: TieBreakRandom,
+			want: func(t *testing.T, wins map[string]int) {
+				assert.Greater(t, wins["a"], 0)
+				assert.Greater(t, wins["b"], 0)
+				assert.Zero(t, wins["c"])
+			},
+		},
+		{
+			policy: TieBreakWeight,
+			want: func(t *testing.T, wins map[string]int) {
+				assert.Greater(t, wins["b"], wins["a"])
+				assert.Zero(t, wins["c"])
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			bucketed := bucketRules(logger, buildRules(logger, &rules, &AppConfig{TieBreak: tt.policy}))
+			// the specificity compared by the tie-break is found once, when the rules are built
+			prefixLengths := map[string]int{}
+			for _, rule := range bucketed["example.com"] {
+				prefixLengths[rule.id()] = rule.prefixLength
+			}
+			assert.Equal(t, map[string]int{"a": len("/experiment"), "b": len("/experiment"), "c": len("/exp")}, prefixLengths)
+
+			wins := map[string]int{}
+			for range 200 {
+				m, err := findRuleMatch(logger, "example.com", "/experiment", requestAttributes{}, bucketed, false)
+				assert.NoError(t, err)
+				assert.Equal(t, tt.policy != TieBreakOrder, m.tied)
+				wins[m.rule.id()]++
+			}
+			tt.want(t, wins)
+		})
+	}
+}
+
+func Test_unmatchedRules(t *testing.T) {
+	logger := newTestLogger()
+	ac := &AppConfig{}
+	rules := bucketRules(logger, buildRules(logger, &Rules{
+		{Name: "matched", From: "unmatched-rules.example.com/matched", To: "https://foo.com/"},
+		{Name: "unmatched", From: "unmatched-rules.example.com/unmatched", To: "https://foo.com/"},
+		{From: "unmatched-rules.example.com/unnamed", To: "https://foo.com/"},
+	}, ac))
+
+	_, err := findMatch(logger, "unmatched-rules.example.com", "/matched", rules)
+	assert.Nil(t, err)
+
+	assert.Equal(t, []string{"unmatched", "unmatched-rules.example.com/unnamed"}, unmatchedRules(rules))
+}
+
+func TestRuleTagMetric(t *testing.T) {
+	logger := newTestLogger()
+
+	for _, enabled := range []bool{false, true} {
+		cfg, err := parseConfig(logger, []byte(fmt.Sprintf(`
+metrics:
+  rule_tags: %t
+rules:
+  - from: 'tags.example.com/foo'
+    to: 'https://foo.com/'
+    tags: ['metric-test']
+`, enabled)))
+		assert.NoError(t, err)
+
+		before := testutil.ToFloat64(ruleTagMatchMetric.WithLabelValues("metric-test"))
+		_, err = matchRequest(logger, "tags.example.com", "/foo", requestAttributes{}, "", cfg)
+		assert.NoError(t, err)
+
+		want := before
+		if enabled {
+			want++
+		}
+		assert.Equal(t, want, testutil.ToFloat64(ruleTagMatchMetric.WithLabelValues("metric-test")))
+	}
+}
+
+func TestMatchDurationMetric(t *testing.T) {
+	logger := newTestLogger()
+	cfg, err := parseConfig(logger, []byte(`
+rules:
+  - from: 'example.com/foo'
+    to: 'https://foo.com/'
+`))
+	assert.NoError(t, err)
+
+	count := func() uint64 {
+		var m dto.Metric
+		assert.NoError(t, matchDurationMetric.(prometheus.Metric).Write(&m))
+		return m.GetHistogram().GetSampleCount()
+	}
+
+	// matches, misses, and requests for hosts without rules are all observed
+	before := count()
+	handler := handleRequest(logger, &noopCache{}, cfg)
+	for _, target := range []string{"http://example.com/foo", "http://example.com/missing", "http://unknown.example.com/foo"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", target, nil))
+	}
+	assert.Equal(t, before+3, count())
+}
+
+func Test_findRuleMatchWildcardHost(t *testing.T) {
+	logger := newTestLogger()
+	cfg, err := parseConfig(logger, []byte(`
+rules:
+  - from: 'www.example.com/exact'
+    to: 'https://exact.example.net/'
+  - from: '*.example.com/wild'
+    to: 'https://wild.example.net/'
+  - from: '*.example.com/exact'
+    to: 'https://shadowed.example.net/'
+`))
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name                string
+		host                string
+		path                string
+		wildcardFallthrough bool
+		want                string
+		wantBucket          string
+		wantErr             error
+	}{
+		{name: "exact host", host: "www.example.com", path: "/exact", want: "https://exact.example.net/", wantBucket: "www.example.com"},
+		{name: "exact host wins with fallthrough", host: "www.example.com", path: "/exact", wildcardFallthrough: true, want: "https://exact.example.net/", wantBucket: "www.example.com"},
+		{name: "exact host path miss", host: "www.example.com", path: "/wild", wantErr: NoRuleForPathError{}},
+		{name: "exact host path miss with fallthrough", host: "www.example.com", path: "/wild", wildcardFallthrough: true, want: "https://wild.example.net/", wantBucket: "*.example.com"},
+		{name: "exact host and wildcard miss", host: "www.example.com", path: "/missing", wildcardFallthrough: true, wantErr: NoRuleForPathError{}},
+		{name: "only wildcard host", host: "blog.example.com", path: "/wild", want: "https://wild.example.net/", wantBucket: "*.example.com"},
+		{name: "only wildcard host path miss", host: "blog.example.com", path: "/missing", wantErr: NoRuleForPathError{}},
+		{name: "one label only", host: "a.blog.example.com", path: "/wild", wildcardFallthrough: true, wantErr: NoRuleForHostError{h: "a.blog.example.com"}},
+		{name: "apex isn't covered", host: "example.com", path: "/wild", wildcardFallthrough: true, wantErr: NoRuleForHostError{h: "example.com"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := findRuleMatch(logger, tt.host, tt.path, requestAttributes{}, cfg.RuleMap, tt.wildcardFallthrough)
+			if tt.wantErr != nil {
+				assert.Equal(t, tt.wantErr, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, m.rule.To)
+			assert.Equal(t, tt.wantBucket, m.host)
+		})
+	}
+}
+
+func Test_ruleConditionsVariant(t *testing.T) {
+	c := ruleConditions{languages: []string{"fr", "fr-ca"}}
+	tests := []struct {
+		language string
+		want     string
+	}{
+		{language: "fr-fr", want: "lang=fr"},
+		{language: "fr-x-random", want: "lang=fr"},
+		{language: "fr-ca", want: "lang=fr+fr-ca"},
+		{language: "en", want: "lang=none"},
+		{language: "", want: "lang=none"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.language, func(t *testing.T) {
+			assert.Equal(t, tt.want, c.variant(requestAttributes{language: tt.language}))
+		})
+	}
+}
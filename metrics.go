@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+type MetricsConfig struct {
+	// Namespace and Subsystem prefix the name of every application metric, e.g. `redirector_cache_hit`
+	Namespace string            `yaml:"namespace"`
+	Subsystem string            `yaml:"subsystem"`
+	Auth      MetricsAuthConfig `yaml:"auth"`
+	// RuleTags counts matches per rule tag in rule_tag_matches_total. Tags should be few, since each is a label value
+	RuleTags bool `yaml:"rule_tags"`
+}
+
+// MetricsAuthConfig protects the metrics server's endpoints with basic auth when Username is set
+type MetricsAuthConfig struct {
+	Username string `yaml:"username"`
+	// PasswordHash is the bcrypt hash of the password
+	PasswordHash string `yaml:"password_hash"`
+	// ExemptMetrics lets /metrics be scraped without credentials
+	ExemptMetrics bool `yaml:"exempt_metrics"`
+}
+
+type InvalidPasswordHashError struct {
+	err error
+}
+
+func (e InvalidPasswordHashError) Error() string {
+	return fmt.Sprintf("metrics.auth.password_hash must be a bcrypt hash: %s", e.err)
+}
+
+func (c MetricsAuthConfig) enabled() bool {
+	return c.Username != ""
+}
+
+// parsePasswordHash checks that the configured password hash is a bcrypt hash, so a typo fails when the config is
+// loaded rather than locking everyone out
+func (c *MetricsAuthConfig) parsePasswordHash() error {
+	if !c.enabled() {
+		return nil
+	}
+
+	if _, err := bcrypt.Cost([]byte(c.PasswordHash)); err != nil {
+		return InvalidPasswordHashError{err: err}
+	}
+	return nil
+}
+
+// authorized reports whether the request's basic auth credentials match the configured ones
+func (c MetricsAuthConfig) authorized(r *http.Request) bool {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+
+	// the password is always checked, and the username in constant time, so the response time doesn't reveal which
+	// was wrong
+	usernameOK := subtle.ConstantTimeCompare([]byte(username), []byte(c.Username)) == 1
+	passwordOK := bcrypt.CompareHashAndPassword([]byte(c.PasswordHash), []byte(password)) == nil
+	return usernameOK && passwordOK
+}
+
+// metricsAuthMiddleware requires basic auth for every request to the metrics server, other than scrapes of /metrics
+// when they're exempt
+func metricsAuthMiddleware(c MetricsAuthConfig, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (c.ExemptMetrics && r.URL.Path == "/metrics") || c.authorized(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("WWW-Authenticate", `Basic realm="redirector", charset="UTF-8"`)
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+}
+
+// prefix returns the prefix added to metric names, including the trailing underscore
+func (c MetricsConfig) prefix() string {
+	parts := []string{}
+	for _, p := range []string{c.Namespace, c.Subsystem} {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return strings.Join(parts, "_") + "_"
+}
+
+// pendingRegisterer holds metrics until they're registered by registerMetrics
+//
+// Metrics are declared at package init, before the config that decides their names is loaded, so they're declared
+// with promauto.With(appMetrics) rather than registered straight away
+type pendingRegisterer struct {
+	lock       sync.Mutex
+	collectors []prometheus.Collector
+}
+
+var appMetrics = &pendingRegisterer{}
+
+func (p *pendingRegisterer) Register(c prometheus.Collector) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.collectors = append(p.collectors, c)
+	return nil
+}
+
+func (p *pendingRegisterer) MustRegister(cs ...prometheus.Collector) {
+	for _, c := range cs {
+		_ = p.Register(c)
+	}
+}
+
+func (p *pendingRegisterer) Unregister(c prometheus.Collector) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for i, collector := range p.collectors {
+		if collector == c {
+			p.collectors = append(p.collectors[:i], p.collectors[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// registerMetrics registers the application's metrics with reg, prefixing their names as configured
+func registerMetrics(reg prometheus.Registerer, c MetricsConfig) error {
+	if prefix := c.prefix(); prefix != "" {
+		reg = prometheus.WrapRegistererWithPrefix(prefix, reg)
+	}
+
+	appMetrics.lock.Lock()
+	defer appMetrics.lock.Unlock()
+	for _, collector := range appMetrics.collectors {
+		if err := reg.Register(collector); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+//go:build unit_test
+
+package main
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestMetricsConfigPrefix(t *testing.T) {
+	tests := []struct {
+		config MetricsConfig
+		want   string
+	}{
+		{config: MetricsConfig{}, want: ""},
+		{config: MetricsConfig{Namespace: "redirector"}, want: "redirector_"},
+		{config: MetricsConfig{Namespace: "redirector", Subsystem: "edge"}, want: "redirector_edge_"},
+		{config: MetricsConfig{Subsystem: "edge"}, want: "edge_"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.config.prefix())
+		})
+	}
+}
+
+func Test_registerMetrics(t *testing.T) {
+	tests := []struct {
+		name   string
+		config MetricsConfig
+		want   string
+	}{
+		{name: "no namespace", config: MetricsConfig{}, want: "active_hosts"},
+		{name: "namespace", config: MetricsConfig{Namespace: "redirector"}, want: "redirector_active_hosts"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := prometheus.NewRegistry()
+			assert.NoError(t, registerMetrics(reg, tt.config))
+
+			families, err := reg.Gather()
+			assert.NoError(t, err)
+			names := []string{}
+			for _, f := range families {
+				names = append(names, f.GetName())
+			}
+			assert.Contains(t, names, tt.want)
+		})
+	}
+
+	// registering the same metrics twice with one registry fails rather than panicking
+	reg := prometheus.NewRegistry()
+	assert.NoError(t, registerMetrics(reg, MetricsConfig{}))
+	assert.Error(t, registerMetrics(reg, MetricsConfig{}))
+}
+
+func TestMetricsAuth(t *testing.T) {
+	logger := newTestLogger()
+	// the minimum cost keeps the test fast
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name          string
+		exemptMetrics bool
+		path          string
+		method        string
+		username      string
+		password      string
+		want          int
+	}{
+		{name: "admin without credentials", path: "/admin/config/activate", method: "POST", want: http.StatusUnauthorized},
+		{name: "admin with wrong password", path: "/admin/config/activate", method: "POST", username: "admin", password: "hunter3", want: http.StatusUnauthorized},
+		{name: "admin with wrong username", path: "/admin/config/activate", method: "POST", username: "root", password: "hunter2", want: http.StatusUnauthorized},
+		// nothing is staged, so an authorized request gets through to a 409
+		{name: "admin with credentials", path: "/admin/config/activate", method: "POST", username: "admin", password: "hunter2", want: http.StatusConflict},
+		{name: "metrics without credentials", path: "/metrics", method: "GET", want: http.StatusUnauthorized},
+		{name: "exempt metrics", exemptMetrics: true, path: "/metrics", method: "GET", want: http.StatusOK},
+		{name: "exempt metrics doesn't exempt admin", exemptMetrics: true, path: "/admin/config/activate", method: "POST", want: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := parseConfig(logger, []byte(`
+metrics:
+  auth:
+    username: 'admin'
+    password_hash: '`+string(hash)+`'
+    exempt_metrics: `+strconv.FormatBool(tt.exemptMetrics)+`
+`))
+			assert.NoError(t, err)
+			srv := newMetricsServer(logger, &spyCache{}, cfg)
+
+			req := httptest.NewRequest(tt.method, "http://localhost"+tt.path, nil)
+			if tt.username != "" {
+				req.SetBasicAuth(tt.username, tt.password)
+			}
+			w := httptest.NewRecorder()
+			srv.ServeHTTP(w, req)
+			assert.Equal(t, tt.want, w.Code)
+			if tt.want == http.StatusUnauthorized {
+				assert.Contains(t, w.Header().Get("WWW-Authenticate"), "Basic")
+			}
+		})
+	}
+}
+
+func TestMetricsAuthInvalidHash(t *testing.T) {
+	logger := newTestLogger()
+
+	for _, hash := range []string{
+		"hunter2",
+		// the SHA-256 hash of hunter2
+		"f52fbd32b2b3b86ff88ef6c490628285f482af15ddcb29541f94bcf526a3f6c7",
+		"$2a$10$tooshort",
+	} {
+		_, err := parseConfig(logger, []byte("metrics:\n  auth:\n    username: 'admin'\n    password_hash: '"+hash+"'\n"))
+		var target InvalidPasswordHashError
+		assert.True(t, errors.As(err, &target))
+	}
+
+	// auth is off by default
+	cfg, err := parseConfig(logger, []byte("rules: []"))
+	assert.NoError(t, err)
+	w := httptest.NewRecorder()
+	newMetricsServer(logger, &spyCache{}, cfg).ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/metrics", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
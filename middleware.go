@@ -0,0 +1,197 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var (
+	inflightRequestsMetric = promauto.With(appMetrics).NewGauge(
+		prometheus.GaugeOpts{
+			Name: "inflight_requests",
+			Help: "Number of requests currently being handled",
+		})
+	rejectedRequestsMetric = promauto.With(appMetrics).NewCounter(
+		prometheus.CounterOpts{
+			Name: "concurrency_limit_rejected_requests_total",
+			Help: "Number of requests rejected because max_concurrent_requests was reached",
+		})
+)
+
+// serverHeaderSuppress is the server_header value that removes the Server header from all responses
+const serverHeaderSuppress = "-"
+
+// compressResponseWriter lazily compresses the response body once the status is written, either by WriteHeader or by
+// the first Write
+//
+// Responses without a body, such as redirects, and responses to HEAD requests pass through untouched
+type compressResponseWriter struct {
+	http.ResponseWriter
+	encoding string
+	writer   io.WriteCloser
+	// head is set for HEAD requests, whose responses have no body to compress
+	head bool
+	// wroteHeader is set once the status has been written, after which the encoding headers can't change
+	wroteHeader bool
+}
+
+// hasBody reports whether a response with status code can have a body worth compressing
+func hasBody(code int) bool {
+	return code >= http.StatusOK && code != http.StatusNoContent && (code < 300 || code >= 400)
+}
+
+func (c *compressResponseWriter) WriteHeader(code int) {
+	if !c.wroteHeader {
+		c.wroteHeader = true
+		// the handler already encoded the body, don't do it twice
+		if hasBody(code) && !c.head && c.Header().Get("Content-Encoding") == "" {
+			c.compress()
+		}
+	}
+	c.ResponseWriter.WriteHeader(code)
+}
+
+// compress sets the encoding headers and starts compressing the body. It's called before the status is written, since
+// the headers can't be changed afterwards
+func (c *compressResponseWriter) compress() {
+	h := c.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", c.encoding)
+	h.Add("Vary", "Accept-Encoding")
+
+	switch c.encoding {
+	case "gzip":
+		c.writer = gzip.NewWriter(c.ResponseWriter)
+	case "deflate":
+		// flate.NewWriter only returns an error for an invalid level
+		c.writer, _ = flate.NewWriter(c.ResponseWriter, flate.DefaultCompression)
+	}
+}
+
+func (c *compressResponseWriter) Write(b []byte) (int, error) {
+	if !c.wroteHeader {
+		// once the body is compressed, the content type can't be detected from it
+		if h := c.Header(); h.Get("Content-Type") == "" {
+			h.Set("Content-Type", http.DetectContentType(b))
+		}
+		c.WriteHeader(http.StatusOK)
+	}
+
+	if c.writer == nil {
+		return c.ResponseWriter.Write(b)
+	}
+	return c.writer.Write(b)
+}
+
+func (c *compressResponseWriter) Close() error {
+	if c.writer == nil {
+		return nil
+	}
+	return c.writer.Close()
+}
+
+// acceptedEncoding returns the compression encoding to use for a request's Accept-Encoding header, preferring gzip
+//
+// An empty string is returned if the client doesn't accept a supported encoding
+func acceptedEncoding(header string) string {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(header, ",") {
+		sp := strings.Split(part, ";")
+		encoding := strings.ToLower(strings.TrimSpace(sp[0]))
+		// an encoding with q=0 is explicitly not acceptable
+		if len(sp) > 1 && strings.ReplaceAll(strings.TrimSpace(sp[1]), " ", "") == "q=0" {
+			continue
+		}
+		accepted[encoding] = true
+	}
+
+	for _, encoding := range []string{"gzip", "deflate"} {
+		if accepted[encoding] {
+			return encoding
+		}
+	}
+	return ""
+}
+
+// compressionMiddleware compresses response bodies for clients that accept gzip or deflate encoding
+func compressionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := acceptedEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressResponseWriter{ResponseWriter: w, encoding: encoding, head: r.Method == http.MethodHead}
+		defer cw.Close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// serverHeaderMiddleware sets the Server header on every response
+//
+// If header is serverHeaderSuppress, the Server header is suppressed instead
+func serverHeaderMiddleware(header string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if header == serverHeaderSuppress {
+			// a nil value prevents the header from being written at all
+			w.Header()["Server"] = nil
+		} else {
+			w.Header().Set("Server", header)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// concurrencyLimitMiddleware responds with a 503 when `limit` requests are already being handled
+//
+// A limit <= 0 means there is no limit. If retryAfter is > 0, it's sent as the Retry-After header on rejected requests
+func concurrencyLimitMiddleware(limit int, retryAfter int, next http.Handler) http.Handler {
+	var sem chan struct{}
+	if limit > 0 {
+		sem = make(chan struct{}, limit)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sem != nil {
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			default:
+				rejectedRequestsMetric.Inc()
+				if retryAfter > 0 {
+					w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+				}
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		}
+
+		inflightRequestsMetric.Inc()
+		defer inflightRequestsMetric.Dec()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowedMethodsMiddleware responds with a 405 to requests whose method isn't in methods, before they're matched
+//
+// An empty list allows every method
+func allowedMethodsMiddleware(methods []string, next http.Handler) http.Handler {
+	allow := strings.Join(methods, ", ")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(methods) > 0 && !slices.Contains(methods, r.Method) {
+			w.Header().Set("Allow", allow)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,340 @@
+//go:build unit_test
+
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_acceptedEncoding(t *testing.T) {
+	var testCases = []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{name: "empty", header: "", want: ""},
+		{name: "gzip", header: "gzip", want: "gzip"},
+		{name: "deflate", header: "deflate", want: "deflate"},
+		{name: "gzip preferred", header: "deflate, gzip;q=0.5", want: "gzip"},
+		{name: "gzip refused", header: "gzip;q=0, deflate", want: "deflate"},
+		{name: "unsupported", header: "br", want: ""},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			assert.Equal(t, testCase.want, acceptedEncoding(testCase.header))
+		})
+	}
+}
+
+func TestCompressionMiddleware(t *testing.T) {
+	body := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello world"))
+	}
+	redirect := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", "https://example.com")
+		w.WriteHeader(http.StatusMovedPermanently)
+	}
+
+	t.Run("body is compressed", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "http://localhost/", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		compressionMiddleware(http.HandlerFunc(body)).ServeHTTP(w, req)
+
+		assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+		gr, err := gzip.NewReader(w.Body)
+		assert.Nil(t, err)
+		b, _ := io.ReadAll(gr)
+		assert.Equal(t, "hello world", string(b))
+	})
+
+	t.Run("body is not compressed without Accept-Encoding", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "http://localhost/", nil)
+		w := httptest.NewRecorder()
+		compressionMiddleware(http.HandlerFunc(body)).ServeHTTP(w, req)
+
+		assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+		assert.Equal(t, "hello world", w.Body.String())
+	})
+
+	t.Run("body written after the status is compressed", func(t *testing.T) {
+		for _, encoding := range []string{"gzip", "deflate"} {
+			req := httptest.NewRequest("GET", "http://localhost/", nil)
+			req.Header.Set("Accept-Encoding", encoding)
+			w := httptest.NewRecorder()
+			compressionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Content-Length", "17")
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"error":"miss"}` + "\n"))
+			})).ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusNotFound, w.Code)
+			assert.Equal(t, encoding, w.Header().Get("Content-Encoding"))
+			assert.Equal(t, "", w.Header().Get("Content-Length"))
+			var r io.Reader
+			if encoding == "gzip" {
+				gr, err := gzip.NewReader(w.Body)
+				assert.NoError(t, err)
+				r = gr
+			} else {
+				r = flate.NewReader(w.Body)
+			}
+			b, _ := io.ReadAll(r)
+			assert.Equal(t, `{"error":"miss"}`+"\n", string(b))
+		}
+	})
+
+	t.Run("responses without a body are unaffected", func(t *testing.T) {
+		tests := []struct {
+			method string
+			code   int
+		}{
+			{method: "GET", code: http.StatusNoContent},
+			{method: "GET", code: http.StatusNotModified},
+			{method: "HEAD", code: http.StatusOK},
+		}
+		for _, tt := range tests {
+			req := httptest.NewRequest(tt.method, "http://localhost/", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			w := httptest.NewRecorder()
+			compressionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.code)
+			})).ServeHTTP(w, req)
+
+			assert.Equal(t, tt.code, w.Code)
+			assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+			assert.Equal(t, 0, w.Body.Len())
+		}
+	})
+
+	t.Run("redirect is unaffected", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "http://localhost/", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		compressionMiddleware(http.HandlerFunc(redirect)).ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusMovedPermanently, w.Code)
+		assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+		assert.Equal(t, 0, w.Body.Len())
+	})
+}
+
+func TestServerHeaderMiddleware(t *testing.T) {
+	logger := newTestLogger()
+	cfg, _ := loadConfig(logger, "./fixtures/rules.yml")
+
+	var testCases = []struct {
+		name   string
+		header string
+		url    string
+		want   []string
+	}{
+		{
+			name:   "redirect",
+			header: "redirector",
+			url:    "http://localhost/foo",
+			want:   []string{"redirector"},
+		},
+		{
+			name:   "miss",
+			header: "redirector",
+			url:    "http://localhost/i-dont-exist",
+			want:   []string{"redirector"},
+		},
+		{
+			name:   "status",
+			header: "redirector",
+			url:    "http://localhost/status",
+			want:   []string{"redirector"},
+		},
+		{
+			name:   "suppressed",
+			header: serverHeaderSuppress,
+			url:    "http://localhost/foo",
+			want:   nil,
+		},
+		{
+			name:   "unset",
+			header: "",
+			url:    "http://localhost/foo",
+			want:   nil,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			cfg.Server.ServerHeader = testCase.header
+			req := httptest.NewRequest("GET", testCase.url, nil)
+			w := httptest.NewRecorder()
+			newServer(logger, &spyCache{}, cfg).ServeHTTP(w, req)
+
+			assert.Equal(t, testCase.want, w.Header().Values("Server"))
+		})
+	}
+}
+
+func TestHSTSMiddleware(t *testing.T) {
+	logger := newTestLogger()
+	cfg, err := parseConfig(logger, []byte(`
+force_https: true
+hsts:
+  max_age: 63072000
+  include_subdomains: true
+  preload: true
+server:
+  trusted_proxies: ['10.0.0.0/8']
+rules:
+  - from: 'example.com/foo'
+    to: 'https://foo.com/'
+`))
+	assert.NoError(t, err)
+	srv := newServer(logger, &spyCache{}, cfg)
+
+	var testCases = []struct {
+		name           string
+		url            string
+		forwardedProto string
+		want           string
+	}{
+		{name: "https", url: "https://example.com/foo", want: "max-age=63072000; includeSubDomains; preload"},
+		{name: "https miss", url: "https://example.com/missing", want: "max-age=63072000; includeSubDomains; preload"},
+		{name: "https behind proxy", url: "http://example.com/foo", forwardedProto: "https", want: "max-age=63072000; includeSubDomains; preload"},
+		{name: "http upgrade", url: "http://example.com/foo", want: ""},
+		{name: "http behind proxy", url: "http://example.com/foo", forwardedProto: "http", want: ""},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", testCase.url, nil)
+			if testCase.forwardedProto != "" {
+				req.RemoteAddr = "10.0.0.1:1234"
+				req.Header.Set("X-Forwarded-Proto", testCase.forwardedProto)
+			}
+			w := httptest.NewRecorder()
+			srv.ServeHTTP(w, req)
+			assert.Equal(t, testCase.want, w.Header().Get("Strict-Transport-Security"))
+		})
+	}
+
+	// HSTS is off by default
+	cfg, err = parseConfig(logger, []byte(""))
+	assert.NoError(t, err)
+	w := httptest.NewRecorder()
+	newServer(logger, &spyCache{}, cfg).ServeHTTP(w, httptest.NewRequest("GET", "https://example.com/", nil))
+	assert.Empty(t, w.Header().Get("Strict-Transport-Security"))
+}
+
+func TestHSTSConfigHeader(t *testing.T) {
+	assert.Equal(t, "max-age=300", HSTSConfig{MaxAge: 300}.header())
+	assert.Equal(t, "max-age=300; includeSubDomains", HSTSConfig{MaxAge: 300, IncludeSubdomains: true}.header())
+	assert.False(t, HSTSConfig{MaxAge: 300, IncludeSubdomains: true, Preload: true}.preloadable())
+	assert.True(t, HSTSConfig{MaxAge: hstsPreloadMinMaxAge, IncludeSubdomains: true, Preload: true}.preloadable())
+}
+
+func TestConcurrencyLimitMiddleware(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	blocking := func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}
+
+	h := concurrencyLimitMiddleware(1, 5, http.HandlerFunc(blocking))
+
+	first := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		h.ServeHTTP(first, httptest.NewRequest("GET", "http://localhost/", nil))
+		close(done)
+	}()
+	<-started
+
+	second := httptest.NewRecorder()
+	h.ServeHTTP(second, httptest.NewRequest("GET", "http://localhost/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, second.Code)
+	assert.Equal(t, "5", second.Header().Get("Retry-After"))
+
+	close(release)
+	<-done
+	assert.Equal(t, http.StatusOK, first.Code)
+}
+
+func TestConcurrencyLimitMiddlewareUnlimited(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	w := httptest.NewRecorder()
+	concurrencyLimitMiddleware(0, 0, http.HandlerFunc(ok)).ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "", w.Header().Get("Retry-After"))
+}
+
+func TestAllowedMethodsMiddleware(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	var testCases = []struct {
+		name      string
+		methods   []string
+		method    string
+		want      int
+		wantAllow string
+	}{
+		{name: "allowed", methods: []string{"GET", "HEAD"}, method: "GET", want: http.StatusOK},
+		{name: "head allowed", methods: []string{"GET", "HEAD"}, method: "HEAD", want: http.StatusOK},
+		{name: "trace rejected", methods: []string{"GET", "HEAD"}, method: "TRACE", want: http.StatusMethodNotAllowed, wantAllow: "GET, HEAD"},
+		{name: "post rejected", methods: []string{"GET", "HEAD"}, method: "POST", want: http.StatusMethodNotAllowed, wantAllow: "GET, HEAD"},
+		{name: "empty allows everything", methods: []string{}, method: "TRACE", want: http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			allowedMethodsMiddleware(tc.methods, http.HandlerFunc(ok)).ServeHTTP(w, httptest.NewRequest(tc.method, "http://localhost/", nil))
+			assert.Equal(t, tc.want, w.Code)
+			assert.Equal(t, tc.wantAllow, w.Header().Get("Allow"))
+		})
+	}
+}
+
+func TestAllowedMethodsBeforeMatching(t *testing.T) {
+	logger := newTestLogger()
+	cfg, err := parseConfig(logger, []byte(`
+server:
+  allowed_methods: ['get', 'head', 'post']
+rules:
+  - from: 'example.com/foo'
+    to: 'https://foo.com/'
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"GET", "HEAD", "POST"}, cfg.Server.AllowedMethods)
+
+	cache := &spyCache{}
+	srv := newServer(logger, cache, cfg)
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("POST", "http://example.com/foo", nil))
+	assert.Equal(t, http.StatusMovedPermanently, w.Code)
+
+	// rejected requests never reach the cache
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("TRACE", "http://example.com/foo", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	assert.Equal(t, "GET, HEAD, POST", w.Header().Get("Allow"))
+	assert.Equal(t, 1, cache.gets)
+
+	// the default only allows GET and HEAD
+	cfg, err = parseConfig(logger, []byte("rules: []"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"GET", "HEAD"}, cfg.Server.AllowedMethods)
+}
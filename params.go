@@ -1,13 +1,39 @@
 package main
 
 import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"net/url"
+	"slices"
+	"strings"
+)
+
+var (
+	parameterStrategyMetric = promauto.With(appMetrics).NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "parameter_strategy_total",
+			Help: "Number of times each parameter strategy was used to build a Location header",
+		},
+		[]string{"strategy"},
+	)
 )
 
 const (
 	ParamsStrategyCombine = "combine"
-	ParamsStrategyReplace = "replace"
-	ParamsStrategyUnset   = ""
+	// ParamsStrategyCombineDefaults is combine, but the incoming parameters win and the rule's values only fill in
+	// parameters the request doesn't have
+	ParamsStrategyCombineDefaults = "combine_defaults"
+	ParamsStrategyReplace         = "replace"
+	ParamsStrategyUnset           = ""
+)
+
+const (
+	// QueryDedupKeep keeps every value of a repeated request parameter. This is the default
+	QueryDedupKeep = "keep"
+	// QueryDedupFirst keeps the first value of a repeated request parameter
+	QueryDedupFirst = "first"
+	// QueryDedupLast keeps the last value of a repeated request parameter
+	QueryDedupLast = "last"
 )
 
 type UnknownParameterStrategyError struct {
@@ -18,15 +44,42 @@ func (u UnknownParameterStrategyError) Error() string {
 	return "unknown parameter strategy: " + u.s
 }
 
+// validParameterStrategy reports whether buildLocationParams recognizes the strategy
+func validParameterStrategy(strategy string) bool {
+	switch strategy {
+	case ParamsStrategyCombine, ParamsStrategyCombineDefaults, ParamsStrategyReplace, ParamsStrategyUnset:
+		return true
+	default:
+		return false
+	}
+}
+
+// strategy returns the strategy that builds a Location header's parameters. combine with only_if_absent keeps the
+// request's value for every parameter it has, which is what combine_defaults does
+func (p RuleParameters) strategy() string {
+	if p.OnlyIfAbsent && p.Strategy == ParamsStrategyCombine {
+		return ParamsStrategyCombineDefaults
+	}
+	return p.Strategy
+}
+
 func buildLocationParams(strategy string, c url.Values, n url.Values) (url.Values, error) {
 	switch strategy {
 	case ParamsStrategyCombine:
+		parameterStrategyMetric.With(prometheus.Labels{"strategy": strategy}).Inc()
 		return combine(c, n)
+	case ParamsStrategyCombineDefaults:
+		parameterStrategyMetric.With(prometheus.Labels{"strategy": strategy}).Inc()
+		// the incoming parameters are passed last so that they overwrite the rule's
+		return combine(n, c)
 	case ParamsStrategyReplace:
+		parameterStrategyMetric.With(prometheus.Labels{"strategy": strategy}).Inc()
 		return replace(n)
 	case ParamsStrategyUnset:
+		parameterStrategyMetric.With(prometheus.Labels{"strategy": "unset"}).Inc()
 		return url.Values{}, nil
 	default:
+		parameterStrategyMetric.With(prometheus.Labels{"strategy": "unknown"}).Inc()
 		return url.Values{}, UnknownParameterStrategyError{s: strategy}
 	}
 }
@@ -56,3 +109,108 @@ func replace(n url.Values) (url.Values, error) {
 
 	return final, nil
 }
+
+func validQueryDedup(mode string) bool {
+	switch mode {
+	case QueryDedupKeep, QueryDedupFirst, QueryDedupLast:
+		return true
+	default:
+		return false
+	}
+}
+
+// dedupParams collapses the values of repeated parameters in c to a single value, as chosen by mode
+func dedupParams(c url.Values, mode string) url.Values {
+	if mode == QueryDedupKeep {
+		return c
+	}
+
+	final := url.Values{}
+	for k, v := range c {
+		switch {
+		case len(v) < 2:
+			final[k] = v
+		case mode == QueryDedupFirst:
+			final[k] = v[:1]
+		case mode == QueryDedupLast:
+			final[k] = v[len(v)-1:]
+		}
+	}
+
+	return final
+}
+
+// filterParams returns only the parameters in c whose keys are in allowed
+func filterParams(c url.Values, allowed []string) url.Values {
+	final := url.Values{}
+	for _, k := range allowed {
+		if v, ok := c[k]; ok {
+			final[k] = v
+		}
+	}
+
+	return final
+}
+
+// queryKeyOrder returns the keys of a raw query string in the order they first appear
+func queryKeyOrder(rawQuery string) []string {
+	order := []string{}
+	seen := map[string]bool{}
+	for _, pair := range strings.Split(rawQuery, "&") {
+		k, _, _ := strings.Cut(pair, "=")
+		k, err := url.QueryUnescape(k)
+		if err != nil || k == "" || seen[k] {
+			continue
+		}
+		seen[k] = true
+		order = append(order, k)
+	}
+
+	return order
+}
+
+// appendQueryParam adds a parameter to the end of location's query
+func appendQueryParam(location string, key string, value string) string {
+	sep := "?"
+	if strings.Contains(location, "?") {
+		sep = "&"
+	}
+	return location + sep + url.QueryEscape(key) + "=" + url.QueryEscape(value)
+}
+
+// encodeParams encodes params like url.Values.Encode, except that the keys in order come first, in that order. The
+// remaining keys follow, sorted
+func encodeParams(params url.Values, order []string) string {
+	if len(order) == 0 {
+		return params.Encode()
+	}
+
+	keys := make([]string, 0, len(params))
+	for _, k := range order {
+		if _, ok := params[k]; ok {
+			keys = append(keys, k)
+		}
+	}
+	rest := []string{}
+	for k := range params {
+		if !slices.Contains(keys, k) {
+			rest = append(rest, k)
+		}
+	}
+	slices.Sort(rest)
+	keys = append(keys, rest...)
+
+	var b strings.Builder
+	for _, k := range keys {
+		for _, v := range params[k] {
+			if b.Len() > 0 {
+				b.WriteByte('&')
+			}
+			b.WriteString(url.QueryEscape(k))
+			b.WriteByte('=')
+			b.WriteString(url.QueryEscape(v))
+		}
+	}
+
+	return b.String()
+}
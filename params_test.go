@@ -3,6 +3,7 @@
 package main
 
 import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"net/url"
 	"reflect"
 	"testing"
@@ -65,6 +66,127 @@ func Test_merge(t *testing.T) {
 	}
 }
 
+func Test_buildLocationParamsPrecedence(t *testing.T) {
+	incoming := url.Values{
+		"utm_source": []string{"newsletter"},
+		"page":       []string{"2"},
+	}
+	configured := url.Values{
+		"utm_source": []string{"redirector"},
+		"lang":       []string{"en"},
+	}
+
+	tests := []struct {
+		name     string
+		strategy string
+		incoming url.Values
+		want     url.Values
+	}{
+		{
+			name:     "combine, configured values win",
+			strategy: ParamsStrategyCombine,
+			incoming: incoming,
+			want: url.Values{
+				"utm_source": []string{"redirector"},
+				"page":       []string{"2"},
+				"lang":       []string{"en"},
+			},
+		},
+		{
+			name:     "combine_defaults, incoming values win",
+			strategy: ParamsStrategyCombineDefaults,
+			incoming: incoming,
+			want: url.Values{
+				"utm_source": []string{"newsletter"},
+				"page":       []string{"2"},
+				"lang":       []string{"en"},
+			},
+		},
+		{
+			name:     "combine_defaults, no incoming values",
+			strategy: ParamsStrategyCombineDefaults,
+			incoming: url.Values{},
+			want:     configured,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := buildLocationParams(tt.strategy, tt.incoming, configured)
+			if err != nil {
+				t.Errorf("buildLocationParams() error = %v", err)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("buildLocationParams() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_buildLocationParamsOnlyIfAbsent(t *testing.T) {
+	configured := url.Values{
+		"utm_source": []string{"redirector"},
+		"utm_medium": []string{"redirect"},
+	}
+
+	tests := []struct {
+		name       string
+		parameters RuleParameters
+		incoming   url.Values
+		want       url.Values
+	}{
+		{
+			name:       "no incoming values",
+			parameters: RuleParameters{Strategy: ParamsStrategyCombine, OnlyIfAbsent: true},
+			incoming:   url.Values{},
+			want:       configured,
+		},
+		{
+			name:       "keeps incoming values per key",
+			parameters: RuleParameters{Strategy: ParamsStrategyCombine, OnlyIfAbsent: true},
+			incoming:   url.Values{"utm_source": []string{"newsletter"}, "page": []string{"2"}},
+			want: url.Values{
+				"utm_source": []string{"newsletter"},
+				"utm_medium": []string{"redirect"},
+				"page":       []string{"2"},
+			},
+		},
+		{
+			name:       "empty incoming value counts as present",
+			parameters: RuleParameters{Strategy: ParamsStrategyCombine, OnlyIfAbsent: true},
+			incoming:   url.Values{"utm_source": []string{""}},
+			want: url.Values{
+				"utm_source": []string{""},
+				"utm_medium": []string{"redirect"},
+			},
+		},
+		{
+			name:       "without only_if_absent, configured values win",
+			parameters: RuleParameters{Strategy: ParamsStrategyCombine},
+			incoming:   url.Values{"utm_source": []string{"newsletter"}},
+			want:       configured,
+		},
+		{
+			name:       "ignored by replace",
+			parameters: RuleParameters{Strategy: ParamsStrategyReplace, OnlyIfAbsent: true},
+			incoming:   url.Values{"utm_source": []string{"newsletter"}},
+			want:       configured,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := buildLocationParams(tt.parameters.strategy(), tt.incoming, configured)
+			if err != nil {
+				t.Errorf("buildLocationParams() error = %v", err)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("buildLocationParams() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func Test_replace(t *testing.T) {
 	type args struct {
 		newVals map[string][]string
@@ -90,3 +212,143 @@ func Test_replace(t *testing.T) {
 		})
 	}
 }
+
+func Test_buildLocationParamsMetric(t *testing.T) {
+	tests := []struct {
+		strategy string
+		label    string
+	}{
+		{strategy: ParamsStrategyCombine, label: "combine"},
+		{strategy: ParamsStrategyCombineDefaults, label: "combine_defaults"},
+		{strategy: ParamsStrategyReplace, label: "replace"},
+		{strategy: ParamsStrategyUnset, label: "unset"},
+		{strategy: "idontexist", label: "unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.label, func(t *testing.T) {
+			before := testutil.ToFloat64(parameterStrategyMetric.WithLabelValues(tt.label))
+			_, _ = buildLocationParams(tt.strategy, url.Values{}, url.Values{})
+			after := testutil.ToFloat64(parameterStrategyMetric.WithLabelValues(tt.label))
+			if after-before != 1 {
+				t.Errorf("parameter_strategy_total{strategy=%q} increased by %v, want 1", tt.label, after-before)
+			}
+		})
+	}
+}
+
+func Test_filterParams(t *testing.T) {
+	tests := []struct {
+		name    string
+		c       url.Values
+		allowed []string
+		want    url.Values
+	}{
+		{
+			name:    "disallowed removed",
+			c:       url.Values{"page": {"2"}, "tracking": {"abc"}},
+			allowed: []string{"page", "ref"},
+			want:    url.Values{"page": {"2"}},
+		},
+		{
+			name:    "empty allowlist removes everything",
+			c:       url.Values{"page": {"2"}},
+			allowed: []string{},
+			want:    url.Values{},
+		},
+		{
+			name:    "repeated values kept",
+			c:       url.Values{"page": {"1", "2"}},
+			allowed: []string{"page"},
+			want:    url.Values{"page": {"1", "2"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := filterParams(tt.c, tt.allowed); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("filterParams() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_queryKeyOrder(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want []string
+	}{
+		{raw: "", want: []string{}},
+		{raw: "zeta=1&alpha=2", want: []string{"zeta", "alpha"}},
+		{raw: "b=1&a=2&b=3", want: []string{"b", "a"}},
+		{raw: "flag&a%20b=1", want: []string{"flag", "a b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			if got := queryKeyOrder(tt.raw); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("queryKeyOrder() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_encodeParams(t *testing.T) {
+	params := url.Values{
+		"zeta":  []string{"1"},
+		"alpha": []string{"2", "3"},
+		"lang":  []string{"en"},
+		"beta":  []string{"a b"},
+	}
+
+	tests := []struct {
+		name  string
+		order []string
+		want  string
+	}{
+		{name: "sorted without an order", order: nil, want: "alpha=2&alpha=3&beta=a+b&lang=en&zeta=1"},
+		{name: "ordered keys first", order: []string{"zeta", "beta", "alpha"}, want: "zeta=1&beta=a+b&alpha=2&alpha=3&lang=en"},
+		{name: "missing keys skipped", order: []string{"missing", "zeta"}, want: "zeta=1&alpha=2&alpha=3&beta=a+b&lang=en"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := encodeParams(params, tt.order); got != tt.want {
+				t.Errorf("encodeParams() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_dedupParams(t *testing.T) {
+	incoming := url.Values{
+		"a": []string{"1", "2", "3"},
+		"b": []string{"x"},
+		"c": []string{""},
+	}
+
+	tests := []struct {
+		name string
+		mode string
+		want url.Values
+	}{
+		{
+			name: "keep",
+			mode: QueryDedupKeep,
+			want: incoming,
+		},
+		{
+			name: "first",
+			mode: QueryDedupFirst,
+			want: url.Values{"a": []string{"1"}, "b": []string{"x"}, "c": []string{""}},
+		},
+		{
+			name: "last",
+			mode: QueryDedupLast,
+			want: url.Values{"a": []string{"3"}, "b": []string{"x"}, "c": []string{""}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := dedupParams(incoming, tt.mode); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("dedupParams() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
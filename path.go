@@ -2,7 +2,17 @@ package main
 
 import (
 	"net/url"
+	"path"
 	"regexp"
+	"strings"
+)
+
+const (
+	// wildcardSuffix is the suffix of a from directive that captures the rest of the path
+	wildcardSuffix = "/*"
+	// splatToken is substituted in a to directive with the path captured by wildcardSuffix
+	splatToken = ":splat"
+	splatGroup = "SPLAT"
 )
 
 type StringNotExpandableError struct {
@@ -25,11 +35,138 @@ func rewritePath(path string, from *regexp.Regexp, to string) (string, error) {
 		b = from.ExpandString(b, to, path, submatches)
 	}
 
+	return parseExpandedPath(path, from, to, b)
+}
+
+// expandPath is rewritePath for a single match whose submatches have already been found
+func expandPath(path string, from *regexp.Regexp, to string, submatches []int) (string, error) {
+	if submatches == nil {
+		return rewritePath(path, from, to)
+	}
+
+	return parseExpandedPath(path, from, to, from.ExpandString(nil, to, path, submatches))
+}
+
+// parseExpandedPath returns the path of an expanded `to` directive
+func parseExpandedPath(path string, from *regexp.Regexp, to string, b []byte) (string, error) {
 	if len(b) == 0 {
 		return path, StringNotExpandableError{path, from.String(), to}
 	}
 
-	p, _ := url.Parse(string(b))
+	// captures can contain characters that don't survive being parsed as a URL, e.g. a lone `%`
+	p, err := url.Parse(string(b))
+	if err != nil {
+		return path, StringNotExpandableError{path, from.String(), to}
+	}
 
 	return p.Path, nil
 }
+
+// expandWildcard translates a path ending in wildcardSuffix into a regular expression with a named capture group
+// and replaces splatToken in `to` with a reference to that group
+//
+// Paths that don't end with wildcardSuffix are returned unchanged
+func expandWildcard(path string, to string) (string, string) {
+	if !strings.HasSuffix(path, wildcardSuffix) {
+		return path, to
+	}
+
+	p := strings.TrimSuffix(path, wildcardSuffix) + "/(?P<" + splatGroup + ">.*)"
+	t := strings.ReplaceAll(to, splatToken, "${"+splatGroup+"}")
+
+	return p, t
+}
+
+// rewriteRulePath returns the path for the Location header of a request matched by the rule
+func rewriteRulePath(path string, m ruleMatch) (string, error) {
+	switch m.rule.Match {
+	// an exact match has no remainder, so this yields the path from `to`
+	case MatchPrefix, MatchExact:
+		return rewritePrefix(path, m.rule.path, m.rule.To)
+	default:
+		return expandPath(path, m.rule.compiled, m.rule.To, m.submatches)
+	}
+}
+
+// expandCanonical returns the rule's canonical URL for a request path, expanding any captures it references
+func expandCanonical(path string, m ruleMatch) string {
+	rule := m.rule
+	if rule.Canonical == "" || rule.compiled == nil {
+		return rule.Canonical
+	}
+
+	submatches := m.submatches
+	if submatches == nil {
+		submatches = rule.compiled.FindStringSubmatchIndex(path)
+	}
+	if submatches == nil {
+		return rule.Canonical
+	}
+	return string(rule.compiled.ExpandString(nil, rule.Canonical, path, submatches))
+}
+
+// namedCaptures returns the named capture groups of the rule that matched path, and the values they captured, encoded
+// as a query string in the order the groups appear in the rule, e.g. `year=2024&slug=hello`. Groups that didn't
+// participate in the match are left out
+func namedCaptures(path string, m ruleMatch) string {
+	rule := m.rule
+	if rule.compiled == nil {
+		return ""
+	}
+
+	submatches := m.submatches
+	if submatches == nil {
+		submatches = rule.compiled.FindStringSubmatchIndex(path)
+	}
+	if submatches == nil {
+		return ""
+	}
+
+	parts := []string{}
+	for i, name := range rule.compiled.SubexpNames() {
+		if name == "" || 2*i+1 >= len(submatches) || submatches[2*i] < 0 {
+			continue
+		}
+		parts = append(parts, url.QueryEscape(name)+"="+url.QueryEscape(path[submatches[2*i]:submatches[2*i+1]]))
+	}
+	return strings.Join(parts, "&")
+}
+
+// rewritePrefix replaces the matched prefix of the request path with the path of the `to` directive,
+// keeping the unmatched remainder of the request path
+func rewritePrefix(path string, prefix string, to string) (string, error) {
+	t, err := url.Parse(to)
+	if err != nil {
+		return path, StringNotExpandableError{path, prefix, to}
+	}
+
+	suffix := strings.TrimPrefix(path, prefix)
+	p := t.Path
+	// avoid doubling up slashes when both `to` and the remainder have one, e.g. `/bar/` + `/baz`
+	if strings.HasSuffix(p, "/") && strings.HasPrefix(suffix, "/") {
+		suffix = suffix[1:]
+	}
+	p += suffix
+
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+
+	return p, nil
+}
+
+// normalizePath collapses repeated slashes and resolves `.` and `..` segments in a request path
+//
+// `..` can't go above the root, so `/../foo` becomes `/foo`. A trailing slash is kept because rules can treat `/foo`
+// and `/foo/` differently
+func normalizePath(p string) string {
+	if p == "" {
+		return "/"
+	}
+
+	cleaned := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
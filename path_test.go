@@ -72,6 +72,16 @@ func Test_rewrite(t *testing.T) {
 			},
 			want: "/xyz",
 		},
+		{
+			// the path is returned unchanged alongside an error rather than panicking
+			name: "capture with invalid escape",
+			args: args{
+				path: "example.com/test/100%",
+				from: `example.com/test/(.+)`,
+				to:   "https://foo.com/$1",
+			},
+			want: "example.com/test/100%",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -85,3 +95,181 @@ func Test_rewrite(t *testing.T) {
 		})
 	}
 }
+
+func Test_expandWildcard(t *testing.T) {
+	type args struct {
+		path string
+		to   string
+	}
+	tests := []struct {
+		name     string
+		args     args
+		wantPath string
+		wantTo   string
+	}{
+		{
+			name:     "splat variable",
+			args:     args{path: "/old/*", to: "https://example.com/new/$SPLAT"},
+			wantPath: "/old/(?P<SPLAT>.*)",
+			wantTo:   "https://example.com/new/$SPLAT",
+		},
+		{
+			name:     "splat token",
+			args:     args{path: "/old/*", to: "https://example.com/new/:splat"},
+			wantPath: "/old/(?P<SPLAT>.*)",
+			wantTo:   "https://example.com/new/${SPLAT}",
+		},
+		{
+			name:     "no wildcard",
+			args:     args{path: "/old/.*", to: "https://example.com/new/:splat"},
+			wantPath: "/old/.*",
+			wantTo:   "https://example.com/new/:splat",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotPath, gotTo := expandWildcard(tt.args.path, tt.args.to)
+			if gotPath != tt.wantPath {
+				t.Errorf("expandWildcard() path = %v, want %v", gotPath, tt.wantPath)
+			}
+			if gotTo != tt.wantTo {
+				t.Errorf("expandWildcard() to = %v, want %v", gotTo, tt.wantTo)
+			}
+		})
+	}
+}
+
+func Test_rewritePrefix(t *testing.T) {
+	type args struct {
+		path   string
+		prefix string
+		to     string
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "exact prefix",
+			args: args{path: "/foo", prefix: "/foo", to: "https://example.com/bar"},
+			want: "/bar",
+		},
+		{
+			name: "remainder appended",
+			args: args{path: "/foo/baz/qux", prefix: "/foo", to: "https://example.com/bar"},
+			want: "/bar/baz/qux",
+		},
+		{
+			name: "trailing slash in to",
+			args: args{path: "/foo/baz", prefix: "/foo", to: "https://example.com/bar/"},
+			want: "/bar/baz",
+		},
+		{
+			name: "partial segment",
+			args: args{path: "/foobaz", prefix: "/foo", to: "https://example.com/bar"},
+			want: "/barbaz",
+		},
+		{
+			name: "host only to",
+			args: args{path: "/foo/baz", prefix: "/foo/", to: "https://example.com"},
+			want: "/baz",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := rewritePrefix(tt.args.path, tt.args.prefix, tt.args.to)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("rewritePrefix() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("rewritePrefix() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_normalizePath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "/foo/bar", want: "/foo/bar"},
+		{path: "/foo//bar", want: "/foo/bar"},
+		{path: "//foo///bar//", want: "/foo/bar/"},
+		{path: "/foo/./bar", want: "/foo/bar"},
+		{path: "/./", want: "/"},
+		{path: "/foo/../bar", want: "/bar"},
+		{path: "/../../bar", want: "/bar"},
+		{path: "/foo/bar/..", want: "/foo"},
+		{path: "", want: "/"},
+		{path: "/", want: "/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := normalizePath(tt.path); got != tt.want {
+				t.Errorf("normalizePath() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_namedCaptures(t *testing.T) {
+	tests := []struct {
+		name       string
+		expression string
+		path       string
+		want       string
+	}{
+		{
+			name:       "named groups in order",
+			expression: `^/blog/(?P<year>\d+)/(?P<slug>[^/]+)$`,
+			path:       "/blog/2024/hello",
+			want:       "year=2024&slug=hello",
+		},
+		{
+			name:       "unnamed groups are left out",
+			expression: `^/(\w+)/(?P<id>\d+)$`,
+			path:       "/users/42",
+			want:       "id=42",
+		},
+		{
+			name:       "groups that didn't participate are left out",
+			expression: `^/docs(?:/(?P<page>\w+))?(?P<rest>/.*)?$`,
+			path:       "/docs",
+			want:       "",
+		},
+		{
+			name:       "empty capture",
+			expression: `^/search/(?P<q>.*)$`,
+			path:       "/search/",
+			want:       "q=",
+		},
+		{
+			name:       "values are escaped",
+			expression: `^/(?P<SPLAT>.*)$`,
+			path:       "/a b&c=d",
+			want:       "SPLAT=a+b%26c%3Dd",
+		},
+		{
+			name:       "no match",
+			expression: `^/blog/(?P<year>\d+)$`,
+			path:       "/other",
+			want:       "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := ruleMatch{rule: Rule{compiled: regexp.MustCompile(tt.expression)}}
+			if got := namedCaptures(tt.path, m); got != tt.want {
+				t.Errorf("namedCaptures() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if got := namedCaptures("/foo", ruleMatch{rule: Rule{}}); got != "" {
+		t.Errorf("namedCaptures() without an expression got = %v, want empty", got)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"container/list"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	rateLimiterTrackedIPsMetric = promauto.With(appMetrics).NewGauge(
+		prometheus.GaugeOpts{
+			Name: "rate_limiter_tracked_ips",
+			Help: "Number of client IPs with their own rate limiter",
+		})
+	rateLimitedRequestsMetric = promauto.With(appMetrics).NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rate_limited_requests_total",
+			Help: "Number of requests rejected by the rate limiter, by whether the client had its own limiter or shared the overflow limiter",
+		},
+		[]string{"limiter"},
+	)
+)
+
+type RateLimitConfig struct {
+	// RequestsPerSecond is the rate each client IP's requests are limited to. 0 disables rate limiting
+	RequestsPerSecond float64 `yaml:"requests_per_second"`
+	// Burst is the number of requests a client can make at once. It defaults to RequestsPerSecond, and is at least 1
+	Burst int `yaml:"burst"`
+	// MaxTrackedIPs is the number of client IPs given their own limiter. Clients beyond it share a single overflow
+	// limiter, so that requests from many addresses can't exhaust memory
+	MaxTrackedIPs int `yaml:"max_tracked_ips"`
+}
+
+func (c RateLimitConfig) enabled() bool {
+	return c.RequestsPerSecond > 0
+}
+
+// tokenBucket allows bursts of up to `burst` requests, refilling at `rate` requests per second
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens earned since the bucket was last used, up to burst
+func (b *tokenBucket) refill(now time.Time, rate float64, burst int) {
+	b.tokens = min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+}
+
+func (b *tokenBucket) allow(now time.Time, rate float64, burst int) bool {
+	b.refill(now, rate, burst)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+type rateLimiterEntry struct {
+	ip     string
+	bucket tokenBucket
+}
+
+// rateLimiter keeps a token bucket per client IP, for up to max IPs
+//
+// When it's full, the least recently seen IP is forgotten if its bucket has refilled, since a full bucket is the same
+// as a new one. Otherwise the new IP isn't tracked and shares the overflow bucket with every other untracked IP
+type rateLimiter struct {
+	lock     sync.Mutex
+	rate     float64
+	burst    int
+	max      int
+	order    *list.List
+	items    map[string]*list.Element
+	overflow tokenBucket
+	now      func() time.Time
+}
+
+func newRateLimiter(c RateLimitConfig) *rateLimiter {
+	l := &rateLimiter{
+		rate:  c.RequestsPerSecond,
+		burst: c.Burst,
+		max:   c.MaxTrackedIPs,
+		order: list.New(),
+		items: map[string]*list.Element{},
+		now:   time.Now,
+	}
+	l.overflow = tokenBucket{tokens: float64(l.burst), last: l.now()}
+	return l
+}
+
+// allow reports whether a request from ip is allowed, and whether ip has its own bucket
+func (l *rateLimiter) allow(ip string) (bool, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := l.now()
+	if e, ok := l.items[ip]; ok {
+		l.order.MoveToFront(e)
+		return e.Value.(*rateLimiterEntry).bucket.allow(now, l.rate, l.burst), true
+	}
+
+	if l.order.Len() >= l.max {
+		oldest := l.order.Back()
+		entry := oldest.Value.(*rateLimiterEntry)
+		entry.bucket.refill(now, l.rate, l.burst)
+		if entry.bucket.tokens < float64(l.burst) {
+			return l.overflow.allow(now, l.rate, l.burst), false
+		}
+		l.order.Remove(oldest)
+		delete(l.items, entry.ip)
+	}
+
+	entry := &rateLimiterEntry{ip: ip, bucket: tokenBucket{tokens: float64(l.burst), last: now}}
+	l.items[ip] = l.order.PushFront(entry)
+	rateLimiterTrackedIPsMetric.Set(float64(l.order.Len()))
+	return entry.bucket.allow(now, l.rate, l.burst), true
+}
+
+func (l *rateLimiter) len() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.order.Len()
+}
+
+// rateLimitMiddleware responds with a 429 to clients that exceed the rate limit. If retryAfter is > 0, it's sent as
+// the Retry-After header on rejected requests
+func rateLimitMiddleware(l *rateLimiter, trustedProxies []*net.IPNet, retryAfter int, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := ""
+		if ip := requestClientIP(r, trustedProxies); ip != nil {
+			key = ip.String()
+		}
+
+		allowed, tracked := l.allow(key)
+		if !allowed {
+			limiter := "ip"
+			if !tracked {
+				limiter = "overflow"
+			}
+			rateLimitedRequestsMetric.With(prometheus.Labels{"limiter": limiter}).Inc()
+			if retryAfter > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			}
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
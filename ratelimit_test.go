@@ -0,0 +1,106 @@
+//go:build unit_test
+
+package main
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestRateLimiter(c RateLimitConfig, now *time.Time) *rateLimiter {
+	l := newRateLimiter(c)
+	l.now = func() time.Time { return *now }
+	l.overflow.last = *now
+	return l
+}
+
+func TestRateLimiterBeyondMaxTrackedIPs(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := newTestRateLimiter(RateLimitConfig{RequestsPerSecond: 1, Burst: 1, MaxTrackedIPs: 3}, &now)
+
+	for i := 0; i < 3; i++ {
+		allowed, tracked := l.allow(fmt.Sprintf("10.0.0.%d", i))
+		assert.True(t, allowed)
+		assert.True(t, tracked)
+	}
+	assert.Equal(t, 3, l.len())
+	assert.Equal(t, 3.0, testutil.ToFloat64(rateLimiterTrackedIPsMetric))
+
+	// every tracked IP has used its burst, so new IPs share the overflow limiter
+	for i := 3; i < 100; i++ {
+		allowed, tracked := l.allow(fmt.Sprintf("10.0.0.%d", i))
+		assert.Equal(t, i == 3, allowed, "only the first untracked IP gets the overflow burst")
+		assert.False(t, tracked)
+	}
+	assert.Equal(t, 3, l.len())
+
+	// tracked IPs keep their own limiter
+	allowed, tracked := l.allow("10.0.0.0")
+	assert.False(t, allowed)
+	assert.True(t, tracked)
+
+	// once the least recently seen IP's bucket refills, it's replaced
+	now = now.Add(time.Second)
+	allowed, tracked = l.allow("10.0.0.200")
+	assert.True(t, allowed)
+	assert.True(t, tracked)
+	assert.Equal(t, 3, l.len())
+	_, ok := l.items["10.0.0.1"]
+	assert.False(t, ok)
+}
+
+func TestRateLimiterRefill(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := newTestRateLimiter(RateLimitConfig{RequestsPerSecond: 2, Burst: 2, MaxTrackedIPs: 10}, &now)
+
+	tests := []struct {
+		advance time.Duration
+		want    bool
+	}{
+		{want: true},
+		{want: true},
+		{want: false},
+		{advance: 250 * time.Millisecond, want: false},
+		{advance: 250 * time.Millisecond, want: true},
+		{advance: time.Hour, want: true},
+		{want: true},
+		{want: false},
+	}
+	for i, tt := range tests {
+		now = now.Add(tt.advance)
+		allowed, _ := l.allow("10.0.0.1")
+		assert.Equal(t, tt.want, allowed, "request %d", i)
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := newTestRateLimiter(RateLimitConfig{RequestsPerSecond: 1, Burst: 1, MaxTrackedIPs: 10}, &now)
+	handler := rateLimitMiddleware(l, nil, 5, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusMovedPermanently)
+	}))
+
+	tests := []struct {
+		remoteAddr string
+		want       int
+	}{
+		{remoteAddr: "10.0.0.1:1234", want: http.StatusMovedPermanently},
+		{remoteAddr: "10.0.0.1:5678", want: http.StatusTooManyRequests},
+		{remoteAddr: "10.0.0.2:1234", want: http.StatusMovedPermanently},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "http://example.com/foo", nil)
+		req.RemoteAddr = tt.remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		assert.Equal(t, tt.want, w.Code, tt.remoteAddr)
+		if tt.want == http.StatusTooManyRequests {
+			assert.Equal(t, "5", w.Header().Get("Retry-After"))
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// redisKeyPrefix namespaces redirects, e.g. `redirector:example.com:/foo`
+	redisKeyPrefix = "redirector:"
+	// redisNegativeKeyPrefix namespaces misses stored by a negative cache, so that flushing one doesn't flush the other
+	redisNegativeKeyPrefix = "redirector-negative:"
+	// redisFlushBatch is the number of keys asked for by each SCAN, and deleted by each DEL, when flushing
+	redisFlushBatch = 1000
+)
+
+type RedisConfig struct {
+	// Address is the host and port of the Redis server, e.g. `redis:6379`
+	Address string `yaml:"address"`
+	// Username is the ACL user to authenticate as. Without it, only Password is sent, as the `default` user
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	DB       int    `yaml:"db"`
+	// Timeout is how long connecting to Redis, and each command, can take before it's treated as an error
+	Timeout time.Duration  `yaml:"timeout"`
+	TLS     RedisTLSConfig `yaml:"tls"`
+}
+
+// RedisTLSConfig configures TLS for the connection to Redis, which most managed Redis services require
+type RedisTLSConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// CAFile is a PEM file of the certificate authorities the server's certificate is verified with, instead of the
+	// system's
+	CAFile string `yaml:"ca_file"`
+	// ServerName is the name the server's certificate is verified against, instead of Address's host
+	ServerName string `yaml:"server_name"`
+}
+
+// newRedisTLSConfig returns the TLS config for the connection to Redis, or nil when TLS isn't enabled
+func newRedisTLSConfig(c RedisTLSConfig) (*tls.Config, error) {
+	if !c.Enabled {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12, ServerName: c.ServerName}
+	if c.CAFile != "" {
+		b, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading cache.redis.tls.ca_file: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("cache.redis.tls.ca_file '%s' has no PEM certificates", c.CAFile)
+		}
+	}
+	return tlsConfig, nil
+}
+
+// redisCacheItem is how a cached response is stored in Redis
+type redisCacheItem struct {
+	Location            string `json:"location"`
+	Canonical           string `json:"canonical,omitempty"`
+	Code                int    `json:"code"`
+	CacheControlMaxAge  int    `json:"cache_control_max_age"`
+	PreserveRequestPort bool   `json:"preserve_request_port,omitempty"`
+	Miss                bool   `json:"miss,omitempty"`
+	Rule                string `json:"rule,omitempty"`
+}
+
+// RedisCache stores responses in Redis, under keys namespaced like `redirector:{host}:{path}`
+//
+// Entries expire after the TTL by themselves, so unlike InMemoryCache there's no cleanup job
+type RedisCache struct {
+	logger *slog.Logger
+	client *redis.Client
+	prefix string
+	ttl    int64
+}
+
+// NewRedisCache returns a cache backed by the Redis server c points at. The client connects when it's first used, so
+// an unreachable server isn't an error here
+func NewRedisCache(l *slog.Logger, c RedisConfig, prefix string, ttl int64) (*RedisCache, error) {
+	tlsConfig, err := newRedisTLSConfig(c.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RedisCache{
+		logger: l.WithGroup("cache").WithGroup("redis"),
+		client: redis.NewClient(&redis.Options{
+			Addr:         c.Address,
+			Username:     c.Username,
+			Password:     c.Password,
+			DB:           c.DB,
+			DialTimeout:  c.Timeout,
+			ReadTimeout:  c.Timeout,
+			WriteTimeout: c.Timeout,
+			TLSConfig:    tlsConfig,
+			// a failed command is treated as a miss, so retrying it would only delay the response while Redis is down
+			MaxRetries:    -1,
+			DialerRetries: 1,
+		}),
+		prefix: prefix,
+		ttl:    ttl,
+	}, nil
+}
+
+func (c *RedisCache) key(host string, path string, query string, variant string) string {
+	return c.prefix + host + ":" + cacheKey(path, query, variant)
+}
+
+func (c *RedisCache) Get(parameters CacheGetParameters) (*CacheResponse, error) {
+	b, err := c.client.Get(context.Background(), c.key(parameters.host, parameters.path, parameters.query, parameters.variant)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		c.logger.Debug("cache miss", "host", parameters.host, "path", parameters.path)
+		recordCacheMetric("miss", parameters.host, parameters.path)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var item redisCacheItem
+	if err := json.Unmarshal(b, &item); err != nil {
+		return nil, err
+	}
+
+	c.logger.Debug("cache hit for path", "host", parameters.host, "path", parameters.path)
+	recordCacheMetric("hit", parameters.host, parameters.path)
+	return &CacheResponse{
+		code:                item.Code,
+		location:            item.Location,
+		canonical:           item.Canonical,
+		cacheMaxAge:         item.CacheControlMaxAge,
+		preserveRequestPort: item.PreserveRequestPort,
+		miss:                item.Miss,
+		rule:                item.Rule,
+	}, nil
+}
+
+func (c *RedisCache) Set(parameters CacheSetParameters) error {
+	b, err := json.Marshal(redisCacheItem{
+		Location:            parameters.location,
+		Canonical:           parameters.canonical,
+		Code:                parameters.code,
+		CacheControlMaxAge:  parameters.cacheControlMaxAge,
+		PreserveRequestPort: parameters.preserveRequestPort,
+		Miss:                parameters.miss,
+		Rule:                parameters.rule,
+	})
+	if err != nil {
+		return err
+	}
+
+	// an expiration of 0 stores the key without one
+	ttl := parameters.entryTTL(c.ttl)
+	c.logger.Debug("adding item to cache", "host", parameters.host, "path", parameters.path, "code", parameters.code, "ttl", ttl, "location", parameters.location)
+	key := c.key(parameters.host, parameters.path, parameters.query, parameters.variant)
+	return c.client.Set(context.Background(), key, b, time.Duration(ttl)*time.Second).Err()
+}
+
+// Flush deletes every key under the cache's prefix, including those set by other instances
+func (c *RedisCache) Flush() (int, error) {
+	n, err := c.deleteMatching(c.prefix + "*")
+	c.logger.Debug("flushed cache", "entries", n)
+	return n, err
+}
+
+// FlushHost deletes every key for host under the cache's prefix, including those set by other instances
+func (c *RedisCache) FlushHost(host string) (int, error) {
+	n, err := c.deleteMatching(redisGlobEscaper.Replace(c.prefix+host+":") + "*")
+	c.logger.Debug("flushed host from cache", "host", host, "entries", n)
+	return n, err
+}
+
+// redisGlobEscaper escapes the characters SCAN's MATCH treats as special, e.g. the brackets of IPv6 hosts
+var redisGlobEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+// deleteMatching deletes every key matching the glob pattern, returning the number deleted
+func (c *RedisCache) deleteMatching(pattern string) (int, error) {
+	n := 0
+	err := c.scan(pattern, func(keys []string) error {
+		deleted, err := c.client.Del(context.Background(), keys...).Result()
+		n += int(deleted)
+		return err
+	})
+	return n, err
+}
+
+// scan calls fn with batches of up to redisFlushBatch keys matching the glob pattern, stopping at the first error
+func (c *RedisCache) scan(pattern string, fn func(keys []string) error) error {
+	ctx := context.Background()
+	iter := c.client.Scan(ctx, 0, pattern, redisFlushBatch).Iterator()
+	keys := make([]string, 0, redisFlushBatch)
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+		if len(keys) < redisFlushBatch {
+			continue
+		}
+		if err := fn(keys); err != nil {
+			return err
+		}
+		keys = keys[:0]
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	if len(keys) > 0 {
+		return fn(keys)
+	}
+	return nil
+}
+
+// Stats counts the keys under the cache's prefix, including those set by other instances. Keys are scanned in batches,
+// so Redis isn't blocked while they're counted
+func (c *RedisCache) Stats() (CacheStats, error) {
+	hosts := map[string]int{}
+	err := c.scan(c.prefix+"*", func(keys []string) error {
+		for _, k := range keys {
+			hosts[redisKeyHost(strings.TrimPrefix(k, c.prefix))]++
+		}
+		return nil
+	})
+	if err != nil {
+		return CacheStats{}, err
+	}
+	return newCacheStats(hosts), nil
+}
+
+// redisKeyHost returns the host of a key with its prefix removed. IPv6 hosts are bracketed, so they end at the `]`
+// rather than at their first `:`
+func redisKeyHost(key string) string {
+	if strings.HasPrefix(key, "[") {
+		if end := strings.Index(key, "]"); end != -1 {
+			return key[:end+1]
+		}
+	}
+	host, _, _ := strings.Cut(key, ":")
+	return host
+}
@@ -0,0 +1,187 @@
+//go:build unit_test
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRedisCache(t *testing.T) {
+	logger := newTestLogger()
+	server := miniredis.RunT(t)
+	server.RequireUserAuth("redirector", "hunter2")
+	cache, err := NewRedisCache(logger, RedisConfig{Address: server.Addr(), Username: "redirector", Password: "hunter2", DB: 2, Timeout: defaultRedisTimeout}, redisKeyPrefix, 3600)
+	assert.NoError(t, err)
+
+	r, err := cache.Get(CacheGetParameters{host: "example.com", path: "/foo"})
+	assert.NoError(t, err)
+	assert.Nil(t, r)
+
+	err = cache.Set(CacheSetParameters{host: "example.com", path: "/foo", location: "https://example.org/foo", code: 301, cacheControlMaxAge: 60, rule: "foo"})
+	assert.NoError(t, err)
+	err = cache.Set(CacheSetParameters{host: "example.com", path: "/foo", query: "a=1", location: "https://example.org/foo?a=1", code: 302})
+	assert.NoError(t, err)
+
+	r, err = cache.Get(CacheGetParameters{host: "example.com", path: "/foo"})
+	assert.NoError(t, err)
+	assert.Equal(t, &CacheResponse{location: "https://example.org/foo", code: 301, cacheMaxAge: 60, rule: "foo"}, r)
+	r, err = cache.Get(CacheGetParameters{host: "example.com", path: "/foo", query: "a=1"})
+	assert.NoError(t, err)
+	assert.Equal(t, &CacheResponse{location: "https://example.org/foo?a=1", code: 302}, r)
+
+	// keys are namespaced by host, and expire after the TTL
+	db := server.DB(2)
+	assert.True(t, db.Exists("redirector:example.com:/foo"))
+	assert.Equal(t, 3600*time.Second, db.TTL("redirector:example.com:/foo"))
+	assert.NoError(t, db.Set("other:key", "untouched"))
+
+	// stats only count the cache's own keys, including those of IPv6 hosts
+	_ = cache.Set(CacheSetParameters{host: "[::1]", path: "/foo", location: "https://example.org/foo", code: 301})
+	stats, err := cache.Stats()
+	assert.NoError(t, err)
+	assert.Equal(t, CacheStats{Entries: 3, Hosts: []CacheHostStats{{Host: "[::1]", Entries: 1}, {Host: "example.com", Entries: 2}}}, stats)
+	n, err := cache.FlushHost("[::1]")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	// flushing a host only deletes its own keys
+	_ = cache.Set(CacheSetParameters{host: "example.org", path: "/foo", location: "https://example.org/foo", code: 301})
+	n, err = cache.FlushHost("example.org")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	// flushing only deletes the cache's own keys
+	n, err = cache.Flush()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	r, err = cache.Get(CacheGetParameters{host: "example.com", path: "/foo"})
+	assert.NoError(t, err)
+	assert.Nil(t, r)
+	assert.Equal(t, []string{"other:key"}, db.Keys())
+}
+
+func TestRedisCacheFlushBatches(t *testing.T) {
+	logger := newTestLogger()
+	server := miniredis.RunT(t)
+	cache, err := NewRedisCache(logger, RedisConfig{Address: server.Addr(), Timeout: defaultRedisTimeout}, redisKeyPrefix, 3600)
+	assert.NoError(t, err)
+
+	// more keys than a single SCAN asks for, so they're deleted in several batches
+	for i := range redisFlushBatch + 10 {
+		assert.NoError(t, server.Set(fmt.Sprintf("redirector:example.com:/%d", i), "{}"))
+	}
+	n, err := cache.Flush()
+	assert.NoError(t, err)
+	assert.Equal(t, redisFlushBatch+10, n)
+	assert.Empty(t, server.Keys())
+}
+
+func TestRedisCacheErrors(t *testing.T) {
+	logger := newTestLogger()
+	server := miniredis.RunT(t)
+	server.RequireAuth("hunter2")
+
+	cache, err := NewRedisCache(logger, RedisConfig{Address: server.Addr(), Password: "wrong", Timeout: defaultRedisTimeout}, redisKeyPrefix, 3600)
+	assert.NoError(t, err)
+	_, err = cache.Get(CacheGetParameters{host: "example.com", path: "/foo"})
+	var redisError redis.Error
+	assert.ErrorAs(t, err, &redisError)
+
+	// the client connects lazily, so an unreachable server only fails the commands
+	address := server.Addr()
+	server.Close()
+	cache, err = NewRedisCache(logger, RedisConfig{Address: address, Timeout: defaultRedisTimeout}, redisKeyPrefix, 3600)
+	assert.NoError(t, err)
+	assert.Error(t, cache.Set(CacheSetParameters{host: "example.com", path: "/foo", location: "https://example.org/", code: 301}))
+}
+
+func TestRedisCacheTLS(t *testing.T) {
+	logger := newTestLogger()
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCertificate(t, dir, "redis.example")
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	assert.NoError(t, err)
+	server, err := miniredis.RunTLS(&tls.Config{Certificates: []tls.Certificate{cert}})
+	assert.NoError(t, err)
+	t.Cleanup(server.Close)
+
+	tests := []struct {
+		name       string
+		config     RedisTLSConfig
+		wantNewErr bool
+		wantErr    bool
+	}{
+		{name: "trusted CA", config: RedisTLSConfig{Enabled: true, CAFile: certFile, ServerName: "redis.example"}},
+		{name: "untrusted certificate", config: RedisTLSConfig{Enabled: true, ServerName: "redis.example"}, wantErr: true},
+		{name: "wrong server name", config: RedisTLSConfig{Enabled: true, CAFile: certFile, ServerName: "other.example"}, wantErr: true},
+		{name: "TLS disabled", config: RedisTLSConfig{CAFile: certFile}, wantErr: true},
+		{name: "missing CA file", config: RedisTLSConfig{Enabled: true, CAFile: dir + "/missing.crt"}, wantNewErr: true},
+		{name: "CA file without certificates", config: RedisTLSConfig{Enabled: true, CAFile: keyFile}, wantNewErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache, err := NewRedisCache(logger, RedisConfig{Address: server.Addr(), Timeout: defaultRedisTimeout, TLS: tt.config}, redisKeyPrefix, 3600)
+			if tt.wantNewErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+
+			err = cache.Set(CacheSetParameters{host: "example.com", path: "/foo", location: "https://example.org/foo", code: 301})
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			r, err := cache.Get(CacheGetParameters{host: "example.com", path: "/foo"})
+			assert.NoError(t, err)
+			assert.Equal(t, &CacheResponse{location: "https://example.org/foo", code: 301}, r)
+		})
+	}
+}
+
+func TestRedisCacheConfig(t *testing.T) {
+	logger := newTestLogger()
+	tests := []struct {
+		name             string
+		config           string
+		wantBackend      string
+		wantNegative     string
+		wantPositiveType Cache
+	}{
+		{name: "memory is the default", config: "", wantBackend: CacheBackendMemory, wantPositiveType: &InMemoryCache{}},
+		{name: "redis", config: "cache:\n  backend: redis\n  redis:\n    address: localhost:6379", wantBackend: CacheBackendRedis, wantPositiveType: &RedisCache{}},
+		{name: "redis without an address", config: "cache:\n  backend: redis", wantBackend: CacheBackendMemory, wantPositiveType: &InMemoryCache{}},
+		{name: "redis negative cache", config: "cache:\n  redis:\n    address: localhost:6379\n  negative:\n    backend: redis", wantBackend: CacheBackendMemory, wantNegative: CacheBackendRedis},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := parseConfig(logger, []byte(tt.config))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantBackend, cfg.Cache.Backend)
+			assert.Equal(t, defaultRedisTimeout, cfg.Cache.Redis.Timeout)
+
+			cache, err := newCache(t.Context(), logger, cfg.Cache)
+			assert.NoError(t, err)
+			if tt.wantNegative == "" {
+				assert.IsType(t, tt.wantPositiveType, cache)
+				return
+			}
+			assert.Equal(t, tt.wantNegative, cfg.Cache.Negative.Backend)
+			if split, ok := cache.(*splitCache); assert.True(t, ok) {
+				assert.IsType(t, &InMemoryCache{}, split.positive)
+				if negative, ok := split.negative.(*RedisCache); assert.True(t, ok) {
+					assert.Equal(t, redisNegativeKeyPrefix, negative.prefix)
+				}
+			}
+		})
+	}
+}
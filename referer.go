@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// RefererLoopOff doesn't compare the Referer header with the Location header. This is the default
+	RefererLoopOff = "off"
+	// RefererLoopLog logs a warning and counts redirects to the page the request came from, but still redirects
+	RefererLoopLog = "log"
+	// RefererLoopMiss logs and counts redirects to the page the request came from, and sends the miss response instead
+	RefererLoopMiss = "miss"
+)
+
+var (
+	probableLoopMetric = promauto.With(appMetrics).NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "probable_loop_total",
+			Help: "Number of redirects whose Location has the same host and path as the request's Referer header",
+		},
+		[]string{"host"},
+	)
+)
+
+type RefererLoopError struct {
+	location string
+}
+
+func (e RefererLoopError) Error() string {
+	return fmt.Sprintf("location '%s' redirects back to the referer", e.location)
+}
+
+func validRefererLoop(mode string) bool {
+	switch mode {
+	case RefererLoopOff, RefererLoopLog, RefererLoopMiss:
+		return true
+	default:
+		return false
+	}
+}
+
+// isRefererLoop reports whether location has the same host and path as referer, ignoring the scheme, port, and query
+//
+// Browsers send the page they were redirected from as the Referer of the next request, so a redirect back to it is
+// likely part of a loop that spans several requests, which isSelfRedirect can't see. A relative location is on
+// requestHost
+func isRefererLoop(referer string, requestHost string, location string) bool {
+	if referer == "" {
+		return false
+	}
+	ref, err := url.Parse(referer)
+	if err != nil || ref.Host == "" {
+		return false
+	}
+	loc, err := url.Parse(location)
+	if err != nil {
+		return false
+	}
+
+	host := loc.Hostname()
+	if loc.Host == "" {
+		host = stripPort(requestHost)
+	}
+	return strings.EqualFold(strings.TrimSuffix(ref.Hostname(), "."), strings.TrimSuffix(host, ".")) && refererPath(ref.Path) == refererPath(loc.Path)
+}
+
+// refererPath returns path, or `/` if it's empty, since `https://example.com` and `https://example.com/` are the same
+// page
+func refererPath(path string) string {
+	if path == "" {
+		return "/"
+	}
+	return path
+}
+
+// handleRefererLoop checks a redirect to location against the request's Referer header when referer_loop is enabled.
+// With referer_loop set to `miss`, the miss response is written for a probable loop, and it returns true
+//
+// It's checked for every request, including those served from the cache, since the Referer isn't part of the cache key
+func handleRefererLoop(logger *slog.Logger, w http.ResponseWriter, r *http.Request, ac *AppConfig, host string, path string, location string) bool {
+	if ac.RefererLoop == RefererLoopOff || !isRefererLoop(r.Header.Get("Referer"), r.Host, location) {
+		return false
+	}
+
+	logger.Warn("redirect leads back to the referer, probable redirect loop", "location", location, "referer", r.Header.Get("Referer"))
+	probableLoopMetric.With(prometheus.Labels{"host": host}).Inc()
+	if ac.RefererLoop != RefererLoopMiss {
+		return false
+	}
+
+	// as with self redirects, this isn't cached
+	if ac.LocationOnMiss != "" {
+		w.Header().Set("Location", ac.LocationOnMiss)
+	}
+	setMissCacheControl(ac.CacheControlOnMiss, w)
+	writeErrorStatus(w, ac.StatusOnMiss, RefererLoopError{location}, host, path, wantsJSONError(r, ac.ErrorFormat))
+	return true
+}
@@ -0,0 +1,87 @@
+//go:build unit_test
+
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_isRefererLoop(t *testing.T) {
+	tests := []struct {
+		name     string
+		referer  string
+		location string
+		want     bool
+	}{
+		{name: "no referer", location: "https://example.com/foo"},
+		{name: "same host and path", referer: "https://example.com/foo", location: "https://example.com/foo", want: true},
+		{name: "scheme, port, and query are ignored", referer: "http://example.com:8080/foo?a=1", location: "https://example.com/foo?b=2", want: true},
+		{name: "host is case-insensitive", referer: "https://EXAMPLE.com./foo", location: "https://example.com/foo", want: true},
+		{name: "empty path is the root", referer: "https://example.com", location: "https://example.com/", want: true},
+		{name: "relative location is on the request's host", referer: "https://redirector.example.com/foo", location: "/foo", want: true},
+		{name: "different path", referer: "https://example.com/foo", location: "https://example.com/bar"},
+		{name: "different host", referer: "https://example.org/foo", location: "https://example.com/foo"},
+		{name: "relative referer", referer: "/foo", location: "https://example.com/foo"},
+		{name: "malformed referer", referer: "https://example.com/%zz", location: "https://example.com/%zz"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, isRefererLoop(tt.referer, "redirector.example.com:8484", tt.location))
+		})
+	}
+}
+
+func TestRefererLoop(t *testing.T) {
+	logger := newTestLogger()
+	rules := `
+status_on_miss: 404
+rules:
+  - from: 'a.example.com/foo'
+    to: 'https://b.example.com/foo'
+`
+
+	tests := []struct {
+		name      string
+		mode      string
+		referer   string
+		wantCode  int
+		wantCount float64
+	}{
+		{name: "off by default", referer: "https://b.example.com/foo", wantCode: http.StatusMovedPermanently},
+		{name: "log", mode: RefererLoopLog, referer: "https://b.example.com/foo", wantCode: http.StatusMovedPermanently, wantCount: 2},
+		{name: "miss", mode: RefererLoopMiss, referer: "https://b.example.com/foo", wantCode: http.StatusNotFound, wantCount: 2},
+		{name: "unrelated referer", mode: RefererLoopMiss, referer: "https://c.example.com/foo", wantCode: http.StatusMovedPermanently},
+		{name: "unknown mode", mode: "block", referer: "https://b.example.com/foo", wantCode: http.StatusMovedPermanently},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := rules
+			if tt.mode != "" {
+				config = "referer_loop: " + tt.mode + "\n" + rules
+			}
+			cfg, err := parseConfig(logger, []byte(config))
+			assert.NoError(t, err)
+			handler := handleRequest(logger, NewInMemoryCache(t.Context(), logger, 3600, 3600), cfg)
+			before := testutil.ToFloat64(probableLoopMetric.WithLabelValues("a.example.com"))
+
+			// the Referer isn't part of the cache key, so cached redirects are checked too
+			for range 2 {
+				req := httptest.NewRequest("GET", "http://a.example.com/foo", nil)
+				req.Header.Set("Referer", tt.referer)
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, req)
+				assert.Equal(t, tt.wantCode, w.Code)
+			}
+			assert.Equal(t, before+tt.wantCount, testutil.ToFloat64(probableLoopMetric.WithLabelValues("a.example.com")))
+
+			// requests without the Referer are still redirected
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", "http://a.example.com/foo", nil))
+			assert.Equal(t, http.StatusMovedPermanently, w.Code)
+		})
+	}
+}
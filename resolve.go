@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+)
+
+type resolveResponse struct {
+	Location    string `json:"location"`
+	Code        int    `json:"code"`
+	MatchedRule string `json:"matched_rule"`
+}
+
+type ruleHeaderKey struct{}
+
+// withRuleHeader returns a copy of ctx that makes the redirect handler send the X-Redirector-Rule header, whether or
+// not debug.rule_header is set
+func withRuleHeader(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ruleHeaderKey{}, true)
+}
+
+// wantsRuleHeader reports whether the request's context asks for the X-Redirector-Rule header
+func wantsRuleHeader(r *http.Request) bool {
+	v, _ := r.Context().Value(ruleHeaderKey{}).(bool)
+	return v
+}
+
+// handleResolve responds with the redirect that redirects would send for the URL in the `url` query parameter, as
+// JSON with a 200, rather than redirecting
+//
+// The URL is run through redirects like any other request, including the cache. Its scheme is optional, and the
+// Accept-Language and Cookie headers and client address of the resolve request are passed along so that rules match as
+// they would for the client
+func handleResolve(redirects http.Handler) http.Handler {
+	f := func(w http.ResponseWriter, r *http.Request) {
+		target := r.URL.Query().Get("url")
+		if target == "" {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: "the url parameter is required"})
+			return
+		}
+
+		req, err := newTestRequest(http.MethodGet, target)
+		if err != nil || req.URL.Host == "" {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: "the url parameter isn't a valid URL"})
+			return
+		}
+		req = req.WithContext(withRuleHeader(r.Context()))
+		req.RemoteAddr = r.RemoteAddr
+		if lang := r.Header.Get("Accept-Language"); lang != "" {
+			req.Header.Set("Accept-Language", lang)
+		}
+		for _, cookie := range r.Header.Values("Cookie") {
+			req.Header.Add("Cookie", cookie)
+		}
+
+		rec := httptest.NewRecorder()
+		redirects.ServeHTTP(rec, req)
+		writeJSON(w, http.StatusOK, resolveResponse{
+			Location:    rec.Header().Get("Location"),
+			Code:        rec.Code,
+			MatchedRule: rec.Header().Get("X-Redirector-Rule"),
+		})
+	}
+
+	return http.HandlerFunc(f)
+}
@@ -0,0 +1,81 @@
+//go:build unit_test
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	logger := newTestLogger()
+	cfg, err := parseConfig(logger, []byte(`
+server:
+  resolve_endpoint: true
+rules:
+  - from: 'example.com/foo'
+    to: 'https://foo.com/'
+    name: 'foo'
+  - from: 'example.com/secure'
+    to: 'https://foo.com/secure'
+    match_scheme: 'https'
+  - from: 'example.com/fr'
+    to: 'https://foo.com/fr'
+    match_language: ['fr']
+`))
+	assert.NoError(t, err)
+	handler := newServer(logger, &noopCache{}, cfg)
+
+	tests := []struct {
+		name     string
+		target   string
+		language string
+		status   int
+		want     resolveResponse
+	}{
+		{name: "match", target: "http://example.com/foo", status: http.StatusOK, want: resolveResponse{Location: "https://foo.com/", Code: http.StatusMovedPermanently, MatchedRule: "foo"}},
+		{name: "no scheme", target: "example.com/foo", status: http.StatusOK, want: resolveResponse{Location: "https://foo.com/", Code: http.StatusMovedPermanently, MatchedRule: "foo"}},
+		{name: "https", target: "https://example.com/secure", status: http.StatusOK, want: resolveResponse{Location: "https://foo.com/secure", Code: http.StatusMovedPermanently, MatchedRule: "example.com/secure"}},
+		{name: "language", target: "example.com/fr", language: "fr-CA", status: http.StatusOK, want: resolveResponse{Location: "https://foo.com/fr", Code: http.StatusMovedPermanently, MatchedRule: "example.com/fr"}},
+		{name: "miss", target: "example.com/missing", status: http.StatusOK, want: resolveResponse{Code: http.StatusNotFound}},
+		{name: "missing url", status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://localhost/resolve?url="+url.QueryEscape(tt.target), nil)
+			if tt.language != "" {
+				req.Header.Set("Accept-Language", tt.language)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			assert.Equal(t, tt.status, w.Code)
+			assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+			if tt.status != http.StatusOK {
+				return
+			}
+
+			var got resolveResponse
+			assert.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestResolveDisabled(t *testing.T) {
+	logger := newTestLogger()
+	cfg, err := parseConfig(logger, []byte(`
+rules:
+  - from: 'localhost/resolve'
+    to: 'https://foo.com/resolve'
+`))
+	assert.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	newServer(logger, &noopCache{}, cfg).ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/resolve?url=example.com", nil))
+	assert.Equal(t, http.StatusMovedPermanently, w.Code)
+	assert.Equal(t, "https://foo.com/resolve?url=example.com", w.Header().Get("Location"))
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	SchemeHTTP  = "http"
+	SchemeHTTPS = "https"
+)
+
+func validMatchScheme(scheme string) bool {
+	switch scheme {
+	case "", SchemeHTTP, SchemeHTTPS:
+		return true
+	default:
+		return false
+	}
+}
+
+func validForceHTTPSCode(code int) bool {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	default:
+		return false
+	}
+}
+
+// requestScheme returns the scheme the client made a request with
+//
+// X-Forwarded-Proto is only used when the request came from a trusted proxy. Its first value is the scheme the client
+// used to reach the first proxy
+func requestScheme(r *http.Request, trustedProxies []*net.IPNet) string {
+	if forwarded := r.Header.Get("X-Forwarded-Proto"); forwarded != "" {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		if ip := net.ParseIP(host); ip != nil && containsIP(trustedProxies, ip) {
+			proto, _, _ := strings.Cut(forwarded, ",")
+			if p := strings.ToLower(strings.TrimSpace(proto)); p == SchemeHTTP || p == SchemeHTTPS {
+				return p
+			}
+		}
+	}
+
+	if r.TLS != nil {
+		return SchemeHTTPS
+	}
+	return SchemeHTTP
+}
+
+// httpsURL returns the URL of a request on https. The request's port is dropped, since it's the http port
+func httpsURL(r *http.Request) string {
+	return SchemeHTTPS + "://" + stripPort(r.Host) + r.URL.RequestURI()
+}
@@ -0,0 +1,48 @@
+//go:build unit_test
+
+package main
+
+import (
+	"crypto/tls"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_requestScheme(t *testing.T) {
+	_, trusted, _ := net.ParseCIDR("10.0.0.0/8")
+
+	tests := []struct {
+		name           string
+		remoteAddr     string
+		tls            bool
+		forwardedProto string
+		want           string
+	}{
+		{name: "plaintext", remoteAddr: "192.0.2.1:1234", want: SchemeHTTP},
+		{name: "tls", remoteAddr: "192.0.2.1:1234", tls: true, want: SchemeHTTPS},
+		{name: "untrusted proxy", remoteAddr: "192.0.2.1:1234", forwardedProto: "https", want: SchemeHTTP},
+		{name: "trusted proxy", remoteAddr: "10.1.2.3:1234", forwardedProto: "HTTPS", want: SchemeHTTPS},
+		{name: "first proxy's scheme", remoteAddr: "10.1.2.3:1234", forwardedProto: "http, https", want: SchemeHTTP},
+		{name: "unknown forwarded scheme", remoteAddr: "10.1.2.3:1234", tls: true, forwardedProto: "ws", want: SchemeHTTPS},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://example.com/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.tls {
+				req.TLS = &tls.ConnectionState{}
+			}
+			if tt.forwardedProto != "" {
+				req.Header.Set("X-Forwarded-Proto", tt.forwardedProto)
+			}
+			assert.Equal(t, tt.want, requestScheme(req, []*net.IPNet{trusted}))
+		})
+	}
+}
+
+func Test_httpsURL(t *testing.T) {
+	assert.Equal(t, "https://example.com/foo?a=b", httpsURL(httptest.NewRequest("GET", "http://example.com:8080/foo?a=b", nil)))
+	assert.Equal(t, "https://[2001:db8::1]/", httpsURL(httptest.NewRequest("GET", "http://[2001:db8::1]:80/", nil)))
+}
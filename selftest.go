@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+)
+
+// SelfTest is a request that's run through the rules to check that the config redirects it as expected
+type SelfTest struct {
+	// Request is the URL to request. The scheme is optional, e.g. `example.com/foo?bar=baz`
+	Request string `yaml:"request"`
+	// ExpectLocation is the expected Location header. An empty value accepts any location
+	ExpectLocation string `yaml:"expect_location"`
+	// ExpectCode is the expected status code. 0 accepts any redirect
+	ExpectCode int `yaml:"expect_code"`
+}
+
+type SelfTestError struct {
+	failed int
+	total  int
+}
+
+func (e SelfTestError) Error() string {
+	return fmt.Sprintf("%d of %d self tests failed", e.failed, e.total)
+}
+
+// selfTestFailure describes a self test whose response didn't match its expectations
+type selfTestFailure struct {
+	Request  string
+	Reason   string
+	Location string
+	Code     int
+}
+
+// newTestRequest returns a request for target, a URL whose scheme is optional, e.g. `example.com/foo?bar=baz`
+//
+// https targets are treated as if they were requested over TLS, so that they aren't upgraded by force_https and match
+// rules with `match_scheme: https`
+func newTestRequest(method string, target string) (*http.Request, error) {
+	if !strings.Contains(target, "://") {
+		target = "http://" + target
+	}
+	req, err := http.NewRequest(method, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	if req.URL.Scheme == SchemeHTTPS {
+		req.TLS = &tls.ConnectionState{}
+	}
+	return req, nil
+}
+
+// runSelfTest runs a single self test through handler, returning a failure if the response isn't what's expected
+func runSelfTest(handler http.Handler, test SelfTest) *selfTestFailure {
+	req, err := newTestRequest(http.MethodGet, test.Request)
+	if err != nil {
+		return &selfTestFailure{Request: test.Request, Reason: fmt.Sprintf("invalid request: %s", err)}
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	location := w.Header().Get("Location")
+
+	failure := &selfTestFailure{Request: test.Request, Location: location, Code: w.Code}
+	switch {
+	case test.ExpectCode != 0 && w.Code != test.ExpectCode:
+		failure.Reason = fmt.Sprintf("expected status %d", test.ExpectCode)
+	case test.ExpectCode == 0 && (w.Code < http.StatusMultipleChoices || w.Code >= http.StatusBadRequest):
+		failure.Reason = "expected a redirect"
+	case test.ExpectLocation != "" && location != test.ExpectLocation:
+		failure.Reason = fmt.Sprintf("expected location '%s'", test.ExpectLocation)
+	default:
+		return nil
+	}
+	return failure
+}
+
+// runSelfTests runs the config's self tests through the same handler that serves redirects, logging every failure
+//
+// Responses aren't cached between tests so that each one is matched against the rules
+func runSelfTests(l *slog.Logger, ac *AppConfig) error {
+	logger := l.WithGroup("selftest")
+
+	// the handler's own logs would drown out the results
+	handler := handleRequest(slog.New(slog.DiscardHandler), &noopCache{}, ac)
+
+	failed := 0
+	for _, test := range ac.Tests {
+		if f := runSelfTest(handler, test); f != nil {
+			failed++
+			logger.Error("self test failed", "request", f.Request, "reason", f.Reason, "location", f.Location, "code", f.Code)
+		}
+	}
+
+	logger.Info("ran self tests", "total", len(ac.Tests), "failed", failed)
+	if failed > 0 {
+		return SelfTestError{failed: failed, total: len(ac.Tests)}
+	}
+	return nil
+}
+
+// selfTest runs the self tests of the config at CONFIG_PATH
+func selfTest(logger *slog.Logger) error {
+	confPath, ok := os.LookupEnv("CONFIG_PATH")
+	if !ok {
+		logger.Error("CONFIG_PATH environment variable is not set, exiting")
+		os.Exit(1)
+	}
+
+	cfg, err := loadConfig(logger, confPath)
+	if err != nil {
+		logger.Error("error parsing cfg file", "err", err.Error())
+		return err
+	}
+
+	return runSelfTests(logger, cfg)
+}
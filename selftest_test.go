@@ -0,0 +1,84 @@
+//go:build unit_test
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func Test_runSelfTest(t *testing.T) {
+	logger := newTestLogger()
+	cfg, err := parseConfig(logger, []byte(`
+rules:
+  - from: 'example.com/foo'
+    to: 'https://foo.com/bar'
+  - from: 'example.com/found'
+    to: 'https://foo.com/found'
+    code: 302
+`))
+	assert.NoError(t, err)
+	handler := handleRequest(logger, &noopCache{}, cfg)
+
+	tests := []struct {
+		name       string
+		test       SelfTest
+		wantReason string
+	}{
+		{name: "location and code", test: SelfTest{Request: "example.com/foo", ExpectLocation: "https://foo.com/bar", ExpectCode: http.StatusMovedPermanently}},
+		{name: "with scheme", test: SelfTest{Request: "https://example.com/foo", ExpectLocation: "https://foo.com/bar"}},
+		{name: "any redirect", test: SelfTest{Request: "example.com/found"}},
+		{name: "wrong location", test: SelfTest{Request: "example.com/foo", ExpectLocation: "https://foo.com/baz"}, wantReason: "expected location 'https://foo.com/baz'"},
+		{name: "wrong code", test: SelfTest{Request: "example.com/found", ExpectCode: http.StatusMovedPermanently}, wantReason: "expected status 301"},
+		{name: "miss", test: SelfTest{Request: "example.com/missing"}, wantReason: "expected a redirect"},
+		{name: "expected miss", test: SelfTest{Request: "example.com/missing", ExpectCode: http.StatusNotFound}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := runSelfTest(handler, tt.test)
+			if tt.wantReason == "" {
+				assert.Nil(t, got)
+				return
+			}
+			assert.NotNil(t, got)
+			assert.Equal(t, tt.wantReason, got.Reason)
+		})
+	}
+}
+
+func Test_runSelfTestScheme(t *testing.T) {
+	logger := newTestLogger()
+	cfg, err := parseConfig(logger, []byte(`
+force_https: true
+rules:
+  - from: 'example.com/foo'
+    to: 'https://foo.com/bar'
+  - from: 'example.com/secure'
+    to: 'https://foo.com/secure'
+    match_scheme: 'https'
+tests:
+  - request: 'https://example.com/foo'
+    expect_location: 'https://foo.com/bar'
+  - request: 'https://example.com/secure'
+    expect_location: 'https://foo.com/secure'
+  - request: 'example.com/foo'
+    expect_location: 'https://example.com/foo'
+`))
+	assert.NoError(t, err)
+
+	// https requests are matched against the rules rather than upgraded
+	assert.NoError(t, runSelfTests(logger, cfg))
+}
+
+func Test_runSelfTests(t *testing.T) {
+	logger := newTestLogger()
+
+	cfg, err := loadConfig(logger, "./fixtures/selftest.yml")
+	assert.NoError(t, err)
+	assert.NoError(t, runSelfTests(logger, cfg))
+
+	cfg.Tests = append(cfg.Tests, SelfTest{Request: "selftest.example.com/foo", ExpectLocation: "https://wrong.example.com/"})
+	assert.Equal(t, SelfTestError{failed: 1, total: 3}, runSelfTests(logger, cfg))
+}
@@ -2,11 +2,29 @@ package main
 
 import (
 	"net/http"
+	"strings"
 )
 
-func handleStatus() http.Handler {
+// version is the version of the build, set with `go build -ldflags "-X main.version=..."`
+var version = "dev"
+
+type statusResponse struct {
+	Status string `json:"status"`
+	// Rules is the number of rules being served
+	Rules   int    `json:"rules"`
+	Version string `json:"version"`
+}
+
+// handleStatus responds with `OK`, or with a JSON status to clients that accept JSON
+func handleStatus(ac *AppConfig) http.Handler {
 	f := func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte("OK"))
+		if !strings.Contains(r.Header.Get("Accept"), "application/json") {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Write([]byte("OK"))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, statusResponse{Status: "ok", Rules: countRules(ac.ruleMap()), Version: version})
 	}
 
 	return http.HandlerFunc(f)
@@ -0,0 +1,85 @@
+//go:build unit_test
+
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStatus(t *testing.T) {
+	logger := newTestLogger()
+	cfg, err := parseConfig(logger, []byte(`
+rules:
+  - from: 'example.com/foo'
+    to: 'https://foo.com/'
+  - from: 'example.com/bar'
+    to: 'https://foo.com/'
+  - from: 'other.com/'
+    to: 'https://foo.com/'
+`))
+	assert.NoError(t, err)
+	handler := handleStatus(cfg)
+
+	tests := []struct {
+		name   string
+		accept string
+		json   bool
+	}{
+		{name: "no accept header"},
+		{name: "plain text", accept: "text/plain"},
+		{name: "json", accept: "application/json", json: true},
+		{name: "json among others", accept: "text/html;q=0.9, application/json", json: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://localhost/status", nil)
+			req.Header.Set("Accept", tt.accept)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			assert.Equal(t, 200, w.Code)
+
+			if !tt.json {
+				assert.Equal(t, "text/plain; charset=utf-8", w.Header().Get("Content-Type"))
+				assert.Equal(t, "OK", w.Body.String())
+				return
+			}
+
+			assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+			var got statusResponse
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+			assert.Equal(t, statusResponse{Status: "ok", Rules: 3, Version: version}, got)
+		})
+	}
+}
+
+func TestStatusCompressed(t *testing.T) {
+	logger := newTestLogger()
+	cfg, err := parseConfig(logger, []byte(`
+server:
+  compression: true
+rules:
+  - from: 'example.com/foo'
+    to: 'https://foo.com/'
+`))
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "http://localhost/status", nil)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	newServer(logger, &noopCache{}, cfg).ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+
+	gr, err := gzip.NewReader(w.Body)
+	if !assert.NoError(t, err) {
+		return
+	}
+	var got statusResponse
+	assert.NoError(t, json.NewDecoder(gr).Decode(&got))
+	assert.Equal(t, statusResponse{Status: "ok", Rules: 1, Version: version}, got)
+}
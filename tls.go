@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+type TLSConfig struct {
+	// CertFile and KeyFile are the default certificate, used when a client's SNI doesn't match Certificates
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// Certificates are selected by the hostname a client sends in SNI
+	Certificates []TLSCertificate `yaml:"certificates"`
+}
+
+type TLSCertificate struct {
+	Host     string `yaml:"host"`
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+}
+
+type NoCertificateError struct {
+	serverName string
+}
+
+func (e NoCertificateError) Error() string {
+	return fmt.Sprintf("no certificate for server name '%s'", e.serverName)
+}
+
+// enabled reports whether the redirect server should terminate TLS itself
+func (c TLSConfig) enabled() bool {
+	return c.CertFile != "" || len(c.Certificates) > 0
+}
+
+// newTLSConfig loads the configured certificates into a tls.Config that selects a certificate using the client's SNI
+func newTLSConfig(c TLSConfig) (*tls.Config, error) {
+	var fallback *tls.Certificate
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading default certificate: %w", err)
+		}
+		fallback = &cert
+	}
+
+	certs := make(map[string]*tls.Certificate, len(c.Certificates))
+	for _, certificate := range c.Certificates {
+		cert, err := tls.LoadX509KeyPair(certificate.CertFile, certificate.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading certificate for '%s': %w", certificate.Host, err)
+		}
+		host, err := certificateHost(certificate.Host)
+		if err != nil {
+			return nil, InvalidHostnameError{certificate.Host}
+		}
+		certs[host] = &cert
+	}
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if host, err := certificateHost(hello.ServerName); err == nil {
+				if cert, ok := certs[host]; ok {
+					return cert, nil
+				}
+			}
+			if fallback != nil {
+				return fallback, nil
+			}
+			return nil, NoCertificateError{serverName: hello.ServerName}
+		},
+	}, nil
+}
+
+// certificateHost normalizes a hostname so that configured hosts and SNI server names can be compared
+func certificateHost(host string) (string, error) {
+	h, err := normalizeHost(strings.ToLower(host))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(h, "."), nil
+}
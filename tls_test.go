@@ -0,0 +1,118 @@
+//go:build unit_test
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCertificate writes a self-signed certificate for host to dir and returns the certificate and key paths
+func writeTestCertificate(t *testing.T, dir string, host string) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	certPath := filepath.Join(dir, host+".crt")
+	keyPath := filepath.Join(dir, host+".key")
+	assert.NoError(t, os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certPath, keyPath
+}
+
+func Test_newTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	fooCert, fooKey := writeTestCertificate(t, dir, "foo.example")
+	barCert, barKey := writeTestCertificate(t, dir, "bar.example")
+	defaultCert, defaultKey := writeTestCertificate(t, dir, "default.example")
+
+	tests := []struct {
+		name       string
+		config     TLSConfig
+		serverName string
+		want       string
+		wantErr    bool
+	}{
+		{
+			name: "first host",
+			config: TLSConfig{Certificates: []TLSCertificate{
+				{Host: "foo.example", CertFile: fooCert, KeyFile: fooKey},
+				{Host: "bar.example", CertFile: barCert, KeyFile: barKey},
+			}},
+			serverName: "foo.example",
+			want:       "foo.example",
+		},
+		{
+			name: "second host",
+			config: TLSConfig{Certificates: []TLSCertificate{
+				{Host: "foo.example", CertFile: fooCert, KeyFile: fooKey},
+				{Host: "bar.example", CertFile: barCert, KeyFile: barKey},
+			}},
+			serverName: "BAR.example",
+			want:       "bar.example",
+		},
+		{
+			name: "fallback",
+			config: TLSConfig{
+				CertFile:     defaultCert,
+				KeyFile:      defaultKey,
+				Certificates: []TLSCertificate{{Host: "foo.example", CertFile: fooCert, KeyFile: fooKey}},
+			},
+			serverName: "unknown.example",
+			want:       "default.example",
+		},
+		{
+			name:       "no fallback",
+			config:     TLSConfig{Certificates: []TLSCertificate{{Host: "foo.example", CertFile: fooCert, KeyFile: fooKey}}},
+			serverName: "unknown.example",
+			wantErr:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := newTLSConfig(tt.config)
+			assert.NoError(t, err)
+
+			cert, err := c.GetCertificate(&tls.ClientHelloInfo{ServerName: tt.serverName})
+			if tt.wantErr {
+				assert.ErrorAs(t, err, &NoCertificateError{})
+				return
+			}
+			assert.NoError(t, err)
+
+			leaf, err := x509.ParseCertificate(cert.Certificate[0])
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, leaf.Subject.CommonName)
+		})
+	}
+}
+
+func Test_newTLSConfigMissingFile(t *testing.T) {
+	_, err := newTLSConfig(TLSConfig{Certificates: []TLSCertificate{{Host: "foo.example", CertFile: "./i-dont-exist.crt", KeyFile: "./i-dont-exist.key"}}})
+	assert.Error(t, err)
+}